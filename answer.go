@@ -8,7 +8,12 @@
 
 package dnscore
 
-import "github.com/miekg/dns"
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
 
 // DecodeLookupA decodes RRs from a lookup A response.
 func DecodeLookupA(rrs []dns.RR) (addrs []string, cname string, err error) {
@@ -47,3 +52,164 @@ func DecodeLookupAAAA(rrs []dns.RR) (addrs []string, cname string, err error) {
 
 	return
 }
+
+// DecodeLookupCNAME decodes RRs from a lookup response and returns the
+// canonical name, which is the target of the last CNAME RR, if any, or
+// otherwise the owner name of the first RR.
+func DecodeLookupCNAME(rrs []dns.RR) (cname string, err error) {
+	for _, answer := range rrs {
+		switch answer := answer.(type) {
+		case *dns.CNAME:
+			cname = answer.Target
+
+		default:
+			if cname == "" {
+				cname = answer.Header().Name
+			}
+		}
+	}
+
+	if cname == "" {
+		return "", ErrNoData
+	}
+
+	return
+}
+
+// DecodeLookupMX decodes RRs from a lookup MX response.
+//
+// The records are in the same order as the RRs. Use [*Resolver.LookupMX]
+// for obtaining the records sorted by preference like [*net.Resolver] does.
+func DecodeLookupMX(rrs []dns.RR) (records []*net.MX, err error) {
+	for _, answer := range rrs {
+		switch answer := answer.(type) {
+		case *dns.MX:
+			records = append(records, &net.MX{Host: answer.Mx, Pref: answer.Preference})
+		}
+	}
+
+	if len(records) <= 0 {
+		return nil, ErrNoData
+	}
+
+	return
+}
+
+// DecodeLookupNS decodes RRs from a lookup NS response.
+func DecodeLookupNS(rrs []dns.RR) (records []*net.NS, err error) {
+	for _, answer := range rrs {
+		switch answer := answer.(type) {
+		case *dns.NS:
+			records = append(records, &net.NS{Host: answer.Ns})
+		}
+	}
+
+	if len(records) <= 0 {
+		return nil, ErrNoData
+	}
+
+	return
+}
+
+// DecodeLookupPTR decodes RRs from a lookup PTR response.
+func DecodeLookupPTR(rrs []dns.RR) (names []string, err error) {
+	for _, answer := range rrs {
+		switch answer := answer.(type) {
+		case *dns.PTR:
+			names = append(names, answer.Ptr)
+		}
+	}
+
+	if len(names) <= 0 {
+		return nil, ErrNoData
+	}
+
+	return
+}
+
+// DecodeLookupSRV decodes RRs from a lookup SRV response.
+//
+// The records are in the same order as the RRs. Use [*Resolver.LookupSRV]
+// for obtaining the records sorted by priority and randomized by weight
+// like [*net.Resolver] does.
+func DecodeLookupSRV(rrs []dns.RR) (records []*net.SRV, err error) {
+	for _, answer := range rrs {
+		switch answer := answer.(type) {
+		case *dns.SRV:
+			records = append(records, &net.SRV{
+				Target:   answer.Target,
+				Port:     answer.Port,
+				Priority: answer.Priority,
+				Weight:   answer.Weight,
+			})
+		}
+	}
+
+	if len(records) <= 0 {
+		return nil, ErrNoData
+	}
+
+	return
+}
+
+// DecodeLookupTXT decodes RRs from a lookup TXT response.
+//
+// Like [*net.Resolver], we concatenate the strings of each TXT RR.
+func DecodeLookupTXT(rrs []dns.RR) (txts []string, err error) {
+	for _, answer := range rrs {
+		switch answer := answer.(type) {
+		case *dns.TXT:
+			txts = append(txts, strings.Join(answer.Txt, ""))
+		}
+	}
+
+	if len(txts) <= 0 {
+		return nil, ErrNoData
+	}
+
+	return
+}
+
+// DecodeLookupHTTPS decodes RRs from a lookup HTTPS response.
+//
+// The records are in the same order as the RRs and we skip the incompatible
+// ServiceMode records (see [*SVCBRecord]). Use [*Resolver.LookupHTTPS] for
+// following AliasMode records and sorting the records by priority.
+func DecodeLookupHTTPS(rrs []dns.RR) (records []*SVCBRecord, err error) {
+	for _, answer := range rrs {
+		switch answer := answer.(type) {
+		case *dns.HTTPS:
+			if record, ok := newSVCBRecord(&answer.SVCB); ok {
+				records = append(records, record)
+			}
+		}
+	}
+
+	if len(records) <= 0 {
+		return nil, ErrNoData
+	}
+
+	return
+}
+
+// DecodeLookupSVCB decodes RRs from a lookup SVCB response.
+//
+// The records are in the same order as the RRs and we skip the incompatible
+// ServiceMode records (see [*SVCBRecord]). Use [*Resolver.LookupSVCB] for
+// following AliasMode records and sorting the records by priority.
+func DecodeLookupSVCB(rrs []dns.RR) (records []*SVCBRecord, err error) {
+	for _, answer := range rrs {
+		switch answer := answer.(type) {
+		case *dns.SVCB:
+			if record, ok := newSVCBRecord(answer); ok {
+				records = append(records, record)
+			}
+		}
+	}
+
+	if len(records) <= 0 {
+		return nil, ErrNoData
+	}
+
+	return
+}
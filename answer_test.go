@@ -4,6 +4,7 @@ package dnscore
 
 import (
 	"net"
+	"net/netip"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -149,3 +150,172 @@ func TestDecodeLookupAAAA(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeLookupCNAME(t *testing.T) {
+	tests := []struct {
+		name     string
+		rrs      []dns.RR
+		expected string
+		err      error
+	}{
+		{
+			name: "A records without CNAME",
+			rrs: []dns.RR{
+				&dns.A{Hdr: dns.RR_Header{Name: "example.com."}, A: net.ParseIP("192.0.2.1")},
+			},
+			expected: "example.com.",
+			err:      nil,
+		},
+
+		{
+			name: "CNAME chain",
+			rrs: []dns.RR{
+				&dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.com."}, Target: "web.example.com."},
+				&dns.CNAME{Hdr: dns.RR_Header{Name: "web.example.com."}, Target: "example.com."},
+				&dns.A{Hdr: dns.RR_Header{Name: "example.com."}, A: net.ParseIP("192.0.2.1")},
+			},
+			expected: "example.com.",
+			err:      nil,
+		},
+
+		{
+			name:     "No records",
+			rrs:      []dns.RR{},
+			expected: "",
+			err:      ErrNoData,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cname, err := DecodeLookupCNAME(tt.rrs)
+			assert.Equal(t, tt.expected, cname)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+}
+
+func TestDecodeLookupMX(t *testing.T) {
+	records, err := DecodeLookupMX([]dns.RR{
+		&dns.MX{Mx: "mx2.example.com.", Preference: 20},
+		&dns.A{A: net.ParseIP("192.0.2.1")},
+		&dns.MX{Mx: "mx1.example.com.", Preference: 10},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []*net.MX{
+		{Host: "mx2.example.com.", Pref: 20},
+		{Host: "mx1.example.com.", Pref: 10},
+	}, records)
+
+	records, err = DecodeLookupMX([]dns.RR{&dns.A{A: net.ParseIP("192.0.2.1")}})
+	assert.Nil(t, records)
+	assert.Equal(t, ErrNoData, err)
+}
+
+func TestDecodeLookupNS(t *testing.T) {
+	records, err := DecodeLookupNS([]dns.RR{
+		&dns.NS{Ns: "ns1.example.com."},
+		&dns.NS{Ns: "ns2.example.com."},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []*net.NS{{Host: "ns1.example.com."}, {Host: "ns2.example.com."}}, records)
+
+	records, err = DecodeLookupNS(nil)
+	assert.Nil(t, records)
+	assert.Equal(t, ErrNoData, err)
+}
+
+func TestDecodeLookupPTR(t *testing.T) {
+	names, err := DecodeLookupPTR([]dns.RR{&dns.PTR{Ptr: "dns.google."}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dns.google."}, names)
+
+	names, err = DecodeLookupPTR(nil)
+	assert.Nil(t, names)
+	assert.Equal(t, ErrNoData, err)
+}
+
+func TestDecodeLookupSRV(t *testing.T) {
+	records, err := DecodeLookupSRV([]dns.RR{
+		&dns.SRV{Target: "sip.example.com.", Port: 5060, Priority: 10, Weight: 60},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []*net.SRV{{Target: "sip.example.com.", Port: 5060, Priority: 10, Weight: 60}}, records)
+
+	records, err = DecodeLookupSRV(nil)
+	assert.Nil(t, records)
+	assert.Equal(t, ErrNoData, err)
+}
+
+func TestDecodeLookupTXT(t *testing.T) {
+	txts, err := DecodeLookupTXT([]dns.RR{
+		&dns.TXT{Txt: []string{"v=spf1 ", "-all"}},
+		&dns.TXT{Txt: []string{"hello"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v=spf1 -all", "hello"}, txts)
+
+	txts, err = DecodeLookupTXT(nil)
+	assert.Nil(t, txts)
+	assert.Equal(t, ErrNoData, err)
+}
+
+func TestDecodeLookupHTTPS(t *testing.T) {
+	newRR := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+
+	records, err := DecodeLookupHTTPS([]dns.RR{
+		newRR(`example.com. HTTPS 1 . alpn="h3,h2" no-default-alpn port=8443 ipv4hint=192.0.2.1 ech=AQID ipv6hint=2001:db8::1`),
+		newRR(`example.com. HTTPS 2 svc.example.com. mandatory=key666 key666=foo`),
+		newRR(`example.com. HTTPS 3 svc.example.com. mandatory=port port=443`),
+		newRR(`example.com. SVCB 1 svcb.example.com.`),
+		newRR(`example.com. A 192.0.2.1`),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []*SVCBRecord{{
+		ALPN:          []string{"h3", "h2"},
+		ECHConfigList: []byte{1, 2, 3},
+		IPv4Hint:      []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+		IPv6Hint:      []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+		NoDefaultALPN: true,
+		Port:          8443,
+		Priority:      1,
+		Target:        "example.com.",
+	}, {
+		Port:     443,
+		Priority: 3,
+		Target:   "svc.example.com.",
+	}}, records)
+
+	records, err = DecodeLookupHTTPS([]dns.RR{newRR(`example.com. HTTPS 0 .`)})
+	assert.NoError(t, err)
+	assert.Equal(t, []*SVCBRecord{{Priority: 0, Target: "."}}, records)
+
+	records, err = DecodeLookupHTTPS([]dns.RR{newRR(`example.com. SVCB 1 .`)})
+	assert.Nil(t, records)
+	assert.Equal(t, ErrNoData, err)
+}
+
+func TestDecodeLookupSVCB(t *testing.T) {
+	rr, err := dns.NewRR(`_dns.resolver.arpa. SVCB 1 dns.example.net. alpn=dot port=853`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := DecodeLookupSVCB([]dns.RR{rr})
+	assert.NoError(t, err)
+	assert.Equal(t, []*SVCBRecord{{
+		ALPN:     []string{"dot"},
+		Port:     853,
+		Priority: 1,
+		Target:   "dns.example.net.",
+	}}, records)
+
+	records, err = DecodeLookupSVCB(nil)
+	assert.Nil(t, records)
+	assert.Equal(t, ErrNoData, err)
+}
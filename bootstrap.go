@@ -0,0 +1,173 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// Bootstrapping encrypted DNS servers using hostnames.
+//
+
+package dnscore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/rbmk-project/common/closepool"
+	"github.com/rbmk-project/common/httpconntrace"
+)
+
+// hostname returns the hostname contained in the server address, which
+// is a URL for DoH, DoH3, and ODoH, and an endpoint otherwise.
+func (a *ServerAddr) hostname() string {
+	switch a.Protocol {
+	case ProtocolDoH, ProtocolDoH3, ProtocolODoH:
+		URL, err := url.Parse(a.Address)
+		if err != nil {
+			return ""
+		}
+		return URL.Hostname()
+
+	default:
+		host, _, err := net.SplitHostPort(a.Address)
+		if err != nil {
+			return ""
+		}
+		return host
+	}
+}
+
+// hasBootstrap returns whether the server address configures
+// bootstrap IP addresses or bootstrap resolvers.
+func (a *ServerAddr) hasBootstrap() bool {
+	return len(a.BootstrapIPs) > 0 || a.BootstrapResolver != nil || len(a.BootstrapResolvers) > 0
+}
+
+// bootstrapResolver returns the resolver to use for resolving the hostname
+// of the given server address or nil if we should use the default dialer.
+//
+// When the server address only contains BootstrapResolvers, we create a
+// resolver using this transport, such that we log the bootstrap queries.
+func (t *Transport) bootstrapResolver(addr *ServerAddr) *Resolver {
+	if addr.BootstrapResolver != nil {
+		return addr.BootstrapResolver
+	}
+	if len(addr.BootstrapResolvers) <= 0 {
+		return nil
+	}
+	config := NewConfig()
+	for _, resolver := range addr.BootstrapResolvers {
+		config.AddServer(NewServerAddr(ProtocolUDP, resolver.String()))
+	}
+	return &Resolver{Config: config, Transport: t}
+}
+
+// bootstrapEndpoints returns the endpoints to dial for connecting to the
+// given address, in the form returned by [net.JoinHostPort].
+//
+// We only bootstrap when the host of the address is the hostname of the
+// server address. In such a case, we use the BootstrapIPs, if any, or we
+// resolve the hostname using the bootstrap resolver. Otherwise, we return
+// the address unmodified and let the dialer resolve it.
+func (t *Transport) bootstrapEndpoints(ctx context.Context, addr *ServerAddr, address string) ([]string, error) {
+	// 1. Determine whether we need to bootstrap
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil || !strings.EqualFold(host, addr.hostname()) {
+		return []string{address}, nil
+	}
+
+	// 2. Prefer the bootstrap IP addresses
+	var endpoints []string
+	if len(addr.BootstrapIPs) > 0 {
+		for _, ip := range addr.BootstrapIPs {
+			endpoints = append(endpoints, net.JoinHostPort(ip.String(), port))
+		}
+		return endpoints, nil
+	}
+
+	// 3. Otherwise, use the bootstrap resolver, if any
+	reso := t.bootstrapResolver(addr)
+	if reso == nil {
+		return []string{address}, nil
+	}
+	addrs, err := reso.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range addrs {
+		endpoints = append(endpoints, net.JoinHostPort(ip, port))
+	}
+	return endpoints, nil
+}
+
+// dialEndpoints dials each endpoint in sequence using the given function
+// and returns the first successfully established connection.
+func dialEndpoints[T any](ctx context.Context, endpoints []string,
+	dial func(ctx context.Context, endpoint string) (T, error)) (T, error) {
+	var errv []error
+	for _, endpoint := range endpoints {
+		conn, err := dial(ctx, endpoint)
+		if err == nil {
+			return conn, nil
+		}
+		errv = append(errv, err)
+	}
+	var zero T
+	if len(errv) == 1 {
+		return zero, errv[0]
+	}
+	return zero, errors.Join(errv...)
+}
+
+// needsAddrHTTPClient returns whether we need a dedicated HTTP client
+// for honouring the settings of the given server address or the client
+// certificates configured in the transport.
+func (t *Transport) needsAddrHTTPClient(addr *ServerAddr) bool {
+	return addr.hasBootstrap() || addr.hasTLSSettings() || len(t.ClientCertificates) > 0
+}
+
+// httpClientDoAddr is like [*Transport.httpClientDo] but, when using the
+// default HTTP client and the server address requires bootstrapping or
+// customizes the TLS settings, or we have client certificates, uses a
+// dedicated [*http.Transport] dialing the bootstrap endpoints and
+// applying the TLS settings.
+//
+// In such a case, like we do for DoH3, we use a new connection for each query
+// and we close the connection when the caller closes the response body.
+func (t *Transport) httpClientDoAddr(addr *ServerAddr,
+	req *http.Request) (*http.Response, netip.AddrPort, netip.AddrPort, error) {
+	// 1. When using a custom HTTP client, the client is responsible for
+	// bootstrapping and TLS settings, so we just defer to the client.
+	if t.HTTPClientDo != nil || t.HTTPClient != nil || !t.needsAddrHTTPClient(addr) {
+		return t.httpClientDo(req)
+	}
+
+	// 2. Create an HTTP transport dialing the bootstrap endpoints
+	txp := &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return t.dialTLSAddr(ctx, addr, network, address, []string{"h2", "http/1.1"})
+		},
+		ForceAttemptHTTP2: true,
+	}
+	connPool := &closepool.Pool{}
+	connPool.Add(closepool.CloserFunc(func() error {
+		txp.CloseIdleConnections()
+		return nil
+	}))
+
+	// 3. Perform the round trip
+	resp, endpoints, err := httpconntrace.Do(&http.Client{Transport: txp}, req)
+	if err != nil {
+		connPool.Close()
+		return nil, endpoints.LocalAddr, endpoints.RemoteAddr, err
+	}
+
+	// 4. Make sure closing the body closes the connection
+	resp.Body = &httpResponseBody{ReadCloser: resp.Body, connPool: connPool}
+	return resp, endpoints.LocalAddr, endpoints.RemoteAddr, nil
+}
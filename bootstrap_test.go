@@ -0,0 +1,291 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerAddr_hostname(t *testing.T) {
+	tests := []struct {
+		name   string
+		addr   *ServerAddr
+		expect string
+	}{
+		{name: "DoT", addr: NewServerAddr(ProtocolDoT, "dns.google:853"), expect: "dns.google"},
+		{name: "DoQ with IPv6", addr: NewServerAddr(ProtocolDoQ, "[::1]:853"), expect: "::1"},
+		{name: "DoH", addr: NewServerAddr(ProtocolDoH, "https://dns.google/dns-query"), expect: "dns.google"},
+		{name: "ODoH", addr: NewServerAddr(ProtocolODoH, "https://relay.example.com:8443/proxy"), expect: "relay.example.com"},
+		{name: "invalid endpoint", addr: NewServerAddr(ProtocolDoT, "dns.google"), expect: ""},
+		{name: "invalid URL", addr: NewServerAddr(ProtocolDoH, "\t"), expect: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, tt.addr.hostname())
+		})
+	}
+}
+
+// bootstrapTestTransport is a [ResolverTransport] resolving any name to
+// the configured addresses or failing with the configured error.
+type bootstrapTestTransport struct {
+	addrs []string
+	err   error
+}
+
+func (txp *bootstrapTestTransport) Query(ctx context.Context, addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+	if txp.err != nil {
+		return nil, txp.err
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	for _, addr := range txp.addrs {
+		rr, err := dns.NewRR(query.Question[0].Name + " 3600 IN A " + addr)
+		if err != nil {
+			return nil, err
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+	if query.Question[0].Qtype != dns.TypeA {
+		resp.Answer = nil
+	}
+	return resp, nil
+}
+
+func TestTransport_bootstrapEndpoints(t *testing.T) {
+	newResolver := func(txp ResolverTransport) *Resolver {
+		config := NewConfig()
+		config.AddServer(NewServerAddr(ProtocolUDP, "127.0.0.1:53"))
+		return &Resolver{Config: config, Transport: txp}
+	}
+
+	tests := []struct {
+		name      string
+		addr      *ServerAddr
+		address   string
+		expect    []string
+		expectErr error
+	}{{
+		name:    "without bootstrap",
+		addr:    NewServerAddr(ProtocolDoT, "dns.google:853"),
+		address: "dns.google:853",
+		expect:  []string{"dns.google:853"},
+	}, {
+		name: "with IP address",
+		addr: &ServerAddr{
+			Protocol:     ProtocolDoT,
+			Address:      "8.8.8.8:853",
+			BootstrapIPs: []netip.Addr{netip.MustParseAddr("8.8.4.4")},
+		},
+		address: "8.8.8.8:853",
+		expect:  []string{"8.8.8.8:853"},
+	}, {
+		name: "with another hostname",
+		addr: &ServerAddr{
+			Protocol:     ProtocolODoH,
+			Address:      "https://relay.example.com/proxy",
+			BootstrapIPs: []netip.Addr{netip.MustParseAddr("8.8.4.4")},
+		},
+		address: "target.example.com:443",
+		expect:  []string{"target.example.com:443"},
+	}, {
+		name: "with bootstrap IPs",
+		addr: &ServerAddr{
+			Protocol:     ProtocolDoH,
+			Address:      "https://dns.google/dns-query",
+			BootstrapIPs: []netip.Addr{netip.MustParseAddr("8.8.8.8"), netip.MustParseAddr("2001:4860:4860::8888")},
+		},
+		address: "DNS.google:443",
+		expect:  []string{"8.8.8.8:443", "[2001:4860:4860::8888]:443"},
+	}, {
+		name: "with bootstrap resolver",
+		addr: &ServerAddr{
+			Protocol:          ProtocolDoQ,
+			Address:           "dns.google:853",
+			BootstrapResolver: newResolver(&bootstrapTestTransport{addrs: []string{"8.8.8.8", "8.8.4.4"}}),
+		},
+		address: "dns.google:853",
+		expect:  []string{"8.8.4.4:853", "8.8.8.8:853"},
+	}, {
+		name: "with bootstrap resolver failure",
+		addr: &ServerAddr{
+			Protocol:          ProtocolDoQ,
+			Address:           "dns.google:853",
+			BootstrapResolver: newResolver(&bootstrapTestTransport{err: errors.New("mocked error")}),
+		},
+		address:   "dns.google:853",
+		expectErr: errors.New("mocked error"),
+	}, {
+		name:      "with invalid address",
+		addr:      NewServerAddr(ProtocolDoT, "dns.google:853"),
+		address:   "dns.google",
+		expectErr: errors.New("address dns.google: missing port in address"),
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoints, err := (&Transport{}).bootstrapEndpoints(context.Background(), tt.addr, tt.address)
+			if tt.expectErr != nil {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectErr.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tt.expect, endpoints)
+		})
+	}
+}
+
+func TestTransport_bootstrapResolver(t *testing.T) {
+	txp := &Transport{}
+
+	t.Run("without bootstrap resolvers", func(t *testing.T) {
+		assert.Nil(t, txp.bootstrapResolver(NewServerAddr(ProtocolDoT, "dns.google:853")))
+	})
+
+	t.Run("with bootstrap resolver", func(t *testing.T) {
+		reso := &Resolver{}
+		addr := &ServerAddr{
+			Protocol:           ProtocolDoT,
+			Address:            "dns.google:853",
+			BootstrapResolver:  reso,
+			BootstrapResolvers: []netip.AddrPort{netip.MustParseAddrPort("8.8.8.8:53")},
+		}
+		assert.Same(t, reso, txp.bootstrapResolver(addr))
+	})
+
+	t.Run("with bootstrap resolvers", func(t *testing.T) {
+		addr := &ServerAddr{
+			Protocol:           ProtocolDoT,
+			Address:            "dns.google:853",
+			BootstrapResolvers: []netip.AddrPort{netip.MustParseAddrPort("8.8.8.8:53"), netip.MustParseAddrPort("[::1]:5353")},
+		}
+		reso := txp.bootstrapResolver(addr)
+		assert.Same(t, txp, reso.Transport)
+		servers := reso.Config.servers()
+		assert.Len(t, servers, 2)
+		assert.Equal(t, NewServerAddr(ProtocolUDP, "8.8.8.8:53"), servers[0].address)
+		assert.Equal(t, NewServerAddr(ProtocolUDP, "[::1]:5353"), servers[1].address)
+	})
+}
+
+func Test_dialEndpoints(t *testing.T) {
+	t.Run("returns the first success", func(t *testing.T) {
+		var dialed []string
+		conn, err := dialEndpoints(context.Background(), []string{"a", "b", "c"},
+			func(ctx context.Context, endpoint string) (string, error) {
+				dialed = append(dialed, endpoint)
+				if endpoint == "a" {
+					return "", errors.New("mocked error")
+				}
+				return endpoint, nil
+			})
+		assert.NoError(t, err)
+		assert.Equal(t, "b", conn)
+		assert.Equal(t, []string{"a", "b"}, dialed)
+	})
+
+	t.Run("returns the only error", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		_, err := dialEndpoints(context.Background(), []string{"a"},
+			func(ctx context.Context, endpoint string) (string, error) {
+				return "", expected
+			})
+		assert.Equal(t, expected, err)
+	})
+
+	t.Run("joins all the errors", func(t *testing.T) {
+		errA, errB := errors.New("error a"), errors.New("error b")
+		_, err := dialEndpoints(context.Background(), []string{"a", "b"},
+			func(ctx context.Context, endpoint string) (string, error) {
+				if endpoint == "a" {
+					return "", errA
+				}
+				return "", errB
+			})
+		assert.ErrorIs(t, err, errA)
+		assert.ErrorIs(t, err, errB)
+	})
+}
+
+func TestTransport_needsAddrHTTPClient(t *testing.T) {
+	tests := []struct {
+		name   string
+		txp    *Transport
+		addr   *ServerAddr
+		expect bool
+	}{{
+		name:   "no settings",
+		txp:    &Transport{},
+		addr:   &ServerAddr{},
+		expect: false,
+	}, {
+		name:   "bootstrap IPs",
+		txp:    &Transport{},
+		addr:   &ServerAddr{BootstrapIPs: []netip.Addr{netip.MustParseAddr("8.8.8.8")}},
+		expect: true,
+	}, {
+		name:   "TLS settings",
+		txp:    &Transport{},
+		addr:   &ServerAddr{TLSServerName: "dns.google"},
+		expect: true,
+	}, {
+		name:   "client certificates",
+		txp:    &Transport{ClientCertificates: []tls.Certificate{{}}},
+		addr:   &ServerAddr{},
+		expect: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, tt.txp.needsAddrHTTPClient(tt.addr))
+		})
+	}
+}
+
+func TestTransport_httpClientDoAddr(t *testing.T) {
+	t.Run("defers to HTTPClientDo", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		txp := &Transport{
+			HTTPClientDo: func(req *http.Request) (*http.Response, netip.AddrPort, netip.AddrPort, error) {
+				return nil, netip.AddrPort{}, netip.AddrPort{}, expected
+			},
+		}
+		addr := &ServerAddr{
+			Protocol:     ProtocolDoH,
+			Address:      "https://dns.google/dns-query",
+			BootstrapIPs: []netip.Addr{netip.MustParseAddr("8.8.8.8")},
+		}
+		req, err := http.NewRequest(http.MethodPost, addr.Address, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, err = txp.httpClientDoAddr(addr, req)
+		assert.Equal(t, expected, err)
+	})
+
+	t.Run("bootstrap failure", func(t *testing.T) {
+		txp := &Transport{}
+		addr := &ServerAddr{
+			Protocol:          ProtocolDoH,
+			Address:           "https://dns.google/dns-query",
+			BootstrapResolver: &Resolver{Transport: &bootstrapTestTransport{err: errors.New("mocked error")}},
+		}
+		req, err := http.NewRequest(http.MethodPost, addr.Address, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, _, _, err := txp.httpClientDoAddr(addr, req)
+		assert.ErrorContains(t, err, "mocked error")
+		assert.Nil(t, resp)
+	})
+}
@@ -0,0 +1,366 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// TTL-aware cache of lookup results.
+//
+// See https://datatracker.ietf.org/doc/html/rfc2308
+// See https://datatracker.ietf.org/doc/html/rfc8767
+//
+
+package dnscore
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Cache is a TTL-aware cache of the lookup results of a [*Resolver].
+//
+// We cache answers for the minimum TTL of the answer RRs, and NXDOMAIN
+// and NODATA results for the minimum between the TTL and the MINIMUM
+// field of the SOA RR in the authority section, as specified by RFC 2308.
+// Results without a SOA RR and failures are never cached.
+//
+// When the cache is full, we evict the least recently used entries.
+//
+// Since the cache operates above the [ResolverTransport], it works with
+// any transport. However, the cache does not know which servers, query
+// options, and DNSSEC settings were used to obtain a result, therefore
+// only share a cache between resolvers with the same configuration.
+//
+// Construct using [NewCache].
+//
+// This struct is safe for concurrent use by multiple goroutines.
+type Cache struct {
+	// entries maps keys to elements of lru.
+	entries map[cacheKey]*list.Element
+
+	// lru contains the entries from the most to the least recently used.
+	lru *list.List
+
+	// maxBytes is the maximum estimated memory usage.
+	maxBytes int
+
+	// maxEntries is the maximum number of entries.
+	maxEntries int
+
+	// maxStale is the serve-stale window, which is zero when disabled.
+	maxStale time.Duration
+
+	// mu protects the mutable fields.
+	mu sync.Mutex
+
+	// stats contains the statistics.
+	stats CacheStats
+
+	// timeNow is the function returning the current time.
+	timeNow func() time.Time
+}
+
+// CacheStats contains the statistics of a [*Cache].
+type CacheStats struct {
+	// Bytes is the estimated memory used by the entries.
+	Bytes int
+
+	// Entries is the number of entries.
+	Entries int
+
+	// Evictions counts the entries evicted to make room for new entries.
+	Evictions int64
+
+	// Hits counts the lookups served using fresh entries.
+	Hits int64
+
+	// Misses counts the lookups for which there was no fresh entry.
+	Misses int64
+
+	// StaleHits counts the lookups served using expired entries
+	// after failing to refresh them (see [CacheOptionServeStale]).
+	StaleHits int64
+}
+
+// CacheOption is an option for constructing a [*Cache].
+type CacheOption func(*Cache)
+
+// DefaultCacheMaxBytes is the default maximum estimated memory used by a [*Cache].
+const DefaultCacheMaxBytes = 4 << 20
+
+// DefaultCacheMaxEntries is the default maximum number of entries of a [*Cache].
+const DefaultCacheMaxEntries = 4096
+
+// CacheOptionMaxBytes sets the maximum estimated memory used by the cache.
+//
+// If this option is not used, we use [DefaultCacheMaxBytes].
+func CacheOptionMaxBytes(maxBytes int) CacheOption {
+	return func(c *Cache) {
+		c.maxBytes = maxBytes
+	}
+}
+
+// CacheOptionMaxEntries sets the maximum number of entries of the cache.
+//
+// If this option is not used, we use [DefaultCacheMaxEntries].
+func CacheOptionMaxEntries(maxEntries int) CacheOption {
+	return func(c *Cache) {
+		c.maxEntries = maxEntries
+	}
+}
+
+// CacheOptionServeStale enables serving expired entries for up to maxStale
+// after their expiration when we fail to refresh them, as specified by RFC
+// 8767, which suggests a maxStale value between one and three days.
+//
+// If this option is not used, we never serve expired entries.
+func CacheOptionServeStale(maxStale time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.maxStale = maxStale
+	}
+}
+
+// CacheOptionTimeNow sets the function returning the current time.
+//
+// If this option is not used, we use [time.Now].
+func CacheOptionTimeNow(timeNow func() time.Time) CacheOption {
+	return func(c *Cache) {
+		c.timeNow = timeNow
+	}
+}
+
+// NewCache creates a new [*Cache].
+func NewCache(options ...CacheOption) *Cache {
+	c := &Cache{
+		entries:    make(map[cacheKey]*list.Element),
+		lru:        list.New(),
+		maxBytes:   DefaultCacheMaxBytes,
+		maxEntries: DefaultCacheMaxEntries,
+		maxStale:   0,
+		mu:         sync.Mutex{},
+		stats:      CacheStats{},
+		timeNow:    time.Now,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Stats returns the current statistics.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// cacheMaxTTL is the maximum TTL of cached answers as
+// recommended by RFC 8767 Sect. 4.
+const cacheMaxTTL = 7 * 24 * time.Hour
+
+// cacheMaxNegativeTTL is the maximum TTL of cached NXDOMAIN and
+// NODATA results as recommended by RFC 2308 Sect. 5.
+const cacheMaxNegativeTTL = 3 * time.Hour
+
+// cacheStaleTTL is the TTL of the RRs of stale answers in
+// seconds as recommended by RFC 8767 Sect. 4.
+const cacheStaleTTL = 30
+
+// cacheEntryOverhead is the estimated memory used
+// by an entry in addition to the name and the RRs.
+const cacheEntryOverhead = 128
+
+// cacheKey is the key of a [*Cache] entry.
+type cacheKey struct {
+	name   string
+	qclass uint16
+	qtype  uint16
+}
+
+// newCacheKey returns the key for the given name and type, using the
+// IDNA-encoded canonical name, or false if the name is invalid.
+func newCacheKey(name string, qtype uint16) (cacheKey, bool) {
+	punyName, err := idnaToASCII(name)
+	if err != nil {
+		return cacheKey{}, false
+	}
+	return cacheKey{name: dns.CanonicalName(punyName), qclass: dns.ClassINET, qtype: qtype}, true
+}
+
+// cacheEntry is an entry of a [*Cache].
+type cacheEntry struct {
+	// canonicalName is the canonical name of the answer.
+	canonicalName string
+
+	// cnameChain contains the targets of the CNAME RRs.
+	cnameChain []string
+
+	// err is [ErrNoName] or [ErrNoData] for negative entries.
+	err error
+
+	// expires is when the entry expires.
+	expires time.Time
+
+	// key is the entry key.
+	key cacheKey
+
+	// rrs contains the answer RRs.
+	rrs []dns.RR
+
+	// size is the estimated memory used by the entry.
+	size int
+
+	// status is the DNSSEC status of the answer.
+	status DNSSECStatus
+}
+
+// cacheTTL returns how long to cache the result of a lookup, which
+// is zero when the result should not be cached.
+func cacheTTL(resp *dns.Msg, err error) time.Duration {
+	// 1. we need a response to cache
+	if resp == nil {
+		return 0
+	}
+
+	// 2. handle answers using the minimum TTL of the RRs including CNAMEs
+	if err == nil {
+		ttl := cacheMaxTTL
+		for _, rr := range resp.Answer {
+			ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+		}
+		return ttl
+	}
+
+	// 3. handle NXDOMAIN and NODATA using the SOA RR
+	if !errors.Is(err, ErrNoName) && !errors.Is(err, ErrNoData) {
+		return 0
+	}
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+			return min(ttl, cacheMaxNegativeTTL)
+		}
+	}
+	return 0
+}
+
+// put caches the result of a lookup using the given response
+// to determine the TTL. We do not cache results with a zero TTL.
+func (c *Cache) put(key cacheKey, resp *dns.Msg, rrs []dns.RR, status DNSSECStatus, err error) {
+	// 1. determine whether we can cache
+	ttl := cacheTTL(resp, err)
+	if ttl <= 0 {
+		return
+	}
+	entry := &cacheEntry{
+		err:    err,
+		key:    key,
+		rrs:    rrs,
+		size:   cacheEntryOverhead + len(key.name),
+		status: status,
+	}
+	if len(resp.Question) > 0 {
+		entry.canonicalName, entry.cnameChain = lookupCNAMEChain(resp.Question[0].Name, resp)
+	}
+	entry.size += len(entry.canonicalName)
+	for _, name := range entry.cnameChain {
+		entry.size += len(name)
+	}
+	for _, rr := range rrs {
+		entry.size += dns.Len(rr)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 2. make sure the entry fits into the cache
+	if entry.size > c.maxBytes || c.maxEntries <= 0 {
+		return
+	}
+
+	// 3. replace the existing entry, if any
+	entry.expires = c.timeNow().Add(ttl)
+	if elem, found := c.entries[key]; found {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.stats.Bytes += entry.size
+	c.stats.Entries++
+
+	// 4. evict the least recently used entries
+	for c.stats.Entries > c.maxEntries || c.stats.Bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// get returns the entry for the given key with the TTLs of the RRs
+// adjusted to the remaining lifetime. When stale is true, we return the
+// entries that expired within the serve-stale window, using a short
+// TTL, and otherwise we only return the entries that did not expire.
+func (c *Cache) get(key cacheKey, stale bool) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 1. find the entry and remove it when it is too old to be useful
+	now := c.timeNow()
+	elem, found := c.entries[key]
+	if found && !now.Before(elem.Value.(*cacheEntry).expires.Add(c.maxStale)) {
+		c.remove(elem)
+		found = false
+	}
+	var entry *cacheEntry
+	if found {
+		entry = elem.Value.(*cacheEntry)
+	}
+
+	// 2. update the statistics
+	fresh := found && now.Before(entry.expires)
+	switch {
+	case !stale && fresh:
+		c.stats.Hits++
+	case !stale:
+		c.stats.Misses++
+		return nil, false
+	case !found:
+		return nil, false
+	default:
+		c.stats.StaleHits++
+	}
+	c.lru.MoveToFront(elem)
+
+	// 3. copy the RRs adjusting their TTL
+	ttl := uint32(cacheStaleTTL)
+	if fresh {
+		ttl = uint32(entry.expires.Sub(now).Round(time.Second) / time.Second)
+	}
+	result := *entry
+	result.rrs = make([]dns.RR, 0, len(entry.rrs))
+	for _, rr := range entry.rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = ttl
+		result.rrs = append(result.rrs, rr)
+	}
+	return &result, true
+}
+
+// result returns a [*LookupResult] containing the entry RRs.
+func (entry *cacheEntry) result() *LookupResult {
+	return &LookupResult{
+		Addrs:         lookupAddrs(entry.rrs),
+		CNAMEChain:    entry.cnameChain,
+		CanonicalName: entry.canonicalName,
+		Cached:        true,
+		DNSSECStatus:  entry.status,
+		RRs:           entry.rrs,
+	}
+}
+
+// remove removes the given element. The caller must hold the mutex.
+func (c *Cache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.stats.Bytes -= entry.size
+	c.stats.Entries--
+}
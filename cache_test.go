@@ -0,0 +1,324 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// cacheTestClock is a manually advanced clock.
+type cacheTestClock struct {
+	now time.Time
+}
+
+func (c *cacheTestClock) timeNow() time.Time {
+	return c.now
+}
+
+// newCacheTestA returns an A RR for the given name and TTL.
+func newCacheTestA(name string, ttl uint32) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.IPv4(192, 0, 2, 1),
+	}
+}
+
+// newCacheTestSOA returns an SOA RR with the given TTL and MINIMUM.
+func newCacheTestSOA(ttl, minttl uint32) dns.RR {
+	return &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: minttl,
+	}
+}
+
+func Test_cacheTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		resp   *dns.Msg
+		err    error
+		expect time.Duration
+	}{{
+		name:   "no response",
+		resp:   nil,
+		err:    nil,
+		expect: 0,
+	}, {
+		name: "minimum TTL of the answer RRs",
+		resp: &dns.Msg{Answer: []dns.RR{
+			&dns.CNAME{
+				Hdr:    dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: "example.com.",
+			},
+			newCacheTestA("example.com.", 300),
+		}},
+		expect: time.Minute,
+	}, {
+		name:   "capped answer TTL",
+		resp:   &dns.Msg{Answer: []dns.RR{newCacheTestA("example.com.", 1<<30)}},
+		expect: cacheMaxTTL,
+	}, {
+		name:   "NXDOMAIN using the SOA MINIMUM",
+		resp:   &dns.Msg{Ns: []dns.RR{newCacheTestSOA(3600, 300)}},
+		err:    ErrNoName,
+		expect: 5 * time.Minute,
+	}, {
+		name:   "NODATA using the SOA TTL",
+		resp:   &dns.Msg{Ns: []dns.RR{newCacheTestSOA(60, 300)}},
+		err:    ErrNoData,
+		expect: time.Minute,
+	}, {
+		name:   "capped negative TTL",
+		resp:   &dns.Msg{Ns: []dns.RR{newCacheTestSOA(86400, 86400)}},
+		err:    ErrNoName,
+		expect: cacheMaxNegativeTTL,
+	}, {
+		name:   "NODATA without SOA",
+		resp:   &dns.Msg{},
+		err:    ErrNoData,
+		expect: 0,
+	}, {
+		name:   "failure",
+		resp:   &dns.Msg{Ns: []dns.RR{newCacheTestSOA(3600, 300)}},
+		err:    ErrServerTemporarilyMisbehaving,
+		expect: 0,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, cacheTTL(tt.resp, tt.err))
+		})
+	}
+}
+
+func TestCache(t *testing.T) {
+	t.Run("TTL and expiration", func(t *testing.T) {
+		clock := &cacheTestClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+		cache := NewCache(CacheOptionTimeNow(clock.timeNow))
+		key, _ := newCacheKey("Example.COM", dns.TypeA)
+		rr := newCacheTestA("example.com.", 300)
+		cache.put(key, &dns.Msg{Answer: []dns.RR{rr}}, []dns.RR{rr}, DNSSECSecure, nil)
+
+		clock.now = clock.now.Add(100 * time.Second)
+		entry, ok := cache.get(key, false)
+		if assert.True(t, ok) {
+			assert.NoError(t, entry.err)
+			assert.Equal(t, DNSSECSecure, entry.status)
+			assert.Equal(t, uint32(200), entry.rrs[0].Header().Ttl)
+			assert.Equal(t, uint32(300), rr.Header().Ttl)
+		}
+
+		clock.now = clock.now.Add(200 * time.Second)
+		_, ok = cache.get(key, false)
+		assert.False(t, ok)
+		_, ok = cache.get(key, true)
+		assert.False(t, ok)
+		assert.Equal(t, CacheStats{Hits: 1, Misses: 1}, cache.Stats())
+	})
+
+	t.Run("serve stale", func(t *testing.T) {
+		clock := &cacheTestClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+		cache := NewCache(CacheOptionTimeNow(clock.timeNow), CacheOptionServeStale(time.Hour))
+		key, _ := newCacheKey("example.com", dns.TypeA)
+		rr := newCacheTestA("example.com.", 300)
+		cache.put(key, &dns.Msg{Answer: []dns.RR{rr}}, []dns.RR{rr}, DNSSECIndeterminate, nil)
+
+		clock.now = clock.now.Add(30 * time.Minute)
+		_, ok := cache.get(key, false)
+		assert.False(t, ok)
+		entry, ok := cache.get(key, true)
+		if assert.True(t, ok) {
+			assert.Equal(t, uint32(cacheStaleTTL), entry.rrs[0].Header().Ttl)
+		}
+
+		clock.now = clock.now.Add(time.Hour)
+		_, ok = cache.get(key, true)
+		assert.False(t, ok)
+		assert.Equal(t, CacheStats{Misses: 1, StaleHits: 1}, cache.Stats())
+	})
+
+	t.Run("max entries", func(t *testing.T) {
+		cache := NewCache(CacheOptionMaxEntries(2))
+		for _, name := range []string{"a.example.com", "b.example.com", "a.example.com", "c.example.com"} {
+			key, _ := newCacheKey(name, dns.TypeA)
+			if _, ok := cache.get(key, false); ok {
+				continue
+			}
+			rr := newCacheTestA(key.name, 300)
+			cache.put(key, &dns.Msg{Answer: []dns.RR{rr}}, []dns.RR{rr}, DNSSECIndeterminate, nil)
+		}
+		for name, expect := range map[string]bool{"a.example.com": true, "b.example.com": false, "c.example.com": true} {
+			key, _ := newCacheKey(name, dns.TypeA)
+			_, ok := cache.get(key, false)
+			assert.Equal(t, expect, ok, name)
+		}
+		stats := cache.Stats()
+		assert.Equal(t, 2, stats.Entries)
+		assert.Equal(t, int64(1), stats.Evictions)
+	})
+
+	t.Run("max bytes", func(t *testing.T) {
+		key, _ := newCacheKey("example.com", dns.TypeA)
+		rr := newCacheTestA("example.com.", 300)
+		size := cacheEntryOverhead + len(key.name) + dns.Len(rr)
+		cache := NewCache(CacheOptionMaxBytes(size))
+		cache.put(key, &dns.Msg{Answer: []dns.RR{rr}}, []dns.RR{rr}, DNSSECIndeterminate, nil)
+		assert.Equal(t, CacheStats{Bytes: size, Entries: 1}, cache.Stats())
+
+		// an entry of the same size evicts the existing entry
+		key2, _ := newCacheKey("example.net", dns.TypeA)
+		rr2 := newCacheTestA("example.net.", 300)
+		cache.put(key2, &dns.Msg{Answer: []dns.RR{rr2}}, []dns.RR{rr2}, DNSSECIndeterminate, nil)
+		assert.Equal(t, CacheStats{Bytes: size, Entries: 1, Evictions: 1}, cache.Stats())
+
+		// a larger entry does not fit into the cache
+		key3, _ := newCacheKey("www.example.com", dns.TypeA)
+		rr3 := newCacheTestA("www.example.com.", 300)
+		cache.put(key3, &dns.Msg{Answer: []dns.RR{rr3}}, []dns.RR{rr3}, DNSSECIndeterminate, nil)
+		assert.Equal(t, CacheStats{Bytes: size, Entries: 1, Evictions: 1}, cache.Stats())
+		_, ok := cache.get(key2, false)
+		assert.True(t, ok)
+	})
+
+	t.Run("replacing an entry", func(t *testing.T) {
+		cache := NewCache()
+		key, _ := newCacheKey("example.com", dns.TypeA)
+		rr := newCacheTestA("example.com.", 300)
+		cache.put(key, &dns.Msg{Answer: []dns.RR{rr}}, []dns.RR{rr}, DNSSECIndeterminate, nil)
+		cache.put(key, &dns.Msg{Ns: []dns.RR{newCacheTestSOA(60, 60)}}, nil, DNSSECIndeterminate, ErrNoName)
+		entry, ok := cache.get(key, false)
+		if assert.True(t, ok) {
+			assert.ErrorIs(t, entry.err, ErrNoName)
+			assert.Empty(t, entry.rrs)
+		}
+		assert.Equal(t, 1, cache.Stats().Entries)
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		_, ok := newCacheKey("\u0000", dns.TypeA)
+		assert.False(t, ok)
+	})
+}
+
+func TestResolver_Cache(t *testing.T) {
+	// newTransport returns a transport answering using the given function
+	// and counting the queries, which fails when the function returns nil.
+	newTransport := func(queries *int, respond func(query, resp *dns.Msg)) *MockResolverTransport {
+		return &MockResolverTransport{
+			MockQuery: func(ctx context.Context, addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+				*queries++
+				if respond == nil {
+					return nil, errors.New("mocked error")
+				}
+				resp := &dns.Msg{}
+				resp.SetReply(query)
+				resp.RecursionAvailable = true
+				respond(query, resp)
+				return resp, nil
+			},
+		}
+	}
+
+	t.Run("answer", func(t *testing.T) {
+		var queries int
+		reso := &Resolver{
+			Cache: NewCache(),
+			Transport: newTransport(&queries, func(query, resp *dns.Msg) {
+				resp.Answer = []dns.RR{newCacheTestA(query.Question[0].Name, 300)}
+			}),
+		}
+		for range 3 {
+			addrs, err := reso.LookupA(context.Background(), "example.com")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"192.0.2.1"}, addrs)
+		}
+		assert.Equal(t, 1, queries)
+		assert.Equal(t, CacheStats{Bytes: reso.Cache.Stats().Bytes, Entries: 1, Hits: 2, Misses: 1}, reso.Cache.Stats())
+	})
+
+	t.Run("NXDOMAIN", func(t *testing.T) {
+		var queries int
+		reso := &Resolver{
+			Cache: NewCache(),
+			Transport: newTransport(&queries, func(query, resp *dns.Msg) {
+				resp.Rcode = dns.RcodeNameError
+				resp.Ns = []dns.RR{newCacheTestSOA(3600, 300)}
+			}),
+		}
+		for range 2 {
+			_, err := reso.LookupA(context.Background(), "nxdomain.example.com")
+			assert.ErrorIs(t, err, ErrNoName)
+		}
+		assert.Equal(t, 1, queries)
+	})
+
+	t.Run("NODATA", func(t *testing.T) {
+		var queries int
+		reso := &Resolver{
+			Cache: NewCache(),
+			Transport: newTransport(&queries, func(query, resp *dns.Msg) {
+				resp.Ns = []dns.RR{newCacheTestSOA(3600, 300)}
+			}),
+		}
+		for range 2 {
+			_, err := reso.LookupAAAA(context.Background(), "example.com")
+			assert.ErrorIs(t, err, ErrNoData)
+		}
+		assert.Equal(t, DefaultAttempts, queries)
+	})
+
+	t.Run("NODATA without SOA", func(t *testing.T) {
+		var queries int
+		reso := &Resolver{
+			Cache:     NewCache(),
+			Transport: newTransport(&queries, func(query, resp *dns.Msg) {}),
+		}
+		for range 2 {
+			_, err := reso.LookupAAAA(context.Background(), "example.com")
+			assert.ErrorIs(t, err, ErrNoData)
+		}
+		assert.Equal(t, 2*DefaultAttempts, queries)
+	})
+
+	t.Run("serve stale", func(t *testing.T) {
+		var queries int
+		clock := &cacheTestClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+		reso := &Resolver{
+			Cache: NewCache(CacheOptionTimeNow(clock.timeNow), CacheOptionServeStale(24*time.Hour)),
+			Transport: newTransport(&queries, func(query, resp *dns.Msg) {
+				resp.Answer = []dns.RR{newCacheTestA(query.Question[0].Name, 300)}
+			}),
+		}
+		_, err := reso.LookupA(context.Background(), "example.com")
+		assert.NoError(t, err)
+
+		clock.now = clock.now.Add(time.Hour)
+		reso.Transport = newTransport(&queries, nil)
+		rrs, _, err := reso.lookup(context.Background(), "example.com", dns.TypeA)
+		assert.NoError(t, err)
+		if assert.Len(t, rrs, 1) {
+			assert.Equal(t, uint32(cacheStaleTTL), rrs[0].Header().Ttl)
+		}
+		assert.Equal(t, 1+DefaultAttempts, queries)
+		assert.Equal(t, int64(1), reso.Cache.Stats().StaleHits)
+	})
+
+	t.Run("failure without stale entries", func(t *testing.T) {
+		var queries int
+		reso := &Resolver{
+			Cache:     NewCache(CacheOptionServeStale(24 * time.Hour)),
+			Transport: newTransport(&queries, nil),
+		}
+		_, err := reso.LookupA(context.Background(), "example.com")
+		assert.Error(t, err)
+		assert.Equal(t, 0, reso.Cache.Stats().Entries)
+	})
+}
@@ -0,0 +1,501 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// Connection reuse and pipelining for DNS-over-TCP and DNS-over-TLS.
+//
+// See https://datatracker.ietf.org/doc/html/rfc7766#section-6.2
+//
+
+package dnscore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ConnPool is a pool of DNS-over-TCP and DNS-over-TLS connections.
+//
+// Set the ConnPool field of [*Transport] to opt into reusing connections
+// across queries. We keep connections per [*ServerAddr] and we pipeline
+// multiple in-flight queries over the same connection, as recommended
+// by RFC 7766. Because servers may send responses out of order, we
+// match each response to its query using the DNS message ID.
+//
+// Since we key connections by [*ServerAddr] pointer, you should reuse
+// the same [*ServerAddr] for all the queries to the same server.
+//
+// Make sure you call [*ConnPool.Close] when you are done.
+//
+// The zero value is ready to use. A [*ConnPool] is safe for concurrent
+// use by multiple goroutines as long as you don't modify its fields
+// after you have started using it.
+type ConnPool struct {
+	// IdleTimeout is the optional time after which we close a connection
+	// without any in-flight query. If this field is zero or negative,
+	// we use the [DefaultConnPoolIdleTimeout] default.
+	IdleTimeout time.Duration
+
+	// closed indicates that the pool has been closed.
+	closed bool
+
+	// conns contains the connections for each server.
+	conns map[*ServerAddr][]*pooledConn
+
+	// dials contains the in-progress dial for each server, which
+	// concurrent queries wait for and share rather than dialing.
+	dials map[*ServerAddr]*pendingDial
+
+	// fallbacks maps DNS over UDP servers to the DNS over TCP servers
+	// we use when responses are truncated (see [*ConnPool.tcpFallbackAddr]).
+	fallbacks map[*ServerAddr]*ServerAddr
+
+	// mu protects closed, conns, dials, and fallbacks.
+	mu sync.Mutex
+}
+
+// pendingDial is an in-progress dial of a [*pooledConn].
+type pendingDial struct {
+	// done is closed when the dial completes.
+	done chan struct{}
+
+	// err is the error that caused the dial to fail, which is
+	// only safe to read after done has been closed.
+	err error
+
+	// retry indicates that waiters should dial on their own rather than
+	// sharing err, because the context of the dialing query is done.
+	retry bool
+}
+
+// DefaultConnPoolIdleTimeout is the default idle timeout used by [*ConnPool].
+const DefaultConnPoolIdleTimeout = 10 * time.Second
+
+// ErrConnPoolClosed indicates that the [*ConnPool] has been closed.
+var ErrConnPoolClosed = errors.New("connection pool closed")
+
+// idleTimeout returns the idle timeout to use.
+func (p *ConnPool) idleTimeout() time.Duration {
+	if p.IdleTimeout > 0 {
+		return p.IdleTimeout
+	}
+	return DefaultConnPoolIdleTimeout
+}
+
+// Close closes all the pooled connections. Queries in flight on
+// these connections fail and subsequent queries using this pool
+// fail with [ErrConnPoolClosed].
+func (p *ConnPool) Close() error {
+	p.mu.Lock()
+	conns := p.conns
+	p.closed = true
+	p.conns = nil
+	p.fallbacks = nil
+	p.mu.Unlock()
+	for _, list := range conns {
+		for _, pc := range list {
+			pc.close()
+		}
+	}
+	return nil
+}
+
+// acquire returns a connection for the given server on which no query with
+// the given ID is in flight, registering the ID and returning the channel
+// where the reader will post the response. If no such connection exists,
+// we dial a new one using the given dial function, unless another query is
+// already dialing, in which case we wait for its dial and share the new
+// connection, such that a burst of queries is pipelined over a single
+// connection. The reused return value is true when we did not dial.
+func (p *ConnPool) acquire(ctx context.Context, addr *ServerAddr, id uint16,
+	dial func(ctx context.Context) (dnsStream, error)) (
+	pc *pooledConn, ch <-chan []byte, reused bool, err error) {
+	for {
+		// 1. attempt to reuse an existing connection
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, nil, false, ErrConnPoolClosed
+		}
+		for _, pc := range p.conns[addr] {
+			if ch, ok := pc.register(id); ok {
+				p.mu.Unlock()
+				return pc, ch, true, nil
+			}
+		}
+
+		// 2. otherwise, wait for the in-progress dial, if any, and try again
+		pending := p.dials[addr]
+		if pending == nil {
+			break // while holding the lock
+		}
+		p.mu.Unlock()
+		select {
+		case <-pending.done:
+		case <-ctx.Done():
+			return nil, nil, false, ctx.Err()
+		}
+		if pending.err != nil && !pending.retry {
+			return nil, nil, false, pending.err
+		}
+	}
+
+	// 3. register the in-progress dial and dial without holding the lock
+	pending := &pendingDial{done: make(chan struct{})}
+	if p.dials == nil {
+		p.dials = make(map[*ServerAddr]*pendingDial)
+	}
+	p.dials[addr] = pending
+	p.mu.Unlock()
+	pc, ch, err = p.dialConn(ctx, addr, id, dial)
+	pending.err, pending.retry = err, ctx.Err() != nil
+	close(pending.done)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	go pc.readLoop()
+	return pc, ch, false, nil
+}
+
+// dialConn implements [*ConnPool.acquire] by dialing a new connection,
+// registering the given ID, and adding the connection to the pool.
+func (p *ConnPool) dialConn(ctx context.Context, addr *ServerAddr, id uint16,
+	dial func(ctx context.Context) (dnsStream, error)) (*pooledConn, <-chan []byte, error) {
+	// 1. dial and register the query ID before adding the
+	// connection to the pool such that no one can steal it
+	conn, err := dial(ctx)
+	var (
+		pc *pooledConn
+		ch <-chan []byte
+	)
+	if err == nil {
+		pc = newPooledConn(p, addr, conn)
+		ch, _ = pc.register(id) // cannot fail for a new connection
+	}
+
+	// 2. remove the in-progress dial and add the connection to the pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.dials, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.closed {
+		pc.close()
+		return nil, nil, ErrConnPoolClosed
+	}
+	if p.conns == nil {
+		p.conns = make(map[*ServerAddr][]*pooledConn)
+	}
+	p.conns[addr] = append(p.conns[addr], pc)
+	return pc, ch, nil
+}
+
+// tcpFallbackAddr returns the [*ServerAddr] for retrying queries to the
+// given DNS over UDP server using DNS over TCP. Because we key connections
+// by pointer, we return the same [*ServerAddr] for the same server as long
+// as we have connections for it, such that fallbacks reuse connections.
+func (p *ConnPool) tcpFallbackAddr(addr *ServerAddr) *ServerAddr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if tcpAddr := p.fallbacks[addr]; tcpAddr != nil {
+		return tcpAddr
+	}
+	tcpAddr := addr.withProtocol(ProtocolTCP)
+	if !p.closed {
+		if p.fallbacks == nil {
+			p.fallbacks = make(map[*ServerAddr]*ServerAddr)
+		}
+		p.fallbacks[addr] = tcpAddr
+	}
+	return tcpAddr
+}
+
+// remove removes the given connection from the pool.
+func (p *ConnPool) remove(pc *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var list []*pooledConn
+	for _, entry := range p.conns[pc.addr] {
+		if entry != pc {
+			list = append(list, entry)
+		}
+	}
+	if len(list) <= 0 {
+		delete(p.conns, pc.addr)
+		for udpAddr, tcpAddr := range p.fallbacks {
+			if tcpAddr == pc.addr {
+				delete(p.fallbacks, udpAddr)
+			}
+		}
+		return
+	}
+	p.conns[pc.addr] = list
+}
+
+// pooledConn is a connection managed by [*ConnPool].
+//
+// Construct using [newPooledConn].
+type pooledConn struct {
+	// addr is the server address.
+	addr *ServerAddr
+
+	// closed indicates that we closed the connection.
+	closed bool
+
+	// conn is the underlying connection.
+	conn dnsStream
+
+	// done is closed when the reader terminates.
+	done chan struct{}
+
+	// err is the error that caused the reader to terminate,
+	// which is only safe to read after done has been closed.
+	err error
+
+	// idleGen is the generation of the idle timer, which allows
+	// a stale timer to detect it should not close the connection.
+	idleGen uint64
+
+	// idleTimer is the timer closing the connection when idle.
+	idleTimer *time.Timer
+
+	// mu protects closed, idleGen, idleTimer, and waiters.
+	mu sync.Mutex
+
+	// pool is the pool owning the connection.
+	pool *ConnPool
+
+	// waiters maps the IDs of in-flight queries to the
+	// channels where to post the raw responses.
+	waiters map[uint16]chan []byte
+
+	// wsem is a semaphore serializing writes on the connection, which
+	// allows queries waiting to write to honor their own context.
+	wsem chan struct{}
+}
+
+// newPooledConn creates a new [*pooledConn] instance.
+func newPooledConn(pool *ConnPool, addr *ServerAddr, conn dnsStream) *pooledConn {
+	return &pooledConn{
+		addr:    addr,
+		conn:    conn,
+		done:    make(chan struct{}),
+		pool:    pool,
+		waiters: make(map[uint16]chan []byte),
+		wsem:    make(chan struct{}, 1),
+	}
+}
+
+// register registers a query with the given ID as in flight and returns
+// the channel where the reader will post the raw response. This method
+// fails if the connection is closed or the ID is already in flight.
+func (pc *pooledConn) register(id uint16) (<-chan []byte, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return nil, false
+	}
+	if _, found := pc.waiters[id]; found {
+		return nil, false
+	}
+	ch := make(chan []byte, 1) // buffered so the reader never blocks
+	pc.waiters[id] = ch
+	if pc.idleTimer != nil {
+		pc.idleTimer.Stop()
+		pc.idleTimer = nil
+	}
+	return ch, true
+}
+
+// unregister unregisters the query with the given ID and possibly
+// arms the idle timer if there are no more in-flight queries.
+func (pc *pooledConn) unregister(id uint16) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	delete(pc.waiters, id)
+	if pc.closed || len(pc.waiters) > 0 || pc.idleTimer != nil {
+		return
+	}
+	pc.idleGen++
+	gen := pc.idleGen
+	pc.idleTimer = time.AfterFunc(pc.pool.idleTimeout(), func() {
+		pc.closeIfIdle(gen)
+	})
+}
+
+// closeIfIdle closes the connection if it is still idle.
+func (pc *pooledConn) closeIfIdle(gen uint64) {
+	pc.mu.Lock()
+	idle := gen == pc.idleGen && pc.idleTimer != nil && len(pc.waiters) <= 0
+	pc.mu.Unlock()
+	if idle {
+		pc.close()
+	}
+}
+
+// close closes the connection, which causes the reader to terminate.
+func (pc *pooledConn) close() {
+	pc.mu.Lock()
+	pc.closed = true
+	if pc.idleTimer != nil {
+		pc.idleTimer.Stop()
+		pc.idleTimer = nil
+	}
+	pc.mu.Unlock()
+	_ = pc.conn.Close()
+}
+
+// write writes the given raw frame, closing the connection on failure.
+//
+// Because a peer that stops reading would otherwise block us and all the
+// queries pipelined on the connection forever, we close the connection
+// when the context is done while writing, like [*Transport.queryStream]
+// does, and we stop waiting for our turn to write when the context is done.
+func (pc *pooledConn) write(ctx context.Context, rawFrame []byte) error {
+	// 1. wait for our turn to write
+	select {
+	case pc.wsem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-pc.wsem }()
+
+	// 2. write, closing the connection if the context is done meanwhile,
+	// in which case we return the context error rather than the error
+	// caused by closing the connection
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, pc.close)
+	_, err := pc.conn.Write(rawFrame)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		pc.close()
+		return err
+	}
+	return nil
+}
+
+// readLoop reads responses and dispatches them to the
+// waiters until the connection is closed or fails.
+func (pc *pooledConn) readLoop() {
+	defer close(pc.done)
+	defer pc.close()
+	defer pc.pool.remove(pc)
+	br := bufio.NewReader(pc.conn)
+	for {
+		rawResp, err := readRawMsgFrame(br)
+		if err != nil {
+			pc.err = err
+			return
+		}
+		if len(rawResp) < 2 {
+			pc.err = ErrInvalidResponse
+			return
+		}
+		id := uint16(rawResp[0])<<8 | uint16(rawResp[1])
+		pc.mu.Lock()
+		ch, found := pc.waiters[id]
+		delete(pc.waiters, id)
+		pc.mu.Unlock()
+		if found {
+			ch <- rawResp
+		}
+		// otherwise, it's a late response for a canceled query
+	}
+}
+
+// wait waits for the raw response on the given channel.
+func (pc *pooledConn) wait(ctx context.Context, ch <-chan []byte) ([]byte, error) {
+	select {
+	case rawResp := <-ch:
+		return rawResp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-pc.done:
+		// the reader may have posted the response just before terminating
+		select {
+		case rawResp := <-ch:
+			return rawResp, nil
+		default:
+			return nil, pc.err
+		}
+	}
+}
+
+// queryStreamPooled is like [*Transport.queryStream] but uses the ConnPool
+// to reuse connections, dialing new connections using the given function.
+//
+// Because a server may close an idle connection while we are sending a
+// query, we retry once using a new connection if sending the query using
+// a reused connection fails or the connection is closed before we receive
+// any response for the query. We never retry once we have received a
+// response, since some messages (e.g., UPDATE) are not idempotent.
+func (t *Transport) queryStreamPooled(ctx context.Context, addr *ServerAddr,
+	key *TSIGKey, query *dns.Msg, dial func(ctx context.Context) (dnsStream, error)) (*dns.Msg, error) {
+	// 1. Serialize the query and wrap it into a frame
+	rawQuery, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	rawQueryFrame, err := newRawMsgFrame(addr, rawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Perform the round trip and possibly retry once
+	for attempt := 0; ; attempt++ {
+		pc, ch, reused, err := t.ConnPool.acquire(ctx, addr, query.Id, dial)
+		if err != nil {
+			return nil, err
+		}
+		resp, retry, err := t.roundTripPooledConn(ctx, addr, key, pc, ch, query.Id, rawQuery, rawQueryFrame)
+		if err != nil && retry && reused && attempt <= 0 && ctx.Err() == nil {
+			continue
+		}
+		return resp, err
+	}
+}
+
+// roundTripPooledConn sends the query and receives the response using the
+// given [*pooledConn], on which the caller has registered the query ID.
+//
+// The returned bool is true when we failed without receiving any response
+// for the query, because either writing failed or the connection was closed
+// (or the context is done), which is when retrying could be acceptable.
+func (t *Transport) roundTripPooledConn(ctx context.Context, addr *ServerAddr, key *TSIGKey,
+	pc *pooledConn, ch <-chan []byte, id uint16, rawQuery, rawQueryFrame []byte) (*dns.Msg, bool, error) {
+	// 1. Make sure we unregister the query when done
+	defer pc.unregister(id)
+
+	// 2. Possibly log and send the query.
+	t0 := t.maybeLogQuery(ctx, addr, rawQuery)
+	if err := pc.write(ctx, rawQueryFrame); err != nil {
+		return nil, true, err
+	}
+
+	// 3. Wait for the response with the matching ID
+	rawResp, err := pc.wait(ctx, ch)
+	if err != nil {
+		return nil, true, err
+	}
+
+	// 4. Parse the response, possibly log that we received it,
+	// and possibly verify its TSIG signature.
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rawResp); err != nil {
+		return nil, false, err
+	}
+	t.maybeLogResponseConn(ctx, addr, t0, rawQuery, rawResp, pc.conn)
+	if err := t.maybeVerifyResponseTSIG(key, rawQuery, resp, rawResp); err != nil {
+		return nil, false, err
+	}
+	return resp, false, nil
+}
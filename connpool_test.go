@@ -0,0 +1,444 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// connPoolTestServer serves the server side of a [net.Pipe] by reading
+// all the queries and invoking the given function with each of them.
+func connPoolTestServer(conn net.Conn, serve func(conn net.Conn, query *dns.Msg)) {
+	defer conn.Close()
+	for {
+		rawQuery, err := readRawMsgFrame(conn)
+		if err != nil {
+			return
+		}
+		query := new(dns.Msg)
+		if err := query.Unpack(rawQuery); err != nil {
+			return
+		}
+		serve(conn, query)
+	}
+}
+
+// connPoolTestWriteResponse writes a response for the given query.
+func connPoolTestWriteResponse(conn net.Conn, query *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	rawResp, err := resp.Pack()
+	if err != nil {
+		panic(err)
+	}
+	rawFrame, err := newRawMsgFrame(&ServerAddr{}, rawResp)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = conn.Write(rawFrame)
+}
+
+func newConnPoolTestQuery(id uint16) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	query.Id = id
+	return query
+}
+
+func TestConnPool(t *testing.T) {
+	t.Run("pipelining with out-of-order responses", func(t *testing.T) {
+		var dials atomic.Int64
+		pool := &ConnPool{}
+		defer pool.Close()
+		txp := &Transport{
+			ConnPool: pool,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dials.Add(1)
+				client, server := net.Pipe()
+				go connPoolTestServer(server, func() func(net.Conn, *dns.Msg) {
+					// collect two queries and respond in reverse order
+					// except for the query used to establish the connection
+					var pending []*dns.Msg
+					return func(conn net.Conn, query *dns.Msg) {
+						if query.Id == 0 {
+							connPoolTestWriteResponse(conn, query)
+							return
+						}
+						pending = append(pending, query)
+						if len(pending) == 2 {
+							connPoolTestWriteResponse(conn, pending[1])
+							connPoolTestWriteResponse(conn, pending[0])
+							pending = nil
+						}
+					}
+				}())
+				return client, nil
+			},
+		}
+		addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+
+		// make sure the connection exists before pipelining
+		_, err := txp.Query(context.Background(), addr, newConnPoolTestQuery(0))
+		assert.NoError(t, err)
+
+		wg := &sync.WaitGroup{}
+		for _, id := range []uint16{1, 2} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				query := newConnPoolTestQuery(id)
+				resp, err := txp.Query(context.Background(), addr, query)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.NoError(t, ValidateResponse(query, resp))
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int64(1), dials.Load())
+	})
+
+	t.Run("concurrent first queries share the dial", func(t *testing.T) {
+		var dials atomic.Int64
+		pool := &ConnPool{}
+		defer pool.Close()
+		release := make(chan struct{})
+		txp := &Transport{
+			ConnPool: pool,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dials.Add(1)
+				<-release
+				client, server := net.Pipe()
+				go connPoolTestServer(server, connPoolTestWriteResponse)
+				return client, nil
+			},
+		}
+		addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+
+		wg := &sync.WaitGroup{}
+		for id := uint16(1); id <= 4; id++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := txp.Query(context.Background(), addr, newConnPoolTestQuery(id))
+				assert.NoError(t, err)
+			}()
+		}
+		for dials.Load() < 1 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond) // give the other queries time to wait
+		close(release)
+		wg.Wait()
+		assert.Equal(t, int64(1), dials.Load())
+	})
+
+	t.Run("sequential queries reuse the connection", func(t *testing.T) {
+		var dials atomic.Int64
+		pool := &ConnPool{}
+		defer pool.Close()
+		txp := &Transport{
+			ConnPool: pool,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dials.Add(1)
+				client, server := net.Pipe()
+				go connPoolTestServer(server, connPoolTestWriteResponse)
+				return client, nil
+			},
+		}
+		addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+		for id := uint16(1); id <= 4; id++ {
+			_, err := txp.Query(context.Background(), addr, newConnPoolTestQuery(id))
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, int64(1), dials.Load())
+	})
+
+	t.Run("same ID in flight uses another connection", func(t *testing.T) {
+		var dials atomic.Int64
+		pool := &ConnPool{}
+		defer pool.Close()
+		respond := make(chan struct{})
+		txp := &Transport{
+			ConnPool: pool,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dials.Add(1)
+				client, server := net.Pipe()
+				go connPoolTestServer(server, func(conn net.Conn, query *dns.Msg) {
+					go func() {
+						<-respond
+						connPoolTestWriteResponse(conn, query)
+					}()
+				})
+				return client, nil
+			},
+		}
+		addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := txp.Query(context.Background(), addr, newConnPoolTestQuery(7))
+				assert.NoError(t, err)
+			}()
+		}
+		for dials.Load() < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		close(respond)
+		wg.Wait()
+		assert.Equal(t, int64(2), dials.Load())
+	})
+
+	t.Run("idle connections are closed", func(t *testing.T) {
+		var dials atomic.Int64
+		pool := &ConnPool{IdleTimeout: 10 * time.Millisecond}
+		defer pool.Close()
+		txp := &Transport{
+			ConnPool: pool,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dials.Add(1)
+				client, server := net.Pipe()
+				go connPoolTestServer(server, connPoolTestWriteResponse)
+				return client, nil
+			},
+		}
+		addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+
+		_, err := txp.Query(context.Background(), addr, newConnPoolTestQuery(1))
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			pool.mu.Lock()
+			defer pool.mu.Unlock()
+			return len(pool.conns) <= 0
+		}, time.Second, time.Millisecond)
+
+		_, err = txp.Query(context.Background(), addr, newConnPoolTestQuery(2))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), dials.Load())
+	})
+
+	t.Run("retry when the server closed a reused connection", func(t *testing.T) {
+		var dials atomic.Int64
+		pool := &ConnPool{}
+		defer pool.Close()
+		txp := &Transport{
+			ConnPool: pool,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dials.Add(1)
+				client, server := net.Pipe()
+				go func() {
+					// serve a single query then close the connection without
+					// reading the next query, like an impatient server would do
+					defer server.Close()
+					rawQuery, err := readRawMsgFrame(server)
+					if err != nil {
+						return
+					}
+					query := new(dns.Msg)
+					if err := query.Unpack(rawQuery); err != nil {
+						return
+					}
+					connPoolTestWriteResponse(server, query)
+				}()
+				return client, nil
+			},
+		}
+		addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+
+		_, err := txp.Query(context.Background(), addr, newConnPoolTestQuery(1))
+		assert.NoError(t, err)
+		_, err = txp.Query(context.Background(), addr, newConnPoolTestQuery(2))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), dials.Load())
+	})
+
+	t.Run("no retry after receiving a response on a reused connection", func(t *testing.T) {
+		var dials, queries atomic.Int64
+		pool := &ConnPool{}
+		defer pool.Close()
+		txp := &Transport{
+			ConnPool: pool,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dials.Add(1)
+				client, server := net.Pipe()
+				go connPoolTestServer(server, func(conn net.Conn, query *dns.Msg) {
+					queries.Add(1)
+					if query.Id == 1 {
+						connPoolTestWriteResponse(conn, query)
+						return
+					}
+					// send a response with the matching ID we cannot parse
+					_, _ = conn.Write([]byte{0, 2, byte(query.Id >> 8), byte(query.Id)})
+				})
+				return client, nil
+			},
+		}
+		addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+
+		_, err := txp.Query(context.Background(), addr, newConnPoolTestQuery(1))
+		assert.NoError(t, err)
+		_, err = txp.Query(context.Background(), addr, newConnPoolTestQuery(2))
+		assert.Error(t, err)
+		assert.Equal(t, int64(1), dials.Load())
+		assert.Equal(t, int64(2), queries.Load())
+	})
+
+	t.Run("context cancellation does not close the connection", func(t *testing.T) {
+		var dials atomic.Int64
+		pool := &ConnPool{}
+		defer pool.Close()
+		txp := &Transport{
+			ConnPool: pool,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dials.Add(1)
+				client, server := net.Pipe()
+				go connPoolTestServer(server, func(conn net.Conn, query *dns.Msg) {
+					if query.Id != 1 { // never answer the first query
+						connPoolTestWriteResponse(conn, query)
+					}
+				})
+				return client, nil
+			},
+		}
+		addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := txp.Query(ctx, addr, newConnPoolTestQuery(1))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		_, err = txp.Query(context.Background(), addr, newConnPoolTestQuery(2))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), dials.Load())
+	})
+
+	t.Run("writing honors the context when the server stops reading", func(t *testing.T) {
+		pool := &ConnPool{}
+		defer pool.Close()
+		txp := &Transport{
+			ConnPool: pool,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				client, server := net.Pipe()
+				t.Cleanup(func() { server.Close() })
+				return client, nil // the server never reads
+			},
+		}
+		addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+
+		wg := &sync.WaitGroup{}
+		for id := uint16(1); id <= 2; id++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				defer cancel()
+				_, err := txp.Query(ctx, addr, newConnPoolTestQuery(id))
+				assert.ErrorIs(t, err, context.DeadlineExceeded)
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("truncation fallbacks reuse the connection", func(t *testing.T) {
+		newTransport := func(fallback bool, tcpDials *atomic.Int64) *Transport {
+			return &Transport{
+				ConnPool:                  &ConnPool{},
+				FallbackToTCPOnTruncation: fallback,
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					client, server := net.Pipe()
+					if network == "tcp" {
+						tcpDials.Add(1)
+						go connPoolTestServer(server, connPoolTestWriteResponse)
+						return client, nil
+					}
+					go func() {
+						// emulate a DNS over UDP server truncating the response
+						defer server.Close()
+						buffer := make([]byte, 512)
+						count, err := server.Read(buffer)
+						if err != nil {
+							return
+						}
+						query := new(dns.Msg)
+						if err := query.Unpack(buffer[:count]); err != nil {
+							return
+						}
+						resp := new(dns.Msg)
+						resp.SetReply(query)
+						resp.Truncated = true
+						rawResp, err := resp.Pack()
+						if err != nil {
+							return
+						}
+						_, _ = server.Write(rawResp)
+					}()
+					return client, nil
+				},
+			}
+		}
+
+		t.Run("Transport", func(t *testing.T) {
+			var tcpDials atomic.Int64
+			txp := newTransport(true, &tcpDials)
+			defer txp.ConnPool.Close()
+			addr := NewServerAddr(ProtocolUDP, "127.0.0.1:53")
+			for id := uint16(1); id <= 3; id++ {
+				resp, err := txp.Query(context.Background(), addr, newConnPoolTestQuery(id))
+				if assert.NoError(t, err) {
+					assert.False(t, resp.Truncated)
+				}
+			}
+			assert.Equal(t, int64(1), tcpDials.Load())
+		})
+
+		t.Run("Resolver", func(t *testing.T) {
+			var tcpDials atomic.Int64
+			txp := newTransport(false, &tcpDials)
+			defer txp.ConnPool.Close()
+			config := NewConfig()
+			config.AddServer(NewServerAddr(ProtocolUDP, "127.0.0.1:53"))
+			reso := &Resolver{Config: config, Transport: txp}
+			for i := 0; i < 3; i++ {
+				_, err := reso.Lookup(context.Background(), "example.com", dns.TypeA)
+				assert.ErrorIs(t, err, ErrNoData) // the TCP server sends empty responses
+			}
+			assert.Equal(t, int64(1), tcpDials.Load())
+		})
+	})
+
+	t.Run("dial failure", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		pool := &ConnPool{}
+		defer pool.Close()
+		txp := &Transport{
+			ConnPool: pool,
+			DialTLSContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, expected
+			},
+		}
+		addr := NewServerAddr(ProtocolDoT, "127.0.0.1:853")
+		_, err := txp.Query(context.Background(), addr, newConnPoolTestQuery(1))
+		assert.ErrorIs(t, err, expected)
+	})
+
+	t.Run("closed pool", func(t *testing.T) {
+		pool := &ConnPool{}
+		assert.NoError(t, pool.Close())
+		txp := &Transport{ConnPool: pool}
+		addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+		_, err := txp.Query(context.Background(), addr, newConnPoolTestQuery(1))
+		assert.ErrorIs(t, err, ErrConnPoolClosed)
+	})
+}
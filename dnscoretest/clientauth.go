@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscoretest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"time"
+
+	"github.com/rbmk-project/common/runtimex"
+)
+
+// NewClientCert generates a self-signed client certificate suitable for
+// mutual TLS along with a cert pool containing such a certificate, which
+// you can use as the ClientCAs of the [*Server].
+//
+// This function panics on failure.
+func NewClientCert() (tls.Certificate, *x509.CertPool) {
+	// Generate the private key
+	priv := runtimex.Try1(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+
+	// Build the certificate template
+	notBefore := time.Now().Add(-time.Hour)
+	serialNumber := runtimex.Try1(rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)))
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"RBMK Project"},
+			CommonName:   "client.example.com",
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	// Generate and parse the certificate proper
+	certDER := runtimex.Try1(x509.CreateCertificate(
+		rand.Reader, &template, &template, &priv.PublicKey, priv))
+	parsed := runtimex.Try1(x509.ParseCertificate(certDER))
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+
+	// Return the results
+	cert := tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  priv,
+		Leaf:        parsed,
+	}
+	return cert, pool
+}
+
+// maybeRequireClientCerts configures the given TLS config to require and
+// verify client certificates when the ClientCAs field is not nil.
+func (s *Server) maybeRequireClientCerts(config *tls.Config) *tls.Config {
+	if s.ClientCAs != nil {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = s.ClientCAs
+	}
+	return config
+}
@@ -0,0 +1,329 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscoretest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rbmk-project/common/runtimex"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+// DNSCryptProviderName is the provider name used by [*Server.StartDNSCrypt].
+const DNSCryptProviderName = "2.dnscrypt-cert.example.com."
+
+// StartDNSCrypt starts a DNSCrypt version 2 server listening for UDP and
+// TCP on the same port and handles the incoming decrypted DNS queries.
+//
+// The server generates a provider key pair and a certificate for each
+// supported encryption system: X25519-XSalsa20Poly1305 with serial 1
+// and X25519-XChacha20Poly1305 with serial 2. It returns the certificates
+// in response to cleartext TXT queries for [DNSCryptProviderName].
+//
+// Like real DNSCrypt servers, when using UDP, we truncate responses
+// larger than the query, forcing the client to retry using TCP.
+//
+// This method panics in case of failure.
+func (s *Server) StartDNSCrypt(handler Handler) <-chan struct{} {
+	runtimex.Assert(!s.started, "already started")
+	ready := make(chan struct{})
+	go func() {
+		srv := newDNSCryptServer(handler)
+		pconn := runtimex.Try1(s.listenPacket("udp", "127.0.0.1:0"))
+		listener := runtimex.Try1(s.listen("tcp", pconn.LocalAddr().String()))
+		s.Addr = pconn.LocalAddr().String()
+		s.DNSCryptCerts = srv.rawCerts()
+		s.DNSCryptProviderKey = srv.providerKey
+		s.ioclosers = append(s.ioclosers, pconn, listener)
+		s.started = true
+		close(ready)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go srv.serveConn(conn)
+			}
+		}()
+		for srv.servePacketConn(pconn) == nil {
+			// nothing
+		}
+	}()
+	return ready
+}
+
+// dnscryptServerCert is a certificate along with its private key.
+type dnscryptServerCert struct {
+	// esVersion is the encryption system version.
+	esVersion uint16
+
+	// raw is the serialized certificate.
+	raw []byte
+
+	// secretKey is the resolver's short-term secret key.
+	secretKey *[32]byte
+}
+
+// dnscryptServer implements the DNSCrypt server.
+type dnscryptServer struct {
+	// certs maps the client magic to the corresponding cert.
+	certs map[string]*dnscryptServerCert
+
+	// handler handles the decrypted queries.
+	handler Handler
+
+	// providerKey is the provider public key.
+	providerKey ed25519.PublicKey
+}
+
+// newDNSCryptServer creates a new [*dnscryptServer].
+func newDNSCryptServer(handler Handler) *dnscryptServer {
+	providerKey, providerSecretKey := runtimex.Try2(ed25519.GenerateKey(rand.Reader))
+	srv := &dnscryptServer{
+		certs:       make(map[string]*dnscryptServerCert),
+		handler:     handler,
+		providerKey: providerKey,
+	}
+	now := time.Now()
+	for serial, esVersion := range []uint16{0x0001, 0x0002} {
+		publicKey, secretKey := runtimex.Try2(box.GenerateKey(rand.Reader))
+		signed := make([]byte, 0, 52)
+		signed = append(signed, publicKey[:]...)
+		signed = append(signed, publicKey[:8]...) // client magic
+		signed = binary.BigEndian.AppendUint32(signed, uint32(serial+1))
+		signed = binary.BigEndian.AppendUint32(signed, uint32(now.Add(-time.Hour).Unix()))
+		signed = binary.BigEndian.AppendUint32(signed, uint32(now.Add(time.Hour).Unix()))
+		raw := []byte("DNSC")
+		raw = binary.BigEndian.AppendUint16(raw, esVersion)
+		raw = binary.BigEndian.AppendUint16(raw, 0x0000)
+		raw = append(raw, ed25519.Sign(providerSecretKey, signed)...)
+		raw = append(raw, signed...)
+		srv.certs[string(publicKey[:8])] = &dnscryptServerCert{
+			esVersion: esVersion,
+			raw:       raw,
+			secretKey: secretKey,
+		}
+	}
+	return srv
+}
+
+// rawCerts returns the serialized certs sorted by serial.
+func (srv *dnscryptServer) rawCerts() [][]byte {
+	out := make([][]byte, 0, len(srv.certs))
+	for esVersion := uint16(0x0001); esVersion <= 0x0002; esVersion++ {
+		for _, cert := range srv.certs {
+			if cert.esVersion == esVersion {
+				out = append(out, cert.raw)
+			}
+		}
+	}
+	return out
+}
+
+// servePacketConn serves a single DNSCrypt query over UDP.
+func (srv *dnscryptServer) servePacketConn(pconn net.PacketConn) error {
+	buf := make([]byte, 4096)
+	count, addr, err := pconn.ReadFrom(buf)
+	if err != nil {
+		return err
+	}
+	if rawResp, err := srv.serve(buf[:count], true); err == nil {
+		_, _ = pconn.WriteTo(rawResp, addr)
+	}
+	return nil
+}
+
+// serveConn serves DNSCrypt queries over a TCP connection.
+func (srv *dnscryptServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		packet := make([]byte, int(header[0])<<8|int(header[1]))
+		if _, err := io.ReadFull(conn, packet); err != nil {
+			return
+		}
+		rawResp, err := srv.serve(packet, false)
+		if err != nil {
+			return
+		}
+		frame := binary.BigEndian.AppendUint16(nil, uint16(len(rawResp)))
+		if _, err := conn.Write(append(frame, rawResp...)); err != nil {
+			return
+		}
+	}
+}
+
+// errDNSCryptServer is the error returned when the server cannot serve a query.
+var errDNSCryptServer = errors.New("dnscrypt server: cannot serve query")
+
+// serve serves either a cleartext certificate query or an encrypted query.
+func (srv *dnscryptServer) serve(packet []byte, udp bool) ([]byte, error) {
+	// Handle encrypted queries
+	if len(packet) >= 8 {
+		if cert := srv.certs[string(packet[:8])]; cert != nil {
+			return srv.serveEncrypted(cert, packet, udp)
+		}
+	}
+
+	// Otherwise, handle cleartext certificate queries
+	query := &dns.Msg{}
+	if err := query.Unpack(packet); err != nil || len(query.Question) != 1 {
+		return nil, errDNSCryptServer
+	}
+	resp := &dns.Msg{}
+	resp.SetReply(query)
+	resp.RecursionAvailable = true
+	if q := query.Question[0]; q.Qtype != dns.TypeTXT || !strings.EqualFold(q.Name, DNSCryptProviderName) {
+		resp.Rcode = dns.RcodeNameError
+		return resp.Pack()
+	}
+	for _, rawCert := range srv.rawCerts() {
+		var escaped strings.Builder
+		for _, b := range rawCert {
+			fmt.Fprintf(&escaped, "\\%03d", b)
+		}
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   DNSCryptProviderName,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassINET,
+				Ttl:    3600,
+			},
+			Txt: []string{escaped.String()},
+		})
+	}
+	return resp.Pack()
+}
+
+// serveEncrypted decrypts the query, invokes the handler, and encrypts the response.
+func (srv *dnscryptServer) serveEncrypted(cert *dnscryptServerCert, packet []byte, udp bool) ([]byte, error) {
+	// Decrypt and unpad the query
+	const headerSize = 8 + 32 + 12
+	if len(packet) < headerSize+poly1305.TagSize {
+		return nil, errDNSCryptServer
+	}
+	var clientPK [32]byte
+	copy(clientPK[:], packet[8:40])
+	sharedKey := dnscryptSharedKey(cert.esVersion, cert.secretKey, &clientPK)
+	var nonce [24]byte
+	copy(nonce[:], packet[40:headerSize])
+	padded, ok := dnscryptOpen(cert.esVersion, sharedKey, &nonce, packet[headerSize:])
+	if !ok {
+		return nil, errDNSCryptServer
+	}
+	index := len(padded) - 1
+	for index >= 0 && padded[index] == 0 { // byte by byte since it's not UTF-8
+		index--
+	}
+	if index < 0 || padded[index] != 0x80 {
+		return nil, errDNSCryptServer
+	}
+	rawQuery := padded[:index]
+
+	// Invoke the handler to obtain the response
+	rw := &responseWriterDNSCrypt{}
+	srv.handler.Handle(rw, rawQuery)
+	rawResp := rw.buf.Bytes()
+
+	// Pad the response, truncating it when it's larger than the query
+	const overhead = 8 + 24 + poly1305.TagSize
+	paddedSize := func(size int) int { return (size + 1 + 63) / 64 * 64 }
+	if udp && overhead+paddedSize(len(rawResp)) > len(packet) {
+		resp := &dns.Msg{}
+		if err := resp.Unpack(rawResp); err != nil {
+			return nil, err
+		}
+		resp.Truncated = true
+		resp.Answer, resp.Ns, resp.Extra = nil, nil, nil
+		rawResp = runtimex.Try1(resp.Pack())
+	}
+	paddedResp := make([]byte, paddedSize(len(rawResp)))
+	copy(paddedResp, rawResp)
+	paddedResp[len(rawResp)] = 0x80
+
+	// Encrypt the response using the full nonce
+	runtimex.Try1(rand.Read(nonce[12:]))
+	out := []byte("r6fnvWj8")
+	out = append(out, nonce[:]...)
+	out = append(out, dnscryptSeal(cert.esVersion, sharedKey, &nonce, paddedResp)...)
+	return out, nil
+}
+
+// dnscryptSharedKey computes the shared key using the given encryption system.
+func dnscryptSharedKey(esVersion uint16, secretKey, publicKey *[32]byte) *[32]byte {
+	sharedKey := &[32]byte{}
+	if esVersion == 0x0002 {
+		dhKey := runtimex.Try1(curve25519.X25519(secretKey[:], publicKey[:]))
+		copy(sharedKey[:], runtimex.Try1(chacha20.HChaCha20(dhKey, make([]byte, 16))))
+		return sharedKey
+	}
+	box.Precompute(sharedKey, publicKey, secretKey)
+	return sharedKey
+}
+
+// dnscryptSeal encrypts using XSalsa20Poly1305 or the XChacha20Poly1305
+// construction used by DNSCrypt, which mimics secretbox.
+func dnscryptSeal(esVersion uint16, key *[32]byte, nonce *[24]byte, plaintext []byte) []byte {
+	if esVersion != 0x0002 {
+		return secretbox.Seal(nil, plaintext, nonce, key)
+	}
+	stream := runtimex.Try1(chacha20.NewUnauthenticatedCipher(key[:], nonce[:]))
+	var polyKey [32]byte
+	stream.XORKeyStream(polyKey[:], polyKey[:])
+	out := make([]byte, poly1305.TagSize+len(plaintext))
+	stream.XORKeyStream(out[poly1305.TagSize:], plaintext)
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, out[poly1305.TagSize:], &polyKey)
+	copy(out, tag[:])
+	return out
+}
+
+// dnscryptOpen is the inverse of [dnscryptSeal].
+func dnscryptOpen(esVersion uint16, key *[32]byte, nonce *[24]byte, sealed []byte) ([]byte, bool) {
+	if esVersion != 0x0002 {
+		return secretbox.Open(nil, sealed, nonce, key)
+	}
+	stream := runtimex.Try1(chacha20.NewUnauthenticatedCipher(key[:], nonce[:]))
+	var polyKey [32]byte
+	stream.XORKeyStream(polyKey[:], polyKey[:])
+	var tag [poly1305.TagSize]byte
+	copy(tag[:], sealed)
+	if !poly1305.Verify(&tag, sealed[poly1305.TagSize:], &polyKey) {
+		return nil, false
+	}
+	out := make([]byte, len(sealed)-poly1305.TagSize)
+	stream.XORKeyStream(out, sealed[poly1305.TagSize:])
+	return out, true
+}
+
+// responseWriterDNSCrypt is a response writer collecting the
+// response that the server should encrypt.
+type responseWriterDNSCrypt struct {
+	buf bytes.Buffer
+}
+
+// Ensure responseWriterDNSCrypt implements ResponseWriter.
+var _ ResponseWriter = (*responseWriterDNSCrypt)(nil)
+
+// Write implements ResponseWriter.
+func (r *responseWriterDNSCrypt) Write(rawResp []byte) (int, error) {
+	return r.buf.Write(rawResp)
+}
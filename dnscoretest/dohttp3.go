@@ -0,0 +1,40 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscoretest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/url"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rbmk-project/common/runtimex"
+)
+
+// StartHTTP3 starts an HTTP/3 server and handles incoming DNS queries.
+//
+// Like [*Server.StartHTTPS], the server accepts both GET and POST requests.
+//
+// This method panics in case of failure.
+func (s *Server) StartHTTP3(handler Handler) <-chan struct{} {
+	runtimex.Assert(!s.started, "already started")
+	ready := make(chan struct{})
+	go func() {
+		cert := runtimex.Try1(tls.X509KeyPair(certPEM, keyPEM))
+		config := http3.ConfigureTLSConfig(s.maybeRequireClientCerts(&tls.Config{Certificates: []tls.Certificate{cert}}))
+		pconn := runtimex.Try1(s.listenPacket("udp", "127.0.0.1:0"))
+		s.Addr = pconn.LocalAddr().String()
+		s.RootCAs = x509.NewCertPool()
+		runtimex.Assert(s.RootCAs.AppendCertsFromPEM(certPEM), "cannot append PEM cert")
+		s.URL = (&url.URL{Scheme: "https", Host: s.Addr, Path: "/dns-query"}).String()
+		srv := &http3.Server{
+			Handler:   newHTTPHandler(handler),
+			TLSConfig: config,
+		}
+		s.ioclosers = append(s.ioclosers, srv, pconn)
+		s.started = true
+		close(ready)
+		_ = srv.Serve(pconn)
+	}()
+	return ready
+}
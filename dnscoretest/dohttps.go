@@ -5,6 +5,7 @@ package dnscoretest
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"io"
 	"net/http"
 	"net/url"
@@ -20,7 +21,7 @@ func (s *Server) StartHTTPS(handler Handler) <-chan struct{} {
 	ready := make(chan struct{})
 	go func() {
 		cert := runtimex.Try1(tls.X509KeyPair(certPEM, keyPEM))
-		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		config := s.maybeRequireClientCerts(&tls.Config{Certificates: []tls.Certificate{cert}})
 		listener := runtimex.Try1(s.listenTLS("tcp", "127.0.0.1:0", config))
 		s.Addr = listener.Addr().String()
 		s.RootCAs = x509.NewCertPool()
@@ -37,9 +38,28 @@ func (s *Server) StartHTTPS(handler Handler) <-chan struct{} {
 	return ready
 }
 
+// newHTTPHandler returns an [http.Handler] that accepts both the GET
+// and the POST requests defined by RFC 8484.
 func newHTTPHandler(handler Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rawQuery := runtimex.Try1(io.ReadAll(r.Body))
+		var rawQuery []byte
+		switch r.Method {
+		case http.MethodGet:
+			encoded := r.URL.Query().Get("dns")
+			decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+			if err != nil || len(decoded) <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			rawQuery = decoded
+
+		case http.MethodPost:
+			rawQuery = runtimex.Try1(io.ReadAll(r.Body))
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
 		rw := &responseWriterHTTPS{w}
 		handler.Handle(rw, rawQuery)
 	})
@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscoretest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rbmk-project/common/runtimex"
+)
+
+// StartQUIC starts a QUIC listener and listens for incoming DNS queries.
+//
+// As required by RFC 9250, we read a single query from each stream and
+// we handle multiple streams over the same QUIC connection.
+//
+// This method panics in case of failure.
+func (s *Server) StartQUIC(handler Handler) <-chan struct{} {
+	runtimex.Assert(!s.started, "already started")
+	ready := make(chan struct{})
+	go func() {
+		cert := runtimex.Try1(tls.X509KeyPair(certPEM, keyPEM))
+		config := s.maybeRequireClientCerts(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"doq"},
+		})
+		pconn := runtimex.Try1(s.listenPacket("udp", "127.0.0.1:0"))
+		listener := runtimex.Try1(quic.Listen(pconn, config, &quic.Config{}))
+		s.Addr = pconn.LocalAddr().String()
+		s.RootCAs = x509.NewCertPool()
+		runtimex.Assert(s.RootCAs.AppendCertsFromPEM(certPEM), "cannot append PEM cert")
+		s.ioclosers = append(s.ioclosers, listener, pconn)
+		s.started = true
+		close(ready)
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go s.serveQUICConn(handler, conn)
+		}
+	}()
+	return ready
+}
+
+// serveQUICConn serves all the streams of a QUIC connection.
+func (s *Server) serveQUICConn(handler Handler, conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		sconn := &quicStreamConn{
+			Stream:     stream,
+			localAddr:  conn.LocalAddr(),
+			remoteAddr: conn.RemoteAddr(),
+		}
+		go s.serveQUICStream(handler, sconn)
+	}
+}
+
+// serveQUICStream serves a single DNS query over a QUIC stream.
+func (s *Server) serveQUICStream(handler Handler, conn *quicStreamConn) {
+	// Close the stream when done serving
+	defer conn.Close()
+
+	// Read the query, which RFC 9250 requires to be the only
+	// message sent by the client on the stream
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	length := int(header[0])<<8 | int(header[1])
+	rawQuery := make([]byte, length)
+	if _, err := io.ReadFull(conn, rawQuery); err != nil {
+		return
+	}
+
+	// Wrap into a response writer and serve
+	rw := &responseWriterStream{conn: conn, mu: &sync.Mutex{}}
+	handler.Handle(rw, rawQuery)
+}
+
+// quicStreamConn makes a QUIC stream look like a [net.Conn].
+type quicStreamConn struct {
+	*quic.Stream
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// Ensure quicStreamConn implements net.Conn.
+var _ net.Conn = (*quicStreamConn)(nil)
+
+// LocalAddr implements net.Conn.
+func (c *quicStreamConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// RemoteAddr implements net.Conn.
+func (c *quicStreamConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"math"
 	"net"
+	"sync"
 
 	"github.com/rbmk-project/common/runtimex"
 )
@@ -28,7 +29,7 @@ func (s *Server) StartTCP(handler Handler) <-chan struct{} {
 			if err != nil {
 				return
 			}
-			s.serveConn(handler, conn)
+			go s.serveConn(handler, conn)
 		}
 	}()
 	return ready
@@ -42,27 +43,46 @@ func (s *Server) listen(network, address string) (net.Listener, error) {
 	return net.Listen(network, address)
 }
 
-// serveConn serves a single DNS query over TCP or TLS.
+// serveConn serves DNS queries over TCP or TLS until the client closes
+// the connection. As allowed by RFC 7766, we handle each query in its own
+// goroutine, so responses may be sent out of order.
 func (s *Server) serveConn(handler Handler, conn net.Conn) {
-	// Close the connection when done serving
+	// Close the connection when done serving and after all the
+	// handlers for the in-flight queries have terminated
+	wg := &sync.WaitGroup{}
 	defer conn.Close()
+	defer wg.Wait()
 
-	// Wrap the conn into a bufio.Reader and read the whole message
+	// Make sure we serialize writes for concurrent queries
+	wmu := &sync.Mutex{}
+
+	// Wrap the conn into a bufio.Reader and read each message
 	br := bufio.NewReader(conn)
-	header := make([]byte, 2)
-	_ = runtimex.Try1(io.ReadFull(br, header))
-	length := int(header[0])<<8 | int(header[1])
-	rawQuery := make([]byte, length)
-	_ = runtimex.Try1(io.ReadFull(br, rawQuery))
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return
+		}
+		length := int(header[0])<<8 | int(header[1])
+		rawQuery := make([]byte, length)
+		if _, err := io.ReadFull(br, rawQuery); err != nil {
+			return
+		}
 
-	// Wrap into a response writer and serve
-	rw := &responseWriterStream{conn: conn}
-	handler.Handle(rw, rawQuery)
+		// Wrap into a response writer and serve
+		rw := &responseWriterStream{conn: conn, mu: wmu}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.Handle(rw, rawQuery)
+		}()
+	}
 }
 
 // responseWriterStream is a response writer for TCP or TLS.
 type responseWriterStream struct {
 	conn net.Conn
+	mu   *sync.Mutex
 }
 
 // Ensure responseWriterStream implements ResponseWriter.
@@ -74,5 +94,7 @@ func (r *responseWriterStream) Write(rawMsg []byte) (int, error) {
 	rawMsgFrame := []byte{byte(len(rawMsg) >> 8)}
 	rawMsgFrame = append(rawMsgFrame, byte(len(rawMsg)))
 	rawMsgFrame = append(rawMsgFrame, rawMsg...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	return r.conn.Write(rawMsgFrame)
 }
@@ -27,7 +27,7 @@ func (s *Server) StartTLS(handler Handler) <-chan struct{} {
 	ready := make(chan struct{})
 	go func() {
 		cert := runtimex.Try1(tls.X509KeyPair(certPEM, keyPEM))
-		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		config := s.maybeRequireClientCerts(&tls.Config{Certificates: []tls.Certificate{cert}})
 		listener := runtimex.Try1(s.listenTLS("tcp", "127.0.0.1:0", config))
 		s.Addr = listener.Addr().String()
 		s.RootCAs = x509.NewCertPool()
@@ -40,7 +40,7 @@ func (s *Server) StartTLS(handler Handler) <-chan struct{} {
 			if err != nil {
 				return
 			}
-			s.serveConn(handler, conn)
+			go s.serveConn(handler, conn)
 		}
 	}()
 	return ready
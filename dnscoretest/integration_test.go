@@ -4,12 +4,17 @@ package dnscoretest_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"io"
 	"net/http"
+	"net/url"
 	"testing"
 
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/rbmk-project/common/runtimex"
 	"github.com/rbmk-project/dnscore/dnscoretest"
 	"github.com/stretchr/testify/assert"
@@ -90,6 +95,40 @@ func TestFakeDNSServer_TLS(t *testing.T) {
 	checkResult(t, resp, err)
 }
 
+func TestFakeDNSServer_TLSClientAuth(t *testing.T) {
+	// Create a fake TLS server requiring client certificates
+	clientCert, clientCAs := dnscoretest.NewClientCert()
+	server := &dnscoretest.Server{ClientCAs: clientCAs}
+	handler := dnscoretest.NewExampleComHandler()
+	<-server.StartTLS(handler)
+	defer server.Close()
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+
+	t.Run("with client certificate", func(t *testing.T) {
+		client := &dns.Client{
+			Net: "tcp-tls",
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{clientCert},
+				RootCAs:      server.RootCAs,
+			},
+		}
+		resp, _, err := client.Exchange(query, server.Addr)
+		checkResult(t, resp, err)
+	})
+
+	t.Run("without client certificate", func(t *testing.T) {
+		client := &dns.Client{
+			Net:       "tcp-tls",
+			TLSConfig: &tls.Config{RootCAs: server.RootCAs},
+		}
+		resp, _, err := client.Exchange(query, server.Addr)
+		assert.Error(t, err)
+		assert.Nil(t, resp)
+	})
+}
+
 func TestFakeDNSServer_HTTPS(t *testing.T) {
 	// Create a fake HTTPS server using the example.com handler
 	server := &dnscoretest.Server{}
@@ -134,3 +173,229 @@ func TestFakeDNSServer_HTTPS(t *testing.T) {
 	// Validate the results
 	checkResult(t, resp, err)
 }
+
+func TestFakeDNSServer_HTTPS_GET(t *testing.T) {
+	// Create a fake HTTPS server using the example.com handler
+	server := &dnscoretest.Server{}
+	handler := dnscoretest.NewExampleComHandler()
+	<-server.StartHTTPS(handler)
+	defer server.Close()
+
+	// Create an HTTP client with TLS configuration
+	tlsConfig := &tls.Config{
+		RootCAs: server.RootCAs,
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	// Create the HTTP request
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	rawQuery := runtimex.Try1(query.Pack())
+	URL := server.URL + "?dns=" + base64.RawURLEncoding.EncodeToString(rawQuery)
+	httpReq := runtimex.Try1(http.NewRequest("GET", URL, nil))
+
+	// Send the query to the fake server
+	httpResp, err := client.Do(httpReq)
+
+	// Validate the HTTPS response
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		t.Fatal("expected 200, got", httpResp.StatusCode)
+	}
+	rawResp := runtimex.Try1(io.ReadAll(httpResp.Body))
+	resp := &dns.Msg{}
+	if err := resp.Unpack(rawResp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Validate the results
+	checkResult(t, resp, err)
+
+	// Make sure we reject a GET request with an invalid dns parameter
+	httpReq = runtimex.Try1(http.NewRequest("GET", server.URL+"?dns=@@@", nil))
+	httpResp, err = client.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected 400, got", httpResp.StatusCode)
+	}
+}
+
+func TestFakeDNSServer_QUIC(t *testing.T) {
+	// Create a fake QUIC server using the example.com handler
+	server := &dnscoretest.Server{}
+	handler := dnscoretest.NewExampleComHandler()
+	<-server.StartQUIC(handler)
+	defer server.Close()
+
+	// Establish a QUIC connection with the server
+	tlsConfig := &tls.Config{
+		NextProtos: []string{"doq"},
+		RootCAs:    server.RootCAs,
+		ServerName: "127.0.0.1",
+	}
+	ctx := context.Background()
+	conn, err := quic.DialAddr(ctx, server.Addr, tlsConfig, &quic.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	// Send two queries over distinct streams of the same connection
+	for idx := 0; idx < 2; idx++ {
+		stream, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeA)
+		rawQuery := runtimex.Try1(query.Pack())
+		rawFrame := append([]byte{byte(len(rawQuery) >> 8), byte(len(rawQuery))}, rawQuery...)
+		_ = runtimex.Try1(stream.Write(rawFrame))
+		runtimex.Try0(stream.Close())
+
+		// Read the response until the server closes the stream
+		rawRespFrame := runtimex.Try1(io.ReadAll(stream))
+		if len(rawRespFrame) < 2 {
+			t.Fatal("response too short")
+		}
+		resp := &dns.Msg{}
+		if err := resp.Unpack(rawRespFrame[2:]); err != nil {
+			t.Fatal(err)
+		}
+
+		// Validate the results
+		checkResult(t, resp, err)
+	}
+}
+
+func TestFakeDNSServer_HTTP3(t *testing.T) {
+	// Create a fake HTTP/3 server using the example.com handler
+	server := &dnscoretest.Server{}
+	handler := dnscoretest.NewExampleComHandler()
+	<-server.StartHTTP3(handler)
+	defer server.Close()
+
+	// Create an HTTP/3 client with TLS configuration
+	txp := &http3.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs: server.RootCAs,
+		},
+	}
+	defer txp.Close()
+	client := &http.Client{Transport: txp}
+
+	// Create the HTTP request
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	rawQuery := runtimex.Try1(query.Pack())
+	httpReq := runtimex.Try1(http.NewRequest(
+		"POST", server.URL, bytes.NewReader(rawQuery)))
+
+	// Send the query to the fake server
+	httpResp, err := client.Do(httpReq)
+
+	// Validate the HTTP/3 response
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		t.Fatal("expected 200, got", httpResp.StatusCode)
+	}
+	rawResp := runtimex.Try1(io.ReadAll(httpResp.Body))
+	resp := &dns.Msg{}
+	if err := resp.Unpack(rawResp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Validate the results
+	checkResult(t, resp, err)
+}
+
+func TestFakeDNSServer_ODoH(t *testing.T) {
+	// Create a fake ODoH relay and target using the example.com handler
+	server := &dnscoretest.Server{}
+	handler := dnscoretest.NewExampleComHandler()
+	<-server.StartODoH(handler)
+	defer server.Close()
+
+	// Create an HTTP client with TLS configuration
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: server.RootCAs},
+		},
+	}
+
+	// Make sure the target serves its configs at the well-known location
+	targetURL := runtimex.Try1(url.Parse(server.ODoHTarget))
+	targetURL.Path = "/.well-known/odohconfigs"
+	httpResp, err := client.Get(targetURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	assert.Equal(t, server.ODoHConfigs, runtimex.Try1(io.ReadAll(httpResp.Body)))
+
+	// Make sure the relay forwards invalid messages and the target rejects them
+	relayURL := server.URL + "?targethost=" + targetURL.Host + "&targetpath=/dns-query"
+	httpReq := runtimex.Try1(http.NewRequest("POST", relayURL, bytes.NewReader([]byte{0x01})))
+	httpReq.Header.Set("content-type", "application/oblivious-dns-message")
+	httpResp, err = client.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, httpResp.StatusCode)
+
+	// Make sure the relay rejects requests without the target parameters
+	httpReq = runtimex.Try1(http.NewRequest("POST", server.URL, bytes.NewReader([]byte{0x01})))
+	httpReq.Header.Set("content-type", "application/oblivious-dns-message")
+	httpResp, err = client.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, httpResp.StatusCode)
+}
+
+func TestFakeDNSServer_DNSCrypt(t *testing.T) {
+	// Create a fake DNSCrypt server using the example.com handler
+	server := &dnscoretest.Server{}
+	handler := dnscoretest.NewExampleComHandler()
+	<-server.StartDNSCrypt(handler)
+	defer server.Close()
+
+	// Make sure we can fetch the certificates in clear over UDP and TCP
+	for _, network := range []string{"udp", "tcp"} {
+		client := &dns.Client{Net: network}
+		query := new(dns.Msg)
+		query.SetQuestion(dnscoretest.DNSCryptProviderName, dns.TypeTXT)
+		resp, _, err := client.Exchange(query, server.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, resp.Answer, len(server.DNSCryptCerts))
+		assert.Len(t, server.DNSCryptCerts, 2)
+		assert.Len(t, server.DNSCryptProviderKey, 32)
+	}
+
+	// Make sure we get NXDOMAIN for other cleartext queries
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	resp, err := dns.Exchange(query, server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+}
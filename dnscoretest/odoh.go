@@ -0,0 +1,296 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscoretest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/rbmk-project/common/runtimex"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// odohContentType is the content type used by RFC 9230.
+const odohContentType = "application/oblivious-dns-message"
+
+// StartODoH starts an Oblivious DNS-over-HTTPS relay and target and
+// handles the incoming DNS queries decrypted by the target.
+//
+// The relay and the target listen on distinct ports. The URL field contains
+// the relay URL, the ODoHTarget field the target URL, and the ODoHConfigs
+// field the target's configs, which the target also serves at the
+// /.well-known/odohconfigs path. The relay forwards queries to any HTTPS
+// target trusting the server's RootCAs.
+//
+// This method panics in case of failure.
+func (s *Server) StartODoH(handler Handler) <-chan struct{} {
+	runtimex.Assert(!s.started, "already started")
+	ready := make(chan struct{})
+	go func() {
+		target := newODoHTarget(handler)
+		cert := runtimex.Try1(tls.X509KeyPair(certPEM, keyPEM))
+		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		targetListener := runtimex.Try1(s.listenTLS("tcp", "127.0.0.1:0", config))
+		relayListener := runtimex.Try1(s.listenTLS("tcp", "127.0.0.1:0", config))
+		s.Addr = relayListener.Addr().String()
+		s.RootCAs = x509.NewCertPool()
+		runtimex.Assert(s.RootCAs.AppendCertsFromPEM(certPEM), "cannot append PEM cert")
+		s.URL = (&url.URL{Scheme: "https", Host: s.Addr, Path: "/proxy"}).String()
+		s.ODoHTarget = (&url.URL{
+			Scheme: "https", Host: targetListener.Addr().String(), Path: "/dns-query"}).String()
+		s.ODoHConfigs = target.configs
+		s.ioclosers = append(s.ioclosers, relayListener, targetListener)
+		s.started = true
+		targetSrv := &http.Server{Handler: target}
+		relaySrv := &http.Server{Handler: newODoHRelayHandler(s.RootCAs)}
+		close(ready)
+		go targetSrv.Serve(targetListener)
+		_ = relaySrv.Serve(relayListener)
+	}()
+	return ready
+}
+
+// newODoHRelayHandler returns the [http.Handler] implementing the relay, which
+// forwards the request to the target indicated by the URL parameters.
+func newODoHRelayHandler(rootCAs *x509.CertPool) http.Handler {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{RootCAs: rootCAs},
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Make sure the request is a valid relay request
+		targetHost := r.URL.Query().Get("targethost")
+		targetPath := r.URL.Query().Get("targetpath")
+		if r.Method != http.MethodPost || targetHost == "" || targetPath == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("content-type") != odohContentType {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// Forward the request to the target
+		targetURL := &url.URL{Scheme: "https", Host: targetHost, Path: targetPath}
+		body := runtimex.Try1(io.ReadAll(r.Body))
+		req := runtimex.Try1(http.NewRequestWithContext(
+			r.Context(), http.MethodPost, targetURL.String(), bytes.NewReader(body)))
+		req.Header.Set("content-type", odohContentType)
+		req.Header.Set("accept", odohContentType)
+		resp, err := client.Do(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		// Forward the target response to the client
+		if value := resp.Header.Get("content-type"); value != "" {
+			w.Header().Set("content-type", value)
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	})
+}
+
+// odohTarget is the [http.Handler] implementing the target.
+type odohTarget struct {
+	// configs contains the serialized ObliviousDoHConfigs.
+	configs []byte
+
+	// handler handles the decrypted queries.
+	handler Handler
+
+	// keyID is the key ID of the config.
+	keyID []byte
+
+	// privateKey is the private key of the config.
+	privateKey kem.PrivateKey
+
+	// suite is the HPKE suite of the config.
+	suite hpke.Suite
+}
+
+// newODoHTarget creates a new [*odohTarget] with a fresh X25519 key pair.
+func newODoHTarget(handler Handler) *odohTarget {
+	// Generate the key pair and the config
+	var (
+		kemID  = hpke.KEM_X25519_HKDF_SHA256
+		kdfID  = hpke.KDF_HKDF_SHA256
+		aeadID = hpke.AEAD_AES128GCM
+	)
+	publicKey, privateKey := runtimex.Try2(kemID.Scheme().GenerateKeyPair())
+	contents := cryptobyte.NewBuilder(nil)
+	contents.AddUint16(uint16(kemID))
+	contents.AddUint16(uint16(kdfID))
+	contents.AddUint16(uint16(aeadID))
+	contents.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(runtimex.Try1(publicKey.MarshalBinary()))
+	})
+	rawContents := contents.BytesOrPanic()
+
+	// Wrap the config into the ObliviousDoHConfigs
+	configs := cryptobyte.NewBuilder(nil)
+	configs.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(0x0001)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(rawContents)
+		})
+	})
+
+	// Compute the key ID as specified by RFC 9230 Sect. 6.2
+	prk := kdfID.Extract(rawContents, nil)
+	keyID := kdfID.Expand(prk, []byte("odoh key id"), uint(kdfID.ExtractSize()))
+
+	return &odohTarget{
+		configs:    configs.BytesOrPanic(),
+		handler:    handler,
+		keyID:      keyID,
+		privateKey: privateKey,
+		suite:      hpke.NewSuite(kemID, kdfID, aeadID),
+	}
+}
+
+// ServeHTTP implements [http.Handler].
+func (t *odohTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/.well-known/odohconfigs":
+		_, _ = w.Write(t.configs)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/dns-query":
+		if r.Header.Get("content-type") != odohContentType {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		rawMessage := runtimex.Try1(io.ReadAll(r.Body))
+		rawResp, err := t.serve(rawMessage)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("content-type", odohContentType)
+		_, _ = w.Write(rawResp)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// errODoHTarget is the error returned when the target cannot serve a query.
+var errODoHTarget = errors.New("odoh target: cannot serve query")
+
+// serve decrypts the query, invokes the handler, and encrypts the response.
+func (t *odohTarget) serve(rawMessage []byte) ([]byte, error) {
+	// Parse the ObliviousDoHMessage containing the query
+	var (
+		input       = cryptobyte.String(rawMessage)
+		messageType uint8
+		keyID       cryptobyte.String
+		encrypted   cryptobyte.String
+	)
+	if !input.ReadUint8(&messageType) || !input.ReadUint16LengthPrefixed(&keyID) ||
+		!input.ReadUint16LengthPrefixed(&encrypted) || !input.Empty() ||
+		messageType != 0x01 || !bytes.Equal(keyID, t.keyID) {
+		return nil, errODoHTarget
+	}
+
+	// Decrypt the ObliviousDoHMessagePlaintext
+	encSize := int(t.privateKey.Scheme().CiphertextSize())
+	if len(encrypted) < encSize {
+		return nil, errODoHTarget
+	}
+	receiver, err := t.suite.NewReceiver(t.privateKey, []byte("odoh query"))
+	if err != nil {
+		return nil, err
+	}
+	opener, err := receiver.Setup(encrypted[:encSize])
+	if err != nil {
+		return nil, err
+	}
+	aad := cryptobyte.NewBuilder(nil)
+	aad.AddUint8(0x01)
+	aad.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(keyID)
+	})
+	queryPlaintext, err := opener.Open(encrypted[encSize:], aad.BytesOrPanic())
+	if err != nil {
+		return nil, err
+	}
+	var (
+		ptInput  = cryptobyte.String(queryPlaintext)
+		rawQuery cryptobyte.String
+		padding  cryptobyte.String
+	)
+	if !ptInput.ReadUint16LengthPrefixed(&rawQuery) ||
+		!ptInput.ReadUint16LengthPrefixed(&padding) || !ptInput.Empty() {
+		return nil, errODoHTarget
+	}
+
+	// Invoke the handler to obtain the response
+	rw := &responseWriterODoH{}
+	t.handler.Handle(rw, rawQuery)
+
+	// Encrypt the response as specified by RFC 9230 Sect. 6.4
+	_, kdfID, aeadID := t.suite.Params()
+	secret := opener.Export([]byte("odoh response"), aeadID.KeySize())
+	responseNonce := make([]byte, max(aeadID.KeySize(), aeadID.NonceSize()))
+	runtimex.Try1(rand.Read(responseNonce))
+	salt := cryptobyte.NewBuilder(nil)
+	salt.AddBytes(queryPlaintext)
+	salt.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(responseNonce)
+	})
+	prk := kdfID.Extract(secret, salt.BytesOrPanic())
+	key := kdfID.Expand(prk, []byte("odoh key"), aeadID.KeySize())
+	nonce := kdfID.Expand(prk, []byte("odoh nonce"), aeadID.NonceSize())
+	aead, err := aeadID.New(key)
+	if err != nil {
+		return nil, err
+	}
+	respPlaintext := cryptobyte.NewBuilder(nil)
+	respPlaintext.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(rw.buf.Bytes())
+	})
+	respPlaintext.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {})
+	respAAD := cryptobyte.NewBuilder(nil)
+	respAAD.AddUint8(0x02)
+	respAAD.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(responseNonce)
+	})
+	ciphertext := aead.Seal(nil, nonce, respPlaintext.BytesOrPanic(), respAAD.BytesOrPanic())
+
+	// Serialize the ObliviousDoHMessage containing the response
+	message := cryptobyte.NewBuilder(nil)
+	message.AddUint8(0x02)
+	message.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(responseNonce)
+	})
+	message.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(ciphertext)
+	})
+	return message.BytesOrPanic(), nil
+}
+
+// responseWriterODoH is a response writer collecting the response
+// that the target should encrypt.
+type responseWriterODoH struct {
+	buf bytes.Buffer
+}
+
+// Ensure responseWriterODoH implements ResponseWriter.
+var _ ResponseWriter = (*responseWriterODoH)(nil)
+
+// Write implements ResponseWriter.
+func (r *responseWriterODoH) Write(rawResp []byte) (int, error) {
+	return r.buf.Write(rawResp)
+}
@@ -3,6 +3,7 @@
 package dnscoretest
 
 import (
+	"crypto/ed25519"
 	"crypto/tls"
 	"crypto/x509"
 	"io"
@@ -14,9 +15,21 @@ import (
 // The zero value is a valid server.
 type Server struct {
 	// Addr is the address of the server for DNS-over-UDP,
-	// DNS-over-TCP, and DNS-over-TLS.
+	// DNS-over-TCP, DNS-over-TLS, DNS-over-QUIC, and DNSCrypt.
 	Addr string
 
+	// ClientCAs optionally contains the cert pool for verifying client
+	// certificates (see [NewClientCert]). When this field is not nil, the
+	// DNS-over-TLS, DNS-over-HTTPS, DNS-over-QUIC, and DNS-over-HTTP/3
+	// servers require the clients to present a valid certificate.
+	ClientCAs *x509.CertPool
+
+	// DNSCryptCerts contains the serialized DNSCrypt certificates.
+	DNSCryptCerts [][]byte
+
+	// DNSCryptProviderKey is the DNSCrypt provider public key.
+	DNSCryptProviderKey ed25519.PublicKey
+
 	// Listen is an optional func to override the default
 	// function used to create a [net.Listener].
 	Listen func(network, address string) (net.Listener, error)
@@ -29,11 +42,19 @@ type Server struct {
 	// function used to listen using TLS.
 	ListenTLS func(network, address string, config *tls.Config) (net.Listener, error)
 
-	// RootCAs contains the cert pool the client should use
-	// for DNS-over-TLS and DNS-over-HTTPS.
+	// RootCAs contains the cert pool the client should use for
+	// DNS-over-TLS, DNS-over-HTTPS, DNS-over-QUIC, and DNS-over-HTTP/3.
 	RootCAs *x509.CertPool
 
-	// URL is the URL for DNS-over-HTTPS.
+	// ODoHConfigs contains the serialized ObliviousDoHConfigs
+	// of the Oblivious DNS-over-HTTPS target.
+	ODoHConfigs []byte
+
+	// ODoHTarget is the URL of the Oblivious DNS-over-HTTPS target.
+	ODoHTarget string
+
+	// URL is the URL for DNS-over-HTTPS and DNS-over-HTTP/3 and
+	// the relay URL for Oblivious DNS-over-HTTPS.
 	URL string
 
 	// ioclosers is a list of ioclosers to close when the server is closed.
@@ -0,0 +1,485 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// DNSCrypt version 2.
+//
+// See https://dnscrypt.info/protocol/
+//
+
+package dnscore
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+// Constants defined by the DNSCrypt version 2 protocol.
+const (
+	// dnscryptCertMagic is the magic string starting a certificate.
+	dnscryptCertMagic = "DNSC"
+
+	// dnscryptResolverMagic is the magic string starting a response.
+	dnscryptResolverMagic = "r6fnvWj8"
+
+	// dnscryptXSalsa20Poly1305 is the es-version using X25519-XSalsa20Poly1305.
+	dnscryptXSalsa20Poly1305 = 0x0001
+
+	// dnscryptXChacha20Poly1305 is the es-version using X25519-XChacha20Poly1305.
+	dnscryptXChacha20Poly1305 = 0x0002
+
+	// dnscryptCertSize is the size of a certificate without extensions.
+	dnscryptCertSize = 124
+
+	// dnscryptClientNonceSize is the size of the client half of the nonce.
+	dnscryptClientNonceSize = 12
+
+	// dnscryptMinUDPQuerySize is the minimum size of a padded UDP query.
+	dnscryptMinUDPQuerySize = 256
+
+	// dnscryptPaddingBlockSize is the block size used for padding.
+	dnscryptPaddingBlockSize = 64
+)
+
+// ErrInvalidDNSCryptCert indicates that a DNSCrypt certificate is malformed,
+// uses an unsupported encryption system, or has an invalid signature.
+var ErrInvalidDNSCryptCert = errors.New("invalid DNSCrypt certificate")
+
+// ErrNoValidDNSCryptCert indicates that the DNSCrypt provider did not
+// return any valid certificate or that the certificate is expired.
+var ErrNoValidDNSCryptCert = errors.New("no valid DNSCrypt certificate")
+
+// ErrInvalidDNSCryptResponse indicates that we cannot parse
+// or decrypt the response returned by the DNSCrypt resolver.
+var ErrInvalidDNSCryptResponse = errors.New("invalid DNSCrypt response")
+
+// dnscryptCert is a parsed and verified DNSCrypt certificate.
+type dnscryptCert struct {
+	// esVersion is the encryption system version.
+	esVersion uint16
+
+	// resolverPK is the resolver's short-term public key.
+	resolverPK [32]byte
+
+	// clientMagic is the magic string starting each query.
+	clientMagic [8]byte
+
+	// serial is the certificate serial number.
+	serial uint32
+}
+
+// parseDNSCryptCert parses the given certificate, verifies its
+// signature using the provider key, and checks its validity period.
+func parseDNSCryptCert(rawCert []byte, providerKey ed25519.PublicKey, now time.Time) (*dnscryptCert, error) {
+	// 1. make sure the certificate is well formed
+	if len(rawCert) < dnscryptCertSize || string(rawCert[:4]) != dnscryptCertMagic {
+		return nil, fmt.Errorf("%w: malformed certificate", ErrInvalidDNSCryptCert)
+	}
+	cert := &dnscryptCert{esVersion: binary.BigEndian.Uint16(rawCert[4:6])}
+	switch cert.esVersion {
+	case dnscryptXSalsa20Poly1305, dnscryptXChacha20Poly1305:
+	default:
+		return nil, fmt.Errorf("%w: unsupported es-version %d", ErrInvalidDNSCryptCert, cert.esVersion)
+	}
+
+	// 2. verify the signature over the rest of the certificate
+	if len(providerKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: invalid provider key", ErrInvalidDNSCryptCert)
+	}
+	if !ed25519.Verify(providerKey, rawCert[72:], rawCert[8:72]) {
+		return nil, fmt.Errorf("%w: invalid signature", ErrInvalidDNSCryptCert)
+	}
+
+	// 3. extract the fields we need and check the validity period
+	copy(cert.resolverPK[:], rawCert[72:104])
+	copy(cert.clientMagic[:], rawCert[104:112])
+	cert.serial = binary.BigEndian.Uint32(rawCert[112:116])
+	tsStart := binary.BigEndian.Uint32(rawCert[116:120])
+	tsEnd := binary.BigEndian.Uint32(rawCert[120:124])
+	if unix := now.Unix(); unix < int64(tsStart) || unix > int64(tsEnd) {
+		return nil, fmt.Errorf("%w: expired or not yet valid", ErrNoValidDNSCryptCert)
+	}
+	return cert, nil
+}
+
+// dnscryptTXTBytes returns the bytes contained in the character
+// strings of the given TXT record without any escaping.
+func dnscryptTXTBytes(rr *dns.TXT) ([]byte, error) {
+	buf := make([]byte, dns.Len(rr))
+	off, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	rdata := buf[off-int(rr.Hdr.Rdlength) : off]
+	var out []byte
+	for len(rdata) > 0 {
+		length := int(rdata[0])
+		if 1+length > len(rdata) {
+			return nil, ErrInvalidDNSCryptCert
+		}
+		out = append(out, rdata[1:1+length]...)
+		rdata = rdata[1+length:]
+	}
+	return out, nil
+}
+
+// FetchDNSCryptCert queries the DNSCrypt resolver for the TXT records of
+// the provider name, verifies the certificates they contain using the
+// provider key, and returns the valid certificate with the highest serial.
+//
+// To avoid fetching the certificate for each query, call this method
+// once and save the result into the DNSCryptCert field of the [*ServerAddr].
+func (t *Transport) FetchDNSCryptCert(ctx context.Context, addr *ServerAddr) ([]byte, error) {
+	// 1. Send the TXT query in clear over UDP, falling back to TCP
+	// when the response is truncated.
+	udpAddr := NewServerAddr(ProtocolUDP, addr.Address)
+	query, err := NewQueryWithServerAddr(udpAddr, addr.DNSCryptProviderName, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.queryUDP(ctx, udpAddr, nil, query)
+	if err == nil && resp.Truncated {
+		resp, err = t.queryTCPFallback(ctx, udpAddr, nil, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateResponse(query, resp); err != nil {
+		return nil, err
+	}
+	if err := RCodeToError(resp); err != nil {
+		return nil, err
+	}
+
+	// 2. Pick the valid certificate with the highest serial.
+	var (
+		best    []byte
+		bestCrt *dnscryptCert
+		now     = t.timeNow()
+	)
+	for _, answer := range resp.Answer {
+		txt, ok := answer.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		rawCert, err := dnscryptTXTBytes(txt)
+		if err != nil {
+			continue
+		}
+		cert, err := parseDNSCryptCert(rawCert, addr.DNSCryptProviderKey, now)
+		if err != nil {
+			continue
+		}
+		if bestCrt == nil || cert.serial > bestCrt.serial {
+			best, bestCrt = rawCert, cert
+		}
+	}
+	if best == nil {
+		return nil, ErrNoValidDNSCryptCert
+	}
+	return best, nil
+}
+
+// dnscryptSharedKey computes the shared key using the given encryption system.
+func dnscryptSharedKey(esVersion uint16, secretKey, publicKey *[32]byte) (*[32]byte, error) {
+	sharedKey := &[32]byte{}
+	switch esVersion {
+	case dnscryptXChacha20Poly1305:
+		dhKey, err := curve25519.X25519(secretKey[:], publicKey[:])
+		if err != nil {
+			return nil, err
+		}
+		subKey, err := chacha20.HChaCha20(dhKey, make([]byte, 16))
+		if err != nil {
+			return nil, err
+		}
+		copy(sharedKey[:], subKey)
+	default:
+		box.Precompute(sharedKey, publicKey, secretKey)
+	}
+	return sharedKey, nil
+}
+
+// dnscryptSeal encrypts and authenticates the plaintext using the given
+// encryption system and returns the tag followed by the ciphertext.
+func dnscryptSeal(esVersion uint16, key *[32]byte, nonce *[24]byte, plaintext []byte) []byte {
+	if esVersion != dnscryptXChacha20Poly1305 {
+		return secretbox.Seal(nil, plaintext, nonce, key)
+	}
+
+	// Like secretbox but using XChacha20: the first 32 bytes of the key
+	// stream are the poly1305 key and we encrypt using the rest.
+	stream, polyKey := dnscryptXChacha20Stream(key, nonce)
+	out := make([]byte, poly1305.TagSize+len(plaintext))
+	stream.XORKeyStream(out[poly1305.TagSize:], plaintext)
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, out[poly1305.TagSize:], polyKey)
+	copy(out, tag[:])
+	return out
+}
+
+// dnscryptOpen is the inverse of [dnscryptSeal].
+func dnscryptOpen(esVersion uint16, key *[32]byte, nonce *[24]byte, sealed []byte) ([]byte, bool) {
+	if esVersion != dnscryptXChacha20Poly1305 {
+		return secretbox.Open(nil, sealed, nonce, key)
+	}
+	if len(sealed) < poly1305.TagSize {
+		return nil, false
+	}
+	stream, polyKey := dnscryptXChacha20Stream(key, nonce)
+	var tag [poly1305.TagSize]byte
+	copy(tag[:], sealed)
+	if !poly1305.Verify(&tag, sealed[poly1305.TagSize:], polyKey) {
+		return nil, false
+	}
+	out := make([]byte, len(sealed)-poly1305.TagSize)
+	stream.XORKeyStream(out, sealed[poly1305.TagSize:])
+	return out, true
+}
+
+// dnscryptXChacha20Stream returns the XChacha20 stream and the poly1305 key.
+func dnscryptXChacha20Stream(key *[32]byte, nonce *[24]byte) (*chacha20.Cipher, *[32]byte) {
+	stream, err := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	if err != nil {
+		panic(err) // cannot happen with correctly-sized key and nonce
+	}
+	polyKey := &[32]byte{}
+	stream.XORKeyStream(polyKey[:], polyKey[:])
+	return stream, polyKey
+}
+
+// dnscryptPad pads the message using ISO/IEC 7816-4 to a multiple
+// of the padding block size and at least to the given minimum size.
+func dnscryptPad(message []byte, minSize int) []byte {
+	size := (len(message) + 1 + dnscryptPaddingBlockSize - 1) / dnscryptPaddingBlockSize * dnscryptPaddingBlockSize
+	size = max(size, minSize)
+	padded := make([]byte, size)
+	copy(padded, message)
+	padded[len(message)] = 0x80
+	return padded
+}
+
+// dnscryptUnpad removes the padding added by [dnscryptPad].
+func dnscryptUnpad(padded []byte) ([]byte, bool) {
+	// scan backwards byte by byte because the padding is not UTF-8
+	index := len(padded) - 1
+	for index >= 0 && padded[index] == 0 {
+		index--
+	}
+	if index < 0 || padded[index] != 0x80 {
+		return nil, false
+	}
+	return padded[:index], true
+}
+
+// dnscryptQueryContext contains the state to decrypt the response.
+type dnscryptQueryContext struct {
+	// cert is the certificate we used.
+	cert *dnscryptCert
+
+	// clientNonce is the client half of the nonce.
+	clientNonce [dnscryptClientNonceSize]byte
+
+	// sharedKey is the shared key.
+	sharedKey *[32]byte
+}
+
+// encryptQuery encrypts the raw query using an ephemeral key pair and
+// pads it to the given minimum size. It returns the packet to send along
+// with the context required to decrypt the corresponding response.
+func (c *dnscryptCert) encryptQuery(rawQuery []byte, minSize int) ([]byte, *dnscryptQueryContext, error) {
+	// 1. generate the ephemeral key pair and the shared key
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	qctx := &dnscryptQueryContext{cert: c}
+	qctx.sharedKey, err = dnscryptSharedKey(c.esVersion, secretKey, &c.resolverPK)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 2. generate the client nonce, whose other half is zero
+	if _, err := rand.Read(qctx.clientNonce[:]); err != nil {
+		return nil, nil, err
+	}
+	var nonce [24]byte
+	copy(nonce[:], qctx.clientNonce[:])
+
+	// 3. assemble the query packet
+	packet := make([]byte, 0, len(c.clientMagic)+len(publicKey)+len(qctx.clientNonce))
+	packet = append(packet, c.clientMagic[:]...)
+	packet = append(packet, publicKey[:]...)
+	packet = append(packet, qctx.clientNonce[:]...)
+	packet = append(packet, dnscryptSeal(c.esVersion, qctx.sharedKey, &nonce, dnscryptPad(rawQuery, minSize))...)
+	return packet, qctx, nil
+}
+
+// decryptResponse decrypts the response packet and returns the raw response.
+func (qctx *dnscryptQueryContext) decryptResponse(packet []byte) ([]byte, error) {
+	// 1. make sure the packet is well formed and the nonce matches
+	const headerSize = len(dnscryptResolverMagic) + 24
+	if len(packet) < headerSize+poly1305.TagSize || string(packet[:8]) != dnscryptResolverMagic {
+		return nil, fmt.Errorf("%w: malformed response", ErrInvalidDNSCryptResponse)
+	}
+	var nonce [24]byte
+	copy(nonce[:], packet[8:headerSize])
+	if !bytes.Equal(nonce[:dnscryptClientNonceSize], qctx.clientNonce[:]) {
+		return nil, fmt.Errorf("%w: unexpected nonce", ErrInvalidDNSCryptResponse)
+	}
+
+	// 2. decrypt and unpad the response
+	padded, ok := dnscryptOpen(qctx.cert.esVersion, qctx.sharedKey, &nonce, packet[headerSize:])
+	if !ok {
+		return nil, fmt.Errorf("%w: cannot decrypt", ErrInvalidDNSCryptResponse)
+	}
+	rawResp, ok := dnscryptUnpad(padded)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid padding", ErrInvalidDNSCryptResponse)
+	}
+	return rawResp, nil
+}
+
+// queryDNSCrypt implements [*Transport.Query] for DNSCrypt.
+func (t *Transport) queryDNSCrypt(ctx context.Context,
+	addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+	// 0. immediately fail if the context is already done, which
+	// is useful to write unit tests
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// 1. Obtain and verify the resolver certificate.
+	rawCert := addr.DNSCryptCert
+	if len(rawCert) <= 0 {
+		var err error
+		rawCert, err = t.FetchDNSCryptCert(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cert, err := parseDNSCryptCert(rawCert, addr.DNSCryptProviderKey, t.timeNow())
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Serialize the query.
+	rawQuery, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. Send the query over UDP and retry over TCP when the
+	// resolver truncates the response, as the protocol requires.
+	resp, err := t.queryDNSCryptNetwork(ctx, addr, cert, rawQuery, "udp")
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		t.maybeLogFallbackNetwork(ctx, addr, "udp", "tcp", "truncated")
+		return t.queryDNSCryptNetwork(ctx, addr, cert, rawQuery, "tcp")
+	}
+	return resp, nil
+}
+
+// queryDNSCryptNetwork performs a DNSCrypt round trip using the given network.
+func (t *Transport) queryDNSCryptNetwork(ctx context.Context, addr *ServerAddr,
+	cert *dnscryptCert, rawQuery []byte, network string) (*dns.Msg, error) {
+	// 1. Dial the connection and use the context deadline to limit the query lifetime.
+	conn, err := t.dialContext(ctx, network, addr.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	// 2. Make sure we react to the context being canceled early.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		defer conn.Close()
+		<-ctx.Done()
+	}()
+
+	// 3. Encrypt the query, using the minimum size only for UDP
+	// since the resolver truncates responses larger than the query.
+	t0 := t.maybeLogQueryNetwork(ctx, addr, network, rawQuery)
+	minSize := 0
+	if network == "udp" {
+		minSize = dnscryptMinUDPQuerySize
+	}
+	packet, qctx, err := cert.encryptQuery(rawQuery, minSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// 4. Send the query and read the response.
+	var rawPacket []byte
+	switch network {
+	case "udp":
+		rawPacket, err = dnscryptRoundTripUDP(conn, packet)
+	default:
+		rawPacket, err = dnscryptRoundTripTCP(addr, conn, packet)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 5. Decrypt and parse the response, possibly log it, and
+	// possibly verify its TSIG signature.
+	rawResp, err := qctx.decryptResponse(rawPacket)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rawResp); err != nil {
+		return nil, err
+	}
+	t.maybeLogResponseAddrPortNetwork(ctx, addr, network, t0, rawQuery, rawResp,
+		addrToAddrPort(conn.LocalAddr()), addrToAddrPort(conn.RemoteAddr()), nil)
+	if err := t.maybeVerifyResponseTSIG(addr.TSIGKey, rawQuery, resp, rawResp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// dnscryptRoundTripUDP sends the packet and reads the response packet.
+func dnscryptRoundTripUDP(conn net.Conn, packet []byte) ([]byte, error) {
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, dns.MaxMsgSize)
+	count, err := conn.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:count], nil
+}
+
+// dnscryptRoundTripTCP sends the length-prefixed packet and reads
+// the length-prefixed response packet.
+func dnscryptRoundTripTCP(addr *ServerAddr, conn net.Conn, packet []byte) ([]byte, error) {
+	frame, err := newRawMsgFrame(addr, packet)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(frame); err != nil {
+		return nil, err
+	}
+	return readRawMsgFrame(conn)
+}
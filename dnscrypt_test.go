@@ -0,0 +1,253 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rbmk-project/common/runtimex"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// newDNSCryptTestCert returns a certificate signed using a fresh provider key
+// along with the provider public key and the resolver secret key.
+func newDNSCryptTestCert(esVersion uint16, tsStart, tsEnd time.Time) ([]byte, ed25519.PublicKey, *[32]byte) {
+	providerKey, providerSecretKey := runtimex.Try2(ed25519.GenerateKey(rand.Reader))
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	runtimex.Try0(err)
+	signed := append([]byte{}, publicKey[:]...)
+	signed = append(signed, "abcdefgh"...)
+	signed = binary.BigEndian.AppendUint32(signed, 1)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(tsStart.Unix()))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(tsEnd.Unix()))
+	raw := []byte(dnscryptCertMagic)
+	raw = binary.BigEndian.AppendUint16(raw, esVersion)
+	raw = binary.BigEndian.AppendUint16(raw, 0)
+	raw = append(raw, ed25519.Sign(providerSecretKey, signed)...)
+	raw = append(raw, signed...)
+	return raw, providerKey, secretKey
+}
+
+func Test_parseDNSCryptCert(t *testing.T) {
+	now := time.Now()
+	validCert, providerKey, _ := newDNSCryptTestCert(dnscryptXChacha20Poly1305, now.Add(-time.Hour), now.Add(time.Hour))
+
+	tests := []struct {
+		name        string
+		rawCert     []byte
+		providerKey ed25519.PublicKey
+		expectErr   error
+	}{{
+		name:        "too short",
+		rawCert:     validCert[:dnscryptCertSize-1],
+		providerKey: providerKey,
+		expectErr:   ErrInvalidDNSCryptCert,
+	}, {
+		name:        "invalid magic",
+		rawCert:     append([]byte("XXXX"), validCert[4:]...),
+		providerKey: providerKey,
+		expectErr:   ErrInvalidDNSCryptCert,
+	}, {
+		name: "unsupported es-version",
+		rawCert: func() []byte {
+			rawCert, _, _ := newDNSCryptTestCert(0x0003, now.Add(-time.Hour), now.Add(time.Hour))
+			return rawCert
+		}(),
+		providerKey: providerKey,
+		expectErr:   ErrInvalidDNSCryptCert,
+	}, {
+		name:        "invalid provider key",
+		rawCert:     validCert,
+		providerKey: ed25519.PublicKey{0x00},
+		expectErr:   ErrInvalidDNSCryptCert,
+	}, {
+		name:        "invalid signature",
+		rawCert:     validCert,
+		providerKey: make(ed25519.PublicKey, ed25519.PublicKeySize),
+		expectErr:   ErrInvalidDNSCryptCert,
+	}, {
+		name:        "valid certificate",
+		rawCert:     validCert,
+		providerKey: providerKey,
+		expectErr:   nil,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := parseDNSCryptCert(tt.rawCert, tt.providerKey, now)
+			assert.ErrorIs(t, err, tt.expectErr)
+			if tt.expectErr == nil {
+				assert.Equal(t, uint16(dnscryptXChacha20Poly1305), cert.esVersion)
+				assert.Equal(t, [8]byte{'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h'}, cert.clientMagic)
+				assert.Equal(t, uint32(1), cert.serial)
+			}
+		})
+	}
+
+	t.Run("validity period", func(t *testing.T) {
+		rawCert, providerKey, _ := newDNSCryptTestCert(dnscryptXSalsa20Poly1305, now.Add(-time.Hour), now.Add(time.Hour))
+		_, err := parseDNSCryptCert(rawCert, providerKey, now.Add(2*time.Hour))
+		assert.ErrorIs(t, err, ErrNoValidDNSCryptCert)
+		_, err = parseDNSCryptCert(rawCert, providerKey, now.Add(-2*time.Hour))
+		assert.ErrorIs(t, err, ErrNoValidDNSCryptCert)
+	})
+}
+
+func Test_dnscryptSealOpen(t *testing.T) {
+	for _, esVersion := range []uint16{dnscryptXSalsa20Poly1305, dnscryptXChacha20Poly1305} {
+		key := &[32]byte{0x01}
+		nonce := &[24]byte{0x02}
+		plaintext := bytes.Repeat([]byte{0x55}, 100)
+
+		sealed := dnscryptSeal(esVersion, key, nonce, plaintext)
+		assert.Len(t, sealed, 16+len(plaintext))
+
+		opened, ok := dnscryptOpen(esVersion, key, nonce, sealed)
+		assert.True(t, ok)
+		assert.Equal(t, plaintext, opened)
+
+		sealed[len(sealed)-1] ^= 0x01
+		_, ok = dnscryptOpen(esVersion, key, nonce, sealed)
+		assert.False(t, ok)
+
+		_, ok = dnscryptOpen(esVersion, key, nonce, sealed[:8])
+		assert.False(t, ok)
+	}
+}
+
+func Test_dnscryptSharedKey(t *testing.T) {
+	for _, esVersion := range []uint16{dnscryptXSalsa20Poly1305, dnscryptXChacha20Poly1305} {
+		publicKeyA, secretKeyA, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKeyB, secretKeyB, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sharedA, err := dnscryptSharedKey(esVersion, secretKeyA, publicKeyB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sharedB, err := dnscryptSharedKey(esVersion, secretKeyB, publicKeyA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, sharedA, sharedB)
+	}
+}
+
+func Test_dnscryptPad(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		last       byte
+		minSize    int
+		expectSize int
+	}{
+		{name: "small UDP query", size: 30, minSize: dnscryptMinUDPQuerySize, expectSize: 256},
+		{name: "small TCP query", size: 30, minSize: 0, expectSize: 64},
+		{name: "exact block", size: 64, minSize: 0, expectSize: 128},
+		{name: "large UDP query", size: 300, minSize: dnscryptMinUDPQuerySize, expectSize: 320},
+		{name: "trailing 0xC2 byte", size: 30, last: 0xc2, minSize: 0, expectSize: 64},
+		{name: "trailing 0xDF byte", size: 30, last: 0xdf, minSize: 0, expectSize: 64},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := bytes.Repeat([]byte{0x11}, tt.size)
+			if tt.last != 0 {
+				message[len(message)-1] = tt.last
+			}
+			padded := dnscryptPad(message, tt.minSize)
+			assert.Len(t, padded, tt.expectSize)
+			unpadded, ok := dnscryptUnpad(padded)
+			assert.True(t, ok)
+			assert.Equal(t, message, unpadded)
+		})
+	}
+
+	t.Run("invalid padding", func(t *testing.T) {
+		_, ok := dnscryptUnpad([]byte{0x11, 0x00, 0x00})
+		assert.False(t, ok)
+		_, ok = dnscryptUnpad([]byte{0x00, 0x00})
+		assert.False(t, ok)
+	})
+}
+
+func Test_dnscryptTXTBytes(t *testing.T) {
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{"\\000\\255a", "\\\"b"},
+	}
+	data, err := dnscryptTXTBytes(rr)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x00, 0xff, 'a', '"', 'b'}, data)
+}
+
+func TestDNSCryptCert_encryptQuery(t *testing.T) {
+	for _, esVersion := range []uint16{dnscryptXSalsa20Poly1305, dnscryptXChacha20Poly1305} {
+		now := time.Now()
+		rawCert, providerKey, secretKey := newDNSCryptTestCert(esVersion, now.Add(-time.Hour), now.Add(time.Hour))
+		cert := runtimex.Try1(parseDNSCryptCert(rawCert, providerKey, now))
+		rawQuery := []byte{0x01, 0x02, 0x03}
+
+		// encrypt the query and make sure the resolver can decrypt it
+		packet, qctx, err := cert.encryptQuery(rawQuery, dnscryptMinUDPQuerySize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []byte("abcdefgh"), packet[:8])
+		var clientPK [32]byte
+		copy(clientPK[:], packet[8:40])
+		sharedKey, err := dnscryptSharedKey(esVersion, secretKey, &clientPK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var nonce [24]byte
+		copy(nonce[:], packet[40:52])
+		padded, ok := dnscryptOpen(esVersion, sharedKey, &nonce, packet[52:])
+		assert.True(t, ok)
+		assert.Len(t, padded, dnscryptMinUDPQuerySize)
+
+		// encrypt a response and make sure we can decrypt it
+		copy(nonce[12:], "resolvernonc")
+		response := append([]byte(dnscryptResolverMagic), nonce[:]...)
+		response = append(response, dnscryptSeal(esVersion, sharedKey, &nonce, dnscryptPad([]byte{0x04}, 0))...)
+		rawResp, err := qctx.decryptResponse(response)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x04}, rawResp)
+
+		// make sure we reject responses with invalid nonce or magic
+		response[8] ^= 0x01
+		_, err = qctx.decryptResponse(response)
+		assert.ErrorIs(t, err, ErrInvalidDNSCryptResponse)
+		response[0] ^= 0x01
+		_, err = qctx.decryptResponse(response)
+		assert.ErrorIs(t, err, ErrInvalidDNSCryptResponse)
+	}
+}
+
+func TestTransport_queryDNSCrypt(t *testing.T) {
+	t.Run("invalid certificate", func(t *testing.T) {
+		addr := &ServerAddr{
+			Protocol:            ProtocolDNSCrypt,
+			Address:             "127.0.0.1:443",
+			DNSCryptCert:        []byte("DNSC"),
+			DNSCryptProviderKey: make(ed25519.PublicKey, ed25519.PublicKeySize),
+		}
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeA)
+		resp, err := (&Transport{}).queryDNSCrypt(context.Background(), addr, query)
+		assert.ErrorIs(t, err, ErrInvalidDNSCryptCert)
+		assert.Nil(t, resp)
+	})
+}
@@ -0,0 +1,1081 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// DNSSEC validation.
+//
+// See https://datatracker.ietf.org/doc/rfc4035/
+// and https://datatracker.ietf.org/doc/rfc5155/
+//
+
+package dnscore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSECStatus is the security status of the answers
+// obtained by a validating [*Resolver] -- RFC 4035 Sect. 4.3.
+type DNSSECStatus int
+
+const (
+	// DNSSECIndeterminate indicates that we did not validate the
+	// answers, either because validation is disabled or because there
+	// is no trust anchor covering the name we are resolving.
+	DNSSECIndeterminate = DNSSECStatus(iota)
+
+	// DNSSECSecure indicates that we built a chain of trust from a
+	// trust anchor to the answers or to the authenticated denial of
+	// existence of the name or of the type we are resolving.
+	DNSSECSecure
+
+	// DNSSECInsecure indicates that we proved that the answers
+	// belong to a zone below an unsigned delegation.
+	DNSSECInsecure
+
+	// DNSSECBogus indicates that the answers should have been
+	// signed but we could not validate them, which may indicate
+	// that someone tampered with the answers.
+	DNSSECBogus
+)
+
+// String implements [fmt.Stringer].
+func (s DNSSECStatus) String() string {
+	switch s {
+	case DNSSECSecure:
+		return "secure"
+	case DNSSECInsecure:
+		return "insecure"
+	case DNSSECBogus:
+		return "bogus"
+	default:
+		return "indeterminate"
+	}
+}
+
+// ErrDNSSECBogus indicates that DNSSEC validation failed.
+var ErrDNSSECBogus = errors.New("dnssec: bogus response")
+
+// errDNSSECBogus returns a new error wrapping [ErrDNSSECBogus].
+func errDNSSECBogus(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrDNSSECBogus, fmt.Sprintf(format, args...))
+}
+
+// DNSSECConfig contains the DNSSEC validation configuration.
+//
+// Set the DNSSEC field of [*Resolver] to enable validation.
+type DNSSECConfig struct {
+	// TrustAnchors contains the optional DS RRs of the trust anchors. When
+	// there are several trust anchors, we use the closest enclosing one.
+	//
+	// If empty, we use [DefaultDNSSECTrustAnchors].
+	TrustAnchors []*dns.DS
+
+	// TimeNow is the optional function returning the current time, which
+	// we use to check the validity period of signatures.
+	//
+	// If nil, we use [time.Now].
+	TimeNow func() time.Time
+}
+
+// DefaultDNSSECTrustAnchors returns the DS RRs of the root zone key
+// signing keys published by IANA (i.e., KSK-2017 and KSK-2024).
+//
+// See https://data.iana.org/root-anchors/root-anchors.xml.
+func DefaultDNSSECTrustAnchors() []*dns.DS {
+	return []*dns.DS{{
+		Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+		KeyTag:     20326,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	}, {
+		Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET},
+		KeyTag:     38696,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     "683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+	}}
+}
+
+// trustAnchors returns the configured or the default trust anchors.
+func (c *DNSSECConfig) trustAnchors() []*dns.DS {
+	if len(c.TrustAnchors) > 0 {
+		return c.TrustAnchors
+	}
+	return DefaultDNSSECTrustAnchors()
+}
+
+// timeNow returns the current time using the configured function.
+func (c *DNSSECConfig) timeNow() time.Time {
+	if c.TimeNow != nil {
+		return c.TimeNow()
+	}
+	return time.Now()
+}
+
+// queryOptionDNSSEC sets the DNSSEC OK (DO) bit, adding an OPT RR
+// when needed, and the Checking Disabled (CD) bit, such that the server
+// returns the signatures and does not hide bogus answers from us.
+//
+// Since [QueryOptionTSIG] must be the last option, we apply this option
+// before the options of the server (see [dnssecQueryOptions]).
+func queryOptionDNSSEC(q *dns.Msg) error {
+	q.CheckingDisabled = true
+	if opt := q.IsEdns0(); opt != nil {
+		opt.SetDo()
+		return nil
+	}
+	q.SetEdns0(EDNS0SuggestedMaxResponseSizeUDP, true)
+	return nil
+}
+
+// dnssecQueryOptions returns the options for querying the given server
+// when validating DNSSEC, which apply [queryOptionDNSSEC] before the options
+// of the server, such that signing using [QueryOptionTSIG] comes last.
+func dnssecQueryOptions(server resolverConfigServer) []QueryOption {
+	return append([]QueryOption{queryOptionDNSSEC}, server.queryOptions...)
+}
+
+// LookupDNSSEC resolves the RRs of the given type for the given domain
+// and returns them along with their [DNSSECStatus].
+//
+// When the DNSSEC field is nil, we do not validate and the status is
+// always [DNSSECIndeterminate]. Otherwise, we also validate NXDOMAIN and
+// NODATA responses, in which case we return the status along with either
+// [ErrNoName] or [ErrNoData]. When the status is [DNSSECBogus], the error
+// wraps [ErrDNSSECBogus] and explains why the validation failed.
+func (r *Resolver) LookupDNSSEC(ctx context.Context,
+	host string, qtype uint16) ([]dns.RR, DNSSECStatus, error) {
+	result, err := r.Lookup(ctx, host, qtype)
+	return result.RRs, result.DNSSECStatus, err
+}
+
+// dnssecMaxQueries is the maximum number of queries we
+// send to validate the response to a single query.
+const dnssecMaxQueries = 32
+
+// errDNSSECTooManyQueries indicates that validating
+// requires more than [dnssecMaxQueries] queries.
+var errDNSSECTooManyQueries = errors.New("dnssec: too many queries")
+
+// dnssecValidator validates responses obtained from a specific server,
+// which we also use to fetch the DNSKEY and DS RRs we need.
+//
+// Construct using [*Resolver.newDNSSECValidator].
+type dnssecValidator struct {
+	// anchors contains the trust anchors.
+	anchors []*dns.DS
+
+	// now is the time used to check the signatures validity period.
+	now time.Time
+
+	// queries counts the queries sent so far.
+	queries int
+
+	// resolver is the resolver we are using.
+	resolver *Resolver
+
+	// responses caches the responses to the queries we sent.
+	responses map[string]*dns.Msg
+
+	// server is the server to query.
+	server resolverConfigServer
+
+	// zones caches the results of validating the keys of zones.
+	zones map[string]*dnssecZone
+}
+
+// dnssecZone is the result of validating the keys of a zone.
+type dnssecZone struct {
+	// err is the error that occurred, if any.
+	err error
+
+	// keys contains the validated keys of the zone.
+	keys []*dns.DNSKEY
+
+	// status is the status of the zone.
+	status DNSSECStatus
+}
+
+// newDNSSECValidator creates a new [*dnssecValidator] for the given server.
+func (r *Resolver) newDNSSECValidator(server resolverConfigServer) *dnssecValidator {
+	return &dnssecValidator{
+		anchors:   r.DNSSEC.trustAnchors(),
+		now:       r.DNSSEC.timeNow(),
+		queries:   0,
+		resolver:  r,
+		responses: make(map[string]*dns.Msg),
+		server:    server,
+		zones:     make(map[string]*dnssecZone),
+	}
+}
+
+// validate validates the response to the given question.
+//
+// The returned error is nil when the response is secure,
+// insecure or indeterminate, it wraps [ErrDNSSECBogus] when
+// the response is bogus, and otherwise it is the error that
+// prevented us from fetching the DNSKEY and DS RRs.
+func (v *dnssecValidator) validate(ctx context.Context,
+	q0 dns.Question, resp *dns.Msg) (DNSSECStatus, error) {
+	// 1. make sure there is a trust anchor covering the name
+	qname := dns.CanonicalName(q0.Name)
+	if anchor, _ := v.closestAnchor(qname); anchor == "" {
+		return DNSSECIndeterminate, nil
+	}
+
+	// 2. validate each RRset in the answer section
+	status := DNSSECSecure
+	rrsets := dnssecRRsets(resp.Answer)
+	for _, rrset := range rrsets {
+		sig, rrsetStatus, err := v.verifyRRset(ctx, rrset)
+		if err != nil {
+			return rrsetStatus, err
+		}
+
+		// 2.1. a wildcard expansion requires a proof that
+		// the name does not exist -- RFC 4035 Sect. 5.3.4
+		if sig != nil && int(sig.Labels) < dns.CountLabel(rrset.owner) {
+			wildcardStatus, err := v.verifyWildcard(ctx, rrset.owner, int(sig.Labels), resp)
+			if err != nil {
+				return wildcardStatus, err
+			}
+			rrsetStatus = dnssecMergeStatus(rrsetStatus, wildcardStatus)
+		}
+		status = dnssecMergeStatus(status, rrsetStatus)
+	}
+
+	// 3. follow the CNAME chain to figure out whether the
+	// response actually contains answers for the question
+	found := false
+	for idx := 0; idx < len(rrsets); idx++ {
+		for _, rrset := range rrsets {
+			if rrset.owner != qname {
+				continue
+			}
+			if rrset.rrtype == q0.Qtype || q0.Qtype == dns.TypeANY {
+				found = true
+			}
+			if rrset.rrtype == dns.TypeCNAME && q0.Qtype != dns.TypeCNAME {
+				qname = dns.CanonicalName(rrset.rrs[0].(*dns.CNAME).Target)
+			}
+		}
+	}
+
+	// 4. authenticate the denial of existence of the name or of the
+	// type when we did not find any answer -- RFC 4035 Sect. 5.4
+	if !found {
+		denialStatus, err := v.verifyDenial(ctx, qname, q0.Qtype, resp)
+		if err != nil {
+			return denialStatus, err
+		}
+		status = dnssecMergeStatus(status, denialStatus)
+	}
+	return status, nil
+}
+
+// dnssecMergeStatus combines the status of two RRsets, where
+// bogus trumps insecure, which trumps indeterminate, which
+// trumps secure, so an insecure CNAME target makes the whole
+// response insecure even when the CNAME itself is secure.
+func dnssecMergeStatus(a, b DNSSECStatus) DNSSECStatus {
+	rank := func(s DNSSECStatus) int {
+		switch s {
+		case DNSSECSecure:
+			return 0
+		case DNSSECIndeterminate:
+			return 1
+		case DNSSECInsecure:
+			return 2
+		default:
+			return 3
+		}
+	}
+	if rank(a) >= rank(b) {
+		return a
+	}
+	return b
+}
+
+// dnssecRRset is an RRset along with the RRSIGs covering it.
+type dnssecRRset struct {
+	// owner is the canonical owner name.
+	owner string
+
+	// rrs contains the RRs.
+	rrs []dns.RR
+
+	// rrtype is the type of the RRs.
+	rrtype uint16
+
+	// sigs contains the RRSIGs covering the RRs.
+	sigs []*dns.RRSIG
+}
+
+// dnssecRRsets groups the given RRs into RRsets, preserving the order in
+// which RRsets first appear, and associates each RRset with its RRSIGs.
+func dnssecRRsets(rrs []dns.RR) []*dnssecRRset {
+	var rrsets []*dnssecRRset
+	lookup := func(owner string, rrtype uint16) *dnssecRRset {
+		for _, rrset := range rrsets {
+			if rrset.owner == owner && rrset.rrtype == rrtype {
+				return rrset
+			}
+		}
+		rrset := &dnssecRRset{owner: owner, rrtype: rrtype}
+		rrsets = append(rrsets, rrset)
+		return rrset
+	}
+	for _, rr := range rrs {
+		header := rr.Header()
+		owner := dns.CanonicalName(header.Name)
+		switch rr := rr.(type) {
+		case *dns.RRSIG:
+			rrset := lookup(owner, rr.TypeCovered)
+			rrset.sigs = append(rrset.sigs, rr)
+		case *dns.OPT:
+			// not part of the signed data
+		default:
+			rrset := lookup(owner, header.Rrtype)
+			rrset.rrs = append(rrset.rrs, rr)
+		}
+	}
+
+	// make sure we do not return RRSIGs without RRs
+	return slices.DeleteFunc(rrsets, func(rrset *dnssecRRset) bool {
+		return len(rrset.rrs) <= 0
+	})
+}
+
+// closestAnchor returns the name and the DS RRs of the trust anchor
+// closest to the given name, or an empty name if no anchor covers it.
+func (v *dnssecValidator) closestAnchor(name string) (string, []*dns.DS) {
+	var (
+		closest string
+		dsset   []*dns.DS
+	)
+	for _, ds := range v.anchors {
+		owner := dns.CanonicalName(ds.Hdr.Name)
+		if !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		switch {
+		case owner == closest:
+			dsset = append(dsset, ds)
+		case closest == "" || dns.CountLabel(owner) > dns.CountLabel(closest):
+			closest, dsset = owner, []*dns.DS{ds}
+		}
+	}
+	return closest, dsset
+}
+
+// fetch sends a query for the given name and type to the server,
+// caching the response, and returns either a successful or an
+// NXDOMAIN response, which we need for denial of existence.
+func (v *dnssecValidator) fetch(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	// 1. check whether we already have a response
+	key := dns.CanonicalName(name) + "/" + dns.TypeToString[qtype]
+	if resp, ok := v.responses[key]; ok {
+		return resp, nil
+	}
+
+	// 2. make sure we do not send too many queries
+	if v.queries >= dnssecMaxQueries {
+		return nil, errDNSSECTooManyQueries
+	}
+	v.queries++
+
+	// 3. send the query and check the RCODE
+	query, err := NewQueryWithServerAddr(v.server.address, name, qtype, dnssecQueryOptions(v.server)...)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.resolver.roundTrip(ctx, v.server, query)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, RCodeToError(resp)
+	}
+	v.responses[key] = resp
+	return resp, nil
+}
+
+// verifyRRset verifies the given RRset and returns the RRSIG we used to
+// verify it, which is nil when the RRset is not secure, and its status.
+func (v *dnssecValidator) verifyRRset(ctx context.Context,
+	rrset *dnssecRRset) (*dns.RRSIG, DNSSECStatus, error) {
+	// 1. an unsigned RRset is only fine within an insecure zone, which,
+	// for DS RRs, is the zone containing the parent name
+	if len(rrset.sigs) <= 0 {
+		name := rrset.owner
+		if rrset.rrtype == dns.TypeDS {
+			name = dnssecParentName(name)
+		}
+		status, err := v.unsignedStatus(ctx, name)
+		return nil, status, err
+	}
+
+	// 2. try with each signature until one of them works
+	var lastErr error
+	for _, sig := range rrset.sigs {
+		// 2.1. the signer must be the zone containing the RRset and DS
+		// RRs belong to the parent zone -- RFC 4035 Sect. 5.3.1
+		signer := dns.CanonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, rrset.owner) ||
+			(rrset.rrtype == dns.TypeDS && signer == rrset.owner) {
+			lastErr = errDNSSECBogus("invalid signer %s for %s", signer, rrset.owner)
+			continue
+		}
+
+		// 2.2. obtain the validated keys of the signer
+		keys, status, err := v.zoneKeys(ctx, signer)
+		if status == DNSSECBogus {
+			lastErr = err
+			continue
+		}
+		if err != nil || status != DNSSECSecure {
+			return nil, status, err
+		}
+
+		// 2.3. verify the signature
+		if err := v.verifySig(sig, keys, rrset.rrs); err != nil {
+			lastErr = err
+			continue
+		}
+		return sig, DNSSECSecure, nil
+	}
+	return nil, DNSSECBogus, lastErr
+}
+
+// verifySig verifies the given signature using the given keys.
+func (v *dnssecValidator) verifySig(sig *dns.RRSIG, keys []*dns.DNSKEY, rrs []dns.RR) error {
+	name, rrtype := rrs[0].Header().Name, dns.TypeToString[sig.TypeCovered]
+	if !sig.ValidityPeriod(v.now) {
+		return errDNSSECBogus("signature for %s/%s outside its validity period", name, rrtype)
+	}
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if sig.Verify(key, rrs) == nil {
+			return nil
+		}
+	}
+	return errDNSSECBogus("cannot verify signature for %s/%s", name, rrtype)
+}
+
+// unsignedStatus returns the status of an unsigned RRset owned by the given
+// name, which is bogus unless the name belongs to an insecure zone.
+func (v *dnssecValidator) unsignedStatus(ctx context.Context, name string) (DNSSECStatus, error) {
+	zone, err := v.findZone(ctx, name)
+	if err != nil {
+		return DNSSECIndeterminate, err
+	}
+	_, status, err := v.zoneKeys(ctx, zone)
+	if err != nil {
+		return status, err
+	}
+	if status == DNSSECSecure {
+		return DNSSECBogus, errDNSSECBogus("missing signature for %s", name)
+	}
+	return status, nil
+}
+
+// findZone returns the name of the zone containing the given name using
+// the SOA RR returned by the server. We do not need to trust the server
+// here, since we subsequently validate the chain of trust of the zone.
+func (v *dnssecValidator) findZone(ctx context.Context, name string) (string, error) {
+	for name = dns.CanonicalName(name); ; {
+		// 1. query for the SOA of the name
+		resp, err := v.fetch(ctx, name, dns.TypeSOA)
+		if err != nil {
+			return "", err
+		}
+
+		// 2. look for the SOA in the answer and in the authority sections
+		for _, rr := range append(slices.Clone(resp.Answer), resp.Ns...) {
+			if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, name) {
+				return dns.CanonicalName(soa.Hdr.Name), nil
+			}
+		}
+
+		// 3. otherwise, try with the parent, since the name may be,
+		// e.g., a CNAME, which cannot be the apex of a zone
+		if name == "." {
+			return name, nil
+		}
+		name = dnssecParentName(name)
+	}
+}
+
+// dnssecParentName returns the parent of the given canonical name.
+func dnssecParentName(name string) string {
+	if off, end := dns.NextLabel(name, 0); !end {
+		return name[off:]
+	}
+	return "."
+}
+
+// zoneKeys returns the validated keys of the given zone and the zone
+// status. The keys are only valid when the status is [DNSSECSecure].
+func (v *dnssecValidator) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, DNSSECStatus, error) {
+	// 1. check whether we already know the answer and mark the zone
+	// as bogus while we are validating to prevent loops
+	if entry, ok := v.zones[zone]; ok {
+		return entry.keys, entry.status, entry.err
+	}
+	v.zones[zone] = &dnssecZone{
+		err:    errDNSSECBogus("loop validating %s", zone),
+		status: DNSSECBogus,
+	}
+
+	// 2. validate and only cache the results not caused by network errors
+	keys, status, err := v.validateZoneKeys(ctx, zone)
+	if err == nil || status == DNSSECBogus {
+		v.zones[zone] = &dnssecZone{err: err, keys: keys, status: status}
+	} else {
+		delete(v.zones, zone)
+	}
+	return keys, status, err
+}
+
+// validateZoneKeys implements [*dnssecValidator.zoneKeys].
+func (v *dnssecValidator) validateZoneKeys(ctx context.Context,
+	zone string) ([]*dns.DNSKEY, DNSSECStatus, error) {
+	// 1. find the closest trust anchor
+	anchor, dsset := v.closestAnchor(zone)
+	if anchor == "" {
+		return nil, DNSSECIndeterminate, nil
+	}
+
+	// 2. unless the zone is a trust anchor, obtain the DS
+	// RRs from the parent zone, which may prove that the
+	// zone is insecure -- RFC 4035 Sect. 5.2
+	if anchor != zone {
+		var (
+			status DNSSECStatus
+			err    error
+		)
+		dsset, status, err = v.delegation(ctx, zone)
+		if err != nil || status != DNSSECSecure {
+			return nil, status, err
+		}
+	}
+
+	// 3. use the DS RRs to authenticate the zone keys
+	return v.verifyDNSKEY(ctx, zone, dsset)
+}
+
+// delegation returns the validated DS RRs of the given zone. When the
+// DS RRs do not exist, it returns [DNSSECInsecure] if the parent zone
+// proves that the zone is an unsigned delegation.
+func (v *dnssecValidator) delegation(ctx context.Context,
+	zone string) ([]*dns.DS, DNSSECStatus, error) {
+	// 1. query for the DS RRs
+	resp, err := v.fetch(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return nil, DNSSECIndeterminate, err
+	}
+
+	// 2. when there are DS RRs, make sure they are signed by the parent
+	for _, rrset := range dnssecRRsets(resp.Answer) {
+		if rrset.owner != zone || rrset.rrtype != dns.TypeDS {
+			continue
+		}
+		if _, status, err := v.verifyRRset(ctx, rrset); err != nil || status != DNSSECSecure {
+			return nil, status, err
+		}
+		var dsset []*dns.DS
+		for _, rr := range rrset.rrs {
+			dsset = append(dsset, rr.(*dns.DS))
+		}
+		return dsset, DNSSECSecure, nil
+	}
+
+	// 3. otherwise, make sure the parent proves there is no DS
+	status, err := v.verifyNoDS(ctx, zone, resp)
+	return nil, status, err
+}
+
+// verifyDNSKEY authenticates the DNSKEY RRset of the given zone using the
+// given DS RRs and returns the zone keys -- RFC 4035 Sect. 5.2.
+func (v *dnssecValidator) verifyDNSKEY(ctx context.Context,
+	zone string, dsset []*dns.DS) ([]*dns.DNSKEY, DNSSECStatus, error) {
+	// 1. a zone whose DS RRs all use unsupported algorithms is
+	// treated as insecure -- RFC 4035 Sect. 5.2
+	if !slices.ContainsFunc(dsset, dnssecSupportedDS) {
+		return nil, DNSSECInsecure, nil
+	}
+
+	// 2. obtain the DNSKEY RRset
+	resp, err := v.fetch(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, DNSSECIndeterminate, err
+	}
+	var rrset *dnssecRRset
+	for _, entry := range dnssecRRsets(resp.Answer) {
+		if entry.owner == zone && entry.rrtype == dns.TypeDNSKEY {
+			rrset = entry
+		}
+	}
+	if rrset == nil {
+		return nil, DNSSECBogus, errDNSSECBogus("no DNSKEY for %s", zone)
+	}
+	var keys []*dns.DNSKEY
+	for _, rr := range rrset.rrs {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	// 3. select the keys matching the DS RRs
+	var entryPoints []*dns.DNSKEY
+	for _, key := range keys {
+		for _, ds := range dsset {
+			if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+				continue
+			}
+			if digest := key.ToDS(ds.DigestType); digest != nil && strings.EqualFold(digest.Digest, ds.Digest) {
+				entryPoints = append(entryPoints, key)
+				break
+			}
+		}
+	}
+	if len(entryPoints) <= 0 {
+		return nil, DNSSECBogus, errDNSSECBogus("no DNSKEY for %s matching the DS", zone)
+	}
+
+	// 4. make sure one of the selected keys signs the DNSKEY RRset
+	for _, sig := range rrset.sigs {
+		if dns.CanonicalName(sig.SignerName) != zone {
+			continue
+		}
+		if v.verifySig(sig, entryPoints, rrset.rrs) == nil {
+			return keys, DNSSECSecure, nil
+		}
+	}
+	return nil, DNSSECBogus, errDNSSECBogus("cannot verify the DNSKEY RRset of %s", zone)
+}
+
+// dnssecSupportedDS returns whether we support the algorithm
+// and the digest type used by the given DS RR.
+func dnssecSupportedDS(ds *dns.DS) bool {
+	switch ds.DigestType {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+	default:
+		return false
+	}
+	switch ds.Algorithm {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	default:
+		return false
+	}
+}
+
+// dnssecDenial contains the validated NSEC and NSEC3 RRs of a response.
+type dnssecDenial struct {
+	// nsec contains the NSEC RRs.
+	nsec []*dns.NSEC
+
+	// nsec3 contains the NSEC3 RRs.
+	nsec3 []*dns.NSEC3
+}
+
+// denial validates the NSEC and NSEC3 RRs in the authority section of
+// the given response, which should deny the existence of the given name
+// or of one of its types, and returns them along with their status.
+//
+// When the response does not contain NSEC and NSEC3 RRs, the status is
+// bogus unless the zone containing the name is insecure.
+func (v *dnssecValidator) denial(ctx context.Context,
+	name string, resp *dns.Msg) (*dnssecDenial, DNSSECStatus, error) {
+	// 1. validate the NSEC and NSEC3 RRsets
+	denial := &dnssecDenial{}
+	status := DNSSECSecure
+	for _, rrset := range dnssecRRsets(resp.Ns) {
+		if rrset.rrtype != dns.TypeNSEC && rrset.rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		sig, rrsetStatus, err := v.verifyRRset(ctx, rrset)
+		if err != nil {
+			return nil, rrsetStatus, err
+		}
+
+		// ignore the proofs signed by a zone that cannot be authoritative for
+		// the name, e.g., the last NSEC RR of a child zone, which covers names
+		// sorting after the child zone -- we verified the signer is an ancestor
+		// of the NSEC RR owner but we also need it to be an ancestor of the name
+		if sig != nil && !dns.IsSubDomain(dns.CanonicalName(sig.SignerName), name) {
+			continue
+		}
+		status = dnssecMergeStatus(status, rrsetStatus)
+		for _, rr := range rrset.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				denial.nsec = append(denial.nsec, rr)
+			case *dns.NSEC3:
+				denial.nsec3 = append(denial.nsec3, rr)
+			}
+		}
+	}
+	if len(denial.nsec) > 0 || len(denial.nsec3) > 0 {
+		return denial, status, nil
+	}
+
+	// 2. without proofs, prefer the SOA in the authority section
+	// to figure out the zone containing the name
+	zone := ""
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, name) {
+			zone = dns.CanonicalName(soa.Hdr.Name)
+		}
+	}
+	if zone == "" {
+		var err error
+		if zone, err = v.findZone(ctx, name); err != nil {
+			return nil, DNSSECIndeterminate, err
+		}
+	}
+
+	// 3. the lack of proofs is only fine within an insecure zone
+	_, status, err := v.zoneKeys(ctx, zone)
+	if err != nil {
+		return nil, status, err
+	}
+	if status == DNSSECSecure {
+		return nil, DNSSECBogus, errDNSSECBogus("missing denial of existence for %s", name)
+	}
+	return nil, status, nil
+}
+
+// verifyDenial verifies that the response proves that either the
+// name or the type do not exist, depending on the RCODE.
+func (v *dnssecValidator) verifyDenial(ctx context.Context,
+	name string, qtype uint16, resp *dns.Msg) (DNSSECStatus, error) {
+	denial, status, err := v.denial(ctx, name, resp)
+	if err != nil || status != DNSSECSecure {
+		return status, err
+	}
+	switch resp.Rcode {
+	case dns.RcodeNameError:
+		if !denial.provesNoName(name) {
+			return DNSSECBogus, errDNSSECBogus("cannot prove that %s does not exist", name)
+		}
+	default:
+		if !denial.provesNoData(name, qtype) {
+			return DNSSECBogus, errDNSSECBogus("cannot prove that %s/%s does not exist",
+				name, dns.TypeToString[qtype])
+		}
+	}
+	return DNSSECSecure, nil
+}
+
+// verifyWildcard verifies that the response proves that the given name,
+// which matched a wildcard with the given number of labels, does not
+// exist, to prevent replaying wildcard answers -- RFC 4035 Sect. 5.3.4.
+func (v *dnssecValidator) verifyWildcard(ctx context.Context,
+	name string, labels int, resp *dns.Msg) (DNSSECStatus, error) {
+	denial, status, err := v.denial(ctx, name, resp)
+	if err != nil || status != DNSSECSecure {
+		return status, err
+	}
+	if !denial.provesWildcardExpansion(name, labels) {
+		return DNSSECBogus, errDNSSECBogus("cannot prove that %s does not exist", name)
+	}
+	return DNSSECSecure, nil
+}
+
+// verifyNoDS verifies that the response proves that the given zone is
+// an unsigned delegation, in which case the status is insecure.
+func (v *dnssecValidator) verifyNoDS(ctx context.Context,
+	zone string, resp *dns.Msg) (DNSSECStatus, error) {
+	// note: the proofs, if any, come from the zone containing the parent
+	denial, status, err := v.denial(ctx, dnssecParentName(zone), resp)
+	if err != nil || status != DNSSECSecure {
+		return status, err
+	}
+	if !denial.provesUnsignedDelegation(zone) {
+		return DNSSECBogus, errDNSSECBogus("cannot prove that %s is an unsigned delegation", zone)
+	}
+	return DNSSECInsecure, nil
+}
+
+// provesNoName returns whether the proofs show that the given
+// name does not exist -- RFC 4035 Sect. 5.4 and RFC 5155 Sect. 8.4.
+func (d *dnssecDenial) provesNoName(name string) bool {
+	d = d.withoutAncestorDelegations(name, dns.TypeNone)
+
+	// 1. NSEC: we need a proof that the name does not exist and
+	// a proof that the wildcard at the closest encloser does not
+	// exist, which may be the same NSEC RR
+	for _, nsec := range d.nsec {
+		if !dnssecNSECCovers(nsec, name) {
+			continue
+		}
+		wildcard := "*." + dnssecNSECClosestEncloser(nsec, name)
+		if d.nsecCovers(wildcard) {
+			return true
+		}
+	}
+
+	// 2. NSEC3: we need a closest encloser proof and a
+	// proof that the wildcard at the closest encloser does
+	// not exist -- RFC 5155 Sect. 8.4
+	closest, nextCloser := d.nsec3ClosestEncloser(name)
+	return nextCloser != "" && d.nsec3Covers(nextCloser) && d.nsec3Covers("*."+closest)
+}
+
+// provesNoData returns whether the proofs show that the given name
+// exists but does not own RRs of the given type -- RFC 4035 Sect. 5.4
+// and RFC 5155 Sects. 8.5, 8.6, and 8.7.
+func (d *dnssecDenial) provesNoData(name string, qtype uint16) bool {
+	d = d.withoutAncestorDelegations(name, qtype)
+
+	// 1. NSEC: we need either an NSEC RR for the name without the
+	// type, or a proof that the name is an empty non-terminal, or
+	// a proof that the name does not exist and an NSEC RR for the
+	// matching wildcard without the type
+	for _, nsec := range d.nsec {
+		if dns.CanonicalName(nsec.Hdr.Name) == name {
+			return !dnssecHasType(nsec.TypeBitMap, qtype, dns.TypeCNAME)
+		}
+		if !dnssecNSECCovers(nsec, name) {
+			continue
+		}
+		if dns.IsSubDomain(name, dns.CanonicalName(nsec.NextDomain)) {
+			return true // empty non-terminal
+		}
+		wildcard := "*." + dnssecNSECClosestEncloser(nsec, name)
+		for _, nsecWildcard := range d.nsec {
+			if dns.CanonicalName(nsecWildcard.Hdr.Name) == wildcard {
+				return !dnssecHasType(nsecWildcard.TypeBitMap, qtype, dns.TypeCNAME)
+			}
+		}
+	}
+
+	// 2. NSEC3: we need either an NSEC3 RR matching the name without
+	// the type, or, for DS, a proof that the name is covered by an opt-out
+	// NSEC3 RR, or a closest encloser proof along with an NSEC3 RR matching
+	// the wildcard at the closest encloser without the type
+	if nsec3 := d.nsec3Match(name); nsec3 != nil {
+		return !dnssecHasType(nsec3.TypeBitMap, qtype, dns.TypeCNAME)
+	}
+	closest, nextCloser := d.nsec3ClosestEncloser(name)
+	if nextCloser == "" {
+		return false
+	}
+	if qtype == dns.TypeDS && d.nsec3CoversOptOut(nextCloser) {
+		return true
+	}
+	if nsec3 := d.nsec3Match("*." + closest); nsec3 != nil && d.nsec3Covers(nextCloser) {
+		return !dnssecHasType(nsec3.TypeBitMap, qtype, dns.TypeCNAME)
+	}
+	return false
+}
+
+// provesWildcardExpansion returns whether the proofs show that the given
+// name, which matched a wildcard with the given number of labels, does
+// not exist -- RFC 4035 Sect. 5.3.4 and RFC 5155 Sect. 8.8.
+func (d *dnssecDenial) provesWildcardExpansion(name string, labels int) bool {
+	d = d.withoutAncestorDelegations(name, dns.TypeNone)
+
+	// 1. NSEC: we need an NSEC RR covering the name
+	if d.nsecCovers(name) {
+		return true
+	}
+
+	// 2. NSEC3: we need an NSEC3 RR covering the next closer
+	// name, which is the closest encloser plus one label
+	indexes := dns.Split(name)
+	if labels >= len(indexes) {
+		return false
+	}
+	nextCloser := name[indexes[len(indexes)-labels-1]:]
+	return d.nsec3Covers(nextCloser)
+}
+
+// provesUnsignedDelegation returns whether the proofs show that the
+// given name is a delegation without DS RRs -- RFC 4035 Sect. 5.2 and
+// RFC 5155 Sects. 8.6 and 8.9.
+func (d *dnssecDenial) provesUnsignedDelegation(name string) bool {
+	// 1. the delegation must have NS and must not have DS and SOA,
+	// since a SOA means that the child zone answered the query
+	for _, nsec := range d.nsec {
+		if dns.CanonicalName(nsec.Hdr.Name) == name {
+			return dnssecHasType(nsec.TypeBitMap, dns.TypeNS) &&
+				!dnssecHasType(nsec.TypeBitMap, dns.TypeDS, dns.TypeSOA)
+		}
+	}
+	if nsec3 := d.nsec3Match(name); nsec3 != nil {
+		return dnssecHasType(nsec3.TypeBitMap, dns.TypeNS) &&
+			!dnssecHasType(nsec3.TypeBitMap, dns.TypeDS, dns.TypeSOA)
+	}
+
+	// 2. with NSEC3, the delegation may also be covered by an
+	// opt-out NSEC3 RR, which implies it is unsigned
+	_, nextCloser := d.nsec3ClosestEncloser(name)
+	return nextCloser != "" && d.nsec3CoversOptOut(nextCloser)
+}
+
+// withoutAncestorDelegations returns the proofs excluding the NSEC and NSEC3
+// RRs owned by a delegation point (i.e., with NS but without SOA) or by a
+// DNAME at or above the given name. Such RRs come from the parent side of a
+// zone cut, so they cannot prove that RRs below the cut do not exist, with
+// the exception of the DS RRs of the delegation point -- RFC 6840 Sect. 4.1.
+func (d *dnssecDenial) withoutAncestorDelegations(name string, qtype uint16) *dnssecDenial {
+	unusable := func(owner string, bitmap []uint16) bool {
+		delegation := dnssecHasType(bitmap, dns.TypeNS) && !dnssecHasType(bitmap, dns.TypeSOA)
+		if owner == name {
+			return delegation && qtype != dns.TypeDS
+		}
+		return (delegation || dnssecHasType(bitmap, dns.TypeDNAME)) && dns.IsSubDomain(owner, name)
+	}
+	filtered := &dnssecDenial{}
+	for _, nsec := range d.nsec {
+		if !unusable(dns.CanonicalName(nsec.Hdr.Name), nsec.TypeBitMap) {
+			filtered.nsec = append(filtered.nsec, nsec)
+		}
+	}
+	for _, nsec3 := range d.nsec3 {
+		// the owner is hashed, so we look for the name or ancestor it matches
+		owner := ""
+		for candidate := name; owner == ""; candidate = dnssecParentName(candidate) {
+			if nsec3.Match(candidate) {
+				owner = candidate
+			}
+			if candidate == "." {
+				break
+			}
+		}
+		if owner == "" || !unusable(owner, nsec3.TypeBitMap) {
+			filtered.nsec3 = append(filtered.nsec3, nsec3)
+		}
+	}
+	return filtered
+}
+
+// dnssecHasType returns whether the given NSEC or
+// NSEC3 type bitmap contains any of the given types.
+func dnssecHasType(bitmap []uint16, types ...uint16) bool {
+	for _, rrtype := range types {
+		if slices.Contains(bitmap, rrtype) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCovers returns whether an NSEC RR covers the given name.
+func (d *dnssecDenial) nsecCovers(name string) bool {
+	return slices.ContainsFunc(d.nsec, func(nsec *dns.NSEC) bool {
+		return dnssecNSECCovers(nsec, name)
+	})
+}
+
+// dnssecNSECCovers returns whether the given NSEC RR proves that the given
+// name does not exist, i.e., the name sorts after the owner and before
+// the next name, taking into account that the last NSEC RR of the zone
+// points back to the apex of the zone -- RFC 4034 Sect. 4.1.1.
+func dnssecNSECCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if dnssecCompareNames(owner, name) >= 0 {
+		return false
+	}
+	if dnssecCompareNames(owner, next) >= 0 {
+		return true // last NSEC RR of the zone
+	}
+	return dnssecCompareNames(name, next) < 0
+}
+
+// dnssecNSECClosestEncloser returns the closest encloser of a name
+// covered by the given NSEC RR, i.e., the longest common ancestor
+// of the name and either the owner or the next name.
+func dnssecNSECClosestEncloser(nsec *dns.NSEC, name string) string {
+	closest := "."
+	for _, other := range []string{nsec.Hdr.Name, nsec.NextDomain} {
+		common := dns.CompareDomainName(name, other)
+		if common > dns.CountLabel(closest) {
+			indexes := dns.Split(name)
+			closest = name[indexes[len(indexes)-common]:]
+		}
+	}
+	return closest
+}
+
+// dnssecCompareNames compares two domain names using the canonical
+// DNS name order -- RFC 4034 Sect. 6.1. We compare the labels from the
+// rightmost one as case insensitive sequences of unescaped octets.
+func dnssecCompareNames(a, b string) int {
+	la, lb := dnssecWireLabels(a), dnssecWireLabels(b)
+	for idx := 1; idx <= len(la) && idx <= len(lb); idx++ {
+		if c := bytes.Compare(la[len(la)-idx], lb[len(lb)-idx]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// dnssecWireLabels returns the lowercase wire-format labels of a name.
+func dnssecWireLabels(name string) [][]byte {
+	wire := make([]byte, 256)
+	off, err := dns.PackDomainName(dns.CanonicalName(name), wire, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	var labels [][]byte
+	for idx := 0; idx < off && wire[idx] != 0; idx += int(wire[idx]) + 1 {
+		labels = append(labels, wire[idx+1:idx+1+int(wire[idx])])
+	}
+	return labels
+}
+
+// nsec3Match returns the NSEC3 RR matching the given name, if any.
+func (d *dnssecDenial) nsec3Match(name string) *dns.NSEC3 {
+	for _, nsec3 := range d.nsec3 {
+		if nsec3.Match(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// nsec3Covers returns whether an NSEC3 RR covers the given name.
+func (d *dnssecDenial) nsec3Covers(name string) bool {
+	return slices.ContainsFunc(d.nsec3, func(nsec3 *dns.NSEC3) bool {
+		return nsec3.Cover(name)
+	})
+}
+
+// nsec3CoversOptOut returns whether an NSEC3 RR with
+// the opt-out flag set covers the given name.
+func (d *dnssecDenial) nsec3CoversOptOut(name string) bool {
+	return slices.ContainsFunc(d.nsec3, func(nsec3 *dns.NSEC3) bool {
+		return nsec3.Flags&1 != 0 && nsec3.Cover(name)
+	})
+}
+
+// nsec3ClosestEncloser returns the closest encloser of the given name,
+// i.e., the longest existing ancestor proved by a matching NSEC3 RR, and
+// the next closer name, i.e., the closest encloser plus one label, which
+// is empty when the name itself exists -- RFC 5155 Sect. 8.3.
+func (d *dnssecDenial) nsec3ClosestEncloser(name string) (string, string) {
+	nextCloser := ""
+	for candidate := name; ; candidate = dnssecParentName(candidate) {
+		if d.nsec3Match(candidate) != nil {
+			return candidate, nextCloser
+		}
+		if candidate == "." {
+			return "", ""
+		}
+		nextCloser = candidate
+	}
+}
@@ -0,0 +1,978 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// dnssecTestTime is the time at which we validate the test signatures.
+var dnssecTestTime = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// dnssecTestZone is a zone served by [*dnssecTestServer].
+type dnssecTestZone struct {
+	// key is the zone key or nil when the zone is unsigned.
+	key *dns.DNSKEY
+
+	// name is the zone name.
+	name string
+
+	// nsec3 indicates whether to use NSEC3 rather than NSEC.
+	nsec3 bool
+
+	// rrs contains the zone RRs.
+	rrs []dns.RR
+
+	// signer is the private zone key.
+	signer crypto.Signer
+}
+
+// dnssecTestServer emulates a recursive resolver that serves a fake
+// hierarchy of zones, returning signatures when the query has the DO bit.
+type dnssecTestServer struct {
+	// modify optionally modifies the responses.
+	modify func(query, resp *dns.Msg)
+
+	// queries contains the queries we received.
+	queries []*dns.Msg
+
+	// zones contains the zones by name.
+	zones map[string]*dnssecTestZone
+}
+
+// newDNSSECTestServer creates the following hierarchy:
+//
+//   - "." is signed and uses NSEC;
+//   - "com." is signed and uses NSEC;
+//   - "example.com." is signed and uses NSEC;
+//   - "insecure.com." is an unsigned delegation from "com.";
+//   - "net." is signed and uses NSEC3;
+//   - "example.net." is signed and uses NSEC3;
+//   - "insecure.net." is an unsigned delegation from "net.".
+func newDNSSECTestServer(t *testing.T) *dnssecTestServer {
+	srv := &dnssecTestServer{zones: map[string]*dnssecTestZone{}}
+	srv.addZone(t, "example.com.", true, false,
+		"example.com. 300 IN TXT \"hello\"",
+		"www.example.com. 300 IN A 192.0.2.1",
+		"alias.example.com. 300 IN CNAME www.example.com.",
+		"dangling.example.com. 300 IN CNAME nx.example.com.",
+		"*.wild.example.com. 300 IN A 192.0.2.2",
+	)
+	srv.addZone(t, "insecure.com.", false, false,
+		"www.insecure.com. 300 IN A 192.0.2.3",
+	)
+	srv.addZone(t, "com.", true, false)
+	srv.delegate(t, "com.", "example.com.")
+	srv.delegate(t, "com.", "insecure.com.")
+	srv.addZone(t, "example.net.", true, true,
+		"www.example.net. 300 IN A 192.0.2.4",
+		"*.wild.example.net. 300 IN A 192.0.2.5",
+	)
+	srv.addZone(t, "insecure.net.", false, false,
+		"www.insecure.net. 300 IN A 192.0.2.6",
+	)
+	srv.addZone(t, "net.", true, true)
+	srv.delegate(t, "net.", "example.net.")
+	srv.delegate(t, "net.", "insecure.net.")
+	srv.addZone(t, ".", true, false)
+	srv.delegate(t, ".", "com.")
+	srv.delegate(t, ".", "net.")
+	return srv
+}
+
+// dnssecTestRR parses the given RR.
+func dnssecTestRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// addZone adds a zone containing the given RRs along
+// with its SOA, NS, and, when signed, DNSKEY RRs.
+func (srv *dnssecTestServer) addZone(t *testing.T, name string, signed, nsec3 bool, rrs ...string) {
+	zone := &dnssecTestZone{name: name, nsec3: nsec3}
+	suffix := strings.TrimSuffix(name, ".") + "."
+	zone.rrs = append(zone.rrs,
+		dnssecTestRR(t, name+" 300 IN SOA ns"+suffix+" hostmaster"+suffix+" 1 3600 600 86400 300"),
+		dnssecTestRR(t, name+" 300 IN NS ns"+suffix),
+	)
+	if signed {
+		zone.key = &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+			Flags:     dns.ZONE | dns.SEP,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := zone.key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zone.signer = priv.(crypto.Signer)
+		zone.rrs = append(zone.rrs, zone.key)
+	}
+	for _, rr := range rrs {
+		zone.rrs = append(zone.rrs, dnssecTestRR(t, rr))
+	}
+	srv.zones[name] = zone
+}
+
+// delegate adds the NS and, if the child is signed, the DS RRs of the child zone to the parent zone.
+func (srv *dnssecTestServer) delegate(t *testing.T, parent, child string) {
+	zone := srv.zones[parent]
+	zone.rrs = append(zone.rrs, dnssecTestRR(t, child+" 300 IN NS ns."+child))
+	if key := srv.zones[child].key; key != nil {
+		zone.rrs = append(zone.rrs, key.ToDS(dns.SHA256))
+	}
+}
+
+// trustAnchors returns the DS RRs of the root zone key.
+func (srv *dnssecTestServer) trustAnchors() []*dns.DS {
+	return []*dns.DS{srv.zones["."].key.ToDS(dns.SHA256)}
+}
+
+// Query implements [ResolverTransport].
+func (srv *dnssecTestServer) Query(ctx context.Context, addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+	srv.queries = append(srv.queries, query)
+	q0 := query.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.RecursionAvailable = true
+	opt := query.IsEdns0()
+	srv.resolve(resp, dns.CanonicalName(q0.Name), q0.Qtype, opt != nil && opt.Do())
+	if srv.modify != nil {
+		srv.modify(query, resp)
+	}
+	return resp, nil
+}
+
+// zoneFor returns the zone containing the given name and type, which, for
+// DS RRs, is the parent of the zone whose apex is the given name.
+func (srv *dnssecTestServer) zoneFor(name string, qtype uint16) *dnssecTestZone {
+	if qtype == dns.TypeDS && name != "." && srv.zones[name] != nil {
+		name = dnssecParentName(name)
+	}
+	for ; ; name = dnssecParentName(name) {
+		if zone := srv.zones[name]; zone != nil {
+			return zone
+		}
+	}
+}
+
+// resolve fills the response for the given name and type.
+func (srv *dnssecTestServer) resolve(resp *dns.Msg, name string, qtype uint16, do bool) {
+	zone := srv.zoneFor(name, qtype)
+
+	// 1. handle the case where we have RRs of the given type
+	if rrs := zone.lookup(name, qtype); len(rrs) > 0 {
+		resp.Answer = append(resp.Answer, zone.sign(rrs, do)...)
+		return
+	}
+
+	// 2. follow CNAMEs
+	if rrs := zone.lookup(name, dns.TypeCNAME); len(rrs) > 0 && qtype != dns.TypeCNAME {
+		resp.Answer = append(resp.Answer, zone.sign(rrs, do)...)
+		srv.resolve(resp, dns.CanonicalName(rrs[0].(*dns.CNAME).Target), qtype, do)
+		return
+	}
+
+	// 3. handle NODATA
+	soa := zone.sign(zone.lookup(zone.name, dns.TypeSOA), do)
+	if zone.exists(name) {
+		resp.Ns = append(append(resp.Ns, soa...), zone.proofNoData(name, do)...)
+		return
+	}
+
+	// 4. handle wildcard expansion
+	closest := zone.closestEncloser(name)
+	if rrs := zone.lookup("*."+closest, qtype); len(rrs) > 0 {
+		for _, rr := range zone.sign(rrs, do) {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			resp.Answer = append(resp.Answer, rr)
+		}
+		resp.Ns = append(resp.Ns, zone.proofNoName(name, false, do)...)
+		return
+	}
+
+	// 5. handle NXDOMAIN
+	resp.Rcode = dns.RcodeNameError
+	resp.Ns = append(append(resp.Ns, soa...), zone.proofNoName(name, true, do)...)
+}
+
+// lookup returns the RRs with the given name and type.
+func (zone *dnssecTestZone) lookup(name string, rrtype uint16) (rrs []dns.RR) {
+	for _, rr := range zone.rrs {
+		if dns.CanonicalName(rr.Header().Name) == name && rr.Header().Rrtype == rrtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return
+}
+
+// exists returns whether the name owns RRs or is an empty non-terminal.
+func (zone *dnssecTestZone) exists(name string) bool {
+	return slices.ContainsFunc(zone.rrs, func(rr dns.RR) bool {
+		return dns.IsSubDomain(name, dns.CanonicalName(rr.Header().Name))
+	})
+}
+
+// closestEncloser returns the closest existing ancestor of the name.
+func (zone *dnssecTestZone) closestEncloser(name string) string {
+	for !zone.exists(name) {
+		name = dnssecParentName(name)
+	}
+	return name
+}
+
+// sign returns the RRs followed by their signature when the zone is signed.
+func (zone *dnssecTestZone) sign(rrs []dns.RR, do bool) []dns.RR {
+	if !do || zone.key == nil || len(rrs) <= 0 {
+		return rrs
+	}
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrs[0].Header().Ttl},
+		Algorithm:  zone.key.Algorithm,
+		Expiration: uint32(dnssecTestTime.Add(24 * time.Hour).Unix()),
+		Inception:  uint32(dnssecTestTime.Add(-time.Hour).Unix()),
+		KeyTag:     zone.key.KeyTag(),
+		SignerName: zone.name,
+	}
+	if err := sig.Sign(zone.signer, rrs); err != nil {
+		panic(err)
+	}
+	return append(slices.Clone(rrs), sig)
+}
+
+// names returns the sorted owner names, including, with
+// NSEC3, the empty non-terminals -- RFC 5155 Sect. 7.1.
+func (zone *dnssecTestZone) names() []string {
+	var names []string
+	for _, rr := range zone.rrs {
+		for name := dns.CanonicalName(rr.Header().Name); !slices.Contains(names, name); {
+			names = append(names, name)
+			if !zone.nsec3 || name == zone.name {
+				break
+			}
+			name = dnssecParentName(name)
+		}
+	}
+	slices.SortFunc(names, dnssecCompareNames)
+	return names
+}
+
+// types returns the types owned by the given name including RRSIG
+// and NSEC or NSEC3 when the name owns at least a type.
+func (zone *dnssecTestZone) types(name string) []uint16 {
+	var types []uint16
+	for _, rr := range zone.rrs {
+		if dns.CanonicalName(rr.Header().Name) == name && !slices.Contains(types, rr.Header().Rrtype) {
+			types = append(types, rr.Header().Rrtype)
+		}
+	}
+	if len(types) > 0 {
+		types = append(types, dns.TypeRRSIG)
+		if !zone.nsec3 {
+			types = append(types, dns.TypeNSEC)
+		}
+	}
+	slices.Sort(types)
+	return types
+}
+
+// chain returns the NSEC or NSEC3 chain of the zone.
+func (zone *dnssecTestZone) chain() []dns.RR {
+	names := zone.names()
+	var chain []dns.RR
+	if !zone.nsec3 {
+		for idx, name := range names {
+			chain = append(chain, &dns.NSEC{
+				Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+				NextDomain: names[(idx+1)%len(names)],
+				TypeBitMap: zone.types(name),
+			})
+		}
+		return chain
+	}
+	var hashes []string
+	types := map[string][]uint16{}
+	for _, name := range names {
+		hash := dns.HashName(name, dns.SHA1, 0, "")
+		hashes = append(hashes, hash)
+		types[hash] = zone.types(name)
+	}
+	slices.Sort(hashes)
+	for idx, hash := range hashes {
+		chain = append(chain, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: hash + "." + zone.name, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			HashLength: 20,
+			NextDomain: hashes[(idx+1)%len(hashes)],
+			TypeBitMap: types[hash],
+		})
+	}
+	return chain
+}
+
+// matching returns the signed NSEC or NSEC3 RR matching the name.
+func (zone *dnssecTestZone) matching(name string, do bool) []dns.RR {
+	for _, rr := range zone.chain() {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if rr.Hdr.Name == name {
+				return zone.sign([]dns.RR{rr}, do)
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) {
+				return zone.sign([]dns.RR{rr}, do)
+			}
+		}
+	}
+	return nil
+}
+
+// covering returns the signed NSEC or NSEC3 RR covering the name.
+func (zone *dnssecTestZone) covering(name string, do bool) []dns.RR {
+	for _, rr := range zone.chain() {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if dnssecNSECCovers(rr, name) {
+				return zone.sign([]dns.RR{rr}, do)
+			}
+		case *dns.NSEC3:
+			if rr.Cover(name) {
+				return zone.sign([]dns.RR{rr}, do)
+			}
+		}
+	}
+	return nil
+}
+
+// proofNoData returns the proof that the name does not own the type.
+func (zone *dnssecTestZone) proofNoData(name string, do bool) []dns.RR {
+	if !do || zone.key == nil {
+		return nil
+	}
+	if rrs := zone.matching(name, do); len(rrs) > 0 {
+		return rrs
+	}
+	return zone.covering(name, do) // empty non-terminal with NSEC
+}
+
+// proofNoName returns the proof that the name does not exist, including,
+// when requested, the proof that the wildcard does not exist.
+func (zone *dnssecTestZone) proofNoName(name string, wildcard, do bool) []dns.RR {
+	if !do || zone.key == nil {
+		return nil
+	}
+	closest := zone.closestEncloser(name)
+	var proofs []dns.RR
+	if !zone.nsec3 {
+		proofs = append(proofs, zone.covering(name, do)...)
+	} else {
+		indexes := dns.Split(name)
+		nextCloser := name[indexes[len(indexes)-dns.CountLabel(closest)-1]:]
+		if wildcard {
+			proofs = append(proofs, zone.matching(closest, do)...)
+		}
+		proofs = append(proofs, zone.covering(nextCloser, do)...)
+	}
+	if wildcard {
+		for _, rr := range zone.covering("*."+closest, do) {
+			if !slices.ContainsFunc(proofs, func(other dns.RR) bool { return dns.IsDuplicate(rr, other) }) {
+				proofs = append(proofs, rr)
+			}
+		}
+	}
+	return proofs
+}
+
+// dnssecTestStripSigs removes the RRSIGs from the given section.
+func dnssecTestStripSigs(rrs []dns.RR) []dns.RR {
+	return slices.DeleteFunc(rrs, func(rr dns.RR) bool {
+		return rr.Header().Rrtype == dns.TypeRRSIG
+	})
+}
+
+// dnssecTestIsQuery returns whether the query is for the given name and type.
+func dnssecTestIsQuery(query *dns.Msg, name string, qtype uint16) bool {
+	return query.Question[0].Name == name && query.Question[0].Qtype == qtype
+}
+
+func TestResolver_LookupDNSSEC(t *testing.T) {
+	tests := []struct {
+		name         string
+		domain       string
+		qtype        uint16
+		modify       func(query, resp *dns.Msg)
+		config       func(srv *dnssecTestServer) *DNSSECConfig
+		expectErr    error
+		expectStatus DNSSECStatus
+		expectAddrs  []string
+	}{{
+		name:         "secure answer",
+		domain:       "www.example.com",
+		qtype:        dns.TypeA,
+		expectStatus: DNSSECSecure,
+		expectAddrs:  []string{"192.0.2.1"},
+	}, {
+		name:         "secure CNAME",
+		domain:       "alias.example.com",
+		qtype:        dns.TypeA,
+		expectStatus: DNSSECSecure,
+		expectAddrs:  []string{"192.0.2.1"},
+	}, {
+		name:         "secure NXDOMAIN with NSEC",
+		domain:       "nx.example.com",
+		qtype:        dns.TypeA,
+		expectErr:    ErrNoName,
+		expectStatus: DNSSECSecure,
+	}, {
+		name:         "secure CNAME to NXDOMAIN",
+		domain:       "dangling.example.com",
+		qtype:        dns.TypeA,
+		expectErr:    ErrNoName,
+		expectStatus: DNSSECSecure,
+	}, {
+		name:         "secure NODATA with NSEC",
+		domain:       "www.example.com",
+		qtype:        dns.TypeAAAA,
+		expectErr:    ErrNoData,
+		expectStatus: DNSSECSecure,
+	}, {
+		name:         "secure NODATA for an empty non-terminal with NSEC",
+		domain:       "wild.example.com",
+		qtype:        dns.TypeA,
+		expectErr:    ErrNoData,
+		expectStatus: DNSSECSecure,
+	}, {
+		name:         "secure wildcard with NSEC",
+		domain:       "foo.wild.example.com",
+		qtype:        dns.TypeA,
+		expectStatus: DNSSECSecure,
+		expectAddrs:  []string{"192.0.2.2"},
+	}, {
+		name:         "secure answer with NSEC3 parent",
+		domain:       "www.example.net",
+		qtype:        dns.TypeA,
+		expectStatus: DNSSECSecure,
+		expectAddrs:  []string{"192.0.2.4"},
+	}, {
+		name:         "secure NXDOMAIN with NSEC3",
+		domain:       "nx.example.net",
+		qtype:        dns.TypeA,
+		expectErr:    ErrNoName,
+		expectStatus: DNSSECSecure,
+	}, {
+		name:         "secure NODATA with NSEC3",
+		domain:       "www.example.net",
+		qtype:        dns.TypeAAAA,
+		expectErr:    ErrNoData,
+		expectStatus: DNSSECSecure,
+	}, {
+		name:         "secure wildcard with NSEC3",
+		domain:       "foo.wild.example.net",
+		qtype:        dns.TypeA,
+		expectStatus: DNSSECSecure,
+		expectAddrs:  []string{"192.0.2.5"},
+	}, {
+		name:         "insecure delegation with NSEC",
+		domain:       "www.insecure.com",
+		qtype:        dns.TypeA,
+		expectStatus: DNSSECInsecure,
+		expectAddrs:  []string{"192.0.2.3"},
+	}, {
+		name:         "insecure delegation with NSEC3",
+		domain:       "www.insecure.net",
+		qtype:        dns.TypeA,
+		expectStatus: DNSSECInsecure,
+		expectAddrs:  []string{"192.0.2.6"},
+	}, {
+		name:         "insecure NXDOMAIN",
+		domain:       "nx.insecure.com",
+		qtype:        dns.TypeA,
+		expectErr:    ErrNoName,
+		expectStatus: DNSSECInsecure,
+	}, {
+		name:   "tampered answer",
+		domain: "www.example.com",
+		qtype:  dns.TypeA,
+		modify: func(query, resp *dns.Msg) {
+			if dnssecTestIsQuery(query, "www.example.com.", dns.TypeA) {
+				resp.Answer[0] = &dns.A{Hdr: resp.Answer[0].(*dns.A).Hdr, A: []byte{10, 0, 0, 1}}
+			}
+		},
+		expectErr:    ErrDNSSECBogus,
+		expectStatus: DNSSECBogus,
+	}, {
+		name:   "stripped signatures",
+		domain: "www.example.com",
+		qtype:  dns.TypeA,
+		modify: func(query, resp *dns.Msg) {
+			resp.Answer = dnssecTestStripSigs(resp.Answer)
+		},
+		expectErr:    ErrDNSSECBogus,
+		expectStatus: DNSSECBogus,
+	}, {
+		name:   "forged NXDOMAIN",
+		domain: "www.example.com",
+		qtype:  dns.TypeA,
+		modify: func(query, resp *dns.Msg) {
+			if dnssecTestIsQuery(query, "www.example.com.", dns.TypeA) {
+				resp.Rcode = dns.RcodeNameError
+				resp.Answer = nil
+			}
+		},
+		expectErr:    ErrDNSSECBogus,
+		expectStatus: DNSSECBogus,
+	}, {
+		name:   "NXDOMAIN without proofs",
+		domain: "nx.example.com",
+		qtype:  dns.TypeA,
+		modify: func(query, resp *dns.Msg) {
+			resp.Ns = slices.DeleteFunc(resp.Ns, func(rr dns.RR) bool {
+				_, ok := rr.(*dns.NSEC)
+				return ok
+			})
+		},
+		expectErr:    ErrDNSSECBogus,
+		expectStatus: DNSSECBogus,
+	}, {
+		name:   "wildcard without proofs",
+		domain: "foo.wild.example.net",
+		qtype:  dns.TypeA,
+		modify: func(query, resp *dns.Msg) {
+			if dnssecTestIsQuery(query, "foo.wild.example.net.", dns.TypeA) {
+				resp.Ns = nil
+			}
+		},
+		expectErr:    ErrDNSSECBogus,
+		expectStatus: DNSSECBogus,
+	}, {
+		name:   "forged unsigned delegation",
+		domain: "www.example.com",
+		qtype:  dns.TypeA,
+		modify: func(query, resp *dns.Msg) {
+			switch {
+			case dnssecTestIsQuery(query, "www.example.com.", dns.TypeA):
+				resp.Answer = dnssecTestStripSigs(resp.Answer)
+			case dnssecTestIsQuery(query, "example.com.", dns.TypeDS):
+				resp.Answer = nil
+			}
+		},
+		expectErr:    ErrDNSSECBogus,
+		expectStatus: DNSSECBogus,
+	}, {
+		name:   "expired signatures",
+		domain: "www.example.com",
+		qtype:  dns.TypeA,
+		config: func(srv *dnssecTestServer) *DNSSECConfig {
+			return &DNSSECConfig{
+				TrustAnchors: srv.trustAnchors(),
+				TimeNow:      func() time.Time { return dnssecTestTime.Add(48 * time.Hour) },
+			}
+		},
+		expectErr:    ErrDNSSECBogus,
+		expectStatus: DNSSECBogus,
+	}, {
+		name:   "wrong trust anchor",
+		domain: "www.example.com",
+		qtype:  dns.TypeA,
+		config: func(srv *dnssecTestServer) *DNSSECConfig {
+			return &DNSSECConfig{TimeNow: func() time.Time { return dnssecTestTime }}
+		},
+		expectErr:    ErrDNSSECBogus,
+		expectStatus: DNSSECBogus,
+	}, {
+		name:   "trust anchor for the zone",
+		domain: "www.example.com",
+		qtype:  dns.TypeA,
+		config: func(srv *dnssecTestServer) *DNSSECConfig {
+			return &DNSSECConfig{
+				TrustAnchors: []*dns.DS{srv.zones["example.com."].key.ToDS(dns.SHA256)},
+				TimeNow:      func() time.Time { return dnssecTestTime },
+			}
+		},
+		expectStatus: DNSSECSecure,
+		expectAddrs:  []string{"192.0.2.1"},
+	}, {
+		name:   "unsupported trust anchor",
+		domain: "www.example.com",
+		qtype:  dns.TypeA,
+		config: func(srv *dnssecTestServer) *DNSSECConfig {
+			ds := srv.trustAnchors()[0]
+			ds.DigestType = 99
+			return &DNSSECConfig{
+				TrustAnchors: []*dns.DS{ds},
+				TimeNow:      func() time.Time { return dnssecTestTime },
+			}
+		},
+		expectStatus: DNSSECInsecure,
+		expectAddrs:  []string{"192.0.2.1"},
+	}, {
+		name:   "no trust anchor covering the name",
+		domain: "www.example.com",
+		qtype:  dns.TypeA,
+		config: func(srv *dnssecTestServer) *DNSSECConfig {
+			return &DNSSECConfig{
+				TrustAnchors: []*dns.DS{srv.zones["example.net."].key.ToDS(dns.SHA256)},
+				TimeNow:      func() time.Time { return dnssecTestTime },
+			}
+		},
+		expectStatus: DNSSECIndeterminate,
+		expectAddrs:  []string{"192.0.2.1"},
+	}, {
+		name:   "validation disabled",
+		domain: "www.example.com",
+		qtype:  dns.TypeA,
+		config: func(srv *dnssecTestServer) *DNSSECConfig {
+			return nil
+		},
+		expectStatus: DNSSECIndeterminate,
+		expectAddrs:  []string{"192.0.2.1"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newDNSSECTestServer(t)
+			srv.modify = tt.modify
+			config := &DNSSECConfig{
+				TrustAnchors: srv.trustAnchors(),
+				TimeNow:      func() time.Time { return dnssecTestTime },
+			}
+			if tt.config != nil {
+				config = tt.config(srv)
+			}
+			resolverConfig := NewConfig()
+			resolverConfig.SetAttempts(1)
+			resolverConfig.AddServer(NewServerAddr(ProtocolUDP, "192.0.2.53:53"))
+			reso := &Resolver{Config: resolverConfig, DNSSEC: config, Transport: srv}
+
+			rrs, status, err := reso.LookupDNSSEC(context.Background(), tt.domain, tt.qtype)
+			assert.Truef(t, errors.Is(err, tt.expectErr), "expected %v, got %v", tt.expectErr, err)
+			assert.Equal(t, tt.expectStatus, status)
+			if tt.expectAddrs != nil {
+				addrs, _, err := DecodeLookupA(rrs)
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expectAddrs, addrs)
+			}
+
+			// make sure we only set the DO and CD bits when validating
+			for _, query := range srv.queries {
+				opt := query.IsEdns0()
+				assert.Equal(t, config != nil, query.CheckingDisabled)
+				assert.Equal(t, config != nil, opt != nil && opt.Do())
+			}
+		})
+	}
+}
+
+func TestResolver_LookupA_DNSSECBogus(t *testing.T) {
+	srv := newDNSSECTestServer(t)
+	srv.modify = func(query, resp *dns.Msg) {
+		resp.Answer = dnssecTestStripSigs(resp.Answer)
+	}
+	reso := &Resolver{
+		DNSSEC: &DNSSECConfig{
+			TrustAnchors: srv.trustAnchors(),
+			TimeNow:      func() time.Time { return dnssecTestTime },
+		},
+		Transport: srv,
+	}
+	addrs, err := reso.LookupA(context.Background(), "www.example.com")
+	assert.ErrorIs(t, err, ErrDNSSECBogus)
+	assert.Nil(t, addrs)
+}
+
+func TestResolver_LookupDNSSEC_AncestorDelegation(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain string
+		parent string
+		rcode  int
+	}{{
+		name:   "NODATA using the NSEC RR of the delegation",
+		domain: "example.com.",
+		parent: "com.",
+		rcode:  dns.RcodeSuccess,
+	}, {
+		name:   "NXDOMAIN using the NSEC RR of the delegation",
+		domain: "nx.example.com.",
+		parent: "com.",
+		rcode:  dns.RcodeNameError,
+	}, {
+		name:   "NODATA using the NSEC3 RR of the delegation",
+		domain: "example.net.",
+		parent: "net.",
+		rcode:  dns.RcodeSuccess,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// replay the signed proofs of the parent zone, which
+			// come from the parent side of the zone cut
+			srv := newDNSSECTestServer(t)
+			parent := srv.zones[tt.parent]
+			srv.modify = func(query, resp *dns.Msg) {
+				if !dnssecTestIsQuery(query, tt.domain, dns.TypeA) {
+					return
+				}
+				resp.Rcode, resp.Answer = tt.rcode, nil
+				resp.Ns = parent.sign(parent.lookup(parent.name, dns.TypeSOA), true)
+				if tt.rcode == dns.RcodeNameError {
+					resp.Ns = append(resp.Ns, parent.proofNoName(tt.domain, true, true)...)
+					return
+				}
+				resp.Ns = append(resp.Ns, parent.matching(tt.domain, true)...)
+			}
+			reso := &Resolver{
+				DNSSEC: &DNSSECConfig{
+					TrustAnchors: srv.trustAnchors(),
+					TimeNow:      func() time.Time { return dnssecTestTime },
+				},
+				Transport: srv,
+			}
+
+			_, status, err := reso.LookupDNSSEC(context.Background(), tt.domain, dns.TypeA)
+			assert.ErrorIs(t, err, ErrDNSSECBogus)
+			assert.Equal(t, DNSSECBogus, status)
+		})
+	}
+}
+
+func TestResolver_LookupDNSSEC_TooManyQueries(t *testing.T) {
+	srv := newDNSSECTestServer(t)
+	reso := &Resolver{
+		DNSSEC: &DNSSECConfig{
+			TrustAnchors: srv.trustAnchors(),
+			TimeNow:      func() time.Time { return dnssecTestTime },
+		},
+		Transport: srv,
+	}
+	server := newResolverConfigServer(NewServerAddr(ProtocolUDP, "192.0.2.53:53"))
+	validator := reso.newDNSSECValidator(server)
+	validator.queries = dnssecMaxQueries
+	resp, err := srv.Query(context.Background(), server.address, &dns.Msg{
+		Question: []dns.Question{{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := validator.validate(context.Background(), resp.Question[0], resp)
+	assert.ErrorIs(t, err, errDNSSECTooManyQueries)
+	assert.Equal(t, DNSSECIndeterminate, status)
+}
+
+func TestDNSSECStatus_String(t *testing.T) {
+	assert.Equal(t, "indeterminate", DNSSECIndeterminate.String())
+	assert.Equal(t, "secure", DNSSECSecure.String())
+	assert.Equal(t, "insecure", DNSSECInsecure.String())
+	assert.Equal(t, "bogus", DNSSECBogus.String())
+}
+
+func TestDefaultDNSSECTrustAnchors(t *testing.T) {
+	var tags []uint16
+	for _, ds := range DefaultDNSSECTrustAnchors() {
+		assert.Equal(t, ".", ds.Hdr.Name)
+		assert.True(t, dnssecSupportedDS(ds))
+		tags = append(tags, ds.KeyTag)
+	}
+	assert.Equal(t, []uint16{20326, 38696}, tags)
+	assert.Equal(t, DefaultDNSSECTrustAnchors(), (&DNSSECConfig{}).trustAnchors())
+}
+
+func Test_queryOptionDNSSEC(t *testing.T) {
+	t.Run("without OPT RR", func(t *testing.T) {
+		query, err := NewQuery("example.com", dns.TypeA, queryOptionDNSSEC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, query.CheckingDisabled)
+		if opt := query.IsEdns0(); assert.NotNil(t, opt) {
+			assert.True(t, opt.Do())
+			assert.Equal(t, uint16(EDNS0SuggestedMaxResponseSizeUDP), opt.UDPSize())
+		}
+	})
+
+	t.Run("with OPT RR", func(t *testing.T) {
+		query, err := NewQuery("example.com", dns.TypeA,
+			QueryOptionEDNS0(EDNS0SuggestedMaxResponseSizeOtherwise, 0), queryOptionDNSSEC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, query.CheckingDisabled)
+		assert.Len(t, query.Extra, 1)
+		if opt := query.IsEdns0(); assert.NotNil(t, opt) {
+			assert.True(t, opt.Do())
+			assert.Equal(t, uint16(EDNS0SuggestedMaxResponseSizeOtherwise), opt.UDPSize())
+		}
+	})
+
+	t.Run("followed by QueryOptionEDNS0", func(t *testing.T) {
+		query, err := NewQuery("example.com", dns.TypeA,
+			queryOptionDNSSEC, QueryOptionEDNS0(EDNS0SuggestedMaxResponseSizeOtherwise, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, query.CheckingDisabled)
+		assert.Len(t, query.Extra, 1)
+		if opt := query.IsEdns0(); assert.NotNil(t, opt) {
+			assert.True(t, opt.Do())
+			assert.Equal(t, uint16(EDNS0SuggestedMaxResponseSizeOtherwise), opt.UDPSize())
+		}
+	})
+}
+
+func TestResolver_LookupDNSSECWithTSIG(t *testing.T) {
+	// the server verifies the query MAC and signs the response
+	key := &TSIGKey{Name: "key.example.com.", Secret: "c2VjcmV0LWtleS1mb3ItdGVzdGluZy1wdXJwb3Nlcw=="}
+	srv := newDNSSECTestServer(t)
+	transport := &MockResolverTransport{
+		MockQuery: func(ctx context.Context, addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+			rawQuery, err := query.Pack()
+			if err != nil {
+				return nil, err
+			}
+			if err := dns.TsigVerifyWithProvider(rawQuery, &tsigProvider{key: key}, "", false); err != nil {
+				return nil, err
+			}
+			resp, err := srv.Query(ctx, addr, query)
+			if err != nil {
+				return nil, err
+			}
+			return resp, key.sign(resp, time.Now())
+		},
+	}
+
+	resolverConfig := NewConfig()
+	resolverConfig.SetAttempts(1)
+	resolverConfig.AddServer(NewServerAddr(ProtocolUDP, "192.0.2.53:53"),
+		ServerOptionQueryOptions(
+			QueryOptionEDNS0(EDNS0SuggestedMaxResponseSizeUDP, 0),
+			QueryOptionTSIG(key),
+		))
+	reso := &Resolver{
+		Config: resolverConfig,
+		DNSSEC: &DNSSECConfig{
+			TrustAnchors: srv.trustAnchors(),
+			TimeNow:      func() time.Time { return dnssecTestTime },
+		},
+		Transport: transport,
+	}
+
+	rrs, status, err := reso.LookupDNSSEC(context.Background(), "www.example.com", dns.TypeA)
+	assert.NoError(t, err)
+	assert.Equal(t, DNSSECSecure, status)
+	assert.Len(t, rrs, 2) // the A RR and its RRSIG
+
+	// make sure we sent a single OPT RR with the DO and CD bits
+	for _, query := range srv.queries {
+		assert.True(t, query.CheckingDisabled)
+		assert.Len(t, slices.DeleteFunc(slices.Clone(query.Extra), func(rr dns.RR) bool {
+			_, ok := rr.(*dns.OPT)
+			return !ok
+		}), 1)
+		assert.True(t, query.IsEdns0().Do())
+	}
+}
+
+func Test_dnssecCompareNames(t *testing.T) {
+	// the canonical order example from RFC 4034 Sect. 6.1
+	names := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"\\001.z.example.",
+		"*.z.example.",
+		"\\200.z.example.",
+	}
+	for idx := 1; idx < len(names); idx++ {
+		assert.Negativef(t, dnssecCompareNames(names[idx-1], names[idx]),
+			"%s should sort before %s", names[idx-1], names[idx])
+		assert.Positive(t, dnssecCompareNames(names[idx], names[idx-1]))
+	}
+	assert.Zero(t, dnssecCompareNames("Example.", "example."))
+}
+
+func Test_dnssecDenial(t *testing.T) {
+	nsec := func(owner, next string, types ...uint16) *dns.NSEC {
+		return &dns.NSEC{Hdr: dns.RR_Header{Name: owner}, NextDomain: next, TypeBitMap: types}
+	}
+
+	t.Run("NSEC covering the last name of the zone", func(t *testing.T) {
+		rr := nsec("z.example.", "example.", dns.TypeA)
+		assert.True(t, dnssecNSECCovers(rr, "zz.example."))
+		assert.False(t, dnssecNSECCovers(rr, "a.example."))
+	})
+
+	t.Run("NSEC proving an unsigned delegation", func(t *testing.T) {
+		denial := &dnssecDenial{nsec: []*dns.NSEC{nsec("sub.example.", "z.example.", dns.TypeNS)}}
+		assert.True(t, denial.provesUnsignedDelegation("sub.example."))
+		denial = &dnssecDenial{nsec: []*dns.NSEC{nsec("sub.example.", "z.example.", dns.TypeNS, dns.TypeDS)}}
+		assert.False(t, denial.provesUnsignedDelegation("sub.example."))
+		denial = &dnssecDenial{nsec: []*dns.NSEC{nsec("sub.example.", "z.example.", dns.TypeNS, dns.TypeSOA)}}
+		assert.False(t, denial.provesUnsignedDelegation("sub.example."))
+		denial = &dnssecDenial{nsec: []*dns.NSEC{nsec("sub.example.", "z.example.", dns.TypeA)}}
+		assert.False(t, denial.provesUnsignedDelegation("sub.example."))
+	})
+
+	t.Run("NSEC proving a delegation from the parent zone", func(t *testing.T) {
+		delegation := nsec("sub.example.", "z.example.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)
+		denial := &dnssecDenial{nsec: []*dns.NSEC{delegation}}
+		assert.True(t, denial.provesNoData("sub.example.", dns.TypeDS))
+		assert.False(t, denial.provesNoData("sub.example.", dns.TypeA))
+		assert.False(t, denial.provesNoName("www.sub.example."))
+		delegation.TypeBitMap = append(delegation.TypeBitMap, dns.TypeSOA)
+		assert.True(t, denial.provesNoData("sub.example.", dns.TypeA))
+	})
+
+	t.Run("NSEC3 opt-out", func(t *testing.T) {
+		hash := func(name string) string { return dns.HashName(name, dns.SHA1, 0, "") }
+		next := func(h string) string { // the hash immediately following h
+			b := []byte(h)
+			b[len(b)-1]++
+			return string(b)
+		}
+		apex := &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: hash("example.") + ".example."},
+			Hash:       dns.SHA1,
+			NextDomain: next(hash("example.")),
+			TypeBitMap: []uint16{dns.TypeSOA},
+		}
+		optOut := &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: "0" + hash("sub.example.")[1:] + ".example."},
+			Hash:       dns.SHA1,
+			Flags:      1,
+			NextDomain: "V" + hash("sub.example.")[1:],
+		}
+		denial := &dnssecDenial{nsec3: []*dns.NSEC3{apex, optOut}}
+		assert.True(t, denial.provesUnsignedDelegation("sub.example."))
+		assert.True(t, denial.provesNoData("sub.example.", dns.TypeDS))
+		assert.False(t, denial.provesNoData("sub.example.", dns.TypeA))
+		delegation := &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: hash("sub.example.") + ".example."},
+			Hash:       dns.SHA1,
+			NextDomain: next(hash("sub.example.")),
+			TypeBitMap: []uint16{dns.TypeNS},
+		}
+		denial = &dnssecDenial{nsec3: []*dns.NSEC3{delegation}}
+		assert.True(t, denial.provesNoData("sub.example.", dns.TypeDS))
+		assert.False(t, denial.provesNoData("sub.example.", dns.TypeA))
+		denial = &dnssecDenial{nsec3: []*dns.NSEC3{apex, optOut}}
+		optOut.Flags = 0
+		assert.False(t, denial.provesUnsignedDelegation("sub.example."))
+	})
+}
@@ -20,7 +20,9 @@ DNS messages.
 
 - Low-level [*Transport] API allowing granular control over DNS requests and responses.
 
-- Support for multiple DNS protocols, including UDP, TCP, DoT, DoH, and DoQ.
+- Support for multiple DNS protocols, including UDP, TCP, DoT, DoH, DoH3, DoQ, ODoH, and DNSCrypt.
+
+- Parsing and serialization of DNS stamps (sdns://) into [*ServerAddr].
 
 - Utilities for creating and validating DNS messages.
 
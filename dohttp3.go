@@ -0,0 +1,115 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// DNS-over-HTTPS using HTTP/3.
+//
+// See https://datatracker.ietf.org/doc/rfc8484/ and
+// https://datatracker.ietf.org/doc/rfc9114/
+//
+
+package dnscore
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rbmk-project/common/closepool"
+)
+
+// http3ClientDo performs an HTTP/3 request using a dedicated [*http3.Transport]
+// and returns the response along with the local and remote UDP addresses
+// of the QUIC connection used for the request.
+//
+// Like we do for other protocols, we use a new connection for each query. The
+// connection is closed when the caller closes the response body. We dial the
+// bootstrap endpoints of the given server address, if any.
+func (t *Transport) http3ClientDo(addr *ServerAddr,
+	req *http.Request) (*http.Response, netip.AddrPort, netip.AddrPort, error) {
+	// 1. Create a connection pool to close all the resources
+	connPool := &closepool.Pool{}
+
+	// 2. Create an HTTP/3 transport recording the addresses
+	var (
+		laddr netip.AddrPort
+		mu    sync.Mutex
+		raddr netip.AddrPort
+	)
+	txp := &http3.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: t.RootCAs},
+		Dial: func(ctx context.Context, address string,
+			tlsConfig *tls.Config, quicConfig *quic.Config) (*quic.Conn, error) {
+			hostname, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			endpoints, err := t.bootstrapEndpoints(ctx, addr, address)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig = t.newTLSConfig(addr, hostname, tlsConfig.NextProtos)
+			qc, err := dialEndpoints(ctx, endpoints, func(
+				ctx context.Context, endpoint string) (*quicConnAdapter, error) {
+				return dialQUICConn(ctx, t.listenPacket, endpoint, tlsConfig, quicConfig, false)
+			})
+			if err != nil {
+				return nil, err
+			}
+			connPool.Add(quicConnCloser(qc))
+			mu.Lock()
+			laddr = unmapAddrPort(addrToAddrPort(qc.LocalAddr()))
+			raddr = unmapAddrPort(addrToAddrPort(qc.RemoteAddr()))
+			mu.Unlock()
+			return qc.conn, nil
+		},
+	}
+	connPool.Add(txp)
+
+	// 3. Perform the round trip
+	resp, err := txp.RoundTrip(req)
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		connPool.Close()
+		return nil, laddr, raddr, err
+	}
+
+	// 4. Make sure closing the body closes the connection
+	resp.Body = &httpResponseBody{ReadCloser: resp.Body, connPool: connPool}
+	return resp, laddr, raddr, nil
+}
+
+// unmapAddrPort converts IPv4-mapped IPv6 addresses, which we get when
+// using a dual-stack UDP socket, back to IPv4 addresses.
+func unmapAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// httpResponseBody closes the connections when closing the body.
+type httpResponseBody struct {
+	io.ReadCloser
+	connPool *closepool.Pool
+}
+
+// Close implements io.Closer.
+func (b *httpResponseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.connPool.Close()
+	return err
+}
+
+// queryHTTP3 implements [*Transport.Query] for DNS over HTTPS using HTTP/3.
+func (t *Transport) queryHTTP3(ctx context.Context,
+	addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+	return t.queryHTTPSWithDo(ctx, addr, query, "udp", func(
+		req *http.Request) (*http.Response, netip.AddrPort, netip.AddrPort, error) {
+		return t.http3ClientDo(addr, req)
+	})
+}
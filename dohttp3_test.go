@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rbmk-project/common/closepool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransport_http3ClientDo(t *testing.T) {
+	t.Run("dial failure", func(t *testing.T) {
+		transport := &Transport{}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel() // fail immediately
+		req, err := http.NewRequestWithContext(ctx, "GET", "https://127.0.0.1/dns-query", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, _, _, err := transport.http3ClientDo(NewServerAddr(ProtocolDoH3, "https://127.0.0.1/dns-query"), req)
+		assert.Error(t, err)
+		assert.Nil(t, resp)
+	})
+}
+
+func TestHTTPResponseBody(t *testing.T) {
+	var closed bool
+	connPool := &closepool.Pool{}
+	connPool.Add(closepool.CloserFunc(func() error {
+		closed = true
+		return nil
+	}))
+	expected := errors.New("mocked error")
+	body := &httpResponseBody{
+		ReadCloser: &mockReadCloser{err: expected},
+		connPool:   connPool,
+	}
+	assert.ErrorIs(t, body.Close(), expected)
+	assert.True(t, closed)
+}
+
+// mockReadCloser is an [io.ReadCloser] whose Close returns the given error.
+type mockReadCloser struct {
+	io.Reader
+	err error
+}
+
+func (m *mockReadCloser) Close() error {
+	return m.err
+}
+
+func TestTransport_queryHTTP3(t *testing.T) {
+	t.Run("request creation failure", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		transport := &Transport{
+			NewHTTPRequestWithContext: func(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+				return nil, expected
+			},
+		}
+		addr := NewServerAddr(ProtocolDoH3, "https://127.0.0.1/dns-query")
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeA)
+		_, err := transport.queryHTTP3(context.Background(), addr, query)
+		assert.ErrorIs(t, err, expected)
+	})
+}
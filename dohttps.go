@@ -11,9 +11,13 @@ package dnscore
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/netip"
+	"net/url"
 
 	"github.com/miekg/dns"
 	"github.com/rbmk-project/common/httpconntrace"
@@ -65,9 +69,62 @@ func (t *Transport) readAllContext(ctx context.Context, r io.Reader, c io.Closer
 	return io.ReadAll(r)
 }
 
+// ErrNoSuchHTTPMethod is returned when the [*ServerAddr] HTTPMethod
+// field is neither empty, nor "GET", nor "POST".
+var ErrNoSuchHTTPMethod = errors.New("no such HTTP method")
+
+// newHTTPRequestForQuery creates the HTTP request for sending the given raw
+// query using the HTTP method configured in the given [*ServerAddr].
+func (t *Transport) newHTTPRequestForQuery(
+	ctx context.Context, addr *ServerAddr, rawQuery []byte) (*http.Request, error) {
+	switch addr.HTTPMethod {
+	case "", http.MethodPost:
+		// With POST, the query is the request body. The content-type
+		// header must be set. Otherwise servers may respond with 400.
+		req, err := t.newHTTPRequestWithContext(
+			ctx, http.MethodPost, addr.Address, bytes.NewReader(rawQuery))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("content-type", "application/dns-message")
+		return req, nil
+
+	case http.MethodGet:
+		// With GET, the query is the base64url-encoded value of the dns
+		// parameter, without padding, as specified by RFC 8484 Sect. 4.1.
+		URL, err := url.Parse(addr.Address)
+		if err != nil {
+			return nil, err
+		}
+		values := URL.Query()
+		values.Set("dns", base64.RawURLEncoding.EncodeToString(rawQuery))
+		URL.RawQuery = values.Encode()
+		req, err := t.newHTTPRequestWithContext(ctx, http.MethodGet, URL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("accept", "application/dns-message")
+		return req, nil
+
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchHTTPMethod, addr.HTTPMethod)
+	}
+}
+
 // queryHTTPS implements [*Transport.Query] for DNS over HTTPS.
 func (t *Transport) queryHTTPS(ctx context.Context,
 	addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+	return t.queryHTTPSWithDo(ctx, addr, query, "tcp", func(
+		req *http.Request) (*http.Response, netip.AddrPort, netip.AddrPort, error) {
+		return t.httpClientDoAddr(addr, req)
+	})
+}
+
+// queryHTTPSWithDo implements DNS over HTTPS using the given network for
+// logging and the given function to perform the HTTP round trip.
+func (t *Transport) queryHTTPSWithDo(ctx context.Context, addr *ServerAddr,
+	query *dns.Msg, network string, do func(req *http.Request) (
+		*http.Response, netip.AddrPort, netip.AddrPort, error)) (*dns.Msg, error) {
 	// 0. immediately fail if the context is already done, which
 	// is useful to write unit tests
 	if ctx.Err() != nil {
@@ -81,19 +138,17 @@ func (t *Transport) queryHTTPS(ctx context.Context,
 	}
 	t0 := t.maybeLogQuery(ctx, addr, rawQuery)
 
-	// 2. The query is sent as the body of a POST request. The content-type
-	// header must be set. Otherwise servers may respond with 400.
-	req, err := t.newHTTPRequestWithContext(ctx, "POST", addr.Address, bytes.NewReader(rawQuery))
+	// 2. Create the HTTP request using the configured method.
+	req, err := t.newHTTPRequestForQuery(ctx, addr, rawQuery)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("content-type", "application/dns-message")
 
 	// 3. Log the HTTP request we're sending.
 	httpslog.MaybeLogRoundTripStart(
 		t.Logger,
 		netip.MustParseAddrPort("[::]:0"), // not yet known
-		"tcp",
+		network,
 		netip.MustParseAddrPort("[::]:0"), // not yet known
 		req,
 		t0,
@@ -103,13 +158,13 @@ func (t *Transport) queryHTTPS(ctx context.Context,
 	// the body, the response code is 200, and the content type
 	// is the expected one. Since servers always include the
 	// content type, we don't need to be flexible here.
-	httpResp, laddr, raddr, err := t.httpClientDo(req)
+	httpResp, laddr, raddr, err := do(req)
 
 	// 5. Log the result of the HTTP transfer.
 	httpslog.MaybeLogRoundTripDone(
 		t.Logger,
 		laddr,
-		"tcp",
+		network,
 		raddr,
 		req,
 		httpResp,
@@ -133,7 +188,8 @@ func (t *Transport) queryHTTPS(ctx context.Context,
 	}
 
 	// 7. Now that headers are OK, we read the whole raw response
-	// body, decode it, and possibly log it.
+	// body, decode it, possibly log it, and possibly verify its
+	// TSIG signature.
 	reader := io.LimitReader(httpResp.Body, int64(edns0MaxResponseSize(query)))
 	rawResp, err := t.readAllContext(ctx, reader, httpResp.Body)
 	if err != nil {
@@ -143,6 +199,9 @@ func (t *Transport) queryHTTPS(ctx context.Context,
 	if err := resp.Unpack(rawResp); err != nil {
 		return nil, err
 	}
-	t.maybeLogResponseAddrPort(ctx, addr, t0, rawQuery, rawResp, laddr, raddr)
+	t.maybeLogResponseAddrPort(ctx, addr, t0, rawQuery, rawResp, laddr, raddr, httpResp.TLS)
+	if err := t.maybeVerifyResponseTSIG(addr.TSIGKey, rawQuery, resp, rawResp); err != nil {
+		return nil, err
+	}
 	return resp, nil
 }
@@ -312,6 +312,64 @@ func TestTransport_readAllContext(t *testing.T) {
 	}
 }
 
+func TestTransport_newHTTPRequestForQuery(t *testing.T) {
+	rawQuery := []byte{0xfb, 0xff, 0x01}
+
+	t.Run("default method is POST", func(t *testing.T) {
+		transport := &Transport{}
+		addr := NewServerAddr(ProtocolDoH, "https://dns.google/dns-query")
+		req, err := transport.newHTTPRequestForQuery(context.Background(), addr, rawQuery)
+		assert.NoError(t, err)
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, "https://dns.google/dns-query", req.URL.String())
+		assert.Equal(t, "application/dns-message", req.Header.Get("content-type"))
+		body, err := io.ReadAll(req.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, rawQuery, body)
+	})
+
+	t.Run("GET uses the base64url-encoded dns parameter", func(t *testing.T) {
+		transport := &Transport{}
+		addr := NewServerAddr(ProtocolDoH, "https://dns.google/dns-query?ct=1")
+		addr.HTTPMethod = http.MethodGet
+		req, err := transport.newHTTPRequestForQuery(context.Background(), addr, rawQuery)
+		assert.NoError(t, err)
+		assert.Equal(t, http.MethodGet, req.Method)
+		assert.Equal(t, "https://dns.google/dns-query?ct=1&dns=-_8B", req.URL.String())
+		assert.Equal(t, "application/dns-message", req.Header.Get("accept"))
+		assert.Nil(t, req.Body)
+	})
+
+	t.Run("GET with invalid URL", func(t *testing.T) {
+		transport := &Transport{}
+		addr := NewServerAddr(ProtocolDoH, "\t")
+		addr.HTTPMethod = http.MethodGet
+		_, err := transport.newHTTPRequestForQuery(context.Background(), addr, rawQuery)
+		assert.Error(t, err)
+	})
+
+	t.Run("GET with request creation failure", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		transport := &Transport{
+			NewHTTPRequestWithContext: func(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+				return nil, expected
+			},
+		}
+		addr := NewServerAddr(ProtocolDoH, "https://dns.google/dns-query")
+		addr.HTTPMethod = http.MethodGet
+		_, err := transport.newHTTPRequestForQuery(context.Background(), addr, rawQuery)
+		assert.ErrorIs(t, err, expected)
+	})
+
+	t.Run("unsupported method", func(t *testing.T) {
+		transport := &Transport{}
+		addr := NewServerAddr(ProtocolDoH, "https://dns.google/dns-query")
+		addr.HTTPMethod = http.MethodPut
+		_, err := transport.newHTTPRequestForQuery(context.Background(), addr, rawQuery)
+		assert.ErrorIs(t, err, ErrNoSuchHTTPMethod)
+	})
+}
+
 func TestTransport_queryHTTPS(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -19,74 +19,92 @@ import (
 	"github.com/rbmk-project/common/closepool"
 )
 
-func (t *Transport) queryQUIC(ctx context.Context, addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
-	// 0. immediately fail if the context is already done, which
-	// is useful to write unit tests
-	if ctx.Err() != nil {
-		return nil, ctx.Err()
-	}
+// doqNoError is the DOQ_NO_ERROR error code -- RFC 9250 Sect. 4.3
+const doqNoError = 0x00
+
+// doqRequestCancelled is the DOQ_REQUEST_CANCELLED error code -- RFC 9250 Sect. 4.3
+const doqRequestCancelled = 0x03
+
+// quicSession is a QUIC connection along with the resources it owns.
+type quicSession struct {
+	// conn is the QUIC connection.
+	conn QUICConn
+
+	// connPool contains the resources to close when done.
+	connPool *closepool.Pool
+}
+
+// Close closes the QUIC connection and the resources it owns.
+func (s *quicSession) Close() error {
+	return s.connPool.Close()
+}
 
+// alive returns whether the QUIC connection is still usable.
+func (s *quicSession) alive() bool {
+	return s.conn.Context().Err() == nil
+}
+
+// dialQUIC establishes a new QUIC connection for DNS-over-QUIC. The cache
+// argument is optional and, when not nil, configures TLS session resumption,
+// 0-RTT, and the idle timeout for the connection.
+func (t *Transport) dialQUIC(ctx context.Context,
+	addr *ServerAddr, cache *QUICSessionCache) (*quicSession, error) {
 	// 1. Fill the TLS configuration
 	hostname, _, err := net.SplitHostPort(addr.Address)
 	if err != nil {
 		return nil, err
 	}
-	tlsConfig := &tls.Config{
-		NextProtos: []string{"doq"},
-		ServerName: hostname,
-		RootCAs:    t.RootCAs,
+	tlsConfig := t.newTLSConfig(addr, hostname, []string{"doq"})
+	quicConfig := &quic.Config{}
+	early := false
+	if cache != nil {
+		tlsConfig.ClientSessionCache = cache.TLSClientSessionCache
+		quicConfig.MaxIdleTimeout = cache.IdleTimeout
+		early = cache.Allow0RTT
 	}
 
-	// 2. Create a connection pool to close all opened connections
-	// and ensure we don't leak resources by using defer.
-	connPool := &closepool.Pool{}
-	defer connPool.Close()
-
-	// TODO(bassosimone,roopeshsn): for TCP connections, we abstract
-	// this process of combining the DNS lookup and dialing a connection,
-	// which, in turn, allows for better unit testing and also allows
-	// rbmk-project/rbmk to use rbmk-project/x/netcore for dialing.
-	//
-	// We should probably see to create a similar dialing interface in
-	// rbmk-project/x/netcore for QUIC connections. We started discussing
-	// this in https://github.com/rbmk-project/dnscore/pull/18.
-
-	// 3. Open the UDP connection for supporting QUIC
-	listenConfig := &net.ListenConfig{}
-	udpConn, err := listenConfig.ListenPacket(ctx, "udp", ":0")
+	// 2. Obtain the endpoints to dial, possibly bootstrapping
+	endpoints, err := t.bootstrapEndpoints(ctx, addr, addr.Address)
 	if err != nil {
 		return nil, err
 	}
-	connPool.Add(udpConn)
 
-	// 4. Map the UDP address, which may possibly contain a domain
-	// name, to an actual UDP address structure to dial with
-	udpAddr, err := net.ResolveUDPAddr("udp", addr.Address)
+	// 3. Establish the QUIC connection
+	conn, err := dialEndpoints(ctx, endpoints, func(ctx context.Context, endpoint string) (QUICConn, error) {
+		return t.dialQUICContext(ctx, endpoint, tlsConfig, quicConfig, early)
+	})
 	if err != nil {
 		return nil, err
 	}
+	connPool := &closepool.Pool{}
+	connPool.Add(quicConnCloser(conn))
+	return &quicSession{conn: conn, connPool: connPool}, nil
+}
 
-	// 5. Establish a QUIC connection. Note that the default
-	// configuration implies a 5s timeout for handshaking and
-	// a 30s idle connection timeout.
-	tr := &quic.Transport{
-		Conn: udpConn,
+// dialQUICContext dials a QUIC connection using the custom dialer, if
+// set, or like [DefaultDialQUICContext] otherwise, in which case we
+// create the UDP socket using [*Transport.listenPacket].
+func (t *Transport) dialQUICContext(ctx context.Context, address string,
+	tlsConfig *tls.Config, quicConfig *quic.Config, early bool) (QUICConn, error) {
+	if t.DialQUICContext != nil {
+		return t.DialQUICContext(ctx, address, tlsConfig, quicConfig, early)
 	}
-	connPool.Add(tr)
-	quicConfig := &quic.Config{}
-	quicConn, err := tr.Dial(ctx, udpAddr, tlsConfig, quicConfig)
-	if err != nil {
-		return nil, err
+	return dialQUICConn(ctx, t.listenPacket, address, tlsConfig, quicConfig, early)
+}
+
+// listenPacket creates a UDP socket for QUIC using the custom function,
+// if set, or the [net.ListenConfig] default otherwise.
+func (t *Transport) listenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	if t.ListenPacket != nil {
+		return t.ListenPacket(ctx, network, address)
 	}
-	connPool.Add(closepool.CloserFunc(func() error {
-		// Closing w/o specific error -- RFC 9250 Sect. 4.3
-		const doq_no_error = 0x00
-		return quicConn.CloseWithError(doq_no_error, "")
-	}))
-
-	// 6. Open a stream for sending the DoQ query and wrap it into
-	// an adapter that makes it usable by DNS-over-stream code
-	quicStream, err := quicConn.OpenStream()
+	return defaultListenPacket(ctx, network, address)
+}
+
+// newQUICStreamAdapter opens a stream for sending a DoQ query and wraps it
+// into an adapter that makes it usable by DNS-over-stream code.
+func newQUICStreamAdapter(ctx context.Context, quicConn QUICConn) (*quicStreamAdapter, error) {
+	quicStream, err := quicConn.OpenStreamSync(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -94,29 +112,59 @@ func (t *Transport) queryQUIC(ctx context.Context, addr *ServerAddr, query *dns.
 		Stream:     quicStream,
 		localAddr:  quicConn.LocalAddr(),
 		remoteAddr: quicConn.RemoteAddr(),
+		tlsState:   quicConn.ConnectionState(),
+	}
+	return stream, nil
+}
+
+// queryQUIC implements [*Transport.Query] for DNS over QUIC.
+func (t *Transport) queryQUIC(ctx context.Context, addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+	// 0. immediately fail if the context is already done, which
+	// is useful to write unit tests
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// 1. When using a session cache, defer to the cache
+	if t.QUICSessionCache != nil {
+		return t.queryQUICSessionCache(ctx, addr, query)
+	}
+
+	// 2. Establish a QUIC connection and make sure we close it.
+	session, err := t.dialQUIC(ctx, addr, nil)
+	if err != nil {
+		return nil, err
 	}
-	connPool.Add(stream)
+	defer session.Close()
 
-	// 7. Ensure that we tear down everything which we have set up
+	// 3. Open a stream for sending the DoQ query
+	stream, err := newQUICStreamAdapter(ctx, session.conn)
+	if err != nil {
+		return nil, err
+	}
+	session.connPool.Add(stream)
+
+	// 4. Ensure that we tear down everything which we have set up
 	// in the case in which the context is canceled
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	go func() {
-		defer connPool.Close()
+		defer session.Close()
 		<-ctx.Done()
 	}()
 
-	// 8. defer to queryStream. Note that this method TAKES OWNERSHIP of
+	// 5. defer to queryStream. Note that this method TAKES OWNERSHIP of
 	// the stream and closes it after we've sent the query, honouring the
 	// expectations for DoQ queries -- see RFC 9250 Sect. 4.2.
-	return t.queryStream(ctx, addr, query, stream)
+	return t.queryStream(ctx, addr, addr.TSIGKey, query, stream)
 }
 
 // quicStreamAdapter ensures a QUIC stream implements [dnsStream].
 type quicStreamAdapter struct {
-	Stream     *quic.Stream
+	Stream     QUICStream
 	localAddr  net.Addr
 	remoteAddr net.Addr
+	tlsState   tls.ConnectionState
 }
 
 // Make sure we actually implement [dnsStream].
@@ -145,3 +193,8 @@ func (qsw *quicStreamAdapter) LocalAddr() net.Addr {
 func (qsw *quicStreamAdapter) RemoteAddr() net.Addr {
 	return qsw.remoteAddr
 }
+
+// ConnectionState returns the TLS state of the underlying QUIC connection.
+func (qsw *quicStreamAdapter) ConnectionState() tls.ConnectionState {
+	return qsw.tlsState
+}
@@ -1,10 +1,19 @@
 package dnscore
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -49,3 +58,231 @@ func TestTransport_queryQUIC(t *testing.T) {
 		})
 	}
 }
+
+// mockQUICStream is a mockable [QUICStream].
+type mockQUICStream struct {
+	MockRead       func(p []byte) (int, error)
+	MockWrite      func(p []byte) (int, error)
+	MockClose      func() error
+	MockCancelRead func(code quic.StreamErrorCode)
+}
+
+var _ QUICStream = &mockQUICStream{}
+
+func (s *mockQUICStream) Read(p []byte) (int, error) {
+	return s.MockRead(p)
+}
+
+func (s *mockQUICStream) Write(p []byte) (int, error) {
+	return s.MockWrite(p)
+}
+
+func (s *mockQUICStream) Close() error {
+	return s.MockClose()
+}
+
+func (s *mockQUICStream) CancelRead(code quic.StreamErrorCode) {
+	s.MockCancelRead(code)
+}
+
+func (s *mockQUICStream) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// mockQUICConn is a mockable [QUICConn].
+type mockQUICConn struct {
+	MockOpenStreamSync func(ctx context.Context) (QUICStream, error)
+	MockCloseWithError func(code quic.ApplicationErrorCode, reason string) error
+}
+
+var _ QUICConn = &mockQUICConn{}
+
+func (c *mockQUICConn) OpenStreamSync(ctx context.Context) (QUICStream, error) {
+	return c.MockOpenStreamSync(ctx)
+}
+
+func (c *mockQUICConn) ConnectionState() tls.ConnectionState {
+	return tls.ConnectionState{}
+}
+
+func (c *mockQUICConn) Context() context.Context {
+	return context.Background()
+}
+
+func (c *mockQUICConn) CloseWithError(code quic.ApplicationErrorCode, reason string) error {
+	return c.MockCloseWithError(code, reason)
+}
+
+func (c *mockQUICConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 54321}
+}
+
+func (c *mockQUICConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 853}
+}
+
+func TestTransport_queryQUIC_DialQUICContext(t *testing.T) {
+	// newResponseFrame returns a framed response to the given query
+	newResponseFrame := func(rawQueryFrame []byte) []byte {
+		query := new(dns.Msg)
+		if err := query.Unpack(rawQueryFrame[2:]); err != nil {
+			panic(err)
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(93, 184, 215, 14),
+		})
+		rawResp, err := resp.Pack()
+		if err != nil {
+			panic(err)
+		}
+		return append([]byte{byte(len(rawResp) >> 8), byte(len(rawResp))}, rawResp...)
+	}
+
+	t.Run("dial failure", func(t *testing.T) {
+		expectedErr := errors.New("mocked dial error")
+		var (
+			gotAddress string
+			gotConfig  *tls.Config
+			gotEarly   bool
+		)
+		txp := &Transport{
+			DialQUICContext: func(ctx context.Context, address string,
+				tlsConfig *tls.Config, quicConfig *quic.Config, early bool) (QUICConn, error) {
+				gotAddress, gotConfig, gotEarly = address, tlsConfig, early
+				return nil, expectedErr
+			},
+		}
+		addr := NewServerAddr(ProtocolDoQ, "dns.adguard.com:853")
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeA)
+
+		resp, err := txp.queryQUIC(context.Background(), addr, query)
+		assert.ErrorIs(t, err, expectedErr)
+		assert.Nil(t, resp)
+		assert.Equal(t, "dns.adguard.com:853", gotAddress)
+		assert.Equal(t, "dns.adguard.com", gotConfig.ServerName)
+		assert.Equal(t, []string{"doq"}, gotConfig.NextProtos)
+		assert.False(t, gotEarly)
+	})
+
+	t.Run("stream failure", func(t *testing.T) {
+		expectedErr := errors.New("mocked stream error")
+		var closed atomic.Int64
+		txp := &Transport{
+			DialQUICContext: func(ctx context.Context, address string,
+				tlsConfig *tls.Config, quicConfig *quic.Config, early bool) (QUICConn, error) {
+				conn := &mockQUICConn{
+					MockOpenStreamSync: func(ctx context.Context) (QUICStream, error) {
+						return nil, expectedErr
+					},
+					MockCloseWithError: func(code quic.ApplicationErrorCode, reason string) error {
+						closed.Add(1)
+						return nil
+					},
+				}
+				return conn, nil
+			},
+		}
+		addr := NewServerAddr(ProtocolDoQ, "dns.adguard.com:853")
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeA)
+
+		resp, err := txp.queryQUIC(context.Background(), addr, query)
+		assert.ErrorIs(t, err, expectedErr)
+		assert.Nil(t, resp)
+		assert.Equal(t, int64(1), closed.Load())
+	})
+
+	t.Run("successful query", func(t *testing.T) {
+		var (
+			closeCode   atomic.Int64
+			mu          sync.Mutex
+			streamClose int
+			written     []byte
+			reader      *bytes.Reader
+		)
+		closeCode.Store(-1)
+		stream := &mockQUICStream{
+			MockRead: func(p []byte) (int, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if reader == nil {
+					return 0, io.EOF
+				}
+				return reader.Read(p)
+			},
+			MockWrite: func(p []byte) (int, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				written = append(written, p...)
+				return len(p), nil
+			},
+			MockClose: func() error {
+				mu.Lock()
+				defer mu.Unlock()
+				streamClose++
+				if reader == nil {
+					reader = bytes.NewReader(newResponseFrame(written))
+				}
+				return nil
+			},
+			MockCancelRead: func(code quic.StreamErrorCode) {},
+		}
+		txp := &Transport{
+			DialQUICContext: func(ctx context.Context, address string,
+				tlsConfig *tls.Config, quicConfig *quic.Config, early bool) (QUICConn, error) {
+				conn := &mockQUICConn{
+					MockOpenStreamSync: func(ctx context.Context) (QUICStream, error) {
+						return stream, nil
+					},
+					MockCloseWithError: func(code quic.ApplicationErrorCode, reason string) error {
+						closeCode.Store(int64(code))
+						return nil
+					},
+				}
+				return conn, nil
+			},
+		}
+		addr := NewServerAddr(ProtocolDoQ, "127.0.0.1:853")
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeA)
+
+		resp, err := txp.queryQUIC(context.Background(), addr, query)
+		assert.NoError(t, err)
+		if assert.NotNil(t, resp) && assert.Len(t, resp.Answer, 1) {
+			assert.Equal(t, "93.184.215.14", resp.Answer[0].(*dns.A).A.String())
+		}
+		assert.Equal(t, int64(doqNoError), closeCode.Load())
+		mu.Lock()
+		assert.True(t, streamClose >= 1)
+		mu.Unlock()
+	})
+}
+
+func Test_resolveQUICEndpoints(t *testing.T) {
+	t.Run("IP addresses", func(t *testing.T) {
+		endpoints, err := resolveQUICEndpoints(context.Background(), "[::ffff:127.0.0.1]:853")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"127.0.0.1:853"}, endpoints)
+		endpoints, err = resolveQUICEndpoints(context.Background(), "[::1]:853")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"[::1]:853"}, endpoints)
+	})
+
+	t.Run("hostnames honour the context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		endpoints, err := resolveQUICEndpoints(ctx, "dns.example.com:853")
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Nil(t, endpoints)
+	})
+
+	t.Run("invalid address", func(t *testing.T) {
+		endpoints, err := resolveQUICEndpoints(context.Background(), "127.0.0.1")
+		assert.Error(t, err)
+		assert.Nil(t, endpoints)
+	})
+}
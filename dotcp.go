@@ -30,25 +30,33 @@ type dnsStream interface {
 	RemoteAddr() net.Addr
 }
 
-// queryTCP implements [*Transport.Query] for DNS over TCP.
+// queryTCP implements [*Transport.Query] for DNS over TCP, verifying
+// the TSIG signature of the response using the given key, if not nil.
 func (t *Transport) queryTCP(ctx context.Context,
-	addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+	addr *ServerAddr, key *TSIGKey, query *dns.Msg) (*dns.Msg, error) {
 	// 0. immediately fail if the context is already done, which
 	// is useful to write unit tests
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
 	}
 
-	// 1. Dial the connection
+	// 1. When using a connection pool, defer to the pool
+	if t.ConnPool != nil {
+		return t.queryStreamPooled(ctx, addr, key, query, func(ctx context.Context) (dnsStream, error) {
+			return t.dialContext(ctx, "tcp", addr.Address)
+		})
+	}
+
+	// 2. Dial the connection
 	conn, err := t.dialContext(ctx, "tcp", addr.Address)
 
-	// 2. Handle dialing failure
+	// 3. Handle dialing failure
 	if err != nil {
 		return nil, err
 	}
 
-	// 3. Transfer conn ownership and perform the round trip
-	return t.queryStream(ctx, addr, query, conn)
+	// 4. Transfer conn ownership and perform the round trip
+	return t.queryStream(ctx, addr, key, query, conn)
 }
 
 // ErrQueryTooLargeForTransport indicates that a query is too large for the transport.
@@ -60,17 +68,19 @@ type queryMsg interface {
 	Pack() ([]byte, error)
 }
 
-// queryStream performs the round trip over the given TCP/TLS stream.
+// queryStream performs the round trip over the given TCP/TLS stream,
+// verifying the TSIG signature of the response using the given key,
+// which usually is the TSIG key of the [*ServerAddr], if not nil.
 //
 // This method TAKES OWNERSHIP of the provided connection and is
 // responsible for closing it when done.
 func (t *Transport) queryStream(ctx context.Context,
-	addr *ServerAddr, query queryMsg, conn dnsStream) (*dns.Msg, error) {
+	addr *ServerAddr, key *TSIGKey, query queryMsg, conn dnsStream) (*dns.Msg, error) {
 
 	// 1. Use a single connection for request, which is what the standard library
 	// does as well for TCP and is more robust in terms of residual censorship.
 	//
-	// In the future, we may want to reuse a TLS connection for multiple queries
+	// See [*ConnPool] for reusing connections for multiple queries.
 	//
 	// Make sure we react to context being canceled early.
 	ctx, cancel := context.WithCancel(ctx)
@@ -125,22 +135,21 @@ func (t *Transport) queryStream(ctx context.Context,
 	// 6. Wrap the conn to avoid issuing too many reads
 	// then read the response header and query
 	br := bufio.NewReader(conn)
-	header := make([]byte, 2)
-	if _, err := io.ReadFull(br, header); err != nil {
-		return nil, err
-	}
-	length := int(header[0])<<8 | int(header[1])
-	rawResp := make([]byte, length)
-	if _, err := io.ReadFull(br, rawResp); err != nil {
+	rawResp, err := readRawMsgFrame(br)
+	if err != nil {
 		return nil, err
 	}
 
-	// 7. Parse the response and possibly log that we received it.
+	// 7. Parse the response, possibly log that we received it,
+	// and possibly verify its TSIG signature.
 	resp := new(dns.Msg)
 	if err := resp.Unpack(rawResp); err != nil {
 		return nil, err
 	}
 	t.maybeLogResponseConn(ctx, addr, t0, rawQuery, rawResp, conn)
+	if err := t.maybeVerifyResponseTSIG(key, rawQuery, resp, rawResp); err != nil {
+		return nil, err
+	}
 	return resp, nil
 }
 
@@ -154,3 +163,17 @@ func newRawMsgFrame(addr *ServerAddr, rawMsg []byte) ([]byte, error) {
 	rawMsgFrame = append(rawMsgFrame, rawMsg...)
 	return rawMsgFrame, nil
 }
+
+// readRawMsgFrame reads a length-prefixed raw message from the given reader.
+func readRawMsgFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(header[0])<<8 | int(header[1])
+	rawMsg := make([]byte, length)
+	if _, err := io.ReadFull(r, rawMsg); err != nil {
+		return nil, err
+	}
+	return rawMsg, nil
+}
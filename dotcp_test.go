@@ -94,7 +94,7 @@ func TestTransport_queryTCP(t *testing.T) {
 			query := new(dns.Msg)
 			query.SetQuestion("example.com.", dns.TypeA)
 
-			_, err := transport.queryTCP(context.Background(), addr, query)
+			_, err := transport.queryTCP(context.Background(), addr, nil, query)
 
 			if tt.expectedError != nil {
 				assert.Error(t, err)
@@ -328,7 +328,7 @@ func TestTransport_queryStream(t *testing.T) {
 				defer cancel()
 			}
 
-			_, err := transport.queryStream(ctx, addr, tt.query, conn)
+			_, err := transport.queryStream(ctx, addr, nil, tt.query, conn)
 
 			if tt.expectedError != nil {
 				assert.Error(t, err)
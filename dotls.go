@@ -27,15 +27,28 @@ func (t *Transport) dialTLSContext(ctx context.Context, network, address string)
 		return nil, err
 	}
 	config := &tls.Config{
+		Certificates:       t.ClientCertificates,
 		InsecureSkipVerify: false,
 		NextProtos:         []string{"dot"},
 		RootCAs:            t.RootCAs,
 		ServerName:         hostname,
 	}
 
-	// Defer to the stdlib TLS dialer
-	dialer := &tls.Dialer{Config: config}
-	return dialer.DialContext(ctx, network, address)
+	// Dial and perform the TLS handshake
+	return t.dialTLSWithConfig(ctx, network, address, config)
+}
+
+// dialTLS dials a TLS connection with the given server address. Unless we're
+// using a custom DialTLSContext, we dial the bootstrap endpoints, if any, and
+// we apply the TLS settings of the server address (e.g., the SNI).
+func (t *Transport) dialTLS(ctx context.Context, addr *ServerAddr) (net.Conn, error) {
+	// 1. The custom dialer is responsible for bootstrapping and TLS settings
+	if t.DialTLSContext != nil {
+		return t.dialTLSContext(ctx, "tcp", addr.Address)
+	}
+
+	// 2. Otherwise, dial applying the server address settings
+	return t.dialTLSAddr(ctx, addr, "tcp", addr.Address, []string{"dot"})
 }
 
 // queryTLS implements [*Transport.Query] for DNS over TLS.
@@ -47,14 +60,21 @@ func (t *Transport) queryTLS(ctx context.Context,
 		return nil, ctx.Err()
 	}
 
-	// 1. Dial the TLS connection
-	conn, err := t.dialTLSContext(ctx, "tcp", addr.Address)
+	// 1. When using a connection pool, defer to the pool
+	if t.ConnPool != nil {
+		return t.queryStreamPooled(ctx, addr, addr.TSIGKey, query, func(ctx context.Context) (dnsStream, error) {
+			return t.dialTLS(ctx, addr)
+		})
+	}
+
+	// 2. Dial the TLS connection
+	conn, err := t.dialTLS(ctx, addr)
 
-	// 2. Handle dialing failure
+	// 3. Handle dialing failure
 	if err != nil {
 		return nil, err
 	}
 
-	// 3. Transfer conn ownership and perform the round trip
-	return t.queryStream(ctx, addr, query, conn)
+	// 4. Transfer conn ownership and perform the round trip
+	return t.queryStream(ctx, addr, addr.TSIGKey, query, conn)
 }
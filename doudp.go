@@ -93,10 +93,11 @@ func edns0MaxResponseSize(query *dns.Msg) (maxSize uint16) {
 	return
 }
 
-// recvResponseUDP reads and parses the response from the server and
-// possibly logs the response. It returns the parsed response or an error.
-func (t *Transport) recvResponseUDP(ctx context.Context, addr *ServerAddr, conn net.Conn,
-	t0 time.Time, query *dns.Msg, rawQuery []byte) (*dns.Msg, error) {
+// recvResponseUDP reads and parses the response from the server, possibly
+// logs the response, and verifies its TSIG signature using the given key,
+// if not nil. It returns the parsed response or an error.
+func (t *Transport) recvResponseUDP(ctx context.Context, addr *ServerAddr, key *TSIGKey,
+	conn net.Conn, t0 time.Time, query *dns.Msg, rawQuery []byte) (*dns.Msg, error) {
 	// 1. Read the corresponding raw response
 	buffer := make([]byte, edns0MaxResponseSize(query))
 	count, err := conn.Read(buffer)
@@ -105,18 +106,23 @@ func (t *Transport) recvResponseUDP(ctx context.Context, addr *ServerAddr, conn
 	}
 	rawResp := buffer[:count]
 
-	// 2. Parse the raw response and possibly log that we received it.
+	// 2. Parse the raw response, possibly log that we received it,
+	// and possibly verify its TSIG signature.
 	resp := &dns.Msg{}
 	if err := resp.Unpack(rawResp); err != nil {
 		return nil, err
 	}
 	t.maybeLogResponseConn(ctx, addr, t0, rawQuery, rawResp, conn)
+	if err := t.maybeVerifyResponseTSIG(key, rawQuery, resp, rawResp); err != nil {
+		return nil, err
+	}
 	return resp, nil
 }
 
-// queryUDP implements [*Transport.Query] for DNS over UDP.
+// queryUDP implements [*Transport.Query] for DNS over UDP, verifying
+// the TSIG signature of the response using the given key, if not nil.
 func (t *Transport) queryUDP(ctx context.Context,
-	addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+	addr *ServerAddr, key *TSIGKey, query *dns.Msg) (*dns.Msg, error) {
 	// 0. immediately fail if the context is already done, which
 	// is useful to write unit tests
 	if ctx.Err() != nil {
@@ -141,7 +147,38 @@ func (t *Transport) queryUDP(ctx context.Context,
 	}()
 
 	// Read and parse the response and log it if needed.
-	return t.recvResponseUDP(ctx, addr, conn, t0, query, rawQuery)
+	resp, err := t.recvResponseUDP(ctx, addr, key, conn, t0, query, rawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	// Possibly retry using TCP if the response is truncated.
+	if resp.Truncated && t.FallbackToTCPOnTruncation {
+		return t.queryTCPFallback(ctx, addr, key, query)
+	}
+	return resp, nil
+}
+
+// tcpFallbackAddr returns the [*ServerAddr] for retrying queries to the given
+// DNS over UDP server using DNS over TCP, which is stable when using a
+// [*ConnPool] such that fallbacks reuse the pooled connections.
+func (t *Transport) tcpFallbackAddr(addr *ServerAddr) *ServerAddr {
+	if t.ConnPool != nil {
+		return t.ConnPool.tcpFallbackAddr(addr)
+	}
+	return addr.withProtocol(ProtocolTCP)
+}
+
+// queryTCPFallback retries the given query using DNS over TCP and
+// the same server address, as recommended by RFC 7766 Sect. 5 when
+// the DNS over UDP response is truncated, and logs the fallback. We
+// preserve the server settings, including the TSIG key, such that we
+// verify the TSIG signature of the DNS over TCP response as well.
+func (t *Transport) queryTCPFallback(ctx context.Context,
+	addr *ServerAddr, key *TSIGKey, query *dns.Msg) (*dns.Msg, error) {
+	tcpAddr := t.tcpFallbackAddr(addr)
+	t.maybeLogFallback(ctx, addr, tcpAddr, "truncated")
+	return t.queryTCP(ctx, tcpAddr, key, query)
 }
 
 // emitMessageOrError sends a message or error to the output channel
@@ -198,7 +235,7 @@ func (t *Transport) queryUDPWithDuplicates(ctx context.Context,
 
 		// Loop collecting responses and emitting them until the context is done.
 		for {
-			resp, err := t.recvResponseUDP(ctx, addr, conn, t0, query, rawQuery)
+			resp, err := t.recvResponseUDP(ctx, addr, addr.TSIGKey, conn, t0, query, rawQuery)
 			if err != nil {
 				t.emitMessageOrError(ctx, nil, err, out)
 				return
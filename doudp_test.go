@@ -325,7 +325,7 @@ func TestTransport_recvResponseUDP(t *testing.T) {
 
 			ctx := context.Background()
 			_, err := transport.recvResponseUDP(
-				ctx, addr, conn, time.Now(), query, []byte{0, 0, 0, 0})
+				ctx, addr, nil, conn, time.Now(), query, []byte{0, 0, 0, 0})
 
 			if tt.expectedError != nil {
 				assert.Error(t, err)
@@ -469,7 +469,7 @@ func TestTransport_queryUDP(t *testing.T) {
 			query := new(dns.Msg)
 			query.SetQuestion("example.com.", dns.TypeA)
 
-			_, err := transport.queryUDP(context.Background(), addr, query)
+			_, err := transport.queryUDP(context.Background(), addr, nil, query)
 			if tt.expectedError != nil {
 				assert.Error(t, err)
 				assert.Equal(t, tt.expectedError.Error(), err.Error())
@@ -658,3 +658,96 @@ func TestTransport_queryUDPWithDuplicates(t *testing.T) {
 		})
 	}
 }
+
+func TestTransport_queryUDPFallbackToTCP(t *testing.T) {
+	// newTransport creates a transport where the UDP server always truncates
+	// responses and the TCP server returns the full response.
+	newTransport := func(fallback bool, tcpDials *atomic.Int64) *Transport {
+		return &Transport{
+			FallbackToTCPOnTruncation: fallback,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var rawQuery []byte
+				conn := &mocks.Conn{
+					MockWrite: func(b []byte) (int, error) {
+						rawQuery = append([]byte{}, b...)
+						return len(b), nil
+					},
+					MockClose: func() error {
+						return nil
+					},
+					MockSetDeadline: func(t time.Time) error {
+						return nil
+					},
+				}
+				switch network {
+				case "udp":
+					conn.MockRead = func(b []byte) (int, error) {
+						query := new(dns.Msg)
+						if err := query.Unpack(rawQuery); err != nil {
+							return 0, err
+						}
+						resp := new(dns.Msg)
+						resp.SetReply(query)
+						resp.Truncated = true
+						rawResp, err := resp.Pack()
+						if err != nil {
+							return 0, err
+						}
+						return copy(b, rawResp), nil
+					}
+
+				default:
+					tcpDials.Add(1)
+					var pending []byte
+					conn.MockRead = func(b []byte) (int, error) {
+						if pending == nil {
+							query := new(dns.Msg)
+							if err := query.Unpack(rawQuery[2:]); err != nil {
+								return 0, err
+							}
+							resp := new(dns.Msg)
+							resp.SetReply(query)
+							rawResp, err := resp.Pack()
+							if err != nil {
+								return 0, err
+							}
+							pending, err = newRawMsgFrame(&ServerAddr{}, rawResp)
+							if err != nil {
+								return 0, err
+							}
+						}
+						count := copy(b, pending)
+						pending = pending[count:]
+						return count, nil
+					}
+				}
+				return conn, nil
+			},
+		}
+	}
+
+	t.Run("fallback disabled", func(t *testing.T) {
+		var tcpDials atomic.Int64
+		transport := newTransport(false, &tcpDials)
+		addr := NewServerAddr(ProtocolUDP, "8.8.8.8:53")
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeA)
+		resp, err := transport.Query(context.Background(), addr, query)
+		assert.NoError(t, err)
+		assert.True(t, resp.Truncated)
+		assert.Equal(t, int64(0), tcpDials.Load())
+	})
+
+	t.Run("fallback enabled", func(t *testing.T) {
+		var tcpDials atomic.Int64
+		transport := newTransport(true, &tcpDials)
+		addr := NewServerAddr(ProtocolUDP, "8.8.8.8:53")
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeA)
+		resp, err := transport.Query(context.Background(), addr, query)
+		assert.NoError(t, err)
+		assert.False(t, resp.Truncated)
+		assert.NoError(t, ValidateResponse(query, resp))
+		assert.Equal(t, int64(1), tcpDials.Load())
+	})
+}
@@ -3,10 +3,12 @@ module github.com/rbmk-project/dnscore
 go 1.23.0
 
 require (
+	github.com/cloudflare/circl v1.6.1
 	github.com/miekg/dns v1.1.66
 	github.com/quic-go/quic-go v0.53.0
 	github.com/rbmk-project/common v0.22.0
 	github.com/stretchr/testify v1.10.0
+	golang.org/x/crypto v0.39.0
 	golang.org/x/net v0.41.0
 )
 
@@ -16,8 +18,8 @@ require (
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
 	go.uber.org/mock v0.5.2 // indirect
-	golang.org/x/crypto v0.39.0 // indirect
 	golang.org/x/mod v0.25.0 // indirect
 	golang.org/x/sync v0.15.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
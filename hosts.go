@@ -0,0 +1,167 @@
+//
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Adapted from: https://github.com/golang/go/blob/go1.21.10/src/net/hosts.go
+//
+// Hosts file lookups along with BSD-licensed code from the stdlib.
+//
+
+package dnscore
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultHostsPath is the default path of the hosts file.
+const DefaultHostsPath = "/etc/hosts"
+
+// Hosts contains the entries of a hosts file, which the [*Resolver]
+// consults before the network when its Hosts field is not nil.
+//
+// Construct using [NewHosts].
+//
+// This struct is safe for concurrent use by multiple goroutines.
+type Hosts struct {
+	// byAddr maps addresses to names.
+	byAddr map[string][]string
+
+	// byName maps canonical names to addresses.
+	byName map[string][]string
+
+	// file is the hosts file.
+	file *configFile
+
+	// mu protects byAddr and byName.
+	mu sync.RWMutex
+}
+
+// NewHosts creates a new [*Hosts] using the given hosts file, which
+// usually is [DefaultHostsPath]. Use [ConfigFileOptionReload] to reload
+// the entries when the file changes.
+func NewHosts(path string, options ...ConfigFileOption) (*Hosts, error) {
+	h := &Hosts{
+		byAddr: map[string][]string{},
+		byName: map[string][]string{},
+		file:   newConfigFile(path, options...),
+		mu:     sync.RWMutex{},
+	}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load reads and parses the hosts file.
+func (h *Hosts) load() error {
+	// 1. read the file
+	data, err := h.file.read()
+	if err != nil {
+		return err
+	}
+
+	// 2. parse the entries
+	byAddr, byName := map[string][]string{}, map[string][]string{}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			// Discard comments.
+			line = line[0:i]
+		}
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			continue
+		}
+		ip, err := netip.ParseAddr(f[0])
+		if err != nil {
+			continue
+		}
+		addr := ip.String()
+		for i := 1; i < len(f); i++ {
+			name := dns.Fqdn(f[i])
+			key := dns.CanonicalName(name)
+			byName[key] = append(byName[key], addr)
+			byAddr[addr] = append(byAddr[addr], name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// 3. replace the entries
+	h.mu.Lock()
+	h.byAddr, h.byName = byAddr, byName
+	h.mu.Unlock()
+	return nil
+}
+
+// maybeReload reloads the hosts file when it changed. In case
+// of failure, we continue using the current entries.
+func (h *Hosts) maybeReload() {
+	if h.file.changed() {
+		_ = h.load()
+	}
+}
+
+// LookupHost returns the addresses of the given host or
+// an empty list if the host is not in the hosts file.
+func (h *Hosts) LookupHost(host string) []string {
+	h.maybeReload()
+	key := dns.CanonicalName(host)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]string(nil), h.byName[key]...)
+}
+
+// LookupAddr returns the names of the given address or
+// an empty list if the address is not in the hosts file.
+func (h *Hosts) LookupAddr(addr string) []string {
+	h.maybeReload()
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]string(nil), h.byAddr[ip.String()]...)
+}
+
+// lookup returns a [*LookupResult] containing the A or AAAA RRs of the given
+// host, which may be empty, or false if the host is not in the hosts file.
+func (h *Hosts) lookup(host string, qtype uint16) (*LookupResult, bool) {
+	// 1. find the addresses
+	addrs := h.LookupHost(host)
+	if len(addrs) <= 0 {
+		return nil, false
+	}
+
+	// 2. build the RRs of the requested type
+	name := dns.CanonicalName(host)
+	result := &LookupResult{CanonicalName: name, DNSSECStatus: DNSSECIndeterminate, FromHostsFile: true}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		header := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET}
+		switch {
+		case ip == nil: // e.g., IPv6 addresses with zone
+			continue
+
+		case qtype == dns.TypeA && ip.To4() != nil:
+			result.RRs = append(result.RRs, &dns.A{Hdr: header, A: ip.To4()})
+
+		case qtype == dns.TypeAAAA && ip.To4() == nil:
+			result.RRs = append(result.RRs, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+	result.Addrs = lookupAddrs(result.RRs)
+	return result, true
+}
@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// hostsTestContent is the content of the hosts file used by tests.
+const hostsTestContent = `# comment
+127.0.0.1	localhost
+::1		localhost ip6-localhost
+192.0.2.1	Example.COM www.example.com # trailing comment
+192.0.2.2	www.example.com
+2001:db8::1	v6only.example.com
+fe80::1%lo0	linklocal.example.com
+invalid		broken.example.com
+192.0.2.3
+`
+
+func TestHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	modTime := time.Now().Add(-time.Hour)
+	writeConfigFile(t, path, hostsTestContent, modTime)
+	hosts, err := NewHosts(path, ConfigFileOptionReload(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("LookupHost", func(t *testing.T) {
+		assert.Equal(t, []string{"127.0.0.1", "::1"}, hosts.LookupHost("localhost"))
+		assert.Equal(t, []string{"192.0.2.1"}, hosts.LookupHost("example.com."))
+		assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, hosts.LookupHost("WWW.example.com"))
+		assert.Equal(t, []string{"fe80::1%lo0"}, hosts.LookupHost("linklocal.example.com"))
+		assert.Empty(t, hosts.LookupHost("broken.example.com"))
+		assert.Empty(t, hosts.LookupHost("nonexistent.example.com"))
+	})
+
+	t.Run("LookupAddr", func(t *testing.T) {
+		assert.Equal(t, []string{"Example.COM.", "www.example.com."}, hosts.LookupAddr("192.0.2.1"))
+		assert.Equal(t, []string{"localhost.", "ip6-localhost."}, hosts.LookupAddr("0:0::1"))
+		assert.Empty(t, hosts.LookupAddr("192.0.2.3"))
+		assert.Empty(t, hosts.LookupAddr("invalid"))
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		writeConfigFile(t, path, "192.0.2.9 example.com\n", modTime.Add(time.Second))
+		assert.Equal(t, []string{"192.0.2.9"}, hosts.LookupHost("example.com"))
+		writeConfigFile(t, path, hostsTestContent, modTime)
+		assert.Equal(t, []string{"192.0.2.1"}, hosts.LookupHost("example.com"))
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		hosts, err := NewHosts(filepath.Join(t.TempDir(), "hosts"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.Nil(t, hosts)
+	})
+}
+
+func TestResolver_Hosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	writeConfigFile(t, path, hostsTestContent, time.Now())
+	hosts, err := NewHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reso := newNetResolverTestResolver(t,
+		"example.com. A 198.51.100.1",
+		"dns.example.com. A 198.51.100.2",
+		"1.2.0.192.in-addr.arpa. PTR dns.example.com.",
+		"2.2.0.192.in-addr.arpa. PTR dns.example.com.",
+	)
+	reso.Hosts = hosts
+	ctx := context.Background()
+
+	t.Run("A from the hosts file", func(t *testing.T) {
+		result, err := reso.Lookup(ctx, "www.example.com", dns.TypeA)
+		assert.NoError(t, err)
+		assert.True(t, result.FromHostsFile)
+		assert.Equal(t, "www.example.com.", result.CanonicalName)
+		assert.Equal(t, []LookupAddr{{Addr: "192.0.2.1"}, {Addr: "192.0.2.2"}}, result.Addrs)
+		assert.Nil(t, result.Response)
+	})
+
+	t.Run("no addresses of the requested family", func(t *testing.T) {
+		_, err := reso.LookupAAAA(ctx, "example.com")
+		assert.ErrorIs(t, err, ErrNoData)
+
+		addrs, err := reso.LookupHost(ctx, "localhost")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"127.0.0.1", "::1"}, addrs)
+	})
+
+	t.Run("other names and types use the network", func(t *testing.T) {
+		addrs, err := reso.LookupA(ctx, "dns.example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"198.51.100.2"}, addrs)
+
+		_, err = reso.LookupMX(ctx, "example.com")
+		assertNotFound(t, err, ErrNoData)
+	})
+
+	t.Run("LookupAddr", func(t *testing.T) {
+		names, err := reso.LookupAddr(ctx, "192.0.2.1")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Example.COM.", "www.example.com."}, names)
+
+		names, err = reso.LookupAddr(ctx, "192.0.2.2")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"www.example.com."}, names)
+
+		names, err = reso.LookupAddr(ctx, "192.0.2.3")
+		assertNotFound(t, err, ErrNoName)
+		assert.Nil(t, names)
+	})
+}
@@ -3,13 +3,31 @@
 package dnscore_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/rbmk-project/common/closepool"
 	"github.com/rbmk-project/dnscore"
 	"github.com/rbmk-project/dnscore/dnscoretest"
 	"github.com/stretchr/testify/assert"
@@ -167,4 +185,2412 @@ func TestTransport_RoundTrip_HTTPS(t *testing.T) {
 	checkResult(t, resp, err)
 }
 
-// TODO(bassosimone,roopeshsn): add integration tests for DoQ
+func TestTransport_RoundTrip_HTTPS_GET(t *testing.T) {
+	// create and start a testing server
+	server := &dnscoretest.Server{}
+	handler := dnscoretest.NewExampleComHandler()
+	<-server.StartHTTPS(handler)
+	defer server.Close()
+
+	// create transport, server addr, and query
+	logs := &bytes.Buffer{}
+	txp := &dnscore.Transport{
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs: server.RootCAs,
+				},
+			},
+		},
+		Logger: slog.New(slog.NewJSONHandler(logs, nil)),
+	}
+	serverAddr := &dnscore.ServerAddr{
+		Protocol:   dnscore.ProtocolDoH,
+		Address:    server.URL,
+		HTTPMethod: http.MethodGet,
+	}
+	query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// issue the query and get the response
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := txp.Query(ctx, serverAddr, query)
+
+	// verify the results
+	checkResult(t, resp, err)
+
+	// make sure the logs contain the HTTP method we used
+	var methods []string
+	decoder := json.NewDecoder(logs)
+	for decoder.More() {
+		var entry struct {
+			Msg        string `json:"msg"`
+			HTTPMethod string `json:"httpMethod"`
+		}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.HTTPMethod != "" {
+			methods = append(methods, entry.Msg+"/"+entry.HTTPMethod)
+		}
+	}
+	assert.Equal(t, []string{"httpRoundTripStart/GET", "httpRoundTripDone/GET"}, methods)
+}
+
+func TestTransport_RoundTrip_ConnPool(t *testing.T) {
+	for _, protocol := range []dnscore.Protocol{dnscore.ProtocolTCP, dnscore.ProtocolDoT} {
+		t.Run(string(protocol), func(t *testing.T) {
+			// create and start a testing server
+			server := &dnscoretest.Server{}
+			handler := dnscoretest.NewExampleComHandler()
+			switch protocol {
+			case dnscore.ProtocolDoT:
+				<-server.StartTLS(handler)
+			default:
+				<-server.StartTCP(handler)
+			}
+			defer server.Close()
+
+			// create transport with a connection pool and count dials
+			var dials atomic.Int64
+			pool := &dnscore.ConnPool{}
+			defer pool.Close()
+			dialer := &net.Dialer{}
+			txp := &dnscore.Transport{
+				ConnPool: pool,
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					dials.Add(1)
+					return dialer.DialContext(ctx, network, address)
+				},
+				DialTLSContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					dials.Add(1)
+					tlsDialer := &tls.Dialer{Config: &tls.Config{RootCAs: server.RootCAs}}
+					return tlsDialer.DialContext(ctx, network, address)
+				},
+			}
+			serverAddr := dnscore.NewServerAddr(protocol, server.Addr)
+
+			// issue several queries in parallel and then sequentially
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			query := func() {
+				query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp, err := txp.Query(ctx, serverAddr, query)
+				checkResult(t, resp, err)
+			}
+			wg := &sync.WaitGroup{}
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					query()
+				}()
+			}
+			wg.Wait()
+			before := dials.Load()
+			query()
+
+			// make sure the last query reused a connection
+			assert.Equal(t, before, dials.Load())
+		})
+	}
+}
+
+func TestTransport_RoundTrip_QUIC(t *testing.T) {
+	// create and start a testing server
+	server := &dnscoretest.Server{}
+	handler := dnscoretest.NewExampleComHandler()
+	<-server.StartQUIC(handler)
+	defer server.Close()
+
+	// create transport, server addr, and query
+	txp := &dnscore.Transport{RootCAs: server.RootCAs}
+	serverAddr := &dnscore.ServerAddr{
+		Protocol: dnscore.ProtocolDoQ,
+		Address:  server.Addr,
+	}
+	options := []dnscore.QueryOption{
+		dnscore.QueryOptionEDNS0(
+			dnscore.EDNS0SuggestedMaxResponseSizeOtherwise,
+			dnscore.EDNS0FlagDO|dnscore.EDNS0FlagBlockLengthPadding,
+		),
+	}
+	query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// issue the query and get the response
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := txp.Query(ctx, serverAddr, query)
+
+	// verify the results
+	checkResult(t, resp, err)
+}
+
+func TestTransport_RoundTrip_HTTP3(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		t.Run(method, func(t *testing.T) {
+			// create and start a testing server
+			server := &dnscoretest.Server{}
+			handler := dnscoretest.NewExampleComHandler()
+			<-server.StartHTTP3(handler)
+			defer server.Close()
+
+			// create transport, server addr, and query
+			logs := &bytes.Buffer{}
+			txp := &dnscore.Transport{
+				Logger:  slog.New(slog.NewJSONHandler(logs, nil)),
+				RootCAs: server.RootCAs,
+			}
+			serverAddr := &dnscore.ServerAddr{
+				Protocol:   dnscore.ProtocolDoH3,
+				Address:    server.URL,
+				HTTPMethod: method,
+			}
+			query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// issue the query and get the response
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := txp.Query(ctx, serverAddr, query)
+
+			// verify the results
+			checkResult(t, resp, err)
+
+			// make sure we logged the UDP endpoints of the QUIC connection
+			var found bool
+			decoder := json.NewDecoder(logs)
+			for decoder.More() {
+				var entry struct {
+					Msg        string `json:"msg"`
+					Protocol   string `json:"protocol"`
+					RemoteAddr string `json:"remoteAddr"`
+				}
+				if err := decoder.Decode(&entry); err != nil {
+					t.Fatal(err)
+				}
+				if entry.Msg == "dnsResponse" {
+					found = true
+					assert.Equal(t, "udp", entry.Protocol)
+					assert.Equal(t, server.Addr, entry.RemoteAddr)
+				}
+			}
+			assert.True(t, found)
+		})
+	}
+}
+
+func TestTransport_RoundTrip_ODoH(t *testing.T) {
+	// create and start a testing server
+	server := &dnscoretest.Server{}
+	handler := dnscoretest.NewExampleComHandler()
+	<-server.StartODoH(handler)
+	defer server.Close()
+
+	for _, fetchConfigs := range []bool{true, false} {
+		t.Run(fmt.Sprintf("fetchConfigs=%v", fetchConfigs), func(t *testing.T) {
+			// create transport, server addr, and query
+			logs := &bytes.Buffer{}
+			txp := &dnscore.Transport{
+				HTTPClient: &http.Client{
+					Transport: &http.Transport{
+						TLSClientConfig: &tls.Config{RootCAs: server.RootCAs},
+					},
+				},
+				Logger: slog.New(slog.NewJSONHandler(logs, nil)),
+			}
+			serverAddr := &dnscore.ServerAddr{
+				Protocol:   dnscore.ProtocolODoH,
+				Address:    server.URL,
+				ODoHTarget: server.ODoHTarget,
+			}
+			if !fetchConfigs {
+				serverAddr.ODoHConfigs = server.ODoHConfigs
+			}
+			query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// issue the query and get the response
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := txp.Query(ctx, serverAddr, query)
+
+			// verify the results
+			checkResult(t, resp, err)
+
+			// make sure we logged both the encrypted and the plaintext messages
+			events := make(map[string]int)
+			decoder := json.NewDecoder(logs)
+			for decoder.More() {
+				var entry struct {
+					Msg             string `json:"msg"`
+					DNSRawQuery     []byte `json:"dnsRawQuery"`
+					DNSRawResponse  []byte `json:"dnsRawResponse"`
+					ODoHRawQuery    []byte `json:"odohRawQuery"`
+					ODoHRawResponse []byte `json:"odohRawResponse"`
+				}
+				if err := decoder.Decode(&entry); err != nil {
+					t.Fatal(err)
+				}
+				events[entry.Msg]++
+				switch entry.Msg {
+				case "odohQuery":
+					assert.NotEmpty(t, entry.DNSRawQuery)
+					assert.NotEmpty(t, entry.ODoHRawQuery)
+				case "odohResponse":
+					assert.NotEmpty(t, entry.DNSRawResponse)
+					assert.NotEmpty(t, entry.ODoHRawResponse)
+				}
+			}
+			assert.Equal(t, 1, events["dnsQuery"])
+			assert.Equal(t, 1, events["odohQuery"])
+			assert.Equal(t, 1, events["odohResponse"])
+			assert.Equal(t, 1, events["dnsResponse"])
+		})
+	}
+}
+
+func TestTransport_RoundTrip_DNSCrypt(t *testing.T) {
+	// create and start a testing server
+	server := &dnscoretest.Server{}
+	handler := dnscoretest.NewExampleComHandler()
+	<-server.StartDNSCrypt(handler)
+	defer server.Close()
+
+	// test fetching the certificate as well as using each certificate
+	certs := append([][]byte{nil}, server.DNSCryptCerts...)
+	for idx, cert := range certs {
+		t.Run(fmt.Sprintf("cert=%d", idx), func(t *testing.T) {
+			// create transport, server addr, and query
+			txp := &dnscore.Transport{}
+			serverAddr := &dnscore.ServerAddr{
+				Protocol:             dnscore.ProtocolDNSCrypt,
+				Address:              server.Addr,
+				DNSCryptCert:         cert,
+				DNSCryptProviderKey:  server.DNSCryptProviderKey,
+				DNSCryptProviderName: dnscoretest.DNSCryptProviderName,
+			}
+			query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// issue the query and get the response
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := txp.Query(ctx, serverAddr, query)
+
+			// verify the results
+			checkResult(t, resp, err)
+		})
+	}
+
+	t.Run("invalid provider key", func(t *testing.T) {
+		txp := &dnscore.Transport{}
+		serverAddr := &dnscore.ServerAddr{
+			Protocol:             dnscore.ProtocolDNSCrypt,
+			Address:              server.Addr,
+			DNSCryptProviderKey:  make([]byte, 32),
+			DNSCryptProviderName: dnscoretest.DNSCryptProviderName,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := txp.FetchDNSCryptCert(ctx, serverAddr)
+		assert.ErrorIs(t, err, dnscore.ErrNoValidDNSCryptCert)
+	})
+}
+
+func TestTransport_RoundTrip_DNSCryptTruncated(t *testing.T) {
+	// create and start a server returning responses larger than the query
+	server := &dnscoretest.Server{}
+	<-server.StartDNSCrypt(dnscoretest.HandlerFunc(func(rw dnscoretest.ResponseWriter, rawQuery []byte) {
+		query := &dns.Msg{}
+		if err := query.Unpack(rawQuery); err != nil {
+			return
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(query)
+		for idx := 0; idx < 32; idx++ {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   query.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    3600,
+				},
+				A: net.IPv4(10, 0, 0, byte(idx)),
+			})
+		}
+		rawResp, err := resp.Pack()
+		if err != nil {
+			return
+		}
+		_, _ = rw.Write(rawResp)
+	}))
+	defer server.Close()
+
+	// create transport, server addr, and query
+	logs := &bytes.Buffer{}
+	txp := &dnscore.Transport{
+		Logger: slog.New(slog.NewJSONHandler(logs, nil)),
+	}
+	serverAddr := &dnscore.ServerAddr{
+		Protocol:             dnscore.ProtocolDNSCrypt,
+		Address:              server.Addr,
+		DNSCryptCert:         server.DNSCryptCerts[1],
+		DNSCryptProviderKey:  server.DNSCryptProviderKey,
+		DNSCryptProviderName: dnscoretest.DNSCryptProviderName,
+	}
+	query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// issue the query and make sure we get the full response
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := txp.Query(ctx, serverAddr, query)
+	assert.NoError(t, err)
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, 32)
+
+	// make sure the logs contain the UDP exchange, the fallback, and the TCP exchange
+	var events []string
+	decoder := json.NewDecoder(logs)
+	for decoder.More() {
+		var entry struct {
+			FallbackProtocol string `json:"fallbackProtocol"`
+			Msg              string `json:"msg"`
+			Protocol         string `json:"protocol"`
+		}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		event := entry.Msg + "/" + entry.Protocol
+		if entry.FallbackProtocol != "" {
+			event += "->" + entry.FallbackProtocol
+		}
+		events = append(events, event)
+	}
+	assert.Equal(t, []string{
+		"dnsQuery/udp",
+		"dnsResponse/udp",
+		"dnsFallback/udp->tcp",
+		"dnsQuery/tcp",
+		"dnsResponse/tcp",
+	}, events)
+}
+
+// localAddrsFromLogs returns the localAddr of each dnsResponse log entry.
+func localAddrsFromLogs(t *testing.T, logs *bytes.Buffer) (addrs []string) {
+	decoder := json.NewDecoder(logs)
+	for decoder.More() {
+		var entry struct {
+			Msg       string `json:"msg"`
+			LocalAddr string `json:"localAddr"`
+		}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Msg == "dnsResponse" {
+			addrs = append(addrs, entry.LocalAddr)
+		}
+	}
+	return
+}
+
+func TestTransport_RoundTrip_QUICSessionCache(t *testing.T) {
+	// create and start a testing server
+	server := &dnscoretest.Server{}
+	handler := dnscoretest.NewExampleComHandler()
+	<-server.StartQUIC(handler)
+	defer server.Close()
+
+	// create transport using a session cache with a short idle timeout
+	cache := &dnscore.QUICSessionCache{
+		IdleTimeout:           250 * time.Millisecond,
+		TLSClientSessionCache: tls.NewLRUClientSessionCache(4),
+	}
+	defer cache.Close()
+	logs := &bytes.Buffer{}
+	txp := &dnscore.Transport{
+		Logger:           slog.New(slog.NewJSONHandler(logs, nil)),
+		QUICSessionCache: cache,
+		RootCAs:          server.RootCAs,
+	}
+	serverAddr := dnscore.NewServerAddr(dnscore.ProtocolDoQ, server.Addr)
+	query := func() {
+		query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		resp, err := txp.Query(ctx, serverAddr, query)
+		checkResult(t, resp, err)
+	}
+
+	// the first queries should share the same QUIC connection
+	for i := 0; i < 4; i++ {
+		query()
+	}
+
+	// after the connection idles out, we should reconnect
+	time.Sleep(time.Second)
+	query()
+
+	// make sure we used the expected local addresses
+	addrs := localAddrsFromLogs(t, logs)
+	if len(addrs) != 5 {
+		t.Fatal("expected 5 addrs, got", addrs)
+	}
+	for idx := 1; idx < 4; idx++ {
+		assert.Equal(t, addrs[0], addrs[idx])
+	}
+	assert.NotEqual(t, addrs[0], addrs[4])
+}
+
+func TestResolver_TruncatedUDPFallbackToTCP(t *testing.T) {
+	// create and start a UDP server that always truncates responses
+	udpServer := &dnscoretest.Server{}
+	<-udpServer.StartUDP(dnscoretest.HandlerFunc(func(rw dnscoretest.ResponseWriter, rawQuery []byte) {
+		query := &dns.Msg{}
+		if err := query.Unpack(rawQuery); err != nil {
+			return
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(query)
+		resp.Truncated = true
+		rawResp, err := resp.Pack()
+		if err != nil {
+			return
+		}
+		_, _ = rw.Write(rawResp)
+	}))
+	defer udpServer.Close()
+
+	// create and start a TCP server listening on the same endpoint
+	tcpServer := &dnscoretest.Server{
+		Listen: func(network, address string) (net.Listener, error) {
+			return net.Listen(network, udpServer.Addr)
+		},
+	}
+	<-tcpServer.StartTCP(dnscoretest.NewExampleComHandler())
+	defer tcpServer.Close()
+
+	// create the resolver using the UDP server
+	logs := &bytes.Buffer{}
+	config := dnscore.NewConfig()
+	config.AddServer(dnscore.NewServerAddr(dnscore.ProtocolUDP, udpServer.Addr))
+	reso := &dnscore.Resolver{
+		Config: config,
+		Logger: slog.New(slog.NewJSONHandler(logs, nil)),
+		Transport: &dnscore.Transport{
+			Logger: slog.New(slog.NewJSONHandler(logs, nil)),
+		},
+	}
+
+	// resolve and make sure we get the answer from the TCP server
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := reso.LookupA(ctx, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{dnscoretest.ExampleComAddrA.String()}, addrs)
+
+	// make sure the logs contain both exchanges and the fallback
+	var events []string
+	decoder := json.NewDecoder(logs)
+	for decoder.More() {
+		var entry struct {
+			Msg            string `json:"msg"`
+			ServerProtocol string `json:"serverProtocol"`
+		}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, entry.Msg+"/"+entry.ServerProtocol)
+	}
+	expect := []string{
+		"dnsQuery/udp",
+		"dnsResponse/udp",
+		"dnsFallback/udp",
+		"dnsQuery/tcp",
+		"dnsResponse/tcp",
+	}
+	assert.Equal(t, expect, events)
+}
+
+// newLocalhostHandler returns a handler resolving any name to 127.0.0.1.
+func newLocalhostHandler(queries *atomic.Int64) dnscoretest.Handler {
+	return dnscoretest.HandlerFunc(func(rw dnscoretest.ResponseWriter, rawQuery []byte) {
+		queries.Add(1)
+		query := &dns.Msg{}
+		if err := query.Unpack(rawQuery); err != nil {
+			return
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(query)
+		if query.Question[0].Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   query.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    3600,
+				},
+				A: net.IPv4(127, 0, 0, 1),
+			})
+		}
+		rawResp, err := resp.Pack()
+		if err != nil {
+			return
+		}
+		_, _ = rw.Write(rawResp)
+	})
+}
+
+func TestTransport_RoundTrip_Bootstrap(t *testing.T) {
+	// start a resolver for resolving www.example.com to 127.0.0.1
+	var bootstrapQueries atomic.Int64
+	bootstrapServer := &dnscoretest.Server{}
+	<-bootstrapServer.StartUDP(newLocalhostHandler(&bootstrapQueries))
+	defer bootstrapServer.Close()
+	bootstrapConfig := dnscore.NewConfig()
+	bootstrapConfig.AddServer(dnscore.NewServerAddr(dnscore.ProtocolUDP, bootstrapServer.Addr))
+	bootstrapResolver := &dnscore.Resolver{Config: bootstrapConfig}
+
+	// withHostname replaces 127.0.0.1 with www.example.com, which
+	// is a name included in the testing server certificate
+	withHostname := func(address string) string {
+		return strings.Replace(address, "127.0.0.1", "www.example.com", 1)
+	}
+
+	tests := []struct {
+		name      string
+		start     func(server *dnscoretest.Server) <-chan struct{}
+		protocol  dnscore.Protocol
+		address   func(server *dnscoretest.Server) string
+		bootstrap func(addr *dnscore.ServerAddr)
+	}{{
+		name: "DoT with bootstrap IPs",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartTLS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoT,
+		address:  func(server *dnscoretest.Server) string { return withHostname(server.Addr) },
+		bootstrap: func(addr *dnscore.ServerAddr) {
+			addr.BootstrapIPs = []netip.Addr{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.1")}
+		},
+	}, {
+		name: "DoT with bootstrap resolver",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartTLS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoT,
+		address:  func(server *dnscoretest.Server) string { return withHostname(server.Addr) },
+		bootstrap: func(addr *dnscore.ServerAddr) {
+			addr.BootstrapResolver = bootstrapResolver
+		},
+	}, {
+		name: "DoH with bootstrap IPs",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartHTTPS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoH,
+		address:  func(server *dnscoretest.Server) string { return withHostname(server.URL) },
+		bootstrap: func(addr *dnscore.ServerAddr) {
+			addr.BootstrapIPs = []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+		},
+	}, {
+		name: "DoH with bootstrap resolvers",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartHTTPS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoH,
+		address:  func(server *dnscoretest.Server) string { return withHostname(server.URL) },
+		bootstrap: func(addr *dnscore.ServerAddr) {
+			addr.BootstrapResolvers = []netip.AddrPort{netip.MustParseAddrPort(bootstrapServer.Addr)}
+		},
+	}, {
+		name: "DoH3 with bootstrap IPs",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartHTTP3(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoH3,
+		address:  func(server *dnscoretest.Server) string { return withHostname(server.URL) },
+		bootstrap: func(addr *dnscore.ServerAddr) {
+			addr.BootstrapIPs = []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+		},
+	}, {
+		name: "DoQ with bootstrap resolver",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartQUIC(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoQ,
+		address:  func(server *dnscoretest.Server) string { return withHostname(server.Addr) },
+		bootstrap: func(addr *dnscore.ServerAddr) {
+			addr.BootstrapResolver = bootstrapResolver
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// create and start a testing server
+			server := &dnscoretest.Server{}
+			<-tt.start(server)
+			defer server.Close()
+
+			// create transport, server addr, and query
+			txp := &dnscore.Transport{RootCAs: server.RootCAs}
+			serverAddr := dnscore.NewServerAddr(tt.protocol, tt.address(server))
+			tt.bootstrap(serverAddr)
+			query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// issue the query and get the response
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := txp.Query(ctx, serverAddr, query)
+
+			// verify the results
+			checkResult(t, resp, err)
+		})
+	}
+
+	// make sure we actually used the bootstrap resolver
+	assert.True(t, bootstrapQueries.Load() > 0)
+}
+
+// testServerSPKIHash returns the SHA-256 hash of the SubjectPublicKeyInfo
+// of the certificate used by the [*dnscoretest.Server].
+func testServerSPKIHash(t *testing.T) []byte {
+	data, err := os.ReadFile(filepath.Join("dnscoretest", "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("cannot decode PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hash[:]
+}
+
+// newSNIRecordingListenTLS returns a function suitable for the ListenTLS
+// field of [*dnscoretest.Server] that records the SNI sent by clients.
+func newSNIRecordingListenTLS(sni *atomic.Value) func(network, address string, config *tls.Config) (net.Listener, error) {
+	return func(network, address string, config *tls.Config) (net.Listener, error) {
+		config = config.Clone()
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni.Store(hello.ServerName)
+			return nil, nil
+		}
+		return tls.Listen(network, address, config)
+	}
+}
+
+func TestTransport_RoundTrip_TLSSettings(t *testing.T) {
+	spkiHash := testServerSPKIHash(t)
+
+	// withHostname replaces 127.0.0.1 with www.example.com, which
+	// is a name included in the testing server certificate
+	withHostname := func(address string) string {
+		return strings.Replace(address, "127.0.0.1", "www.example.com", 1)
+	}
+
+	tests := []struct {
+		name      string
+		start     func(server *dnscoretest.Server) <-chan struct{}
+		protocol  dnscore.Protocol
+		address   func(server *dnscoretest.Server) string
+		configure func(addr *dnscore.ServerAddr)
+		rootCAs   bool
+		expectSNI string
+		expectErr error
+	}{{
+		name: "DoT with custom server name",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartTLS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoT,
+		address:  func(server *dnscoretest.Server) string { return server.Addr },
+		configure: func(addr *dnscore.ServerAddr) {
+			addr.TLSServerName = "www.example.com"
+		},
+		rootCAs:   true,
+		expectSNI: "www.example.com",
+	}, {
+		name: "DoT with omitted server name",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartTLS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoT,
+		address:  func(server *dnscoretest.Server) string { return withHostname(server.Addr) },
+		configure: func(addr *dnscore.ServerAddr) {
+			addr.BootstrapIPs = []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+			addr.TLSOmitServerName = true
+		},
+		rootCAs:   true,
+		expectSNI: "",
+	}, {
+		name: "DoT with custom next protos",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartTLS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoT,
+		address:  func(server *dnscoretest.Server) string { return withHostname(server.Addr) },
+		configure: func(addr *dnscore.ServerAddr) {
+			addr.BootstrapIPs = []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+			addr.TLSNextProtos = []string{"custom"}
+		},
+		rootCAs:   true,
+		expectSNI: "www.example.com",
+	}, {
+		name: "DoT with matching SPKI hash",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartTLS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoT,
+		address:  func(server *dnscoretest.Server) string { return server.Addr },
+		configure: func(addr *dnscore.ServerAddr) {
+			addr.SPKIHashes = [][]byte{spkiHash}
+		},
+		rootCAs:   true,
+		expectSNI: "",
+	}, {
+		name: "DoT with mismatching SPKI hash",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartTLS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoT,
+		address:  func(server *dnscoretest.Server) string { return server.Addr },
+		configure: func(addr *dnscore.ServerAddr) {
+			addr.SPKIHashes = [][]byte{make([]byte, 32)}
+		},
+		rootCAs:   true,
+		expectErr: dnscore.ErrSPKIHashMismatch,
+	}, {
+		name: "DoT with SPKI hashes replacing the root CAs",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartTLS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoT,
+		address:  func(server *dnscoretest.Server) string { return server.Addr },
+		configure: func(addr *dnscore.ServerAddr) {
+			addr.SPKIHashes = [][]byte{spkiHash}
+			addr.SPKIHashesOnly = true
+		},
+		rootCAs:   false,
+		expectSNI: "",
+	}, {
+		name: "DoH with custom server name",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartHTTPS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoH,
+		address:  func(server *dnscoretest.Server) string { return server.URL },
+		configure: func(addr *dnscore.ServerAddr) {
+			addr.TLSServerName = "www.example.com"
+		},
+		rootCAs:   true,
+		expectSNI: "www.example.com",
+	}, {
+		name: "DoH with omitted server name",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartHTTPS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoH,
+		address:  func(server *dnscoretest.Server) string { return withHostname(server.URL) },
+		configure: func(addr *dnscore.ServerAddr) {
+			addr.BootstrapIPs = []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+			addr.TLSOmitServerName = true
+		},
+		rootCAs:   true,
+		expectSNI: "",
+	}, {
+		name: "DoH with mismatching SPKI hash",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartHTTPS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoH,
+		address:  func(server *dnscoretest.Server) string { return server.URL },
+		configure: func(addr *dnscore.ServerAddr) {
+			addr.SPKIHashes = [][]byte{make([]byte, 32)}
+		},
+		rootCAs:   true,
+		expectErr: dnscore.ErrSPKIHashMismatch,
+	}, {
+		name: "DoH3 with custom server name",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartHTTP3(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoH3,
+		address:  func(server *dnscoretest.Server) string { return server.URL },
+		configure: func(addr *dnscore.ServerAddr) {
+			addr.TLSServerName = "www.example.com"
+		},
+		rootCAs: true,
+	}, {
+		name: "DoQ with omitted server name and matching SPKI hash",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartQUIC(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoQ,
+		address:  func(server *dnscoretest.Server) string { return withHostname(server.Addr) },
+		configure: func(addr *dnscore.ServerAddr) {
+			addr.BootstrapIPs = []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+			addr.TLSOmitServerName = true
+			addr.SPKIHashes = [][]byte{spkiHash}
+		},
+		rootCAs: true,
+	}, {
+		name: "DoQ with mismatching SPKI hash",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartQUIC(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoQ,
+		address:  func(server *dnscoretest.Server) string { return server.Addr },
+		configure: func(addr *dnscore.ServerAddr) {
+			addr.SPKIHashes = [][]byte{make([]byte, 32)}
+		},
+		rootCAs:   true,
+		expectErr: dnscore.ErrSPKIHashMismatch,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// create and start a testing server recording the SNI
+			var sni atomic.Value
+			server := &dnscoretest.Server{ListenTLS: newSNIRecordingListenTLS(&sni)}
+			<-tt.start(server)
+			defer server.Close()
+
+			// create transport, server addr, and query
+			txp := &dnscore.Transport{}
+			if tt.rootCAs {
+				txp.RootCAs = server.RootCAs
+			}
+			serverAddr := dnscore.NewServerAddr(tt.protocol, tt.address(server))
+			tt.configure(serverAddr)
+			query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// issue the query and get the response
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := txp.Query(ctx, serverAddr, query)
+
+			// verify the results
+			if tt.expectErr != nil {
+				assert.ErrorIs(t, err, tt.expectErr)
+				assert.Nil(t, resp)
+				return
+			}
+			checkResult(t, resp, err)
+			if tt.protocol == dnscore.ProtocolDoT || tt.protocol == dnscore.ProtocolDoH {
+				assert.Equal(t, tt.expectSNI, sni.Load())
+			}
+		})
+	}
+}
+
+func TestTransport_RoundTrip_LogTLSCertificates(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    func(server *dnscoretest.Server) <-chan struct{}
+		protocol dnscore.Protocol
+		address  func(server *dnscoretest.Server) string
+	}{{
+		name: "DoT",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartTLS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoT,
+		address:  func(server *dnscoretest.Server) string { return server.Addr },
+	}, {
+		name: "DoH",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartHTTPS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoH,
+		address:  func(server *dnscoretest.Server) string { return server.URL },
+	}, {
+		name: "DoH3",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartHTTP3(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoH3,
+		address:  func(server *dnscoretest.Server) string { return server.URL },
+	}, {
+		name: "DoQ",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartQUIC(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoQ,
+		address:  func(server *dnscoretest.Server) string { return server.Addr },
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// create and start a testing server
+			server := &dnscoretest.Server{}
+			<-tt.start(server)
+			defer server.Close()
+
+			// create a transport logging to a buffer
+			var logs bytes.Buffer
+			txp := &dnscore.Transport{
+				HTTPClient: &http.Client{
+					Transport: &http.Transport{
+						TLSClientConfig: &tls.Config{
+							RootCAs: server.RootCAs,
+						},
+					},
+				},
+				Logger:  slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{})),
+				RootCAs: server.RootCAs,
+			}
+
+			// create server addr and query
+			serverAddr := dnscore.NewServerAddr(tt.protocol, tt.address(server))
+			serverAddr.LogTLSCertificates = true
+			query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// issue the query and get the response
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := txp.Query(ctx, serverAddr, query)
+			checkResult(t, resp, err)
+
+			// make sure the dnsResponse event contains the certificate chain
+			var certs [][]byte
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				var entry struct {
+					Msg                 string
+					TLSPeerCertificates [][]byte `json:"tlsPeerCertificates"`
+				}
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatal(err)
+				}
+				if entry.Msg == "dnsResponse" {
+					certs = entry.TLSPeerCertificates
+				}
+			}
+			if assert.Len(t, certs, 1) {
+				cert, err := x509.ParseCertificate(certs[0])
+				assert.NoError(t, err)
+				assert.Equal(t, "example.com", cert.Subject.CommonName)
+			}
+		})
+	}
+}
+
+func TestTransport_RoundTrip_ClientCertificates(t *testing.T) {
+	clientCert, clientCAs := dnscoretest.NewClientCert()
+
+	tests := []struct {
+		name     string
+		start    func(server *dnscoretest.Server) <-chan struct{}
+		protocol dnscore.Protocol
+		address  func(server *dnscoretest.Server) string
+		connPool bool
+	}{{
+		name: "DoT",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartTLS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoT,
+		address:  func(server *dnscoretest.Server) string { return server.Addr },
+	}, {
+		name: "DoT with connection pool",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartTLS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoT,
+		address:  func(server *dnscoretest.Server) string { return server.Addr },
+		connPool: true,
+	}, {
+		name: "DoH",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartHTTPS(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoH,
+		address:  func(server *dnscoretest.Server) string { return server.URL },
+	}, {
+		name: "DoH3",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartHTTP3(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoH3,
+		address:  func(server *dnscoretest.Server) string { return server.URL },
+	}, {
+		name: "DoQ",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartQUIC(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoQ,
+		address:  func(server *dnscoretest.Server) string { return server.Addr },
+	}}
+
+	for _, tt := range tests {
+		for _, withCert := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s with client certificate %v", tt.name, withCert), func(t *testing.T) {
+				// create and start a testing server requiring client certificates
+				server := &dnscoretest.Server{ClientCAs: clientCAs}
+				<-tt.start(server)
+				defer server.Close()
+
+				// create transport, server addr, and query
+				txp := &dnscore.Transport{RootCAs: server.RootCAs}
+				if withCert {
+					txp.ClientCertificates = []tls.Certificate{clientCert}
+				} else {
+					// make sure DoH fails because of the missing client
+					// certificate rather than because of the root CAs
+					txp.HTTPClient = &http.Client{
+						Transport: &http.Transport{
+							TLSClientConfig: &tls.Config{RootCAs: server.RootCAs},
+						},
+					}
+				}
+				if tt.connPool {
+					txp.ConnPool = &dnscore.ConnPool{}
+					defer txp.ConnPool.Close()
+				}
+				serverAddr := dnscore.NewServerAddr(tt.protocol, tt.address(server))
+				query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// issue the query and get the response
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				resp, err := txp.Query(ctx, serverAddr, query)
+
+				// verify the results
+				if !withCert {
+					assert.ErrorContains(t, err, "certificate required")
+					assert.Nil(t, resp)
+					return
+				}
+				checkResult(t, resp, err)
+			})
+		}
+	}
+}
+
+func TestTransport_RoundTrip_DialQUICContext(t *testing.T) {
+	// create and start a testing server
+	server := &dnscoretest.Server{}
+	<-server.StartQUIC(dnscoretest.NewExampleComHandler())
+	defer server.Close()
+
+	// create a transport with a dialer wrapping the default one
+	var dials atomic.Int64
+	txp := &dnscore.Transport{
+		DialQUICContext: func(ctx context.Context, address string,
+			tlsConfig *tls.Config, quicConfig *quic.Config, early bool) (dnscore.QUICConn, error) {
+			dials.Add(1)
+			return dnscore.DefaultDialQUICContext(ctx, address, tlsConfig, quicConfig, early)
+		},
+		QUICSessionCache: &dnscore.QUICSessionCache{},
+		RootCAs:          server.RootCAs,
+	}
+	defer txp.QUICSessionCache.Close()
+
+	// issue multiple queries reusing the same server addr
+	serverAddr := dnscore.NewServerAddr(dnscore.ProtocolDoQ, server.Addr)
+	for idx := 0; idx < 3; idx++ {
+		query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		resp, err := txp.Query(ctx, serverAddr, query)
+		cancel()
+		checkResult(t, resp, err)
+	}
+
+	// make sure we used the custom dialer a single time
+	assert.Equal(t, int64(1), dials.Load())
+}
+
+// countingPacketConn is a [net.PacketConn] counting the packets.
+type countingPacketConn struct {
+	net.PacketConn
+	reads  *atomic.Int64
+	writes *atomic.Int64
+}
+
+func (c *countingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.reads.Add(1)
+	}
+	return n, addr, err
+}
+
+func (c *countingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if err == nil {
+		c.writes.Add(1)
+	}
+	return n, err
+}
+
+func TestTransport_RoundTrip_ListenPacket(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    func(server *dnscoretest.Server) <-chan struct{}
+		protocol dnscore.Protocol
+		address  func(server *dnscoretest.Server) string
+	}{{
+		name: "DoQ",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartQUIC(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoQ,
+		address:  func(server *dnscoretest.Server) string { return server.Addr },
+	}, {
+		name: "DoH3",
+		start: func(server *dnscoretest.Server) <-chan struct{} {
+			return server.StartHTTP3(dnscoretest.NewExampleComHandler())
+		},
+		protocol: dnscore.ProtocolDoH3,
+		address:  func(server *dnscoretest.Server) string { return server.URL },
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// create and start a testing server
+			server := &dnscoretest.Server{}
+			<-tt.start(server)
+			defer server.Close()
+
+			// create a transport wrapping the UDP sockets
+			var listens, reads, writes atomic.Int64
+			txp := &dnscore.Transport{
+				ListenPacket: func(ctx context.Context, network, address string) (net.PacketConn, error) {
+					listens.Add(1)
+					lc := &net.ListenConfig{}
+					conn, err := lc.ListenPacket(ctx, network, address)
+					if err != nil {
+						return nil, err
+					}
+					return &countingPacketConn{PacketConn: conn, reads: &reads, writes: &writes}, nil
+				},
+				RootCAs: server.RootCAs,
+			}
+
+			// issue the query and get the response
+			serverAddr := dnscore.NewServerAddr(tt.protocol, tt.address(server))
+			query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := txp.Query(ctx, serverAddr, query)
+			checkResult(t, resp, err)
+
+			// make sure the packets went through our socket
+			assert.Equal(t, int64(1), listens.Load())
+			assert.Positive(t, reads.Load())
+			assert.Positive(t, writes.Load())
+		})
+	}
+}
+
+func TestTransport_RoundTrip_NewQUICConn(t *testing.T) {
+	// create and start a testing server
+	server := &dnscoretest.Server{}
+	<-server.StartQUIC(dnscoretest.NewExampleComHandler())
+	defer server.Close()
+
+	// create a transport with a dialer using its own socket
+	var closed atomic.Bool
+	txp := &dnscore.Transport{
+		DialQUICContext: func(ctx context.Context, address string,
+			tlsConfig *tls.Config, quicConfig *quic.Config, early bool) (dnscore.QUICConn, error) {
+			udpConn, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				return nil, err
+			}
+			tr := &quic.Transport{Conn: udpConn}
+			conn, err := tr.Dial(ctx, net.UDPAddrFromAddrPort(netip.MustParseAddrPort(address)), tlsConfig, quicConfig)
+			if err != nil {
+				tr.Close()
+				udpConn.Close()
+				return nil, err
+			}
+			marker := closepool.CloserFunc(func() error {
+				closed.Store(true)
+				return nil
+			})
+			return dnscore.NewQUICConn(conn, tr, udpConn, marker), nil
+		},
+		RootCAs: server.RootCAs,
+	}
+
+	// issue the query and get the response
+	serverAddr := dnscore.NewServerAddr(dnscore.ProtocolDoQ, server.Addr)
+	query, err := dnscore.NewQueryWithServerAddr(serverAddr, "example.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := txp.Query(ctx, serverAddr, query)
+	checkResult(t, resp, err)
+
+	// make sure closing the connection closed the resources we passed
+	assert.True(t, closed.Load())
+}
+
+// writeTSIGResponse writes the given response to the given query, verifying
+// the query using the secret and signing the response using the signSecret,
+// like a server would do, when the query is signed and the secret is not
+// empty. When we cannot verify the query, we set the TSIG error and the
+// NOTAUTH RCODE like RFC 8945 Sect. 5.2 requires.
+func writeTSIGResponse(rw dnscoretest.ResponseWriter,
+	rawQuery []byte, query, resp *dns.Msg, keyName, secret, signSecret string) {
+	// 1. handle the case where we're not signing the response
+	queryTSIG := query.IsTsig()
+	if secret == "" || queryTSIG == nil {
+		rawResp, err := resp.Pack()
+		if err != nil {
+			return
+		}
+		_, _ = rw.Write(rawResp)
+		return
+	}
+
+	// 2. verify the query and determine the TSIG error
+	var tsigErr uint16
+	switch {
+	case queryTSIG.Hdr.Name != dns.Fqdn(keyName):
+		tsigErr = dns.RcodeBadKey
+	case dns.TsigVerify(rawQuery, secret, "", false) != nil:
+		tsigErr = dns.RcodeBadSig
+	}
+	if tsigErr != 0 {
+		resp.Rcode = dns.RcodeNotAuth
+	}
+
+	// 3. sign the response and send it
+	resp.SetTsig(queryTSIG.Hdr.Name, queryTSIG.Algorithm, 300, time.Now().Unix())
+	resp.Extra[len(resp.Extra)-1].(*dns.TSIG).Error = tsigErr
+	rawResp, _, err := dns.TsigGenerate(resp, signSecret, queryTSIG.MAC, false)
+	if err != nil {
+		return
+	}
+	_, _ = rw.Write(rawResp)
+}
+
+// newTSIGExampleComHandler is like [dnscoretest.NewExampleComHandler] but
+// verifies the queries and signs the responses using TSIG (see [writeTSIGResponse]).
+func newTSIGExampleComHandler(keyName, secret, signSecret string) dnscoretest.Handler {
+	return dnscoretest.HandlerFunc(func(rw dnscoretest.ResponseWriter, rawQuery []byte) {
+		query := &dns.Msg{}
+		if err := query.Unpack(rawQuery); err != nil {
+			return
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(query)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   "example.com.",
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    3600,
+			},
+			A: dnscoretest.ExampleComAddrA,
+		})
+		writeTSIGResponse(rw, rawQuery, query, resp, keyName, secret, signSecret)
+	})
+}
+
+func TestTransport_RoundTrip_TSIG(t *testing.T) {
+	const secret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZy1wdXJwb3Nlcw=="
+	key := &dnscore.TSIGKey{Name: "key.example.com.", Secret: secret}
+
+	tests := []struct {
+		name          string
+		start         func(server *dnscoretest.Server, handler dnscoretest.Handler) <-chan struct{}
+		protocol      dnscore.Protocol
+		address       func(server *dnscoretest.Server) string
+		connPool      bool
+		serverKeyName string
+		serverSecret  string
+		signSecret    string
+		skew          time.Duration
+		verify        bool
+		expectErr     error
+	}{{
+		name:          "UDP",
+		start:         (*dnscoretest.Server).StartUDP,
+		protocol:      dnscore.ProtocolUDP,
+		address:       func(server *dnscoretest.Server) string { return server.Addr },
+		serverKeyName: "key.example.com.",
+		serverSecret:  secret,
+		verify:        true,
+	}, {
+		name:          "TCP",
+		start:         (*dnscoretest.Server).StartTCP,
+		protocol:      dnscore.ProtocolTCP,
+		address:       func(server *dnscoretest.Server) string { return server.Addr },
+		serverKeyName: "key.example.com.",
+		serverSecret:  secret,
+		verify:        true,
+	}, {
+		name:          "TCP with connection pool",
+		start:         (*dnscoretest.Server).StartTCP,
+		protocol:      dnscore.ProtocolTCP,
+		address:       func(server *dnscoretest.Server) string { return server.Addr },
+		connPool:      true,
+		serverKeyName: "key.example.com.",
+		serverSecret:  secret,
+		verify:        true,
+	}, {
+		name:          "DoT",
+		start:         (*dnscoretest.Server).StartTLS,
+		protocol:      dnscore.ProtocolDoT,
+		address:       func(server *dnscoretest.Server) string { return server.Addr },
+		serverKeyName: "key.example.com.",
+		serverSecret:  secret,
+		verify:        true,
+	}, {
+		name:          "DoH",
+		start:         (*dnscoretest.Server).StartHTTPS,
+		protocol:      dnscore.ProtocolDoH,
+		address:       func(server *dnscoretest.Server) string { return server.URL },
+		serverKeyName: "key.example.com.",
+		serverSecret:  secret,
+		verify:        true,
+	}, {
+		name:          "UDP without verifying the MAC",
+		start:         (*dnscoretest.Server).StartUDP,
+		protocol:      dnscore.ProtocolUDP,
+		address:       func(server *dnscoretest.Server) string { return server.Addr },
+		serverKeyName: "key.example.com.",
+		serverSecret:  secret,
+		signSecret:    "d3Jvbmc=",
+		verify:        false,
+	}, {
+		name:          "UDP with response signed using another secret",
+		start:         (*dnscoretest.Server).StartUDP,
+		protocol:      dnscore.ProtocolUDP,
+		address:       func(server *dnscoretest.Server) string { return server.Addr },
+		serverKeyName: "key.example.com.",
+		serverSecret:  secret,
+		signSecret:    "d3Jvbmc=",
+		verify:        true,
+		expectErr:     dnscore.ErrTSIGBadSig,
+	}, {
+		name:          "UDP with query the server cannot verify",
+		start:         (*dnscoretest.Server).StartUDP,
+		protocol:      dnscore.ProtocolUDP,
+		address:       func(server *dnscoretest.Server) string { return server.Addr },
+		serverKeyName: "key.example.com.",
+		serverSecret:  "d3Jvbmc=",
+		verify:        true,
+		expectErr:     dnscore.ErrTSIGBadSig,
+	}, {
+		name:          "UDP with unsigned response",
+		start:         (*dnscoretest.Server).StartUDP,
+		protocol:      dnscore.ProtocolUDP,
+		address:       func(server *dnscoretest.Server) string { return server.Addr },
+		serverKeyName: "key.example.com.",
+		serverSecret:  "",
+		verify:        true,
+		expectErr:     dnscore.ErrTSIGBadSig,
+	}, {
+		name:          "UDP with key unknown to the server",
+		start:         (*dnscoretest.Server).StartUDP,
+		protocol:      dnscore.ProtocolUDP,
+		address:       func(server *dnscoretest.Server) string { return server.Addr },
+		serverKeyName: "other.example.com.",
+		serverSecret:  secret,
+		verify:        true,
+		expectErr:     dnscore.ErrTSIGBadKey,
+	}, {
+		name:          "UDP with clock skew",
+		start:         (*dnscoretest.Server).StartUDP,
+		protocol:      dnscore.ProtocolUDP,
+		address:       func(server *dnscoretest.Server) string { return server.Addr },
+		serverKeyName: "key.example.com.",
+		serverSecret:  secret,
+		skew:          time.Hour,
+		verify:        true,
+		expectErr:     dnscore.ErrTSIGBadTime,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// create and start a testing server
+			server := &dnscoretest.Server{}
+			signSecret := tt.serverSecret
+			if tt.signSecret != "" {
+				signSecret = tt.signSecret
+			}
+			handler := newTSIGExampleComHandler(tt.serverKeyName, tt.serverSecret, signSecret)
+			<-tt.start(server, handler)
+			defer server.Close()
+
+			// create transport, server addr, and signed query
+			txp := &dnscore.Transport{
+				HTTPClient: &http.Client{
+					Transport: &http.Transport{
+						TLSClientConfig: &tls.Config{RootCAs: server.RootCAs},
+					},
+				},
+				RootCAs: server.RootCAs,
+				TimeNow: func() time.Time { return time.Now().Add(tt.skew) },
+			}
+			if tt.connPool {
+				txp.ConnPool = &dnscore.ConnPool{}
+				defer txp.ConnPool.Close()
+			}
+			serverAddr := dnscore.NewServerAddr(tt.protocol, tt.address(server))
+			if tt.verify {
+				serverAddr.TSIGKey = key
+			}
+			query, err := dnscore.NewQueryWithServerAddr(
+				serverAddr, "example.com", dns.TypeA, dnscore.QueryOptionTSIG(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// issue the query, get the response, and validate it
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := txp.Query(ctx, serverAddr, query)
+			if err == nil {
+				err = dnscore.ValidateResponse(query, resp)
+			}
+
+			// verify the results
+			if tt.expectErr != nil {
+				assert.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+			checkResult(t, resp, err)
+			assert.NotNil(t, resp.IsTsig())
+		})
+	}
+}
+
+func TestTruncatedUDPFallbackToTCP_TSIG(t *testing.T) {
+	const secret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZy1wdXJwb3Nlcw=="
+	key := &dnscore.TSIGKey{Name: "key.example.com.", Secret: secret}
+
+	// create and start a UDP server that always truncates the
+	// responses, which it correctly signs using TSIG
+	udpServer := &dnscoretest.Server{}
+	<-udpServer.StartUDP(dnscoretest.HandlerFunc(func(rw dnscoretest.ResponseWriter, rawQuery []byte) {
+		query := &dns.Msg{}
+		if err := query.Unpack(rawQuery); err != nil {
+			return
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(query)
+		resp.Truncated = true
+		writeTSIGResponse(rw, rawQuery, query, resp, key.Name, secret, secret)
+	}))
+	defer udpServer.Close()
+
+	// create and start a TCP server listening on the same endpoint
+	// that signs the responses using another secret
+	tcpServer := &dnscoretest.Server{
+		Listen: func(network, address string) (net.Listener, error) {
+			return net.Listen(network, udpServer.Addr)
+		},
+	}
+	<-tcpServer.StartTCP(newTSIGExampleComHandler(key.Name, secret, "d3Jvbmc="))
+	defer tcpServer.Close()
+
+	// create the server addr verifying the responses
+	serverAddr := dnscore.NewServerAddr(dnscore.ProtocolUDP, udpServer.Addr)
+	serverAddr.TSIGKey = key
+
+	t.Run("Transport", func(t *testing.T) {
+		txp := &dnscore.Transport{FallbackToTCPOnTruncation: true}
+		query, err := dnscore.NewQueryWithServerAddr(
+			serverAddr, "example.com", dns.TypeA, dnscore.QueryOptionTSIG(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		resp, err := txp.Query(ctx, serverAddr, query)
+		assert.ErrorIs(t, err, dnscore.ErrTSIGBadSig)
+		assert.Nil(t, resp)
+	})
+
+	t.Run("Resolver", func(t *testing.T) {
+		config := dnscore.NewConfig()
+		config.AddServer(serverAddr, dnscore.ServerOptionQueryOptions(dnscore.QueryOptionTSIG(key)))
+		reso := &dnscore.Resolver{Config: config}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		addrs, err := reso.LookupA(ctx, "example.com")
+		assert.ErrorIs(t, err, dnscore.ErrTSIGBadSig)
+		assert.Empty(t, addrs)
+	})
+}
+
+// newUpdateHandler returns a handler accepting UPDATE messages for
+// example.com signed with the given TSIG secret, if not empty, which
+// responds using the given RCODE, or NOTAUTH if the signature is invalid.
+func newUpdateHandler(secret string, rcode int, updates *atomic.Int64) dnscoretest.Handler {
+	return dnscoretest.HandlerFunc(func(rw dnscoretest.ResponseWriter, rawQuery []byte) {
+		update := &dns.Msg{}
+		if err := update.Unpack(rawQuery); err != nil {
+			return
+		}
+		resp := &dns.Msg{}
+		resp.SetRcode(update, rcode)
+		if update.Opcode != dns.OpcodeUpdate {
+			resp.Rcode = dns.RcodeRefused
+		}
+		if secret != "" && update.IsTsig() == nil {
+			resp.Rcode = dns.RcodeNotAuth
+		}
+		updates.Add(1)
+		writeTSIGResponse(rw, rawQuery, update, resp, "key.example.com.", secret, secret)
+	})
+}
+
+func TestTransport_Update(t *testing.T) {
+	const secret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZy1wdXJwb3Nlcw=="
+	key := &dnscore.TSIGKey{Name: "key.example.com.", Secret: secret}
+	wrongKey := &dnscore.TSIGKey{Name: "key.example.com.", Secret: "d3Jvbmc="}
+
+	tests := []struct {
+		name      string
+		protocol  dnscore.Protocol
+		secret    string
+		rcode     int
+		key       *dnscore.TSIGKey
+		expectErr error
+	}{
+		{name: "UDP without TSIG", protocol: dnscore.ProtocolUDP, rcode: dns.RcodeSuccess},
+		{name: "TCP without TSIG", protocol: dnscore.ProtocolTCP, rcode: dns.RcodeSuccess},
+		{name: "UDP with TSIG", protocol: dnscore.ProtocolUDP, secret: secret, rcode: dns.RcodeSuccess, key: key},
+		{name: "TCP with TSIG", protocol: dnscore.ProtocolTCP, secret: secret, rcode: dns.RcodeSuccess, key: key},
+		{
+			name:      "UDP with wrong TSIG secret",
+			protocol:  dnscore.ProtocolUDP,
+			secret:    secret,
+			rcode:     dns.RcodeSuccess,
+			key:       wrongKey,
+			expectErr: dnscore.ErrTSIGBadSig,
+		},
+		{
+			name:      "UDP with missing TSIG",
+			protocol:  dnscore.ProtocolUDP,
+			secret:    secret,
+			rcode:     dns.RcodeSuccess,
+			expectErr: dnscore.ErrUpdateNotAuth,
+		},
+		{
+			name:      "TCP with failed prerequisite",
+			protocol:  dnscore.ProtocolTCP,
+			rcode:     dns.RcodeYXRrset,
+			expectErr: dnscore.ErrUpdateYXRRSet,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// create and start a testing server
+			var updates atomic.Int64
+			server := &dnscoretest.Server{}
+			handler := newUpdateHandler(tt.secret, tt.rcode, &updates)
+			switch tt.protocol {
+			case dnscore.ProtocolUDP:
+				<-server.StartUDP(handler)
+			default:
+				<-server.StartTCP(handler)
+			}
+			defer server.Close()
+
+			// create the transport, server addr, and update
+			txp := &dnscore.Transport{}
+			serverAddr := dnscore.NewServerAddr(tt.protocol, server.Addr)
+			update, err := dnscore.NewUpdate(
+				"example.com",
+				dnscore.UpdatePrereqRRsetNotExists("www.example.com", dns.TypeA),
+				dnscore.UpdateAddRRs(&dns.A{
+					Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.IPv4(10, 0, 0, 1),
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// send the update and get the response
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := txp.Update(ctx, serverAddr, update, tt.key)
+
+			// verify the results
+			assert.Equal(t, int64(1), updates.Load())
+			if tt.expectErr != nil {
+				assert.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotNil(t, resp)
+		})
+	}
+}
+
+func TestTransport_UpdateConnPool(t *testing.T) {
+	const secret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZy1wdXJwb3Nlcw=="
+	key := &dnscore.TSIGKey{Name: "key.example.com.", Secret: secret}
+
+	// create and start a testing server
+	var updates atomic.Int64
+	server := &dnscoretest.Server{}
+	<-server.StartTCP(newUpdateHandler(secret, dns.RcodeSuccess, &updates))
+	defer server.Close()
+
+	// create transport with a connection pool and count dials
+	var dials atomic.Int64
+	pool := &dnscore.ConnPool{}
+	defer pool.Close()
+	dialer := &net.Dialer{}
+	txp := &dnscore.Transport{
+		ConnPool: pool,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dials.Add(1)
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+	serverAddr := dnscore.NewServerAddr(dnscore.ProtocolTCP, server.Addr)
+
+	// send several signed updates and make sure they share the connection
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		update, err := dnscore.NewUpdate("example.com", dnscore.UpdateDeleteRRset("www.example.com", dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := txp.Update(ctx, serverAddr, update, key)
+		assert.NoError(t, err)
+		assert.NotNil(t, resp)
+	}
+	assert.Equal(t, int64(3), updates.Load())
+	assert.Equal(t, int64(1), dials.Load())
+}
+
+// zoneTransferHandler is a handler serving transfers of the example.com
+// zone, whose current serial is 10, sending one RR per message.
+type zoneTransferHandler struct {
+	// ixfr indicates whether the handler supports IXFR.
+	ixfr bool
+
+	// secret is the optional TSIG secret for signing the messages.
+	secret string
+
+	// rcode is the optional RCODE to use for responding.
+	rcode int
+}
+
+// zoneTransferSOA returns the example.com SOA with the given serial.
+func zoneTransferSOA(serial uint32) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:      "ns.example.com.",
+		Mbox:    "admin.example.com.",
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  300,
+	}
+}
+
+// zoneTransferA returns an A RR for www.example.com with the given last octet.
+func zoneTransferA(octet byte) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+		A:   net.IPv4(10, 0, 0, octet),
+	}
+}
+
+// Handle implements dnscoretest.Handler.
+func (h *zoneTransferHandler) Handle(rw dnscoretest.ResponseWriter, rawQuery []byte) {
+	query := &dns.Msg{}
+	if err := query.Unpack(rawQuery); err != nil || len(query.Question) != 1 {
+		return
+	}
+
+	// 1. determine the RRs to send or the RCODE to use
+	rcode := h.rcode
+	rrs := []dns.RR{zoneTransferSOA(10), zoneTransferA(1), zoneTransferA(2), zoneTransferSOA(10)}
+	if query.Question[0].Qtype == dns.TypeIXFR {
+		var clientSerial uint32
+		if len(query.Ns) == 1 {
+			clientSerial = query.Ns[0].(*dns.SOA).Serial
+		}
+		switch {
+		case !h.ixfr:
+			rcode = dns.RcodeNotImplemented
+		case clientSerial == 10:
+			rrs = []dns.RR{zoneTransferSOA(10)}
+		case clientSerial == 9:
+			rrs = []dns.RR{
+				zoneTransferSOA(10),
+				zoneTransferSOA(9), zoneTransferA(3),
+				zoneTransferSOA(10), zoneTransferA(2),
+				zoneTransferSOA(10),
+			}
+		}
+	}
+	if rcode != dns.RcodeSuccess {
+		rrs = []dns.RR{nil}
+	}
+
+	// 2. send each RR using a distinct message, possibly signed using TSIG
+	queryTSIG := query.IsTsig()
+	var prevMAC string
+	for idx, rr := range rrs {
+		resp := &dns.Msg{}
+		resp.SetRcode(query, rcode)
+		resp.Authoritative = true
+		resp.Ns = nil
+		if idx > 0 {
+			resp.Question = nil
+		}
+		if rr != nil {
+			resp.Answer = []dns.RR{rr}
+		}
+		var (
+			rawResp []byte
+			err     error
+		)
+		switch {
+		case h.secret != "" && queryTSIG != nil && idx == 0:
+			resp.SetTsig(queryTSIG.Hdr.Name, queryTSIG.Algorithm, 300, time.Now().Unix())
+			rawResp, prevMAC, err = dns.TsigGenerate(resp, h.secret, queryTSIG.MAC, false)
+		case h.secret != "" && queryTSIG != nil:
+			resp.SetTsig(queryTSIG.Hdr.Name, queryTSIG.Algorithm, 300, time.Now().Unix())
+			rawResp, prevMAC, err = dns.TsigGenerate(resp, h.secret, prevMAC, true)
+		default:
+			rawResp, err = resp.Pack()
+		}
+		if err != nil {
+			return
+		}
+		if _, err := rw.Write(rawResp); err != nil {
+			return
+		}
+	}
+}
+
+func TestTransport_Transfer(t *testing.T) {
+	const secret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZy1wdXJwb3Nlcw=="
+	key := &dnscore.TSIGKey{Name: "key.example.com.", Secret: secret}
+
+	tests := []struct {
+		name         string
+		start        func(server *dnscoretest.Server, handler dnscoretest.Handler) <-chan struct{}
+		protocol     dnscore.Protocol
+		handler      *zoneTransferHandler
+		ixfrSerial   uint32
+		sign         bool
+		expectRRs    int
+		expectEvents []string
+		expectErr    error
+	}{{
+		name:      "AXFR over TCP",
+		start:     (*dnscoretest.Server).StartTCP,
+		protocol:  dnscore.ProtocolTCP,
+		handler:   &zoneTransferHandler{},
+		expectRRs: 4,
+		expectEvents: []string{
+			"dnsQuery/tcp",
+			"dnsResponse/tcp", "dnsResponse/tcp", "dnsResponse/tcp", "dnsResponse/tcp",
+		},
+	}, {
+		name:      "AXFR over TLS",
+		start:     (*dnscoretest.Server).StartTLS,
+		protocol:  dnscore.ProtocolDoT,
+		handler:   &zoneTransferHandler{},
+		expectRRs: 4,
+		expectEvents: []string{
+			"dnsQuery/tcp",
+			"dnsResponse/tcp", "dnsResponse/tcp", "dnsResponse/tcp", "dnsResponse/tcp",
+		},
+	}, {
+		name:       "incremental IXFR",
+		start:      (*dnscoretest.Server).StartTCP,
+		protocol:   dnscore.ProtocolTCP,
+		handler:    &zoneTransferHandler{ixfr: true},
+		ixfrSerial: 9,
+		expectRRs:  6,
+	}, {
+		name:       "IXFR with current client",
+		start:      (*dnscoretest.Server).StartTCP,
+		protocol:   dnscore.ProtocolTCP,
+		handler:    &zoneTransferHandler{ixfr: true},
+		ixfrSerial: 10,
+		expectRRs:  1,
+	}, {
+		name:       "IXFR with fallback to AXFR",
+		start:      (*dnscoretest.Server).StartTCP,
+		protocol:   dnscore.ProtocolTCP,
+		handler:    &zoneTransferHandler{},
+		ixfrSerial: 9,
+		expectRRs:  4,
+		expectEvents: []string{
+			"dnsQuery/tcp",
+			"dnsResponse/tcp",
+			"dnsFallback/IXFR->AXFR",
+			"dnsQuery/tcp",
+			"dnsResponse/tcp", "dnsResponse/tcp", "dnsResponse/tcp", "dnsResponse/tcp",
+		},
+	}, {
+		name:       "signed IXFR with fallback to AXFR",
+		start:      (*dnscoretest.Server).StartTCP,
+		protocol:   dnscore.ProtocolTCP,
+		handler:    &zoneTransferHandler{secret: secret},
+		ixfrSerial: 9,
+		sign:       true,
+		expectRRs:  4,
+	}, {
+		name:      "signed AXFR",
+		start:     (*dnscoretest.Server).StartTCP,
+		protocol:  dnscore.ProtocolTCP,
+		handler:   &zoneTransferHandler{secret: secret},
+		sign:      true,
+		expectRRs: 4,
+	}, {
+		name:      "signed AXFR using another secret",
+		start:     (*dnscoretest.Server).StartTCP,
+		protocol:  dnscore.ProtocolTCP,
+		handler:   &zoneTransferHandler{secret: "d3Jvbmc="},
+		sign:      true,
+		expectErr: dnscore.ErrTSIGBadSig,
+	}, {
+		name:      "unsigned AXFR response",
+		start:     (*dnscoretest.Server).StartTCP,
+		protocol:  dnscore.ProtocolTCP,
+		handler:   &zoneTransferHandler{},
+		sign:      true,
+		expectErr: dnscore.ErrTSIGBadSig,
+	}, {
+		name:      "refused AXFR",
+		start:     (*dnscoretest.Server).StartTCP,
+		protocol:  dnscore.ProtocolTCP,
+		handler:   &zoneTransferHandler{rcode: dns.RcodeRefused},
+		expectErr: dnscore.ErrTransferFailed,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// create and start a testing server
+			server := &dnscoretest.Server{}
+			<-tt.start(server, tt.handler)
+			defer server.Close()
+
+			// create transport, server addr, and query
+			logs := &bytes.Buffer{}
+			txp := &dnscore.Transport{
+				Logger:  slog.New(slog.NewJSONHandler(logs, nil)),
+				RootCAs: server.RootCAs,
+			}
+			serverAddr := dnscore.NewServerAddr(tt.protocol, server.Addr)
+			var options []dnscore.QueryOption
+			if tt.sign {
+				serverAddr.TSIGKey = key
+				options = append(options, dnscore.QueryOptionTSIG(key))
+			}
+			var (
+				query *dns.Msg
+				err   error
+			)
+			if tt.ixfrSerial != 0 {
+				query, err = dnscore.NewIXFRQuery(serverAddr, "example.com", tt.ixfrSerial, options...)
+			} else {
+				query, err = dnscore.NewAXFRQuery(serverAddr, "example.com", options...)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// perform the transfer and collect the results
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var (
+				rrs  []dns.RR
+				errs []error
+			)
+			for result := range txp.Transfer(ctx, serverAddr, query) {
+				if result.Err != nil {
+					errs = append(errs, result.Err)
+					continue
+				}
+				rrs = append(rrs, result.Msg.Answer...)
+			}
+
+			// verify the results
+			if tt.expectErr != nil {
+				if assert.Len(t, errs, 1) {
+					assert.ErrorIs(t, errs[0], tt.expectErr)
+				}
+				return
+			}
+			assert.Empty(t, errs)
+			if assert.Len(t, rrs, tt.expectRRs) {
+				assert.Equal(t, dns.TypeSOA, rrs[0].Header().Rrtype)
+				assert.Equal(t, dns.TypeSOA, rrs[len(rrs)-1].Header().Rrtype)
+			}
+
+			// possibly make sure we logged each message
+			if tt.expectEvents == nil {
+				return
+			}
+			var events []string
+			decoder := json.NewDecoder(logs)
+			for decoder.More() {
+				var entry struct {
+					FallbackQueryType string `json:"fallbackQueryType"`
+					Msg               string `json:"msg"`
+					Protocol          string `json:"protocol"`
+					QueryType         string `json:"queryType"`
+				}
+				if err := decoder.Decode(&entry); err != nil {
+					t.Fatal(err)
+				}
+				event := entry.Msg + "/" + entry.Protocol
+				if entry.FallbackQueryType != "" {
+					event += entry.QueryType + "->" + entry.FallbackQueryType
+				}
+				events = append(events, event)
+			}
+			assert.Equal(t, tt.expectEvents, events)
+		})
+	}
+}
+
+func TestTransport_Transfer_UnexpectedEOF(t *testing.T) {
+	// create a TCP server sending the first message and closing the connection
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		rawQuery := make([]byte, int(header[0])<<8|int(header[1]))
+		if _, err := io.ReadFull(conn, rawQuery); err != nil {
+			return
+		}
+		query := &dns.Msg{}
+		if err := query.Unpack(rawQuery); err != nil {
+			return
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(query)
+		resp.Answer = []dns.RR{zoneTransferSOA(10), zoneTransferA(1)}
+		rawResp, err := resp.Pack()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write(append([]byte{byte(len(rawResp) >> 8), byte(len(rawResp))}, rawResp...))
+	}()
+
+	// perform the transfer and collect the results
+	txp := &dnscore.Transport{}
+	serverAddr := dnscore.NewServerAddr(dnscore.ProtocolTCP, listener.Addr().String())
+	query, err := dnscore.NewAXFRQuery(serverAddr, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var results []*dnscore.MessageOrError
+	for result := range txp.Transfer(ctx, serverAddr, query) {
+		results = append(results, result)
+	}
+
+	// make sure we emitted the first message and then the error
+	if assert.Len(t, results, 2) {
+		assert.NotNil(t, results[0].Msg)
+		assert.ErrorIs(t, results[1].Err, io.ErrUnexpectedEOF)
+	}
+}
+
+// authoritativeZone is a zone served by [newAuthoritativeHandler].
+type authoritativeZone struct {
+	apex string
+	rrs  []dns.RR
+}
+
+// newAuthoritativeZone creates an [*authoritativeZone] from RRs in presentation format.
+func newAuthoritativeZone(t *testing.T, apex string, records ...string) *authoritativeZone {
+	zone := &authoritativeZone{apex: apex}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zone.rrs = append(zone.rrs, rr)
+	}
+	return zone
+}
+
+// delegation returns the NS RRs delegating the zone containing name, if any.
+func (zone *authoritativeZone) delegation(name string) (nsRRs []dns.RR) {
+	for _, rr := range zone.rrs {
+		owner := rr.Header().Name
+		if rr.Header().Rrtype == dns.TypeNS && owner != zone.apex && dns.IsSubDomain(owner, name) {
+			nsRRs = append(nsRRs, rr)
+		}
+	}
+	return
+}
+
+// respond fills the response to a query for the given name and type.
+func (zone *authoritativeZone) respond(resp *dns.Msg, name string, qtype uint16) {
+	// 1. refer to the child zone including all the matching A RRs as glue
+	if nsRRs := zone.delegation(name); len(nsRRs) > 0 {
+		resp.Ns = nsRRs
+		for _, ns := range nsRRs {
+			for _, rr := range zone.rrs {
+				if rr.Header().Rrtype == dns.TypeA && rr.Header().Name == ns.(*dns.NS).Ns {
+					resp.Extra = append(resp.Extra, rr)
+				}
+			}
+		}
+		return
+	}
+
+	// 2. answer following CNAMEs within the zone
+	resp.Authoritative = true
+	for cname := true; cname; {
+		cname = false
+		for _, rr := range zone.rrs {
+			if rr.Header().Name != name {
+				continue
+			}
+			switch rrtype := rr.Header().Rrtype; {
+			case rrtype == qtype:
+				resp.Answer = append(resp.Answer, rr)
+			case rrtype == dns.TypeCNAME:
+				resp.Answer = append(resp.Answer, rr)
+				name = rr.(*dns.CNAME).Target
+				cname = dns.IsSubDomain(zone.apex, name) && len(zone.delegation(name)) <= 0
+			}
+		}
+	}
+	if len(resp.Answer) > 0 && resp.Answer[len(resp.Answer)-1].Header().Rrtype != dns.TypeCNAME {
+		return
+	}
+
+	// 3. otherwise, deny the existence of the name or of the type
+	resp.Rcode = dns.RcodeNameError
+	for _, rr := range zone.rrs {
+		if dns.IsSubDomain(name, rr.Header().Name) {
+			resp.Rcode = dns.RcodeSuccess
+		}
+		if rr.Header().Rrtype == dns.TypeSOA {
+			resp.Ns = append(resp.Ns, rr)
+		}
+	}
+}
+
+// newAuthoritativeHandler returns a handler emulating an authoritative server
+// for the given zones, which refuses queries for names outside these zones.
+func newAuthoritativeHandler(zones ...*authoritativeZone) dnscoretest.Handler {
+	return dnscoretest.HandlerFunc(func(rw dnscoretest.ResponseWriter, rawQuery []byte) {
+		query := &dns.Msg{}
+		if err := query.Unpack(rawQuery); err != nil || len(query.Question) != 1 {
+			return
+		}
+		resp := &dns.Msg{}
+		resp.SetRcode(query, dns.RcodeRefused)
+		q0 := query.Question[0]
+		var closest *authoritativeZone
+		for _, zone := range zones {
+			if dns.IsSubDomain(zone.apex, q0.Name) &&
+				(closest == nil || dns.CountLabel(zone.apex) > dns.CountLabel(closest.apex)) {
+				closest = zone
+			}
+		}
+		if closest != nil {
+			resp.Rcode = dns.RcodeSuccess
+			closest.respond(resp, q0.Name, q0.Qtype)
+		}
+		rawResp, err := resp.Pack()
+		if err != nil {
+			return
+		}
+		_, _ = rw.Write(rawResp)
+	})
+}
+
+func TestIterativeResolver_Lookup(t *testing.T) {
+	// create the hierarchy of zones served by each fake IP address
+	soa := func(apex string) string {
+		return apex + " SOA ns.invalid. hostmaster.invalid. 1 3600 600 86400 300"
+	}
+	handlers := map[string]dnscoretest.Handler{
+		"192.0.2.1": newAuthoritativeHandler(newAuthoritativeZone(t, ".",
+			soa("."),
+			"com. NS ns.nic.com.",
+			"ns.nic.com. A 192.0.2.2",
+			"net. NS ns.nic.net.",
+			"ns.nic.net. A 192.0.2.4",
+		)),
+		"192.0.2.2": newAuthoritativeHandler(newAuthoritativeZone(t, "com.",
+			soa("com."),
+			"example.com. NS ns1.example.com.",
+			"example.com. NS ns2.example.com.",
+			"ns1.example.com. A 192.0.2.99",
+			"ns2.example.com. A 192.0.2.3",
+			"lame.com. NS ns.lame.com.",
+			"lame.com. NS ns.other.net.",
+			"ns.lame.com. A 192.0.2.5",
+			"ns.other.net. A 192.0.2.66", // out of bailiwick
+			"dead.com. NS ns.dead.com.",
+			"ns.dead.com. A 192.0.2.7",
+		)),
+		"192.0.2.3": newAuthoritativeHandler(newAuthoritativeZone(t, "example.com.",
+			soa("example.com."),
+			"www.example.com. A 192.0.2.100",
+			"alias.example.com. CNAME www.example.com.",
+			"ext.example.com. CNAME www.lame.com.",
+		)),
+		"192.0.2.4": newAuthoritativeHandler(newAuthoritativeZone(t, "net.",
+			soa("net."),
+			"other.net. NS ns.other.net.",
+			"ns.other.net. A 192.0.2.6",
+		)),
+		"192.0.2.5": newAuthoritativeHandler(),
+		"192.0.2.6": newAuthoritativeHandler(
+			newAuthoritativeZone(t, "other.net.",
+				soa("other.net."),
+				"ns.other.net. A 192.0.2.6",
+			),
+			newAuthoritativeZone(t, "lame.com.",
+				soa("lame.com."),
+				"www.lame.com. A 192.0.2.101",
+			),
+		),
+	}
+
+	// start a server for each fake IP address
+	addrs := make(map[string]string)
+	for ipAddr, handler := range handlers {
+		server := &dnscoretest.Server{}
+		<-server.StartUDP(handler)
+		defer server.Close()
+		addrs[net.JoinHostPort(ipAddr, "53")] = server.Addr
+	}
+
+	// the trace of the queries required to resolve ns.other.net
+	traceNSOtherNet := []string{
+		". 192.0.2.1 ns.other.net. A referral net.",
+		"net. 192.0.2.4 ns.other.net. A referral other.net.",
+		"other.net. 192.0.2.6 ns.other.net. A answer",
+		". 192.0.2.1 ns.other.net. AAAA referral net.",
+		"net. 192.0.2.4 ns.other.net. AAAA referral other.net.",
+		"other.net. 192.0.2.6 ns.other.net. AAAA nodata",
+	}
+
+	tests := []struct {
+		name          string
+		domain        string
+		qtype         uint16
+		maxQueries    int
+		expectAnswers []string
+		expectTrace   []string
+		expectErr     error
+	}{{
+		name:          "answer skipping an unreachable server",
+		domain:        "www.example.com",
+		qtype:         dns.TypeA,
+		expectAnswers: []string{"www.example.com.\t3600\tIN\tA\t192.0.2.100"},
+		expectTrace: []string{
+			". 192.0.2.1 www.example.com. A referral com.",
+			"com. 192.0.2.2 www.example.com. A referral example.com.",
+			"example.com. 192.0.2.99 www.example.com. A error",
+			"example.com. 192.0.2.3 www.example.com. A answer",
+		},
+	}, {
+		name:   "CNAME within the zone",
+		domain: "alias.example.com",
+		qtype:  dns.TypeA,
+		expectAnswers: []string{
+			"alias.example.com.\t3600\tIN\tCNAME\twww.example.com.",
+			"www.example.com.\t3600\tIN\tA\t192.0.2.100",
+		},
+		expectTrace: []string{
+			". 192.0.2.1 alias.example.com. A referral com.",
+			"com. 192.0.2.2 alias.example.com. A referral example.com.",
+			"example.com. 192.0.2.99 alias.example.com. A error",
+			"example.com. 192.0.2.3 alias.example.com. A answer",
+		},
+	}, {
+		name:   "NODATA",
+		domain: "www.example.com",
+		qtype:  dns.TypeAAAA,
+		expectTrace: []string{
+			". 192.0.2.1 www.example.com. AAAA referral com.",
+			"com. 192.0.2.2 www.example.com. AAAA referral example.com.",
+			"example.com. 192.0.2.99 www.example.com. AAAA error",
+			"example.com. 192.0.2.3 www.example.com. AAAA nodata",
+		},
+		expectErr: dnscore.ErrNoData,
+	}, {
+		name:   "NXDOMAIN",
+		domain: "missing.example.com",
+		qtype:  dns.TypeA,
+		expectTrace: []string{
+			". 192.0.2.1 missing.example.com. A referral com.",
+			"com. 192.0.2.2 missing.example.com. A referral example.com.",
+			"example.com. 192.0.2.99 missing.example.com. A error",
+			"example.com. 192.0.2.3 missing.example.com. A nxdomain",
+		},
+		expectErr: dnscore.ErrNoName,
+	}, {
+		name:          "lame server and name server without in-bailiwick glue",
+		domain:        "www.lame.com",
+		qtype:         dns.TypeA,
+		expectAnswers: []string{"www.lame.com.\t3600\tIN\tA\t192.0.2.101"},
+		expectTrace: slices.Concat([]string{
+			". 192.0.2.1 www.lame.com. A referral com.",
+			"com. 192.0.2.2 www.lame.com. A referral lame.com.",
+			"lame.com. 192.0.2.5 www.lame.com. A lame",
+		}, traceNSOtherNet, []string{
+			"lame.com. 192.0.2.6 www.lame.com. A answer",
+		}),
+	}, {
+		name:   "CNAME to another zone",
+		domain: "ext.example.com",
+		qtype:  dns.TypeA,
+		expectAnswers: []string{
+			"ext.example.com.\t3600\tIN\tCNAME\twww.lame.com.",
+			"www.lame.com.\t3600\tIN\tA\t192.0.2.101",
+		},
+		expectTrace: slices.Concat([]string{
+			". 192.0.2.1 ext.example.com. A referral com.",
+			"com. 192.0.2.2 ext.example.com. A referral example.com.",
+			"example.com. 192.0.2.99 ext.example.com. A error",
+			"example.com. 192.0.2.3 ext.example.com. A cname",
+			". 192.0.2.1 www.lame.com. A referral com.",
+			"com. 192.0.2.2 www.lame.com. A referral lame.com.",
+			"lame.com. 192.0.2.5 www.lame.com. A lame",
+		}, traceNSOtherNet, []string{
+			"lame.com. 192.0.2.6 www.lame.com. A answer",
+		}),
+	}, {
+		name:   "all the servers are unreachable",
+		domain: "www.dead.com",
+		qtype:  dns.TypeA,
+		expectTrace: []string{
+			". 192.0.2.1 www.dead.com. A referral com.",
+			"com. 192.0.2.2 www.dead.com. A referral dead.com.",
+			"dead.com. 192.0.2.7 www.dead.com. A error",
+		},
+		expectErr: dnscore.ErrLameDelegation,
+	}, {
+		name:       "too many queries",
+		domain:     "www.example.com",
+		qtype:      dns.TypeA,
+		maxQueries: 2,
+		expectTrace: []string{
+			". 192.0.2.1 www.example.com. A referral com.",
+			"com. 192.0.2.2 www.example.com. A referral example.com.",
+		},
+		expectErr: dnscore.ErrIterativeTooManyQueries,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// create the resolver redirecting queries to the fake servers
+			reso := &dnscore.IterativeResolver{
+				MaxQueries: tt.maxQueries,
+				RootHints: []*dnscore.IterativeNameServer{{
+					Name:  "a.root-servers.invalid.",
+					Addrs: []string{"192.0.2.1"},
+				}},
+				Transport: &dnscore.Transport{
+					DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+						addr, ok := addrs[address]
+						if !ok {
+							return nil, fmt.Errorf("no route to %s", address)
+						}
+						return (&net.Dialer{}).DialContext(ctx, network, addr)
+					},
+				},
+			}
+
+			// perform the lookup
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			result, err := reso.Lookup(ctx, tt.domain, tt.qtype)
+			assert.ErrorIs(t, err, tt.expectErr)
+
+			// make sure the answers and the trace are the expected ones
+			var answers []string
+			for _, rr := range result.Answers {
+				answers = append(answers, rr.String())
+			}
+			assert.Equal(t, tt.expectAnswers, answers)
+			var trace []string
+			for _, step := range result.Trace {
+				host, _, _ := net.SplitHostPort(step.ServerAddr.Address)
+				q0 := step.Query.Question[0]
+				entry := fmt.Sprintf("%s %s %s %s %s", step.Zone, host,
+					q0.Name, dns.TypeToString[q0.Qtype], step.Kind)
+				if step.Referral != "" {
+					entry += " " + step.Referral
+				}
+				assert.Equal(t, step.Kind == dnscore.IterativeStepError, step.Err != nil)
+				trace = append(trace, entry)
+			}
+			assert.Equal(t, tt.expectTrace, trace)
+		})
+	}
+}
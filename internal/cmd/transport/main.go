@@ -17,10 +17,9 @@ import (
 
 // Define command-line flags
 var (
-	serverAddr = flag.String("server", "8.8.8.8:53", "DNS server address")
-	domain     = flag.String("domain", "www.example.com", "Domain to query")
-	qtype      = flag.String("type", "A", "Query type (A, AAAA, CNAME, etc.)")
-	protocol   = flag.String("protocol", "udp", "DNS protocol (udp, tcp, dot, doh, doq)")
+	serverURI = flag.String("server", "udp://8.8.8.8:53", "DNS server URI (udp://, tcp://, tls://, https://, h3://, quic://, sdns://)")
+	domain    = flag.String("domain", "www.example.com", "Domain to query")
+	qtype     = flag.String("type", "A", "Query type (A, AAAA, CNAME, etc.)")
 )
 
 func main() {
@@ -47,17 +46,18 @@ func main() {
 		panic(fmt.Errorf("transport: unsupported query type: %s", *qtype))
 	}
 
-	// Create the server address. Ensure that we set the proper flags
+	// Parse the server URI. Ensure that we set the proper flags
 	// depending on the protocol that we're going to use.
-	server := dnscore.NewServerAddr(dnscore.Protocol(*protocol), *serverAddr)
+	server := runtimex.Try1(dnscore.ParseServerAddr(*serverURI))
 	flags := 0
 	maxlength := uint16(dnscore.EDNS0SuggestedMaxResponseSizeUDP)
-	if *protocol == string(dnscore.ProtocolDoT) ||
-		*protocol == string(dnscore.ProtocolDoH) ||
-		*protocol == string(dnscore.ProtocolDoQ) {
+	if server.Protocol == dnscore.ProtocolDoT ||
+		server.Protocol == dnscore.ProtocolDoH ||
+		server.Protocol == dnscore.ProtocolDoH3 ||
+		server.Protocol == dnscore.ProtocolDoQ {
 		flags |= dnscore.EDNS0FlagDO | dnscore.EDNS0FlagBlockLengthPadding
 	}
-	if *protocol != string(dnscore.ProtocolUDP) {
+	if server.Protocol != dnscore.ProtocolUDP {
 		maxlength = dnscore.EDNS0SuggestedMaxResponseSizeOtherwise
 	}
 
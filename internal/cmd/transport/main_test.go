@@ -6,6 +6,7 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/rbmk-project/dnscore"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,59 +16,67 @@ func Test_main(t *testing.T) {
 	})
 
 	t.Run("DNS-over-UDP", func(t *testing.T) {
-		*serverAddr = "8.8.8.8:53"
-		*protocol = "udp"
+		*serverURI = "udp://8.8.8.8:53"
 		main()
 	})
 
 	t.Run("DNS-over-TCP", func(t *testing.T) {
-		*serverAddr = "8.8.8.8:53"
-		*protocol = "tcp"
+		*serverURI = "tcp://8.8.8.8:53"
 		main()
 	})
 
 	t.Run("DNS-over-TLS", func(t *testing.T) {
-		*serverAddr = "8.8.8.8:853"
-		*protocol = "dot"
+		*serverURI = "tls://8.8.8.8:853"
 		main()
 	})
 
 	t.Run("DNS-over-HTTPS", func(t *testing.T) {
-		*serverAddr = "https://8.8.8.8/dns-query"
-		*protocol = "doh"
+		*serverURI = "https://8.8.8.8/dns-query"
 		main()
 	})
 
 	t.Run("DNS-over-QUIC", func(t *testing.T) {
-		*serverAddr = "dns0.eu:853"
-		*protocol = "doq"
+		*serverURI = "quic://dns0.eu:853"
 		main()
 	})
 
 	t.Run("AAAA query", func(t *testing.T) {
-		*serverAddr = "8.8.8.8:53"
-		*protocol = "udp"
+		*serverURI = "udp://8.8.8.8:53"
 		*qtype = "AAAA"
 		main()
 	})
 
 	t.Run("CNAME query", func(t *testing.T) {
-		*serverAddr = "8.8.8.8:53"
-		*protocol = "udp"
+		*serverURI = "udp://8.8.8.8:53"
 		*qtype = "CNAME"
 		main()
 	})
 
 	t.Run("HTTPS query", func(t *testing.T) {
-		*serverAddr = "8.8.8.8:53"
-		*protocol = "udp"
+		*serverURI = "udp://8.8.8.8:53"
 		*qtype = "HTTPS"
 		main()
 	})
 
+	t.Run("invalid server URI", func(t *testing.T) {
+		*serverURI = "ftp://8.8.8.8"
+		*qtype = "A"
+
+		var err error
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err = r.(error)
+				}
+			}()
+			main()
+		}()
+
+		assert.ErrorIs(t, err, dnscore.ErrInvalidServerAddr)
+	})
+
 	t.Run("unsupported query type", func(t *testing.T) {
-		*serverAddr = "8.8.8.8:53"
-		*protocol = "udp"
+		*serverURI = "udp://8.8.8.8:53"
 		*qtype = "Nothing"
 
 		var err error
@@ -0,0 +1,575 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// Iterative resolution from the root servers.
+//
+// See https://datatracker.ietf.org/doc/html/rfc1034#section-5.3.3
+//
+
+package dnscore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// IterativeNameServer is a name server along with its known addresses.
+type IterativeNameServer struct {
+	// Addrs contains the IPv4 and IPv6 addresses of the name server. When
+	// empty, we resolve the name server addresses before querying it.
+	Addrs []string
+
+	// Name is the name of the name server.
+	Name string
+}
+
+// DefaultRootHints returns the root servers along with
+// their IPv4 and IPv6 addresses as published by IANA.
+//
+// See https://www.internic.net/domain/named.root.
+func DefaultRootHints() []*IterativeNameServer {
+	return []*IterativeNameServer{
+		{Name: "a.root-servers.net.", Addrs: []string{"198.41.0.4", "2001:503:ba3e::2:30"}},
+		{Name: "b.root-servers.net.", Addrs: []string{"170.247.170.2", "2801:1b8:10::b"}},
+		{Name: "c.root-servers.net.", Addrs: []string{"192.33.4.12", "2001:500:2::c"}},
+		{Name: "d.root-servers.net.", Addrs: []string{"199.7.91.13", "2001:500:2d::d"}},
+		{Name: "e.root-servers.net.", Addrs: []string{"192.203.230.10", "2001:500:a8::e"}},
+		{Name: "f.root-servers.net.", Addrs: []string{"192.5.5.241", "2001:500:2f::f"}},
+		{Name: "g.root-servers.net.", Addrs: []string{"192.112.36.4", "2001:500:12::d0d"}},
+		{Name: "h.root-servers.net.", Addrs: []string{"198.97.190.53", "2001:500:1::53"}},
+		{Name: "i.root-servers.net.", Addrs: []string{"192.36.148.17", "2001:7fe::53"}},
+		{Name: "j.root-servers.net.", Addrs: []string{"192.58.128.30", "2001:503:c27::2:30"}},
+		{Name: "k.root-servers.net.", Addrs: []string{"193.0.14.129", "2001:7fd::1"}},
+		{Name: "l.root-servers.net.", Addrs: []string{"199.7.83.42", "2001:500:9f::42"}},
+		{Name: "m.root-servers.net.", Addrs: []string{"202.12.27.33", "2001:dc3::35"}},
+	}
+}
+
+// IterativeStepKind describes how we interpreted a response.
+type IterativeStepKind string
+
+const (
+	// IterativeStepAnswer indicates that the server answered the query.
+	IterativeStepAnswer = IterativeStepKind("answer")
+
+	// IterativeStepCNAME indicates that the server answered with a CNAME
+	// chain whose target we need to resolve starting from the root.
+	IterativeStepCNAME = IterativeStepKind("cname")
+
+	// IterativeStepError indicates that the query failed, e.g., because
+	// of a timeout, in which case the Err field contains the error.
+	IterativeStepError = IterativeStepKind("error")
+
+	// IterativeStepLame indicates that the server is not authoritative for
+	// the zone and did not refer us to a child zone (a lame delegation),
+	// or that the server failed or refused to answer.
+	IterativeStepLame = IterativeStepKind("lame")
+
+	// IterativeStepNoData indicates that the name exists but has no RRs of
+	// the requested type (NODATA), which terminates the resolution.
+	IterativeStepNoData = IterativeStepKind("nodata")
+
+	// IterativeStepNoName indicates that the name does not
+	// exist (NXDOMAIN), which terminates the resolution.
+	IterativeStepNoName = IterativeStepKind("nxdomain")
+
+	// IterativeStepReferral indicates that the server referred us to the
+	// name servers of a child zone, whose name is in the Referral field.
+	IterativeStepReferral = IterativeStepKind("referral")
+)
+
+// IterativeStep is a query sent during the iterative resolution.
+type IterativeStep struct {
+	// Err is the error that occurred, if any.
+	Err error
+
+	// Kind describes how we interpreted the response.
+	Kind IterativeStepKind
+
+	// Query is the query we sent.
+	Query *dns.Msg
+
+	// Referral is the child zone for [IterativeStepReferral] steps.
+	Referral string
+
+	// Response is the response, which is nil on error.
+	Response *dns.Msg
+
+	// ServerAddr is the address of the server we queried.
+	ServerAddr *ServerAddr
+
+	// ServerName is the name of the server we queried.
+	ServerName string
+
+	// Zone is the zone we expected the server to be authoritative for.
+	Zone string
+}
+
+// IterativeResult is the result of [*IterativeResolver.Lookup].
+type IterativeResult struct {
+	// Answers contains the answers including the CNAME chain, if any.
+	Answers []dns.RR
+
+	// Response is the last response we used, if any.
+	Response *dns.Msg
+
+	// Trace contains all the queries we sent, in order, including the
+	// ones required to resolve the name servers lacking glue RRs.
+	Trace []*IterativeStep
+}
+
+// Errors returned by [*IterativeResolver.Lookup].
+var (
+	// ErrLameDelegation indicates that none of the name servers of
+	// a zone provided a usable response (see [IterativeStepLame]).
+	ErrLameDelegation = errors.New("iterative: lame delegation")
+
+	// ErrIterativeTooManyCNAMEs indicates that the CNAME chain is too long.
+	ErrIterativeTooManyCNAMEs = errors.New("iterative: too many CNAMEs")
+
+	// ErrIterativeTooManyQueries indicates that resolving the name
+	// requires more queries than the configured maximum.
+	ErrIterativeTooManyQueries = errors.New("iterative: too many queries")
+)
+
+// DefaultIterativeMaxQueries is the default maximum number
+// of queries sent by [*IterativeResolver.Lookup].
+const DefaultIterativeMaxQueries = 64
+
+// iterativeMaxCNAMEs is the maximum length of a CNAME chain.
+const iterativeMaxCNAMEs = 8
+
+// iterativeMaxDepth is the maximum nesting of name server lookups.
+const iterativeMaxDepth = 4
+
+// IterativeResolver resolves names iteratively starting from the root
+// servers, by following referrals to the authoritative servers, rather
+// than forwarding queries to recursive servers like [*Resolver].
+//
+// We send queries using DNS-over-UDP to port 53, retrying using DNS-over-TCP
+// when the response is truncated. To redirect the queries, for example to
+// fake servers when testing, use the DialContext field of [*Transport].
+//
+// The zero value is ready to use.
+type IterativeResolver struct {
+	// Logger is the optional structured logger for emitting
+	// structured diagnostic events. If this field is nil, we
+	// will not be emitting structured logs. Note that the
+	// [*Transport] has its own logger for logging queries
+	// and responses, which you need to configure separately.
+	Logger *slog.Logger
+
+	// MaxQueries is the optional maximum number of queries for each lookup.
+	//
+	// If zero, we use [DefaultIterativeMaxQueries].
+	MaxQueries int
+
+	// QueryTimeout is the optional timeout for each query.
+	//
+	// If zero, we use [DefaultQueryTimeout].
+	QueryTimeout time.Duration
+
+	// RootHints contains the optional root servers.
+	//
+	// If empty, we use [DefaultRootHints].
+	RootHints []*IterativeNameServer
+
+	// Transport is the optional DNS transport to use for resolving queries.
+	//
+	// If nil, we use [DefaultTransport].
+	Transport ResolverTransport
+}
+
+// Lookup resolves the RRs of the given type for the given domain starting
+// from the root servers and returns the result, which contains the trace of
+// all the queries we sent, along with an error.
+//
+// The returned result is never nil, even on failure, such that the
+// caller can always inspect the delegation path we followed. On failure,
+// the error is either [ErrNoName], [ErrNoData], [ErrLameDelegation],
+// [ErrIterativeTooManyCNAMEs], [ErrIterativeTooManyQueries], the context
+// error when the context is done, or [ErrInvalidQuery] when the domain
+// name is invalid.
+func (r *IterativeResolver) Lookup(ctx context.Context,
+	name string, qtype uint16) (*IterativeResult, error) {
+	// 1. IDNA encode and validate the domain name
+	result := &IterativeResult{}
+	punyName, err := idnaToASCII(name)
+	if err != nil {
+		return result, err
+	}
+	if _, ok := dns.IsDomainName(punyName); !ok {
+		return result, fmt.Errorf("%w: %s", ErrInvalidQuery, name)
+	}
+
+	// 2. resolve starting from the root
+	state := &iterativeLookup{resolver: r}
+	result.Answers, result.Response, err = state.resolve(ctx, dns.CanonicalName(punyName), qtype, 0)
+	result.Trace = state.trace
+	return result, err
+}
+
+// maxQueries returns the configured or the default maximum number of queries.
+func (r *IterativeResolver) maxQueries() int {
+	if r.MaxQueries > 0 {
+		return r.MaxQueries
+	}
+	return DefaultIterativeMaxQueries
+}
+
+// queryTimeout returns the configured or the default query timeout.
+func (r *IterativeResolver) queryTimeout() time.Duration {
+	if r.QueryTimeout > 0 {
+		return r.QueryTimeout
+	}
+	return DefaultQueryTimeout
+}
+
+// rootHints returns the configured or the default root servers.
+func (r *IterativeResolver) rootHints() []*IterativeNameServer {
+	if len(r.RootHints) > 0 {
+		return r.RootHints
+	}
+	return DefaultRootHints()
+}
+
+// transport returns the configured or the default transport.
+func (r *IterativeResolver) transport() ResolverTransport {
+	if r.Transport != nil {
+		return r.Transport
+	}
+	return DefaultTransport
+}
+
+// iterativeLookup contains the state of a single lookup.
+type iterativeLookup struct {
+	// cnames counts the CNAMEs we followed so far.
+	cnames int
+
+	// queries counts the queries we sent so far.
+	queries int
+
+	// resolver is the resolver we are using.
+	resolver *IterativeResolver
+
+	// trace contains the steps so far.
+	trace []*IterativeStep
+}
+
+// resolve resolves the given canonical name and type starting from the root
+// and following CNAMEs pointing outside of the zone of the answering server.
+func (s *iterativeLookup) resolve(ctx context.Context,
+	name string, qtype uint16, depth int) ([]dns.RR, *dns.Msg, error) {
+	var answers []dns.RR
+	for {
+		outcome, resp, err := s.resolveFromRoot(ctx, name, qtype, depth)
+		if outcome != nil {
+			answers = append(answers, outcome.answers...)
+		}
+		if err != nil || outcome.target == "" {
+			return answers, resp, err
+		}
+		if s.cnames++; s.cnames > iterativeMaxCNAMEs {
+			return answers, resp, ErrIterativeTooManyCNAMEs
+		}
+		name = outcome.target
+	}
+}
+
+// resolveFromRoot follows the referrals starting from the root
+// until a server answers the query or denies the name or type exist.
+func (s *iterativeLookup) resolveFromRoot(ctx context.Context,
+	name string, qtype uint16, depth int) (*iterativeOutcome, *dns.Msg, error) {
+	zone, servers := ".", s.resolver.rootHints()
+	for {
+		outcome, resp, err := s.queryZone(ctx, zone, servers, name, qtype, depth)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch outcome.kind {
+		case IterativeStepReferral:
+			zone, servers = outcome.zone, outcome.servers
+		case IterativeStepNoName:
+			return outcome, resp, ErrNoName
+		case IterativeStepNoData:
+			return outcome, resp, ErrNoData
+		default:
+			return outcome, resp, nil
+		}
+	}
+}
+
+// queryZone queries the name servers of the given zone, in order, until one
+// of them provides a usable response, skipping lame and unreachable servers.
+func (s *iterativeLookup) queryZone(ctx context.Context, zone string,
+	servers []*IterativeNameServer, name string, qtype uint16,
+	depth int) (*iterativeOutcome, *dns.Msg, error) {
+	for _, server := range servers {
+		// 1. resolve the addresses of name servers without glue
+		addrs := server.Addrs
+		if len(addrs) <= 0 {
+			addrs = s.resolveAddrs(ctx, server.Name, depth+1)
+		}
+
+		// 2. try with all the addresses of the name server
+		for _, addr := range addrs {
+			outcome, resp, err := s.exchange(ctx, zone, server.Name, addr, name, qtype)
+			if err != nil {
+				return nil, nil, err
+			}
+			if outcome != nil {
+				return outcome, resp, nil
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return nil, nil, fmt.Errorf("%w: %s", ErrLameDelegation, zone)
+}
+
+// resolveAddrs resolves the IPv4 and IPv6 addresses of a name server
+// without glue RRs, returning IPv4 addresses first. On failure, we
+// return an empty list and move on to the next name server.
+func (s *iterativeLookup) resolveAddrs(ctx context.Context, name string, depth int) []string {
+	if depth > iterativeMaxDepth {
+		return nil
+	}
+	var addrs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		rrs, _, _ := s.resolve(ctx, dns.CanonicalName(name), qtype, depth)
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+	}
+	return addrs
+}
+
+// exchange sends the query to the given name server address and returns
+// the outcome, which is nil when the server is lame or unreachable. The
+// returned error is only non-nil when we have sent too many queries or
+// the context is done, since then trying other servers is pointless.
+func (s *iterativeLookup) exchange(ctx context.Context, zone, serverName,
+	addr, name string, qtype uint16) (*iterativeOutcome, *dns.Msg, error) {
+	// 1. make sure the context is not done and we do not send too many queries
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if s.queries >= s.resolver.maxQueries() {
+		return nil, nil, ErrIterativeTooManyQueries
+	}
+	s.queries++
+
+	// 2. create the query, which must not ask for recursion
+	serverAddr := NewServerAddr(ProtocolUDP, net.JoinHostPort(addr, "53"))
+	query, err := NewQueryWithServerAddr(serverAddr, name, qtype,
+		QueryOptionEDNS0(EDNS0SuggestedMaxResponseSizeUDP, 0), queryOptionNoRecursion)
+	if err != nil {
+		return nil, nil, err
+	}
+	step := &IterativeStep{
+		Query:      query,
+		ServerAddr: serverAddr,
+		ServerName: serverName,
+		Zone:       zone,
+	}
+	s.trace = append(s.trace, step)
+
+	// 3. send the query and record the outcome
+	resp, err := s.roundTrip(ctx, serverAddr, query)
+	if err != nil {
+		step.Err, step.Kind = err, IterativeStepError
+		return nil, nil, ctx.Err()
+	}
+	step.Response = resp
+	outcome := iterativeClassify(zone, name, qtype, resp)
+	step.Kind, step.Referral = outcome.kind, outcome.zone
+	if outcome.kind == IterativeStepLame {
+		return nil, nil, nil
+	}
+	return outcome, resp, nil
+}
+
+// roundTrip sends the query and returns the validated response,
+// retrying using TCP when the UDP response is truncated.
+func (s *iterativeLookup) roundTrip(ctx context.Context,
+	addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.resolver.queryTimeout())
+	defer cancel()
+	txp := s.resolver.transport()
+	resp, err := txp.Query(ctx, addr, query)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateResponse(query, resp); err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		tcpAddr := NewServerAddr(ProtocolTCP, addr.Address)
+		maybeLogFallback(ctx, s.resolver.Logger, addr, tcpAddr, "truncated", transportTimeNow(txp))
+		resp, err = txp.Query(ctx, tcpAddr, query)
+		if err != nil {
+			return nil, err
+		}
+		if err := ValidateResponse(query, resp); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// iterativeOutcome is the interpretation of a response.
+type iterativeOutcome struct {
+	// answers contains the answers, including the CNAME chain.
+	answers []dns.RR
+
+	// kind is the kind of outcome.
+	kind IterativeStepKind
+
+	// servers contains the name servers of the child zone for referrals.
+	servers []*IterativeNameServer
+
+	// target is the name to resolve from the root for CNAMEs.
+	target string
+
+	// zone is the child zone for referrals.
+	zone string
+}
+
+// iterativeClassify interprets the response to a query for the given
+// name and type sent to a name server of the given zone.
+//
+// We only accept answer RRs, referrals, and glue RRs that are within the
+// zone of the name server (i.e., in bailiwick), to prevent the server from
+// injecting RRs for zones it is not authoritative for.
+func iterativeClassify(zone, name string, qtype uint16, resp *dns.Msg) *iterativeOutcome {
+	// 1. a server failing or refusing to answer is lame
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return &iterativeOutcome{kind: IterativeStepLame}
+	}
+
+	// 2. handle answers, possibly following the CNAME chain within the response
+	if outcome := iterativeAnswers(zone, name, qtype, resp); outcome != nil {
+		return outcome
+	}
+
+	// 3. handle authoritative denial of existence, considering a
+	// non-authoritative NXDOMAIN lame like we do in iterativeAnswers
+	if resp.Authoritative && resp.Rcode == dns.RcodeNameError {
+		return &iterativeOutcome{kind: IterativeStepNoName}
+	}
+	if resp.Authoritative {
+		return &iterativeOutcome{kind: IterativeStepNoData}
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		return &iterativeOutcome{kind: IterativeStepLame}
+	}
+
+	// 4. handle referrals and consider everything else lame
+	if outcome := iterativeReferral(zone, name, resp); outcome != nil {
+		return outcome
+	}
+	return &iterativeOutcome{kind: IterativeStepLame}
+}
+
+// iterativeAnswers returns the outcome when the response contains answers
+// for the name, or nil otherwise. When the CNAME chain within the response
+// does not lead to answers, we resolve its target starting from the root
+// unless the server is authoritative and says the target does not exist.
+func iterativeAnswers(zone, name string, qtype uint16, resp *dns.Msg) *iterativeOutcome {
+	var answers []dns.RR
+	inBailiwick := func(rr dns.RR, owner string) bool {
+		header := rr.Header()
+		return header.Class == dns.ClassINET && equalASCIIName(header.Name, owner) &&
+			dns.IsSubDomain(zone, owner)
+	}
+	for range iterativeMaxCNAMEs {
+		// 1. collect the RRs matching the type
+		var matching []dns.RR
+		for _, rr := range resp.Answer {
+			if inBailiwick(rr, name) && (rr.Header().Rrtype == qtype || qtype == dns.TypeANY) {
+				matching = append(matching, rr)
+			}
+		}
+		if len(matching) > 0 {
+			return &iterativeOutcome{answers: append(answers, matching...), kind: IterativeStepAnswer}
+		}
+
+		// 2. otherwise, follow the CNAME, if any
+		idx := slices.IndexFunc(resp.Answer, func(rr dns.RR) bool {
+			return inBailiwick(rr, name) && rr.Header().Rrtype == dns.TypeCNAME
+		})
+		if idx < 0 {
+			break
+		}
+		answers = append(answers, resp.Answer[idx])
+		name = dns.CanonicalName(resp.Answer[idx].(*dns.CNAME).Target)
+	}
+	if len(answers) <= 0 {
+		return nil
+	}
+	if resp.Rcode == dns.RcodeNameError && resp.Authoritative && dns.IsSubDomain(zone, name) {
+		return &iterativeOutcome{answers: answers, kind: IterativeStepNoName}
+	}
+	return &iterativeOutcome{answers: answers, kind: IterativeStepCNAME, target: name}
+}
+
+// iterativeReferral returns the outcome when the response refers us to the
+// name servers of a child zone, which must be below the current zone and
+// must contain the name, or nil otherwise. Only the glue RRs within the
+// current zone are acceptable, otherwise we resolve the name servers.
+func iterativeReferral(zone, name string, resp *dns.Msg) *iterativeOutcome {
+	// 1. find the child zone and its name servers
+	var (
+		child   string
+		servers []*IterativeNameServer
+	)
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok || ns.Hdr.Class != dns.ClassINET {
+			continue
+		}
+		owner := dns.CanonicalName(ns.Hdr.Name)
+		if child == "" && owner != zone && dns.IsSubDomain(zone, owner) && dns.IsSubDomain(owner, name) {
+			child = owner
+		}
+		if owner == child {
+			servers = append(servers, &IterativeNameServer{Name: dns.CanonicalName(ns.Ns)})
+		}
+	}
+	if child == "" {
+		return nil
+	}
+
+	// 2. associate the in-bailiwick glue RRs to the name servers
+	for _, server := range servers {
+		if !dns.IsSubDomain(zone, server.Name) {
+			continue
+		}
+		for _, rr := range resp.Extra {
+			if rr.Header().Class != dns.ClassINET || !equalASCIIName(rr.Header().Name, server.Name) {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.A:
+				server.Addrs = append(server.Addrs, rr.A.String())
+			case *dns.AAAA:
+				server.Addrs = append(server.Addrs, rr.AAAA.String())
+			}
+		}
+		server.Addrs = resolverDedupAndSort(server.Addrs)
+	}
+	return &iterativeOutcome{kind: IterativeStepReferral, servers: servers, zone: child}
+}
@@ -0,0 +1,312 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newIterativeTestResponse creates a response containing the given RRs.
+func newIterativeTestResponse(t *testing.T, rcode int, aa bool, answer, ns, extra []string) *dns.Msg {
+	parse := func(records []string) (rrs []dns.RR) {
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rrs = append(rrs, rr)
+		}
+		return
+	}
+	return &dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: rcode, Authoritative: aa, Response: true},
+		Answer: parse(answer),
+		Ns:     parse(ns),
+		Extra:  parse(extra),
+	}
+}
+
+func Test_iterativeClassify(t *testing.T) {
+	tests := []struct {
+		name          string
+		zone          string
+		qtype         uint16
+		rcode         int
+		aa            bool
+		answer        []string
+		ns            []string
+		extra         []string
+		expectKind    IterativeStepKind
+		expectAnswers int
+		expectTarget  string
+		expectZone    string
+		expectServers []*IterativeNameServer
+	}{{
+		name:          "answer",
+		zone:          "example.com.",
+		qtype:         dns.TypeA,
+		aa:            true,
+		answer:        []string{"www.example.com. A 192.0.2.1"},
+		expectKind:    IterativeStepAnswer,
+		expectAnswers: 1,
+	}, {
+		name:  "answer for ANY",
+		zone:  "example.com.",
+		qtype: dns.TypeANY,
+		aa:    true,
+		answer: []string{
+			"www.example.com. A 192.0.2.1",
+			"www.example.com. AAAA 2001:db8::1",
+		},
+		expectKind:    IterativeStepAnswer,
+		expectAnswers: 2,
+	}, {
+		name:       "out of bailiwick answer",
+		zone:       "com.",
+		qtype:      dns.TypeA,
+		answer:     []string{"www.example.org. A 192.0.2.1"},
+		expectKind: IterativeStepLame,
+	}, {
+		name:  "CNAME chain within the response",
+		zone:  "example.com.",
+		qtype: dns.TypeA,
+		aa:    true,
+		answer: []string{
+			"www.example.com. CNAME web.example.com.",
+			"web.example.com. A 192.0.2.1",
+		},
+		expectKind:    IterativeStepAnswer,
+		expectAnswers: 2,
+	}, {
+		name:  "CNAME to another zone ignoring out of bailiwick answers",
+		zone:  "example.com.",
+		qtype: dns.TypeA,
+		aa:    true,
+		answer: []string{
+			"www.example.com. CNAME www.example.org.",
+			"www.example.org. A 192.0.2.1",
+		},
+		expectKind:    IterativeStepCNAME,
+		expectAnswers: 1,
+		expectTarget:  "www.example.org.",
+	}, {
+		name:          "CNAME to a nonexistent name within the zone",
+		zone:          "example.com.",
+		qtype:         dns.TypeA,
+		rcode:         dns.RcodeNameError,
+		aa:            true,
+		answer:        []string{"www.example.com. CNAME missing.example.com."},
+		expectKind:    IterativeStepNoName,
+		expectAnswers: 1,
+	}, {
+		name:       "NXDOMAIN",
+		zone:       "example.com.",
+		qtype:      dns.TypeA,
+		rcode:      dns.RcodeNameError,
+		aa:         true,
+		expectKind: IterativeStepNoName,
+	}, {
+		name:       "non-authoritative NXDOMAIN",
+		zone:       "example.com.",
+		qtype:      dns.TypeA,
+		rcode:      dns.RcodeNameError,
+		expectKind: IterativeStepLame,
+	}, {
+		name:       "non-authoritative NXDOMAIN with referral",
+		zone:       "com.",
+		qtype:      dns.TypeA,
+		rcode:      dns.RcodeNameError,
+		ns:         []string{"example.com. NS ns1.example.com."},
+		expectKind: IterativeStepLame,
+	}, {
+		name:       "NODATA",
+		zone:       "example.com.",
+		qtype:      dns.TypeA,
+		aa:         true,
+		expectKind: IterativeStepNoData,
+	}, {
+		name:       "SERVFAIL",
+		zone:       "example.com.",
+		qtype:      dns.TypeA,
+		rcode:      dns.RcodeServerFailure,
+		expectKind: IterativeStepLame,
+	}, {
+		name:       "REFUSED",
+		zone:       "example.com.",
+		qtype:      dns.TypeA,
+		rcode:      dns.RcodeRefused,
+		expectKind: IterativeStepLame,
+	}, {
+		name:       "neither authoritative nor a referral",
+		zone:       "example.com.",
+		qtype:      dns.TypeA,
+		expectKind: IterativeStepLame,
+	}, {
+		name:  "referral with glue",
+		zone:  "com.",
+		qtype: dns.TypeA,
+		ns: []string{
+			"example.com. NS ns1.example.com.",
+			"example.com. NS ns2.example.net.",
+		},
+		extra: []string{
+			"ns1.example.com. AAAA 2001:db8::53",
+			"ns1.example.com. A 192.0.2.53",
+			"ns2.example.net. A 192.0.2.66",
+		},
+		expectKind: IterativeStepReferral,
+		expectZone: "example.com.",
+		expectServers: []*IterativeNameServer{
+			{Name: "ns1.example.com.", Addrs: []string{"192.0.2.53", "2001:db8::53"}},
+			{Name: "ns2.example.net."},
+		},
+	}, {
+		name:  "referral from the root",
+		zone:  ".",
+		qtype: dns.TypeA,
+		ns:    []string{"com. NS a.gtld-servers.net."},
+		extra: []string{"a.gtld-servers.net. A 192.5.6.30"},
+		expectServers: []*IterativeNameServer{
+			{Name: "a.gtld-servers.net.", Addrs: []string{"192.5.6.30"}},
+		},
+		expectKind: IterativeStepReferral,
+		expectZone: "com.",
+	}, {
+		name:       "upward referral",
+		zone:       "example.com.",
+		qtype:      dns.TypeA,
+		ns:         []string{"com. NS a.gtld-servers.net."},
+		expectKind: IterativeStepLame,
+	}, {
+		name:       "referral to the same zone",
+		zone:       "example.com.",
+		qtype:      dns.TypeA,
+		ns:         []string{"example.com. NS ns1.example.com."},
+		expectKind: IterativeStepLame,
+	}, {
+		name:       "sideways referral",
+		zone:       "com.",
+		qtype:      dns.TypeA,
+		ns:         []string{"example.org. NS ns1.example.org."},
+		expectKind: IterativeStepLame,
+	}, {
+		name:       "referral to a zone not containing the name",
+		zone:       "com.",
+		qtype:      dns.TypeA,
+		ns:         []string{"other.com. NS ns1.other.com."},
+		expectKind: IterativeStepLame,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := newIterativeTestResponse(t, tt.rcode, tt.aa, tt.answer, tt.ns, tt.extra)
+			outcome := iterativeClassify(tt.zone, "www.example.com.", tt.qtype, resp)
+			assert.Equal(t, tt.expectKind, outcome.kind)
+			assert.Len(t, outcome.answers, tt.expectAnswers)
+			assert.Equal(t, tt.expectTarget, outcome.target)
+			assert.Equal(t, tt.expectZone, outcome.zone)
+			assert.Equal(t, tt.expectServers, outcome.servers)
+		})
+	}
+}
+
+func TestIterativeResolver_LookupEdgeCases(t *testing.T) {
+	t.Run("CNAME loop", func(t *testing.T) {
+		reso := &IterativeResolver{
+			RootHints: []*IterativeNameServer{{Name: "a.root-servers.invalid.", Addrs: []string{"192.0.2.1"}}},
+			Transport: &MockResolverTransport{
+				MockQuery: func(ctx context.Context, addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+					resp := &dns.Msg{}
+					resp.SetReply(query)
+					resp.Authoritative = true
+					resp.Answer = []dns.RR{&dns.CNAME{
+						Hdr: dns.RR_Header{
+							Name:   query.Question[0].Name,
+							Rrtype: dns.TypeCNAME,
+							Class:  dns.ClassINET,
+							Ttl:    3600,
+						},
+						Target: "a" + query.Question[0].Name,
+					}}
+					return resp, nil
+				},
+			},
+		}
+		result, err := reso.Lookup(context.Background(), "example.com", dns.TypeA)
+		assert.ErrorIs(t, err, ErrIterativeTooManyCNAMEs)
+		assert.Len(t, result.Answers, iterativeMaxCNAMEs+1)
+		assert.Len(t, result.Trace, iterativeMaxCNAMEs+1)
+		for _, step := range result.Trace {
+			assert.False(t, step.Query.RecursionDesired)
+			assert.Equal(t, IterativeStepCNAME, step.Kind)
+		}
+	})
+
+	t.Run("truncated response", func(t *testing.T) {
+		var protocols []Protocol
+		reso := &IterativeResolver{
+			RootHints: []*IterativeNameServer{{Name: "a.root-servers.invalid.", Addrs: []string{"192.0.2.1"}}},
+			Transport: &MockResolverTransport{
+				MockQuery: func(ctx context.Context, addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+					protocols = append(protocols, addr.Protocol)
+					resp := &dns.Msg{}
+					resp.SetReply(query)
+					resp.Authoritative = true
+					resp.Truncated = addr.Protocol == ProtocolUDP
+					return resp, nil
+				},
+			},
+		}
+		result, err := reso.Lookup(context.Background(), "example.com", dns.TypeA)
+		assert.ErrorIs(t, err, ErrNoData)
+		assert.Equal(t, []Protocol{ProtocolUDP, ProtocolTCP}, protocols)
+		assert.Len(t, result.Trace, 1)
+	})
+
+	t.Run("context canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		reso := &IterativeResolver{
+			RootHints: []*IterativeNameServer{
+				{Name: "a.root-servers.invalid.", Addrs: []string{"192.0.2.1", "192.0.2.2"}},
+				{Name: "b.root-servers.invalid.", Addrs: []string{"192.0.2.3"}},
+			},
+			Transport: &MockResolverTransport{
+				MockQuery: func(ctx context.Context, addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+					cancel()
+					return nil, ctx.Err()
+				},
+			},
+		}
+		result, err := reso.Lookup(ctx, "example.com", dns.TypeA)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Len(t, result.Trace, 1)
+		assert.Equal(t, IterativeStepError, result.Trace[0].Kind)
+	})
+
+	t.Run("invalid domain name", func(t *testing.T) {
+		reso := &IterativeResolver{
+			Transport: &MockResolverTransport{
+				MockQuery: func(ctx context.Context, addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+					panic("should not be called")
+				},
+			},
+		}
+		result, err := reso.Lookup(context.Background(), "invalid..example.com", dns.TypeA)
+		assert.ErrorIs(t, err, ErrInvalidQuery)
+		assert.Empty(t, result.Trace)
+	})
+}
+
+func TestDefaultRootHints(t *testing.T) {
+	hints := DefaultRootHints()
+	assert.Len(t, hints, 13)
+	for _, hint := range hints {
+		assert.True(t, dns.IsSubDomain("root-servers.net.", hint.Name))
+		assert.Len(t, hint.Addrs, 2)
+	}
+}
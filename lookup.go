@@ -16,6 +16,7 @@ package dnscore
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -29,15 +30,63 @@ func (r *Resolver) transport() ResolverTransport {
 	return DefaultTransport
 }
 
-// exchange implements [*Resolver.lookup] with a specific server.
-func (r *Resolver) exchange(ctx context.Context,
-	name string, qtype uint16, server resolverConfigServer) ([]dns.RR, error) {
+// exchange implements [*Resolver.lookup] with a specific server. The returned
+// result is never nil and contains the response, if any, even on NXDOMAIN.
+func (r *Resolver) exchange(ctx context.Context, name string, qtype uint16,
+	server resolverConfigServer) (*LookupResult, error) {
+	result := &LookupResult{DNSSECStatus: DNSSECIndeterminate, ServerAddr: server.address}
+
 	// Handle the case of domains that should not be resolved
 	labels := dns.SplitDomainName(dns.CanonicalName(name))
 	if len(labels) > 0 && labels[len(labels)-1] == "onion" {
-		return nil, ErrNoData
+		return result, ErrNoData
+	}
+
+	// Encode the query, possibly asking for DNSSEC signatures
+	options := server.queryOptions
+	if r.DNSSEC != nil {
+		options = dnssecQueryOptions(server)
+	}
+	query, err := NewQueryWithServerAddr(server.address, name, qtype, options...)
+	if err != nil {
+		return result, err
 	}
+	q0 := query.Question[0] // we know it's present because we just created it
 
+	// Obtain the response
+	t0 := time.Now()
+	resp, err := r.roundTrip(ctx, server, query)
+	result.RTT = time.Since(t0)
+	if err != nil {
+		return result, err
+	}
+
+	// Possibly validate using DNSSEC before checking for errors
+	// since we also need to authenticate NXDOMAIN and NODATA
+	if r.DNSSEC != nil {
+		result.DNSSECStatus, err = r.newDNSSECValidator(server).validate(ctx, q0, resp)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	// Check for errors and extract RRs
+	result.Response = resp
+	result.CanonicalName, result.CNAMEChain = lookupCNAMEChain(q0.Name, resp)
+	if err := RCodeToError(resp); err != nil {
+		return result, err
+	}
+	rrs, err := ValidAnswers(q0, resp)
+	if err != nil {
+		return result, err
+	}
+	result.Addrs, result.RRs = lookupAddrs(rrs), rrs
+	return result, nil
+}
+
+// roundTrip sends the query to the given server and returns the response.
+func (r *Resolver) roundTrip(ctx context.Context,
+	server resolverConfigServer, query *dns.Msg) (*dns.Msg, error) {
 	// Enforce an operation timeout
 	if server.timeout > 0 {
 		var cancel context.CancelFunc
@@ -45,35 +94,129 @@ func (r *Resolver) exchange(ctx context.Context,
 		defer cancel()
 	}
 
-	// Encode the query
-	query, err := NewQueryWithServerAddr(server.address, name, qtype, server.queryOptions...)
-	if err != nil {
-		return nil, err
-	}
-	q0 := query.Question[0] // we know it's present because we just created it
-
 	// Obtain the transport and perform the query
 	resp, err := r.transport().Query(ctx, server.address, query)
 	if err != nil {
 		return nil, err
 	}
 
-	// Validate the response, check for errors and extract RRs
+	// Validate the response and possibly retry using TCP when the
+	// UDP response is truncated, as recommended by RFC 7766 Sect. 5.
 	if err := ValidateResponse(query, resp); err != nil {
 		return nil, err
 	}
-	if err := RCodeToError(resp); err != nil {
-		return nil, err
+	if resp.Truncated && server.address.Protocol == ProtocolUDP {
+		tcpAddr := server.tcpFallbackAddress()
+		maybeLogFallback(ctx, r.Logger, server.address, tcpAddr, "truncated", transportTimeNow(r.transport()))
+		resp, err = r.transport().Query(ctx, tcpAddr, query)
+		if err != nil {
+			return nil, err
+		}
+		if err := ValidateResponse(query, resp); err != nil {
+			return nil, err
+		}
 	}
-	return ValidAnswers(q0, resp)
+	return resp, nil
 }
 
 // lookup is the internal implementation of the Lookup* functions.
 func (r *Resolver) lookup(ctx context.Context,
-	name string, qtype uint16) ([]dns.RR, error) {
-	// by default, on failure, we return the EAI_NODATA equivalent
-	lastErr := ErrNoData
+	name string, qtype uint16) ([]dns.RR, DNSSECStatus, error) {
+	result, err := r.lookupResult(ctx, name, qtype)
+	return result.RRs, result.DNSSECStatus, err
+}
+
+// lookupResult is like [*Resolver.lookup] but returns the [*LookupResult],
+// which is never nil and may be shared with concurrent callers.
+func (r *Resolver) lookupResult(ctx context.Context,
+	name string, qtype uint16) (*LookupResult, error) {
+	// possibly serve the answer using the hosts file
+	if r.Hosts != nil && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+		if result, found := r.Hosts.lookup(name, qtype); found {
+			if len(result.RRs) <= 0 {
+				return result, ErrNoData
+			}
+			return result, nil
+		}
+	}
+
+	// invalid names fail when creating the query, so there is
+	// no point in expanding them using the search list
+	if _, valid := newCacheKey(name, qtype); !valid || name == "" {
+		return r.lookupName(ctx, name, qtype)
+	}
+	names := r.config().nameList(name)
+	if len(names) <= 0 {
+		return &LookupResult{DNSSECStatus: DNSSECIndeterminate}, ErrNoName
+	}
 
+	// try each name in order and stop on success or when the context is
+	// done. Like glibc, on failure, we return NODATA when a name exists
+	// without RRs of the requested type, or otherwise an error other than
+	// NXDOMAIN, such that we do not claim that a name does not exist when
+	// we could not query all the names, or otherwise the last NXDOMAIN.
+	var (
+		lastResult, failResult, noDataResult *LookupResult
+		lastErr, failErr, noDataErr          error
+	)
+	for _, fqdn := range names {
+		result, err := r.lookupName(ctx, fqdn, qtype)
+		if err == nil {
+			return result, nil
+		}
+		switch {
+		case errors.Is(err, ErrNoData):
+			if noDataErr == nil {
+				noDataResult, noDataErr = result, err
+			}
+		case errors.Is(err, ErrNoName):
+			// nothing
+		default:
+			if failErr == nil {
+				failResult, failErr = result, err
+			}
+		}
+		lastResult, lastErr = result, err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	switch {
+	case noDataErr != nil:
+		return noDataResult, noDataErr
+	case failErr != nil:
+		return failResult, failErr
+	default:
+		return lastResult, lastErr
+	}
+}
+
+// lookupName implements [*Resolver.lookupResult] for a single name.
+func (r *Resolver) lookupName(ctx context.Context,
+	name string, qtype uint16) (*LookupResult, error) {
+	// possibly serve a fresh answer from the cache
+	key, valid := newCacheKey(name, qtype)
+	if valid && r.Cache != nil {
+		if entry, ok := r.Cache.get(key, false); ok {
+			return entry.result(), entry.err
+		}
+	}
+
+	// invalid names fail when creating the query, so there is no point in
+	// coalescing, otherwise share the exchange with concurrent callers
+	if !valid {
+		return r.lookupServers(ctx, name, qtype, key, false)
+	}
+	return r.coalesce(ctx, key, func(ctx context.Context) (*LookupResult, error) {
+		return r.lookupServers(ctx, name, qtype, key, r.Cache != nil)
+	})
+}
+
+// lookupServers queries the configured servers and possibly updates the cache.
+func (r *Resolver) lookupServers(ctx context.Context, name string,
+	qtype uint16, key cacheKey, cacheable bool) (*LookupResult, error) {
+	// by default, on failure, we return the EAI_NODATA equivalent
+	lastResult, lastErr := &LookupResult{DNSSECStatus: DNSSECIndeterminate}, ErrNoData
 	// obtain the list of servers and prepare to walk it
 	var (
 		config   = r.config()
@@ -83,21 +226,108 @@ func (r *Resolver) lookup(ctx context.Context,
 	for idx := 0; len(servers) > 0 && idx < attempts; idx++ {
 		// select a server and exchange the query
 		server := servers[uint32(idx)%uint32(len(servers))]
-		rrs, err := r.exchange(ctx, name, qtype, server)
+		result, err := r.exchange(ctx, name, qtype, server)
+		result.Attempts = idx + 1
 
 		// immediately handle success and stop on NXDOMAIN
 		//
 		// note: it's not so common to use NXDOMAIN for censorship
 		// so this is a trade off to privilege fast convergence
-		if err == nil {
-			return rrs, nil
+		if err == nil || errors.Is(err, ErrNoName) {
+			if cacheable {
+				r.Cache.put(key, result.Response, result.RRs, result.DNSSECStatus, err)
+			}
+			return result, err
 		}
-		if errors.Is(err, ErrNoName) {
-			return nil, err
+
+		lastResult, lastErr = result, err
+	}
+
+	// possibly cache NODATA or serve a stale answer on failure
+	if cacheable {
+		if cacheTTL(lastResult.Response, lastErr) > 0 {
+			r.Cache.put(key, lastResult.Response, nil, lastResult.DNSSECStatus, lastErr)
+		} else if entry, ok := r.Cache.get(key, true); ok {
+			result := entry.result()
+			result.Attempts = lastResult.Attempts
+			return result, entry.err
 		}
+	}
+
+	return lastResult, lastErr
+}
+
+// resolverInflight is an in-flight lookup shared by concurrent callers.
+type resolverInflight struct {
+	// cancel cancels the shared lookup.
+	cancel context.CancelFunc
+
+	// done is closed when the shared lookup is complete.
+	done chan struct{}
 
-		lastErr = err
+	// err is the lookup error, if any.
+	err error
+
+	// result is the lookup result.
+	result *LookupResult
+
+	// waiters is the number of callers waiting for the
+	// result, which is protected by the resolver mutex.
+	waiters int
+}
+
+// coalesce runs the lookup function in the background using a context
+// detached from the one of the caller and shares the result with concurrent
+// callers using the same key. When the context of a caller is done, the caller
+// stops waiting, and we only cancel the shared lookup when it was the last
+// caller still waiting for the result.
+func (r *Resolver) coalesce(ctx context.Context, key cacheKey,
+	fx func(ctx context.Context) (*LookupResult, error)) (*LookupResult, error) {
+	// 1. join the in-flight lookup or start a new one
+	r.mu.Lock()
+	if r.inflight == nil {
+		r.inflight = make(map[cacheKey]*resolverInflight)
+	}
+	call, found := r.inflight[key]
+	if !found {
+		sharedCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &resolverInflight{cancel: cancel, done: make(chan struct{})}
+		r.inflight[key] = call
+		go func() {
+			defer close(call.done)
+			defer cancel()
+			call.result, call.err = fx(sharedCtx)
+			r.mu.Lock()
+			if r.inflight[key] == call {
+				delete(r.inflight, key)
+			}
+			r.mu.Unlock()
+		}()
 	}
+	call.waiters++
+	waiters := call.waiters
+	r.mu.Unlock()
+	if found {
+		maybeLogCoalesce(ctx, r.Logger, "dnsLookupCoalesced", key, waiters, transportTimeNow(r.transport()))
+	}
+
+	// 2. wait for the result or for the caller to give up
+	select {
+	case <-call.done:
+		return call.result, call.err
 
-	return nil, lastErr
+	case <-ctx.Done():
+		r.mu.Lock()
+		call.waiters--
+		waiters = call.waiters
+		if waiters <= 0 {
+			call.cancel()
+			if r.inflight[key] == call {
+				delete(r.inflight, key)
+			}
+		}
+		r.mu.Unlock()
+		maybeLogCoalesce(ctx, r.Logger, "dnsLookupAbandoned", key, waiters, transportTimeNow(r.transport()))
+		return &LookupResult{DNSSECStatus: DNSSECIndeterminate}, ctx.Err()
+	}
 }
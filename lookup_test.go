@@ -3,9 +3,14 @@
 package dnscore
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -47,13 +52,48 @@ func TestResolver_exchange(t *testing.T) {
 		server := resolverConfigServer{
 			address: &ServerAddr{Address: "8.8.8.8:53"},
 		}
-		rrs, err := resolver.exchange(context.Background(), "example.com", dns.TypeA, server)
+		result, err := resolver.exchange(context.Background(), "example.com", dns.TypeA, server)
 		if err != nil {
 			t.Fatal("unexpected error:", err)
 		}
-		if len(rrs) != 1 || rrs[0].String() != expectedRR.String() {
+		if rrs := result.RRs; len(rrs) != 1 || rrs[0].String() != expectedRR.String() {
+			t.Fatalf("unexpected result: got %v, want %v", rrs, expectedRR)
+		}
+	})
+
+	t.Run("truncated UDP response", func(t *testing.T) {
+		expectedRR := &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("192.0.2.1"),
+		}
+		var protocols []Protocol
+		mockTransport := &MockResolverTransport{
+			MockQuery: func(ctx context.Context, addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+				protocols = append(protocols, addr.Protocol)
+				resp := &dns.Msg{}
+				resp.SetReply(query)
+				if addr.Protocol == ProtocolUDP {
+					resp.Truncated = true
+					return resp, nil
+				}
+				resp.Answer = append(resp.Answer, expectedRR)
+				return resp, nil
+			},
+		}
+		resolver := &Resolver{Transport: mockTransport}
+		server := resolverConfigServer{
+			address: &ServerAddr{Protocol: ProtocolUDP, Address: "8.8.8.8:53"},
+		}
+		result, err := resolver.exchange(context.Background(), "example.com", dns.TypeA, server)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if rrs := result.RRs; len(rrs) != 1 || rrs[0].String() != expectedRR.String() {
 			t.Fatalf("unexpected result: got %v, want %v", rrs, expectedRR)
 		}
+		if len(protocols) != 2 || protocols[0] != ProtocolUDP || protocols[1] != ProtocolTCP {
+			t.Fatalf("unexpected protocols: %v", protocols)
+		}
 	})
 
 	t.Run("query timeout", func(t *testing.T) {
@@ -135,7 +175,7 @@ func TestResolver_lookup(t *testing.T) {
 			},
 		}
 		resolver.Config = config
-		rrs, err := resolver.lookup(context.Background(), "example.com", dns.TypeA)
+		rrs, _, err := resolver.lookup(context.Background(), "example.com", dns.TypeA)
 		if err != nil {
 			t.Fatal("unexpected error:", err)
 		}
@@ -160,7 +200,7 @@ func TestResolver_lookup(t *testing.T) {
 			},
 		}
 		resolver.Config = config
-		_, err := resolver.lookup(context.Background(), "example.com", dns.TypeA)
+		_, _, err := resolver.lookup(context.Background(), "example.com", dns.TypeA)
 		if !errors.Is(err, ErrNoData) {
 			t.Fatalf("unexpected error: got %v, want %v", err, ErrNoData)
 		}
@@ -183,9 +223,238 @@ func TestResolver_lookup(t *testing.T) {
 			},
 		}
 		resolver.Config = config
-		_, err := resolver.lookup(context.Background(), "example.com", dns.TypeA)
+		_, _, err := resolver.lookup(context.Background(), "example.com", dns.TypeA)
 		if !errors.Is(err, ErrNoName) {
 			t.Fatalf("unexpected error: got %v, want %v", err, ErrNoName)
 		}
 	})
 }
+
+// waitForWaiters waits for the given number of callers to be
+// waiting for the in-flight lookup with the given key.
+func waitForWaiters(t *testing.T, resolver *Resolver, key cacheKey, waiters int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resolver.mu.Lock()
+		call := resolver.inflight[key]
+		done := call != nil && call.waiters == waiters
+		resolver.mu.Unlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for callers")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestResolver_coalesce(t *testing.T) {
+	// newBlockingResolver returns a resolver whose transport blocks
+	// until the release channel is closed, counting the queries and
+	// forwarding the query contexts to the given channel.
+	newBlockingResolver := func(queries *atomic.Int64,
+		release <-chan struct{}, contexts chan<- context.Context, logs *bytes.Buffer) *Resolver {
+		config := NewConfig()
+		config.AddServer(NewServerAddr(ProtocolUDP, "8.8.8.8:53"))
+		return &Resolver{
+			Config: config,
+			Logger: slog.New(slog.NewJSONHandler(logs, nil)),
+			Transport: &MockResolverTransport{
+				MockQuery: func(ctx context.Context, addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+					queries.Add(1)
+					if contexts != nil {
+						contexts <- ctx
+					}
+					select {
+					case <-release:
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					}
+					resp := &dns.Msg{}
+					resp.SetReply(query)
+					resp.Answer = []dns.RR{&dns.A{
+						Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+						A:   net.IPv4(192, 0, 2, 1),
+					}}
+					return resp, nil
+				},
+			},
+		}
+	}
+
+	// countEvents counts the log events with the given message.
+	countEvents := func(logs *bytes.Buffer, msg string) (count int) {
+		decoder := json.NewDecoder(bytes.NewReader(logs.Bytes()))
+		for decoder.More() {
+			var entry struct {
+				Msg             string `json:"msg"`
+				DNSLookupDomain string `json:"dnsLookupDomain"`
+				DNSLookupType   string `json:"dnsLookupType"`
+			}
+			if err := decoder.Decode(&entry); err != nil {
+				t.Fatal(err)
+			}
+			if entry.Msg == msg && entry.DNSLookupDomain == "example.com." && entry.DNSLookupType == "A" {
+				count++
+			}
+		}
+		return
+	}
+
+	t.Run("concurrent lookups share a single exchange", func(t *testing.T) {
+		const callers = 8
+		var queries atomic.Int64
+		release := make(chan struct{})
+		logs := &bytes.Buffer{}
+		resolver := newBlockingResolver(&queries, release, nil, logs)
+
+		var wg sync.WaitGroup
+		errch := make(chan error, callers)
+		for idx := 0; idx < callers; idx++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				addrs, err := resolver.LookupA(context.Background(), "EXAMPLE.com")
+				if err == nil && (len(addrs) != 1 || addrs[0] != "192.0.2.1") {
+					err = errors.New("unexpected addresses")
+				}
+				errch <- err
+			}()
+		}
+		key, _ := newCacheKey("example.com", dns.TypeA)
+		waitForWaiters(t, resolver, key, callers)
+		close(release)
+		wg.Wait()
+		close(errch)
+
+		for err := range errch {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := queries.Load(); n != 1 {
+			t.Fatalf("unexpected number of queries: got %d, want 1", n)
+		}
+		if n := countEvents(logs, "dnsLookupCoalesced"); n != callers-1 {
+			t.Fatalf("unexpected number of coalesced events: got %d, want %d", n, callers-1)
+		}
+		if len(resolver.inflight) != 0 {
+			t.Fatal("expected no in-flight lookups")
+		}
+	})
+
+	t.Run("different types are not coalesced", func(t *testing.T) {
+		var queries atomic.Int64
+		release := make(chan struct{})
+		close(release)
+		resolver := newBlockingResolver(&queries, release, nil, &bytes.Buffer{})
+		if _, err := resolver.LookupHost(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if n := queries.Load(); n != 2 {
+			t.Fatalf("unexpected number of queries: got %d, want 2", n)
+		}
+	})
+
+	t.Run("cancelling one caller does not abort the others", func(t *testing.T) {
+		var queries atomic.Int64
+		release := make(chan struct{})
+		contexts := make(chan context.Context, 1)
+		logs := &bytes.Buffer{}
+		resolver := newBlockingResolver(&queries, release, contexts, logs)
+		key, _ := newCacheKey("example.com", dns.TypeA)
+
+		// start the first caller, which we cancel later
+		ctx, cancel := context.WithCancel(context.Background())
+		errch := make(chan error, 1)
+		go func() {
+			_, err := resolver.LookupA(ctx, "example.com")
+			errch <- err
+		}()
+		waitForWaiters(t, resolver, key, 1)
+
+		// start the second caller
+		type result struct {
+			addrs []string
+			err   error
+		}
+		resultch := make(chan result, 1)
+		go func() {
+			addrs, err := resolver.LookupA(context.Background(), "example.com")
+			resultch <- result{addrs, err}
+		}()
+		waitForWaiters(t, resolver, key, 2)
+
+		// cancel the first caller and make sure it returns immediately
+		cancel()
+		if err := <-errch; !errors.Is(err, context.Canceled) {
+			t.Fatalf("unexpected error: got %v, want %v", err, context.Canceled)
+		}
+		queryCtx := <-contexts
+		if queryCtx.Err() != nil {
+			t.Fatal("the shared lookup should not have been cancelled")
+		}
+
+		// let the second caller complete
+		close(release)
+		res := <-resultch
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if len(res.addrs) != 1 || res.addrs[0] != "192.0.2.1" {
+			t.Fatalf("unexpected addresses: %v", res.addrs)
+		}
+		if n := countEvents(logs, "dnsLookupAbandoned"); n != 1 {
+			t.Fatalf("unexpected number of abandoned events: got %d, want 1", n)
+		}
+	})
+
+	t.Run("cancelling all the callers aborts the exchange", func(t *testing.T) {
+		var queries atomic.Int64
+		release := make(chan struct{})
+		contexts := make(chan context.Context, 2)
+		resolver := newBlockingResolver(&queries, release, contexts, &bytes.Buffer{})
+		key, _ := newCacheKey("example.com", dns.TypeA)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errch := make(chan error, 1)
+		go func() {
+			_, err := resolver.LookupA(ctx, "example.com")
+			errch <- err
+		}()
+		queryCtx := <-contexts
+		resolver.mu.Lock()
+		call := resolver.inflight[key]
+		resolver.mu.Unlock()
+		cancel()
+		if err := <-errch; !errors.Is(err, context.Canceled) {
+			t.Fatalf("unexpected error: got %v, want %v", err, context.Canceled)
+		}
+		select {
+		case <-queryCtx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("the shared lookup should have been cancelled")
+		}
+
+		// a subsequent lookup must not join the cancelled one
+		ctx2, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel2()
+		go func() {
+			_, err := resolver.LookupA(ctx2, "example.com")
+			errch <- err
+		}()
+		select {
+		case <-contexts:
+		case <-ctx2.Done():
+			t.Fatal("expected a new exchange")
+		}
+
+		// wait for the background lookups to terminate
+		close(release)
+		if err := <-errch; err != nil {
+			t.Fatal(err)
+		}
+		<-call.done
+	})
+}
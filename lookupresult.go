@@ -0,0 +1,115 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// Lookup results including metadata.
+//
+
+package dnscore
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// LookupResult is the result of [*Resolver.Lookup].
+type LookupResult struct {
+	// Addrs contains the addresses of the A and AAAA answer RRs.
+	Addrs []LookupAddr
+
+	// Attempts is the number of exchanges with the servers, which is
+	// zero when we served a fresh answer from the cache.
+	Attempts int
+
+	// CNAMEChain contains the targets of the CNAME RRs we followed
+	// from the queried name to the canonical name, in order.
+	CNAMEChain []string
+
+	// CanonicalName is the canonical name, which is the last
+	// element of CNAMEChain or the queried name.
+	CanonicalName string
+
+	// Cached indicates that we served the answer from the cache.
+	Cached bool
+
+	// DNSSECStatus is the DNSSEC status (see [*Resolver.LookupDNSSEC]).
+	DNSSECStatus DNSSECStatus
+
+	// FromHostsFile indicates that we served the answer
+	// using the hosts file (see [*Resolver.Hosts]).
+	FromHostsFile bool
+
+	// RRs contains the valid answer RRs excluding the CNAME chain.
+	RRs []dns.RR
+
+	// RTT is the round-trip time of the exchange that produced
+	// the response, including retrying truncated responses.
+	RTT time.Duration
+
+	// Response is the response, which is nil when the result comes from
+	// the cache or when the last exchange did not receive a response.
+	Response *dns.Msg
+
+	// ServerAddr is the server of the last exchange, which
+	// is nil when the result comes from the cache.
+	ServerAddr *ServerAddr
+}
+
+// LookupAddr is an address in a [*LookupResult].
+type LookupAddr struct {
+	// Addr is the IPv4 or IPv6 address.
+	Addr string
+
+	// TTL is the remaining time to live of the address.
+	TTL time.Duration
+}
+
+// Lookup resolves the RRs of the given type for the given domain and returns
+// them along with the metadata about the lookup. Use constants such as
+// [dns.TypeA] to specify the query type.
+//
+// The returned result is never nil, even on failure, such that the caller
+// can inspect, e.g., the response code of the last response. When concurrent
+// lookups are coalesced, the callers share the same RRs and response,
+// therefore the caller must not modify them.
+func (r *Resolver) Lookup(ctx context.Context, host string, qtype uint16) (*LookupResult, error) {
+	shared, err := r.lookupResult(ctx, host, qtype)
+	result := *shared
+	return &result, err
+}
+
+// lookupAddrs extracts the addresses and TTLs from the A and AAAA RRs.
+func lookupAddrs(rrs []dns.RR) (addrs []LookupAddr) {
+	for _, rr := range rrs {
+		ttl := time.Duration(rr.Header().Ttl) * time.Second
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, LookupAddr{Addr: rr.A.String(), TTL: ttl})
+
+		case *dns.AAAA:
+			addrs = append(addrs, LookupAddr{Addr: rr.AAAA.String(), TTL: ttl})
+		}
+	}
+	return
+}
+
+// lookupCNAMEChain follows the CNAME RRs in the answer section starting from
+// the given name and returns the canonical name along with the CNAME chain.
+func lookupCNAMEChain(name string, resp *dns.Msg) (string, []string) {
+	var chain []string
+	for range resp.Answer { // bound the number of iterations to avoid loops
+		found := false
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && equalASCIIName(cname.Hdr.Name, name) {
+				name, found = cname.Target, true
+				chain = append(chain, name)
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return name, chain
+}
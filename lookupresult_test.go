@@ -0,0 +1,328 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolver_Lookup(t *testing.T) {
+	records := []string{
+		"www.example.com. 300 CNAME cdn.example.com.",
+		"cdn.example.com. 300 CNAME edge.example.net.",
+		"edge.example.net. 60 A 192.0.2.1",
+		"edge.example.net. 30 A 192.0.2.2",
+		"edge.example.net. 60 AAAA 2001:db8::1",
+		"example.com. SOA ns.example.com. admin.example.com. 1 3600 600 86400 300",
+	}
+	ctx := context.Background()
+
+	t.Run("CNAME chain and per-address TTL", func(t *testing.T) {
+		reso := newNetResolverTestResolver(t, records...)
+		result, err := reso.Lookup(ctx, "www.example.com", dns.TypeA)
+		assert.NoError(t, err)
+		assert.Equal(t, []LookupAddr{
+			{Addr: "192.0.2.1", TTL: 60 * time.Second},
+			{Addr: "192.0.2.2", TTL: 30 * time.Second},
+		}, result.Addrs)
+		assert.Equal(t, 1, result.Attempts)
+		assert.Equal(t, []string{"cdn.example.com.", "edge.example.net."}, result.CNAMEChain)
+		assert.Equal(t, "edge.example.net.", result.CanonicalName)
+		assert.False(t, result.Cached)
+		assert.Len(t, result.RRs, 2)
+		if assert.NotNil(t, result.Response) {
+			assert.Len(t, result.Response.Answer, 4)
+		}
+		assert.NotNil(t, result.ServerAddr)
+
+		addrs, err := reso.LookupA(ctx, "www.example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, addrs)
+	})
+
+	t.Run("NXDOMAIN", func(t *testing.T) {
+		reso := newNetResolverTestResolver(t, records...)
+		result, err := reso.Lookup(ctx, "nxdomain.example.com", dns.TypeA)
+		assert.ErrorIs(t, err, ErrNoName)
+		if assert.NotNil(t, result.Response) {
+			assert.Equal(t, dns.RcodeNameError, result.Response.Rcode)
+		}
+		assert.Equal(t, "nxdomain.example.com.", result.CanonicalName)
+		assert.Nil(t, result.RRs)
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		reso := newNetResolverTestResolver(t, records...)
+		mock := reso.Transport.(*MockResolverTransport)
+		query, count := mock.MockQuery, 0
+		mock.MockQuery = func(ctx context.Context, addr *ServerAddr, q *dns.Msg) (*dns.Msg, error) {
+			if count++; count == 1 {
+				return nil, errors.New("mocked error")
+			}
+			return query(ctx, addr, q)
+		}
+		reso.Config = NewConfig()
+		reso.Config.AddServer(NewServerAddr(ProtocolUDP, "192.0.2.53:53"))
+		reso.Config.AddServer(NewServerAddr(ProtocolUDP, "192.0.2.54:53"))
+
+		result, err := reso.Lookup(ctx, "edge.example.net", dns.TypeAAAA)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, result.Attempts)
+		assert.Equal(t, []LookupAddr{{Addr: "2001:db8::1", TTL: 60 * time.Second}}, result.Addrs)
+		assert.Equal(t, "192.0.2.54:53", result.ServerAddr.Address)
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		now := time.Now()
+		reso := newNetResolverTestResolver(t, records...)
+		reso.Cache = NewCache(CacheOptionTimeNow(func() time.Time { return now }))
+		_, err := reso.Lookup(ctx, "www.example.com", dns.TypeA)
+		assert.NoError(t, err)
+
+		now = now.Add(20 * time.Second)
+		result, err := reso.Lookup(ctx, "www.example.com", dns.TypeA)
+		assert.NoError(t, err)
+		assert.True(t, result.Cached)
+		assert.Equal(t, 0, result.Attempts)
+		assert.Equal(t, []string{"cdn.example.com.", "edge.example.net."}, result.CNAMEChain)
+		assert.Equal(t, "edge.example.net.", result.CanonicalName)
+		assert.Equal(t, []LookupAddr{
+			{Addr: "192.0.2.1", TTL: 10 * time.Second},
+			{Addr: "192.0.2.2", TTL: 10 * time.Second},
+		}, result.Addrs)
+		assert.Nil(t, result.Response)
+		assert.Nil(t, result.ServerAddr)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		reso := newNetResolverTestResolver(t, records...)
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		result, err := reso.Lookup(ctx, "www.example.com", dns.TypeA)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.NotNil(t, result)
+	})
+}
+
+func Test_lookupCNAMEChain(t *testing.T) {
+	newMsg := func(records ...string) *dns.Msg {
+		resp := &dns.Msg{}
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Answer = append(resp.Answer, rr)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		resp        *dns.Msg
+		expectName  string
+		expectChain []string
+	}{{
+		name:       "no CNAME",
+		query:      "example.com.",
+		resp:       newMsg("example.com. A 192.0.2.1"),
+		expectName: "example.com.",
+	}, {
+		name:  "out of order",
+		query: "a.example.com.",
+		resp: newMsg(
+			"b.example.com. CNAME c.example.com.",
+			"A.example.com. CNAME b.example.com.",
+			"c.example.com. A 192.0.2.1",
+		),
+		expectName:  "c.example.com.",
+		expectChain: []string{"b.example.com.", "c.example.com."},
+	}, {
+		name:  "unrelated CNAME",
+		query: "a.example.com.",
+		resp: newMsg(
+			"x.example.com. CNAME y.example.com.",
+			"a.example.com. A 192.0.2.1",
+		),
+		expectName: "a.example.com.",
+	}, {
+		name:  "loop",
+		query: "a.example.com.",
+		resp: newMsg(
+			"a.example.com. CNAME b.example.com.",
+			"b.example.com. CNAME a.example.com.",
+		),
+		expectName:  "a.example.com.",
+		expectChain: []string{"b.example.com.", "a.example.com."},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, chain := lookupCNAMEChain(tt.query, tt.resp)
+			assert.Equal(t, tt.expectName, name)
+			assert.Equal(t, tt.expectChain, chain)
+		})
+	}
+}
+
+func TestResolver_Lookup_search(t *testing.T) {
+	// newResolver returns a resolver using the search list along
+	// with a function returning the names it queried for
+	newResolver := func(t *testing.T, ndots int) (*Resolver, func() []string) {
+		reso := newNetResolverTestResolver(t,
+			"db.example.com. A 192.0.2.1",
+			"db.corp.example.com. A 192.0.2.2",
+			"mail.corp.example.com. MX 10 mx.example.com.",
+			"www.example.com. A 192.0.2.3",
+		)
+		mock := reso.Transport.(*MockResolverTransport)
+		var (
+			mu    sync.Mutex
+			names []string
+			query = mock.MockQuery
+		)
+		mock.MockQuery = func(ctx context.Context, addr *ServerAddr, q *dns.Msg) (*dns.Msg, error) {
+			name := q.Question[0].Name
+			mu.Lock()
+			names = append(names, name)
+			mu.Unlock()
+			if name == "broken.corp.example.com." {
+				resp := &dns.Msg{}
+				resp.SetRcode(q, dns.RcodeServerFailure)
+				return resp, nil
+			}
+			return query(ctx, addr, q)
+		}
+		reso.Config = NewConfig()
+		reso.Config.AddServer(NewServerAddr(ProtocolUDP, "192.0.2.53:53"))
+		reso.Config.SetAttempts(1)
+		reso.Config.SetNdots(ndots)
+		reso.Config.SetSearch([]string{"corp.example.com", "example.com"})
+		return reso, func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return slices.Clone(names)
+		}
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		name          string
+		host          string
+		ndots         int
+		expectErr     error
+		expectName    string
+		expectQueries []string
+	}{{
+		name:          "short name stops on success",
+		host:          "db",
+		ndots:         1,
+		expectName:    "db.corp.example.com.",
+		expectQueries: []string{"db.corp.example.com."},
+	}, {
+		name:       "short name tries the search list first",
+		host:       "www",
+		ndots:      1,
+		expectName: "www.example.com.",
+		expectQueries: []string{
+			"www.corp.example.com.",
+			"www.example.com.",
+		},
+	}, {
+		name:          "name with ndots dots is tried as is first",
+		host:          "db.example.com",
+		ndots:         1,
+		expectName:    "db.example.com.",
+		expectQueries: []string{"db.example.com."},
+	}, {
+		name:       "name with fewer than ndots dots is tried as is last",
+		host:       "db.example.com",
+		ndots:      3,
+		expectName: "db.example.com.",
+		expectQueries: []string{
+			"db.example.com.corp.example.com.",
+			"db.example.com.example.com.",
+			"db.example.com.",
+		},
+	}, {
+		name:          "fully qualified name is tried as is only",
+		host:          "db.",
+		ndots:         1,
+		expectErr:     ErrNoName,
+		expectName:    "db.",
+		expectQueries: []string{"db."},
+	}, {
+		name:       "NODATA takes precedence over NXDOMAIN",
+		host:       "mail",
+		ndots:      1,
+		expectErr:  ErrNoData,
+		expectName: "mail.corp.example.com.",
+		expectQueries: []string{
+			"mail.corp.example.com.",
+			"mail.example.com.",
+			"mail.",
+		},
+	}, {
+		name:       "failures take precedence over NXDOMAIN",
+		host:       "broken",
+		ndots:      1,
+		expectErr:  ErrServerTemporarilyMisbehaving,
+		expectName: "broken.corp.example.com.",
+		expectQueries: []string{
+			"broken.corp.example.com.",
+			"broken.example.com.",
+			"broken.",
+		},
+	}, {
+		name:       "NXDOMAIN when no name exists",
+		host:       "nonexistent",
+		ndots:      1,
+		expectErr:  ErrNoName,
+		expectName: "nonexistent.",
+		expectQueries: []string{
+			"nonexistent.corp.example.com.",
+			"nonexistent.example.com.",
+			"nonexistent.",
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reso, names := newResolver(t, tt.ndots)
+			result, err := reso.Lookup(ctx, tt.host, dns.TypeA)
+			if tt.expectErr != nil {
+				assert.ErrorIs(t, err, tt.expectErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectName, result.CanonicalName)
+			assert.Equal(t, tt.expectQueries, names())
+		})
+	}
+
+	t.Run("errors use the original name", func(t *testing.T) {
+		reso, _ := newResolver(t, 1)
+		_, err := reso.LookupMX(ctx, "nonexistent")
+		var dnsErr *net.DNSError
+		if assert.ErrorAs(t, err, &dnsErr) {
+			assert.Equal(t, "nonexistent", dnsErr.Name)
+		}
+	})
+
+	t.Run("canceled context stops the search", func(t *testing.T) {
+		reso, names := newResolver(t, 1)
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := reso.Lookup(ctx, "nonexistent", dns.TypeA)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.LessOrEqual(t, len(names()), 1)
+	})
+}
@@ -0,0 +1,434 @@
+//
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Adapted from: https://github.com/golang/go/blob/go1.21.10/src/net/lookup.go
+//
+// Adapted from: https://github.com/golang/go/blob/go1.21.10/src/net/dnsclient.go
+//
+// Lookup methods compatible with [*net.Resolver] along
+// with BSD-licensed code from the stdlib.
+//
+
+package dnscore
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// errMalformedDNSRecordsDetail is the [*net.DNSError] description used
+// when the response contains records with invalid names.
+const errMalformedDNSRecordsDetail = "DNS response contained records which contain invalid names"
+
+// newDNSError wraps an error returned by [*Resolver.lookup] into
+// a [*net.DNSError] like the [*net.Resolver] does. The returned
+// error unwraps to the original error, therefore, for example,
+// [errors.Is] still works with [ErrNoName] and [ErrNoData].
+func newDNSError(err error, name string) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return err
+	}
+	timeout := errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded)
+	return &net.DNSError{
+		UnwrapErr:   err,
+		Err:         err.Error(),
+		Name:        name,
+		IsTimeout:   timeout,
+		IsTemporary: timeout || errors.Is(err, ErrServerTemporarilyMisbehaving),
+		IsNotFound:  errors.Is(err, ErrNoName) || errors.Is(err, ErrNoData),
+	}
+}
+
+// lookupRRs obtains the RRs of the given type wrapping errors like [*net.Resolver].
+func (r *Resolver) lookupRRs(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	rrs, _, err := r.lookup(ctx, name, qtype)
+	if err != nil {
+		return nil, newDNSError(err, name)
+	}
+	return rrs, nil
+}
+
+// LookupCNAME returns the canonical name for the given host, which is
+// the final name after following zero or more CNAME records.
+//
+// Like [*net.Resolver], we do not return an error if host does not
+// contain CNAME records, as long as host resolves to address records.
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	// Obtain the A RRs and fallback to AAAA for IPv6-only hosts
+	rrs, _, err := r.lookup(ctx, host, dns.TypeA)
+	if errors.Is(err, ErrNoData) {
+		rrs, _, err = r.lookup(ctx, host, dns.TypeAAAA)
+	}
+	if err != nil {
+		return "", newDNSError(err, host)
+	}
+
+	// Decode and validate the canonical name
+	cname, err := DecodeLookupCNAME(rrs)
+	if err != nil {
+		return "", newDNSError(err, host)
+	}
+	if !isDomainName(cname) {
+		return "", &net.DNSError{Err: errMalformedDNSRecordsDetail, Name: host}
+	}
+	return cname, nil
+}
+
+// LookupMX returns the DNS MX records for the given domain name
+// sorted by preference, randomizing records with the same preference.
+//
+// Like [*net.Resolver], when the response contains records with invalid
+// names, we return the valid records along with a [*net.DNSError].
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	// Obtain and decode the RRs
+	rrs, err := r.lookupRRs(ctx, name, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	records, err := DecodeLookupMX(rrs)
+	if err != nil {
+		return nil, newDNSError(err, name)
+	}
+
+	// Sort and filter the records with invalid names
+	mxSort(records)
+	filtered := slices.DeleteFunc(slices.Clone(records), func(mx *net.MX) bool {
+		return !isDomainName(mx.Host)
+	})
+	if len(filtered) != len(records) {
+		return filtered, &net.DNSError{Err: errMalformedDNSRecordsDetail, Name: name}
+	}
+	return filtered, nil
+}
+
+// LookupNS returns the DNS NS records for the given domain name.
+//
+// Like [*net.Resolver], when the response contains records with invalid
+// names, we return the valid records along with a [*net.DNSError].
+func (r *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	// Obtain and decode the RRs
+	rrs, err := r.lookupRRs(ctx, name, dns.TypeNS)
+	if err != nil {
+		return nil, err
+	}
+	records, err := DecodeLookupNS(rrs)
+	if err != nil {
+		return nil, newDNSError(err, name)
+	}
+
+	// Filter the records with invalid names
+	filtered := slices.DeleteFunc(slices.Clone(records), func(ns *net.NS) bool {
+		return !isDomainName(ns.Host)
+	})
+	if len(filtered) != len(records) {
+		return filtered, &net.DNSError{Err: errMalformedDNSRecordsDetail, Name: name}
+	}
+	return filtered, nil
+}
+
+// LookupTXT returns the DNS TXT records for the given domain name.
+//
+// Like [*net.Resolver], we concatenate the strings of each TXT record.
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	rrs, err := r.lookupRRs(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	txts, err := DecodeLookupTXT(rrs)
+	if err != nil {
+		return nil, newDNSError(err, name)
+	}
+	return txts, nil
+}
+
+// LookupSRV tries to resolve an SRV query of the given service, protocol,
+// and domain name. The proto is "tcp" or "udp". The returned records are
+// sorted by priority and randomized by weight within a priority.
+//
+// Like [*net.Resolver], LookupSRV constructs the DNS name to look up
+// following RFC 2782. That is, it looks up _service._proto.name. To
+// accommodate services publishing SRV records under non-standard names,
+// if both service and proto are empty strings, LookupSRV looks up name
+// directly. The returned cname is the canonical name of the records.
+//
+// Like [*net.Resolver], when the response contains records with invalid
+// names, we return the valid records along with a [*net.DNSError].
+func (r *Resolver) LookupSRV(ctx context.Context,
+	service, proto, name string) (string, []*net.SRV, error) {
+	// Build the name to look up
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+
+	// Obtain and decode the RRs
+	rrs, err := r.lookupRRs(ctx, target, dns.TypeSRV)
+	if err != nil {
+		return "", nil, err
+	}
+	records, err := DecodeLookupSRV(rrs)
+	if err != nil {
+		return "", nil, newDNSError(err, name)
+	}
+	cname := rrs[0].Header().Name // we know it's present because we decoded records
+	if !isDomainName(cname) {
+		return "", nil, &net.DNSError{Err: "SRV header name is invalid", Name: name}
+	}
+
+	// Sort and filter the records with invalid names
+	srvSort(records)
+	filtered := slices.DeleteFunc(slices.Clone(records), func(srv *net.SRV) bool {
+		return !isDomainName(srv.Target)
+	})
+	if len(filtered) != len(records) {
+		return cname, filtered, &net.DNSError{Err: errMalformedDNSRecordsDetail, Name: name}
+	}
+	return cname, filtered, nil
+}
+
+// LookupAddr performs a reverse lookup for the given address, returning
+// the names mapping to that address using PTR records.
+//
+// Like [*net.Resolver], when the response contains records with invalid
+// names, we return the valid names along with a [*net.DNSError].
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	// Possibly use the hosts file
+	if r.Hosts != nil {
+		if names := r.Hosts.LookupAddr(addr); len(names) > 0 {
+			return names, nil
+		}
+	}
+
+	// Build the reverse name
+	reverse, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+
+	// Obtain and decode the RRs
+	rrs, err := r.lookupRRs(ctx, reverse, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	names, err := DecodeLookupPTR(rrs)
+	if err != nil {
+		return nil, newDNSError(err, reverse)
+	}
+
+	// Filter the records with invalid names
+	filtered := slices.DeleteFunc(slices.Clone(names), func(name string) bool {
+		return !isDomainName(name)
+	})
+	if len(filtered) != len(names) {
+		return filtered, &net.DNSError{Err: errMalformedDNSRecordsDetail, Name: addr}
+	}
+	return filtered, nil
+}
+
+// LookupIP looks up host for the given network using the DNS resolver.
+// The network must be one of "ip", "ip4" or "ip6".
+func (r *Resolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	addrs, err := r.lookupNetIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, net.IP(addr.AsSlice()))
+	}
+	return ips, nil
+}
+
+// LookupIPAddr looks up host using the DNS resolver.
+// It returns a slice of that host's IPv4 and IPv6 addresses.
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := r.lookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	ipAddrs := make([]net.IPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		ipAddrs = append(ipAddrs, net.IPAddr{IP: net.IP(addr.AsSlice()), Zone: addr.Zone()})
+	}
+	return ipAddrs, nil
+}
+
+// LookupNetIP looks up host using the DNS resolver. It returns a slice
+// of that host's IP addresses of the type specified by network. The
+// network must be one of "ip", "ip4" or "ip6".
+func (r *Resolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return r.lookupNetIP(ctx, network, host)
+}
+
+// lookupNetIP implements [*Resolver.LookupNetIP].
+func (r *Resolver) lookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	// Select the lookup function and the address family
+	var (
+		lookup func(ctx context.Context, host string) ([]string, error)
+		filter func(addr netip.Addr) bool
+	)
+	switch network {
+	case "ip":
+		lookup, filter = r.LookupHost, func(addr netip.Addr) bool { return true }
+	case "ip4":
+		lookup, filter = r.LookupA, func(addr netip.Addr) bool { return addr.Unmap().Is4() }
+	case "ip6":
+		lookup, filter = r.LookupAAAA, func(addr netip.Addr) bool { return !addr.Unmap().Is4() }
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	// Handle the empty host and IP addresses, including the ones with a zone
+	if host == "" {
+		return nil, &net.DNSError{UnwrapErr: ErrNoName, Err: ErrNoName.Error(), Name: host, IsNotFound: true}
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !filter(addr) {
+			return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+		}
+		return []netip.Addr{addr}, nil
+	}
+
+	// Perform the lookup and filter by address family
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return nil, newDNSError(err, host)
+	}
+	var result []netip.Addr
+	for _, s := range addrs {
+		if addr, err := netip.ParseAddr(s); err == nil && filter(addr) {
+			result = append(result, addr)
+		}
+	}
+	if len(result) <= 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	return result, nil
+}
+
+// isDomainName checks if a string is a presentation-format domain name
+// (currently restricted to hostname-compatible "preferred name" LDH labels and
+// SRV-like "underscore labels"; see golang.org/issue/12421).
+func isDomainName(s string) bool {
+	// The root domain name is valid. See golang.org/issue/45715.
+	if s == "." {
+		return true
+	}
+
+	// See RFC 1035, RFC 3696.
+	// Presentation format has dots before every label except the first, and the
+	// terminal empty label is optional here because we assume fully-qualified
+	// (absolute) input. We must therefore reserve space for the first and last
+	// labels' length octets in wire format, where they are necessary and the
+	// maximum total length is 255.
+	// So our _effective_ maximum is 253, but 254 is not rejected if the last
+	// character is a dot.
+	l := len(s)
+	if l == 0 || l > 254 || l == 254 && s[l-1] != '.' {
+		return false
+	}
+
+	last := byte('.')
+	nonNumeric := false // true once we've seen a letter or hyphen
+	partlen := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		default:
+			return false
+		case 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_':
+			nonNumeric = true
+			partlen++
+		case '0' <= c && c <= '9':
+			// fine
+			partlen++
+		case c == '-':
+			// Byte before dash cannot be dot.
+			if last == '.' {
+				return false
+			}
+			partlen++
+			nonNumeric = true
+		case c == '.':
+			// Byte before dot cannot be dot, dash.
+			if last == '.' || last == '-' {
+				return false
+			}
+			if partlen > 63 || partlen == 0 {
+				return false
+			}
+			partlen = 0
+		}
+		last = c
+	}
+	if last == '-' || partlen > 63 {
+		return false
+	}
+
+	return nonNumeric
+}
+
+// srvShuffleByWeight shuffles SRV records by weight using the algorithm
+// described in RFC 2782.
+func srvShuffleByWeight(addrs []*net.SRV) {
+	sum := 0
+	for _, addr := range addrs {
+		sum += int(addr.Weight)
+	}
+	for sum > 0 && len(addrs) > 1 {
+		s := 0
+		n := rand.IntN(sum)
+		for i := range addrs {
+			s += int(addrs[i].Weight)
+			if s > n {
+				if i > 0 {
+					addrs[0], addrs[i] = addrs[i], addrs[0]
+				}
+				break
+			}
+		}
+		sum -= int(addrs[0].Weight)
+		addrs = addrs[1:]
+	}
+}
+
+// srvSort reorders SRV records as specified in RFC 2782.
+func srvSort(addrs []*net.SRV) {
+	slices.SortFunc(addrs, func(a, b *net.SRV) int {
+		if a.Priority != b.Priority {
+			return int(a.Priority) - int(b.Priority)
+		}
+		return int(a.Weight) - int(b.Weight)
+	})
+	i := 0
+	for j := 1; j < len(addrs); j++ {
+		if addrs[i].Priority != addrs[j].Priority {
+			srvShuffleByWeight(addrs[i:j])
+			i = j
+		}
+	}
+	srvShuffleByWeight(addrs[i:])
+}
+
+// mxSort reorders MX records as specified in RFC 5321.
+func mxSort(s []*net.MX) {
+	for i := range s {
+		j := rand.IntN(i + 1)
+		s[i], s[j] = s[j], s[i]
+	}
+	slices.SortStableFunc(s, func(a, b *net.MX) int {
+		return int(a.Pref) - int(b.Pref)
+	})
+}
@@ -0,0 +1,380 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// newNetResolverTestResolver returns a [*Resolver] whose transport emulates
+// a recursive resolver serving the given RRs in presentation format.
+func newNetResolverTestResolver(t *testing.T, records ...string) *Resolver {
+	var rrs []dns.RR
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return &Resolver{
+		Transport: &MockResolverTransport{
+			MockQuery: func(ctx context.Context, addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+				resp := &dns.Msg{}
+				resp.SetReply(query)
+				resp.RecursionAvailable = true
+				q0 := query.Question[0]
+				name, exists := q0.Name, false
+				for followed := true; followed; {
+					followed = false
+					for _, rr := range rrs {
+						if !equalASCIIName(rr.Header().Name, name) {
+							continue
+						}
+						exists = true
+						rrtype := rr.Header().Rrtype
+						if rrtype == dns.TypeCNAME && q0.Qtype != dns.TypeCNAME {
+							resp.Answer = append(resp.Answer, rr)
+							name, followed = rr.(*dns.CNAME).Target, true
+							break
+						}
+						if rrtype == q0.Qtype {
+							resp.Answer = append(resp.Answer, rr)
+						}
+					}
+				}
+				if !exists {
+					resp.Rcode = dns.RcodeNameError
+				}
+				return resp, nil
+			},
+		},
+	}
+}
+
+// netResolverTestRecords contains the records used by most tests.
+var netResolverTestRecords = []string{
+	"example.com. A 192.0.2.1",
+	"example.com. AAAA 2001:db8::1",
+	"example.com. MX 20 mx2.example.com.",
+	"example.com. MX 10 mx1.example.com.",
+	"example.com. NS ns1.example.com.",
+	"example.com. NS ns2.example.com.",
+	`example.com. TXT "v=spf1 " "-all"`,
+	"www.example.com. CNAME example.com.",
+	"v6only.example.com. AAAA 2001:db8::2",
+	"_sip._udp.example.com. SRV 10 60 5060 sip1.example.com.",
+	"_sip._udp.example.com. SRV 0 0 5060 sip0.example.com.",
+	"_sip._udp.example.com. SRV 10 40 5060 sip2.example.com.",
+	"1.2.0.192.in-addr.arpa. PTR example.com.",
+	"invalid.example.com. MX 10 invalid_name!.example.com.",
+	"invalid.example.com. MX 20 mx.example.com.",
+	"invalid.example.com. NS ns!.example.com.",
+	"2.2.0.192.in-addr.arpa. PTR bad!name.",
+	"2.2.0.192.in-addr.arpa. PTR good.example.com.",
+}
+
+// assertNotFound asserts that err is a [*net.DNSError] with IsNotFound set.
+func assertNotFound(t *testing.T, err error, sentinel error) {
+	var dnsErr *net.DNSError
+	if assert.True(t, errors.As(err, &dnsErr)) {
+		assert.True(t, dnsErr.IsNotFound)
+		assert.ErrorIs(t, err, sentinel)
+	}
+}
+
+func TestResolver_LookupCNAME(t *testing.T) {
+	reso := newNetResolverTestResolver(t, netResolverTestRecords...)
+	ctx := context.Background()
+
+	cname, err := reso.LookupCNAME(ctx, "www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com.", cname)
+
+	cname, err = reso.LookupCNAME(ctx, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com.", cname)
+
+	cname, err = reso.LookupCNAME(ctx, "v6only.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "v6only.example.com.", cname)
+
+	_, err = reso.LookupCNAME(ctx, "nxdomain.example.com")
+	assertNotFound(t, err, ErrNoName)
+}
+
+func TestResolver_LookupMX(t *testing.T) {
+	reso := newNetResolverTestResolver(t, netResolverTestRecords...)
+	ctx := context.Background()
+
+	records, err := reso.LookupMX(ctx, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []*net.MX{
+		{Host: "mx1.example.com.", Pref: 10},
+		{Host: "mx2.example.com.", Pref: 20},
+	}, records)
+
+	records, err = reso.LookupMX(ctx, "invalid.example.com")
+	var dnsErr *net.DNSError
+	if assert.True(t, errors.As(err, &dnsErr)) {
+		assert.Equal(t, errMalformedDNSRecordsDetail, dnsErr.Err)
+	}
+	assert.Equal(t, []*net.MX{{Host: "mx.example.com.", Pref: 20}}, records)
+
+	_, err = reso.LookupMX(ctx, "v6only.example.com")
+	assertNotFound(t, err, ErrNoData)
+}
+
+func TestResolver_LookupNS(t *testing.T) {
+	reso := newNetResolverTestResolver(t, netResolverTestRecords...)
+	ctx := context.Background()
+
+	records, err := reso.LookupNS(ctx, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []*net.NS{{Host: "ns1.example.com."}, {Host: "ns2.example.com."}}, records)
+
+	records, err = reso.LookupNS(ctx, "invalid.example.com")
+	assert.Error(t, err)
+	assert.Empty(t, records)
+
+	_, err = reso.LookupNS(ctx, "nxdomain.example.com")
+	assertNotFound(t, err, ErrNoName)
+}
+
+func TestResolver_LookupTXT(t *testing.T) {
+	reso := newNetResolverTestResolver(t, netResolverTestRecords...)
+	ctx := context.Background()
+
+	txts, err := reso.LookupTXT(ctx, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v=spf1 -all"}, txts)
+
+	_, err = reso.LookupTXT(ctx, "v6only.example.com")
+	assertNotFound(t, err, ErrNoData)
+}
+
+func TestResolver_LookupSRV(t *testing.T) {
+	reso := newNetResolverTestResolver(t, netResolverTestRecords...)
+	ctx := context.Background()
+
+	for _, args := range [][3]string{
+		{"sip", "udp", "example.com"},
+		{"", "", "_sip._udp.example.com"},
+	} {
+		cname, records, err := reso.LookupSRV(ctx, args[0], args[1], args[2])
+		assert.NoError(t, err)
+		assert.Equal(t, "_sip._udp.example.com.", cname)
+		if assert.Len(t, records, 3) {
+			assert.Equal(t, "sip0.example.com.", records[0].Target)
+			assert.ElementsMatch(t, []string{"sip1.example.com.", "sip2.example.com."},
+				[]string{records[1].Target, records[2].Target})
+		}
+	}
+
+	_, _, err := reso.LookupSRV(ctx, "xmpp", "tcp", "example.com")
+	assertNotFound(t, err, ErrNoName)
+}
+
+func TestResolver_LookupAddr(t *testing.T) {
+	reso := newNetResolverTestResolver(t, netResolverTestRecords...)
+	ctx := context.Background()
+
+	names, err := reso.LookupAddr(ctx, "192.0.2.1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com."}, names)
+
+	names, err = reso.LookupAddr(ctx, "192.0.2.2")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"good.example.com."}, names)
+
+	_, err = reso.LookupAddr(ctx, "192.0.2.3")
+	assertNotFound(t, err, ErrNoName)
+
+	_, err = reso.LookupAddr(ctx, "not-an-address")
+	var dnsErr *net.DNSError
+	if assert.True(t, errors.As(err, &dnsErr)) {
+		assert.Equal(t, "unrecognized address", dnsErr.Err)
+	}
+}
+
+func TestResolver_LookupNetIP(t *testing.T) {
+	reso := newNetResolverTestResolver(t, netResolverTestRecords...)
+
+	tests := []struct {
+		name    string
+		network string
+		host    string
+		expect  []netip.Addr
+		checkFn func(t *testing.T, err error)
+	}{{
+		name:    "ip",
+		network: "ip",
+		host:    "example.com",
+		expect:  []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+	}, {
+		name:    "ip4",
+		network: "ip4",
+		host:    "www.example.com",
+		expect:  []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+	}, {
+		name:    "ip6",
+		network: "ip6",
+		host:    "example.com",
+		expect:  []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+	}, {
+		name:    "IPv6 address with zone",
+		network: "ip",
+		host:    "fe80::1%eth0",
+		expect:  []netip.Addr{netip.MustParseAddr("fe80::1%eth0")},
+	}, {
+		name:    "IPv4 address for ip6",
+		network: "ip6",
+		host:    "192.0.2.1",
+		checkFn: func(t *testing.T, err error) {
+			var addrErr *net.AddrError
+			assert.True(t, errors.As(err, &addrErr))
+		},
+	}, {
+		name:    "no addresses of the requested family",
+		network: "ip4",
+		host:    "v6only.example.com",
+		checkFn: func(t *testing.T, err error) {
+			assertNotFound(t, err, ErrNoData)
+		},
+	}, {
+		name:    "NXDOMAIN",
+		network: "ip",
+		host:    "nxdomain.example.com",
+		checkFn: func(t *testing.T, err error) {
+			assertNotFound(t, err, ErrNoName)
+		},
+	}, {
+		name:    "empty host",
+		network: "ip",
+		host:    "",
+		checkFn: func(t *testing.T, err error) {
+			assertNotFound(t, err, ErrNoName)
+		},
+	}, {
+		name:    "unknown network",
+		network: "tcp",
+		host:    "example.com",
+		checkFn: func(t *testing.T, err error) {
+			assert.Equal(t, net.UnknownNetworkError("tcp"), err)
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs, err := reso.LookupNetIP(context.Background(), tt.network, tt.host)
+			if tt.checkFn != nil {
+				tt.checkFn(t, err)
+				assert.Nil(t, addrs)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expect, addrs)
+		})
+	}
+}
+
+func TestResolver_LookupIP(t *testing.T) {
+	reso := newNetResolverTestResolver(t, netResolverTestRecords...)
+
+	ips, err := reso.LookupIP(context.Background(), "ip", "example.com")
+	assert.NoError(t, err)
+	if assert.Len(t, ips, 2) {
+		assert.True(t, ips[0].Equal(net.ParseIP("192.0.2.1")))
+		assert.True(t, ips[1].Equal(net.ParseIP("2001:db8::1")))
+	}
+
+	_, err = reso.LookupIP(context.Background(), "ip", "nxdomain.example.com")
+	assertNotFound(t, err, ErrNoName)
+}
+
+func TestResolver_LookupIPAddr(t *testing.T) {
+	reso := newNetResolverTestResolver(t, netResolverTestRecords...)
+
+	addrs, err := reso.LookupIPAddr(context.Background(), "example.com")
+	assert.NoError(t, err)
+	if assert.Len(t, addrs, 2) {
+		assert.True(t, addrs[0].IP.Equal(net.ParseIP("192.0.2.1")))
+		assert.True(t, addrs[1].IP.Equal(net.ParseIP("2001:db8::1")))
+	}
+
+	addrs, err = reso.LookupIPAddr(context.Background(), "fe80::1%eth0")
+	assert.NoError(t, err)
+	assert.Equal(t, []net.IPAddr{{IP: net.ParseIP("fe80::1"), Zone: "eth0"}}, addrs)
+}
+
+func Test_newDNSError(t *testing.T) {
+	err := newDNSError(context.DeadlineExceeded, "example.com")
+	var dnsErr *net.DNSError
+	if assert.True(t, errors.As(err, &dnsErr)) {
+		assert.True(t, dnsErr.Timeout())
+		assert.False(t, dnsErr.IsNotFound)
+		assert.Equal(t, "lookup example.com: context deadline exceeded", err.Error())
+	}
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	err = newDNSError(ErrServerTemporarilyMisbehaving, "example.com")
+	if assert.True(t, errors.As(err, &dnsErr)) {
+		assert.True(t, dnsErr.Temporary())
+	}
+
+	assert.Same(t, err, newDNSError(err, "example.com"))
+}
+
+func Test_isDomainName(t *testing.T) {
+	tests := []struct {
+		name   string
+		expect bool
+	}{
+		{".", true},
+		{"example.com.", true},
+		{"_sip._udp.example.com", true},
+		{"a-b.example.com", true},
+		{"", false},
+		{"-a.example.com", false},
+		{"a-.example.com", false},
+		{"a..example.com", false},
+		{"bad!name.", false},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expect, isDomainName(tt.name), tt.name)
+	}
+}
+
+func Test_srvSort(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "c.", Priority: 20, Weight: 0},
+		{Target: "b.", Priority: 10, Weight: 0},
+		{Target: "a.", Priority: 10, Weight: 100},
+		{Target: "z.", Priority: 0, Weight: 5},
+	}
+	srvSort(records)
+	var targets []string
+	for _, record := range records {
+		targets = append(targets, record.Target)
+	}
+	// with weight zero, "b." is only selected after "a."
+	assert.Equal(t, []string{"z.", "a.", "b.", "c."}, targets)
+}
+
+func Test_mxSort(t *testing.T) {
+	records := []*net.MX{
+		{Host: "c.", Pref: 30},
+		{Host: "a.", Pref: 10},
+		{Host: "b.", Pref: 20},
+	}
+	mxSort(records)
+	assert.Equal(t, []*net.MX{{Host: "a.", Pref: 10}, {Host: "b.", Pref: 20}, {Host: "c.", Pref: 30}}, records)
+}
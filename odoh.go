@@ -0,0 +1,512 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// Oblivious DNS-over-HTTPS.
+//
+// See https://datatracker.ietf.org/doc/rfc9230/
+//
+
+package dnscore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/miekg/dns"
+	"github.com/rbmk-project/common/httpslog"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Constants defined by RFC 9230.
+const (
+	// odohVersion is the ObliviousDoHConfig version defined by RFC 9230.
+	odohVersion = 0x0001
+
+	// odohMessageTypeQuery is the ObliviousDoHMessage type for queries.
+	odohMessageTypeQuery = 0x01
+
+	// odohMessageTypeResponse is the ObliviousDoHMessage type for responses.
+	odohMessageTypeResponse = 0x02
+
+	// odohContentType is the content type of ObliviousDoHMessage.
+	odohContentType = "application/oblivious-dns-message"
+
+	// odohConfigsWellKnownPath is the well-known path from which
+	// targets serve their ObliviousDoHConfigs.
+	odohConfigsWellKnownPath = "/.well-known/odohconfigs"
+)
+
+// odohMaxMessageSize is the maximum size of the ObliviousDoHConfigs
+// and of the ObliviousDoHMessage we're willing to read.
+const odohMaxMessageSize = 1 << 17
+
+// ErrInvalidODoHConfigs indicates that we cannot parse the ObliviousDoHConfigs.
+var ErrInvalidODoHConfigs = errors.New("invalid ObliviousDoHConfigs")
+
+// ErrNoSupportedODoHConfig indicates that none of the ObliviousDoHConfig
+// advertised by the target uses a version and HPKE suite we support.
+var ErrNoSupportedODoHConfig = errors.New("no supported ObliviousDoHConfig")
+
+// ErrInvalidODoHMessage indicates that we cannot parse or decrypt
+// the ObliviousDoHMessage returned by the target.
+var ErrInvalidODoHMessage = errors.New("invalid ObliviousDoHMessage")
+
+// ErrInvalidODoHTarget indicates that the ODoHTarget field of
+// the [*ServerAddr] is not a valid HTTPS URL.
+var ErrInvalidODoHTarget = errors.New("invalid ODoH target")
+
+// odohConfig is a parsed ObliviousDoHConfigContents.
+type odohConfig struct {
+	// suite is the HPKE suite.
+	suite hpke.Suite
+
+	// kemID is the HPKE KEM identifier.
+	kemID hpke.KEM
+
+	// kdfID is the HPKE KDF identifier.
+	kdfID hpke.KDF
+
+	// aeadID is the HPKE AEAD identifier.
+	aeadID hpke.AEAD
+
+	// publicKey is the target's serialized public key.
+	publicKey []byte
+
+	// raw is the serialized ObliviousDoHConfigContents.
+	raw []byte
+}
+
+// parseODoHConfigs parses the serialized ObliviousDoHConfigs and returns
+// the first ObliviousDoHConfig whose version and HPKE suite we support.
+func parseODoHConfigs(rawConfigs []byte) (*odohConfig, error) {
+	// 1. parse the outer list of configs
+	var (
+		input   = cryptobyte.String(rawConfigs)
+		configs cryptobyte.String
+	)
+	if !input.ReadUint16LengthPrefixed(&configs) || !input.Empty() || configs.Empty() {
+		return nil, ErrInvalidODoHConfigs
+	}
+
+	// 2. walk the configs and pick the first one we support, skipping
+	// the ones with unknown versions as required by RFC 9230 Sect. 6.1
+	for !configs.Empty() {
+		var (
+			version  uint16
+			contents cryptobyte.String
+		)
+		if !configs.ReadUint16(&version) || !configs.ReadUint16LengthPrefixed(&contents) {
+			return nil, ErrInvalidODoHConfigs
+		}
+		if version != odohVersion {
+			continue
+		}
+		config, err := parseODoHConfigContents(contents)
+		if err != nil {
+			return nil, err
+		}
+		if config != nil {
+			return config, nil
+		}
+	}
+	return nil, ErrNoSupportedODoHConfig
+}
+
+// parseODoHConfigContents parses the ObliviousDoHConfigContents and
+// returns nil, nil when we do not support the HPKE suite.
+func parseODoHConfigContents(contents cryptobyte.String) (*odohConfig, error) {
+	var (
+		raw       = []byte(contents)
+		kemID     uint16
+		kdfID     uint16
+		aeadID    uint16
+		publicKey cryptobyte.String
+	)
+	if !contents.ReadUint16(&kemID) || !contents.ReadUint16(&kdfID) ||
+		!contents.ReadUint16(&aeadID) || !contents.ReadUint16LengthPrefixed(&publicKey) ||
+		!contents.Empty() || publicKey.Empty() {
+		return nil, ErrInvalidODoHConfigs
+	}
+	config := &odohConfig{
+		kemID:     hpke.KEM(kemID),
+		kdfID:     hpke.KDF(kdfID),
+		aeadID:    hpke.AEAD(aeadID),
+		publicKey: publicKey,
+		raw:       raw,
+	}
+	if !config.kemID.IsValid() || !config.kdfID.IsValid() || !config.aeadID.IsValid() {
+		return nil, nil
+	}
+	config.suite = hpke.NewSuite(config.kemID, config.kdfID, config.aeadID)
+	return config, nil
+}
+
+// keyID returns the key ID identifying this config as defined by RFC 9230 Sect. 6.2.
+func (c *odohConfig) keyID() []byte {
+	prk := c.kdfID.Extract(c.raw, nil)
+	return c.kdfID.Expand(prk, []byte("odoh key id"), uint(c.kdfID.ExtractSize()))
+}
+
+// odohQueryContext contains the state to decrypt the response.
+type odohQueryContext struct {
+	// config is the config we used to encrypt the query.
+	config *odohConfig
+
+	// plaintext is the serialized ObliviousDoHMessagePlaintext.
+	plaintext []byte
+
+	// secret is the secret exported from the HPKE context.
+	secret []byte
+}
+
+// encodeODoHMessage serializes an ObliviousDoHMessage.
+func encodeODoHMessage(messageType uint8, keyID, encryptedMessage []byte) []byte {
+	builder := cryptobyte.NewBuilder(nil)
+	builder.AddUint8(messageType)
+	builder.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(keyID)
+	})
+	builder.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(encryptedMessage)
+	})
+	return builder.BytesOrPanic()
+}
+
+// encryptQuery encrypts the raw DNS query as specified by RFC 9230 Sect. 6.3
+// and returns the serialized ObliviousDoHMessage along with the context
+// required to decrypt the corresponding response.
+func (c *odohConfig) encryptQuery(rawQuery []byte) ([]byte, *odohQueryContext, error) {
+	// 1. create the ObliviousDoHMessagePlaintext without padding, since
+	// the query itself should already use EDNS(0) block-length padding
+	builder := cryptobyte.NewBuilder(nil)
+	builder.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(rawQuery)
+	})
+	builder.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {})
+	plaintext, err := builder.Bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 2. setup the HPKE context using the target's public key
+	publicKey, err := c.kemID.Scheme().UnmarshalBinaryPublicKey(c.publicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidODoHConfigs, err.Error())
+	}
+	sender, err := c.suite.NewSender(publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	enc, sealer, err := sender.Setup(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 3. seal the plaintext using the key ID as additional data
+	keyID := c.keyID()
+	aad := cryptobyte.NewBuilder(nil)
+	aad.AddUint8(odohMessageTypeQuery)
+	aad.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(keyID)
+	})
+	ciphertext, err := sealer.Seal(plaintext, aad.BytesOrPanic())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 4. build the ObliviousDoHMessage and the query context
+	encrypted := append(enc, ciphertext...)
+	qctx := &odohQueryContext{
+		config:    c,
+		plaintext: plaintext,
+		secret:    sealer.Export([]byte("odoh response"), c.aeadID.KeySize()),
+	}
+	return encodeODoHMessage(odohMessageTypeQuery, keyID, encrypted), qctx, nil
+}
+
+// decryptResponse decrypts the serialized ObliviousDoHMessage containing
+// the response as specified by RFC 9230 Sect. 6.4 and returns the raw
+// DNS response it contains.
+func (qctx *odohQueryContext) decryptResponse(rawMessage []byte) ([]byte, error) {
+	// 1. parse the ObliviousDoHMessage, whose key ID is the response nonce
+	var (
+		input        = cryptobyte.String(rawMessage)
+		messageType  uint8
+		nonceInput   cryptobyte.String
+		encryptedMsg cryptobyte.String
+	)
+	if !input.ReadUint8(&messageType) || !input.ReadUint16LengthPrefixed(&nonceInput) ||
+		!input.ReadUint16LengthPrefixed(&encryptedMsg) || !input.Empty() {
+		return nil, fmt.Errorf("%w: cannot parse message", ErrInvalidODoHMessage)
+	}
+	if messageType != odohMessageTypeResponse {
+		return nil, fmt.Errorf("%w: unexpected message type %d", ErrInvalidODoHMessage, messageType)
+	}
+	responseNonce := []byte(nonceInput)
+
+	// 2. derive the response key and nonce
+	var (
+		aeadID = qctx.config.aeadID
+		kdfID  = qctx.config.kdfID
+	)
+	salt := cryptobyte.NewBuilder(nil)
+	salt.AddBytes(qctx.plaintext)
+	salt.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(responseNonce)
+	})
+	rawSalt, err := salt.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidODoHMessage, err.Error())
+	}
+	prk := kdfID.Extract(qctx.secret, rawSalt)
+	key := kdfID.Expand(prk, []byte("odoh key"), aeadID.KeySize())
+	nonce := kdfID.Expand(prk, []byte("odoh nonce"), aeadID.NonceSize())
+
+	// 3. open the sealed ObliviousDoHMessagePlaintext
+	aead, err := aeadID.New(key)
+	if err != nil {
+		return nil, err
+	}
+	aad := cryptobyte.NewBuilder(nil)
+	aad.AddUint8(odohMessageTypeResponse)
+	aad.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(responseNonce)
+	})
+	rawAAD, err := aad.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidODoHMessage, err.Error())
+	}
+	plaintext, err := aead.Open(nil, nonce, encryptedMsg, rawAAD)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidODoHMessage, err.Error())
+	}
+
+	// 4. extract the DNS message ignoring the padding
+	var (
+		ptInput   = cryptobyte.String(plaintext)
+		rawResp   cryptobyte.String
+		ptPadding cryptobyte.String
+	)
+	if !ptInput.ReadUint16LengthPrefixed(&rawResp) ||
+		!ptInput.ReadUint16LengthPrefixed(&ptPadding) || !ptInput.Empty() {
+		return nil, fmt.Errorf("%w: cannot parse plaintext", ErrInvalidODoHMessage)
+	}
+	return rawResp, nil
+}
+
+// odohTargetURL returns the parsed ODoHTarget URL of the given [*ServerAddr].
+func odohTargetURL(addr *ServerAddr) (*url.URL, error) {
+	URL, err := url.Parse(addr.ODoHTarget)
+	if err != nil {
+		return nil, err
+	}
+	if URL.Scheme != "https" || URL.Host == "" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidODoHTarget, addr.ODoHTarget)
+	}
+	return URL, nil
+}
+
+// FetchODoHConfigs fetches the serialized ObliviousDoHConfigs from the
+// well-known location of the ODoHTarget of the given [*ServerAddr].
+//
+// Because this request is sent directly to the target, the target learns
+// the client's IP address. To avoid fetching the configs for each query,
+// call this method once and save the result into the ODoHConfigs field
+// of the [*ServerAddr].
+func (t *Transport) FetchODoHConfigs(ctx context.Context, addr *ServerAddr) ([]byte, error) {
+	// 1. Create the URL from which to fetch the configs.
+	URL, err := odohTargetURL(addr)
+	if err != nil {
+		return nil, err
+	}
+	URL = &url.URL{Scheme: URL.Scheme, Host: URL.Host, Path: odohConfigsWellKnownPath}
+
+	// 2. Create and log the HTTP request.
+	req, err := t.newHTTPRequestWithContext(ctx, http.MethodGet, URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	t0 := t.timeNow()
+	httpslog.MaybeLogRoundTripStart(
+		t.Logger,
+		netip.MustParseAddrPort("[::]:0"), // not yet known
+		"tcp",
+		netip.MustParseAddrPort("[::]:0"), // not yet known
+		req,
+		t0,
+	)
+
+	// 3. Perform the round trip and log the results.
+	httpResp, laddr, raddr, err := t.httpClientDo(req)
+	httpslog.MaybeLogRoundTripDone(
+		t.Logger,
+		laddr,
+		"tcp",
+		raddr,
+		req,
+		httpResp,
+		err,
+		t0,
+		t.timeNow(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != 200 {
+		return nil, ErrServerMisbehaving
+	}
+
+	// 4. Read and validate the configs.
+	reader := io.LimitReader(httpResp.Body, odohMaxMessageSize)
+	rawConfigs, err := t.readAllContext(ctx, reader, httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseODoHConfigs(rawConfigs); err != nil {
+		return nil, err
+	}
+	return rawConfigs, nil
+}
+
+// newHTTPRequestForODoH creates the HTTP request for sending the given
+// ObliviousDoHMessage to the target through the relay.
+func (t *Transport) newHTTPRequestForODoH(
+	ctx context.Context, addr *ServerAddr, rawMessage []byte) (*http.Request, error) {
+	// 1. Add the target host and path to the relay URL as
+	// specified by RFC 9230 Sect. 4.1.
+	targetURL, err := odohTargetURL(addr)
+	if err != nil {
+		return nil, err
+	}
+	relayURL, err := url.Parse(addr.Address)
+	if err != nil {
+		return nil, err
+	}
+	values := relayURL.Query()
+	values.Set("targethost", targetURL.Host)
+	values.Set("targetpath", targetURL.EscapedPath())
+	relayURL.RawQuery = values.Encode()
+
+	// 2. Create the HTTP request, which must use POST.
+	req, err := t.newHTTPRequestWithContext(
+		ctx, http.MethodPost, relayURL.String(), bytes.NewReader(rawMessage))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", odohContentType)
+	req.Header.Set("accept", odohContentType)
+	return req, nil
+}
+
+// queryODoH implements [*Transport.Query] for Oblivious DNS over HTTPS.
+func (t *Transport) queryODoH(ctx context.Context,
+	addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+	// 0. immediately fail if the context is already done, which
+	// is useful to write unit tests
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// 1. Obtain and parse the target's configs.
+	rawConfigs := addr.ODoHConfigs
+	if len(rawConfigs) <= 0 {
+		var err error
+		rawConfigs, err = t.FetchODoHConfigs(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	config, err := parseODoHConfigs(rawConfigs)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Serialize the query and possibly log that we're sending it.
+	rawQuery, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	t0 := t.maybeLogQuery(ctx, addr, rawQuery)
+
+	// 3. Encrypt the query and log the encrypted message.
+	odohQuery, qctx, err := config.encryptQuery(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	t.maybeLogODoHQuery(ctx, addr, t0, rawQuery, odohQuery)
+
+	// 4. Create the HTTP request for the relay and log it.
+	req, err := t.newHTTPRequestForODoH(ctx, addr, odohQuery)
+	if err != nil {
+		return nil, err
+	}
+	httpslog.MaybeLogRoundTripStart(
+		t.Logger,
+		netip.MustParseAddrPort("[::]:0"), // not yet known
+		"tcp",
+		netip.MustParseAddrPort("[::]:0"), // not yet known
+		req,
+		t0,
+	)
+
+	// 5. Perform the round trip and log the result.
+	httpResp, laddr, raddr, err := t.httpClientDoAddr(addr, req)
+	httpslog.MaybeLogRoundTripDone(
+		t.Logger,
+		laddr,
+		"tcp",
+		raddr,
+		req,
+		httpResp,
+		err,
+		t0,
+		t.timeNow(),
+	)
+
+	// 6. Make sure we close the body, the response code is 200,
+	// and the content type is the expected one.
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != 200 {
+		return nil, ErrServerMisbehaving
+	}
+	if httpResp.Header.Get("content-type") != odohContentType {
+		return nil, ErrServerMisbehaving
+	}
+
+	// 7. Read and decrypt the response and log both the
+	// encrypted and the decrypted messages.
+	reader := io.LimitReader(httpResp.Body, odohMaxMessageSize)
+	odohResp, err := t.readAllContext(ctx, reader, httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	rawResp, err := qctx.decryptResponse(odohResp)
+	if err != nil {
+		return nil, err
+	}
+	t.maybeLogODoHResponse(ctx, addr, t0, odohQuery, odohResp, rawResp)
+
+	// 8. Parse the response, possibly log it, and possibly
+	// verify its TSIG signature.
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rawResp); err != nil {
+		return nil, err
+	}
+	t.maybeLogResponseAddrPort(ctx, addr, t0, rawQuery, rawResp, laddr, raddr, httpResp.TLS)
+	if err := t.maybeVerifyResponseTSIG(addr.TSIGKey, rawQuery, resp, rawResp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,308 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/miekg/dns"
+	"github.com/rbmk-project/common/runtimex"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// newODoHTestConfigs returns serialized ObliviousDoHConfigs containing
+// a single config with the given version and HPKE suite.
+func newODoHTestConfigs(version uint16, kemID hpke.KEM, kdfID hpke.KDF, aeadID hpke.AEAD) []byte {
+	publicKey, _ := runtimex.Try2(hpke.KEM_X25519_HKDF_SHA256.Scheme().GenerateKeyPair())
+	builder := cryptobyte.NewBuilder(nil)
+	builder.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(version)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(uint16(kemID))
+			b.AddUint16(uint16(kdfID))
+			b.AddUint16(uint16(aeadID))
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(runtimex.Try1(publicKey.MarshalBinary()))
+			})
+		})
+	})
+	return builder.BytesOrPanic()
+}
+
+func Test_parseODoHConfigs(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     []byte
+		expectErr error
+	}{
+		{
+			name:      "empty input",
+			input:     []byte{},
+			expectErr: ErrInvalidODoHConfigs,
+		},
+
+		{
+			name:      "empty list of configs",
+			input:     []byte{0x00, 0x00},
+			expectErr: ErrInvalidODoHConfigs,
+		},
+
+		{
+			name:      "truncated config",
+			input:     []byte{0x00, 0x03, 0x00, 0x01, 0x00},
+			expectErr: ErrInvalidODoHConfigs,
+		},
+
+		{
+			name:      "trailing garbage",
+			input:     append(newODoHTestConfigs(0x0001, 0x20, 0x01, 0x01), 0x00),
+			expectErr: ErrInvalidODoHConfigs,
+		},
+
+		{
+			name:      "unsupported version",
+			input:     newODoHTestConfigs(0xff01, 0x20, 0x01, 0x01),
+			expectErr: ErrNoSupportedODoHConfig,
+		},
+
+		{
+			name:      "unsupported HPKE suite",
+			input:     newODoHTestConfigs(0x0001, 0x20, 0x01, 0xffff),
+			expectErr: ErrNoSupportedODoHConfig,
+		},
+
+		{
+			name:      "valid config",
+			input:     newODoHTestConfigs(0x0001, 0x20, 0x01, 0x01),
+			expectErr: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseODoHConfigs(tt.input)
+			assert.ErrorIs(t, err, tt.expectErr)
+			if tt.expectErr == nil {
+				assert.Equal(t, hpke.KEM_X25519_HKDF_SHA256, config.kemID)
+				assert.Len(t, config.keyID(), 32)
+			}
+		})
+	}
+}
+
+func TestODoHConfig_encryptQuery(t *testing.T) {
+	config := runtimex.Try1(parseODoHConfigs(newODoHTestConfigs(0x0001, 0x20, 0x01, 0x01)))
+	rawQuery := []byte{0x00, 0x01, 0x02, 0x03}
+
+	rawMessage, qctx, err := config.encryptQuery(rawQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// make sure the ObliviousDoHMessage is well formed
+	var (
+		input       = cryptobyte.String(rawMessage)
+		messageType uint8
+		keyID       cryptobyte.String
+		encrypted   cryptobyte.String
+	)
+	assert.True(t, input.ReadUint8(&messageType))
+	assert.True(t, input.ReadUint16LengthPrefixed(&keyID))
+	assert.True(t, input.ReadUint16LengthPrefixed(&encrypted))
+	assert.True(t, input.Empty())
+	assert.Equal(t, uint8(odohMessageTypeQuery), messageType)
+	assert.Equal(t, config.keyID(), []byte(keyID))
+
+	// make sure the context contains the plaintext and the secret
+	assert.Equal(t, []byte{0x00, 0x04, 0x00, 0x01, 0x02, 0x03, 0x00, 0x00}, qctx.plaintext)
+	assert.Len(t, qctx.secret, 16)
+}
+
+func TestODoHQueryContext_decryptResponse(t *testing.T) {
+	config := runtimex.Try1(parseODoHConfigs(newODoHTestConfigs(0x0001, 0x20, 0x01, 0x01)))
+	_, qctx := runtimex.Try2(config.encryptQuery([]byte{0x00, 0x01}))
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{{
+		name:  "garbage",
+		input: []byte{0x02, 0x00},
+	}, {
+		name:  "unexpected message type",
+		input: encodeODoHMessage(odohMessageTypeQuery, []byte{0x01}, []byte{0x01}),
+	}, {
+		name:  "decryption failure",
+		input: encodeODoHMessage(odohMessageTypeResponse, make([]byte, 16), make([]byte, 32)),
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rawResp, err := qctx.decryptResponse(tt.input)
+			assert.ErrorIs(t, err, ErrInvalidODoHMessage)
+			assert.Nil(t, rawResp)
+		})
+	}
+}
+
+func TestTransport_newHTTPRequestForODoH(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		addr := &ServerAddr{
+			Protocol:   ProtocolODoH,
+			Address:    "https://relay.example.com/proxy",
+			ODoHTarget: "https://target.example.com/dns-query",
+		}
+		req, err := (&Transport{}).newHTTPRequestForODoH(context.Background(), addr, []byte{0x01})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, "https://relay.example.com/proxy?targethost=target.example.com&targetpath=%2Fdns-query", req.URL.String())
+		assert.Equal(t, odohContentType, req.Header.Get("content-type"))
+		assert.Equal(t, odohContentType, req.Header.Get("accept"))
+	})
+
+	t.Run("invalid target", func(t *testing.T) {
+		addr := &ServerAddr{
+			Protocol:   ProtocolODoH,
+			Address:    "https://relay.example.com/proxy",
+			ODoHTarget: "http://target.example.com/dns-query",
+		}
+		_, err := (&Transport{}).newHTTPRequestForODoH(context.Background(), addr, []byte{0x01})
+		assert.ErrorIs(t, err, ErrInvalidODoHTarget)
+	})
+}
+
+func TestTransport_FetchODoHConfigs(t *testing.T) {
+	validConfigs := newODoHTestConfigs(0x0001, 0x20, 0x01, 0x01)
+	addr := &ServerAddr{
+		Protocol:   ProtocolODoH,
+		Address:    "https://relay.example.com/proxy",
+		ODoHTarget: "https://target.example.com/dns-query",
+	}
+
+	tests := []struct {
+		name      string
+		status    int
+		body      []byte
+		doErr     error
+		expectErr error
+	}{{
+		name:      "success",
+		status:    200,
+		body:      validConfigs,
+		expectErr: nil,
+	}, {
+		name:      "round trip failure",
+		doErr:     errors.New("mocked error"),
+		expectErr: errors.New("mocked error"),
+	}, {
+		name:      "unexpected status code",
+		status:    404,
+		expectErr: ErrServerMisbehaving,
+	}, {
+		name:      "invalid configs",
+		status:    200,
+		body:      []byte{0x00},
+		expectErr: ErrInvalidODoHConfigs,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txp := &Transport{
+				HTTPClientDo: func(req *http.Request) (*http.Response, netip.AddrPort, netip.AddrPort, error) {
+					assert.Equal(t, "https://target.example.com/.well-known/odohconfigs", req.URL.String())
+					if tt.doErr != nil {
+						return nil, netip.AddrPort{}, netip.AddrPort{}, tt.doErr
+					}
+					resp := &http.Response{
+						StatusCode: tt.status,
+						Body:       io.NopCloser(bytes.NewReader(tt.body)),
+					}
+					return resp, netip.AddrPort{}, netip.AddrPort{}, nil
+				},
+			}
+			rawConfigs, err := txp.FetchODoHConfigs(context.Background(), addr)
+			if tt.expectErr != nil {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectErr.Error())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, validConfigs, rawConfigs)
+		})
+	}
+}
+
+func TestTransport_queryODoH(t *testing.T) {
+	addr := &ServerAddr{
+		Protocol:    ProtocolODoH,
+		Address:     "https://relay.example.com/proxy",
+		ODoHConfigs: newODoHTestConfigs(0x0001, 0x20, 0x01, 0x01),
+		ODoHTarget:  "https://target.example.com/dns-query",
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+		body        []byte
+		expectErr   error
+	}{{
+		name:        "unexpected status code",
+		contentType: odohContentType,
+		status:      502,
+		expectErr:   ErrServerMisbehaving,
+	}, {
+		name:        "unexpected content type",
+		contentType: "application/dns-message",
+		status:      200,
+		expectErr:   ErrServerMisbehaving,
+	}, {
+		name:        "invalid response",
+		contentType: odohContentType,
+		status:      200,
+		body:        []byte{0x02},
+		expectErr:   ErrInvalidODoHMessage,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txp := &Transport{
+				HTTPClientDo: func(req *http.Request) (*http.Response, netip.AddrPort, netip.AddrPort, error) {
+					resp := &http.Response{
+						StatusCode: tt.status,
+						Header:     http.Header{"Content-Type": {tt.contentType}},
+						Body:       io.NopCloser(bytes.NewReader(tt.body)),
+					}
+					return resp, netip.AddrPort{}, netip.AddrPort{}, nil
+				},
+			}
+			resp, err := txp.queryODoH(context.Background(), addr, query)
+			assert.ErrorIs(t, err, tt.expectErr)
+			assert.Nil(t, resp)
+		})
+	}
+
+	t.Run("invalid configs", func(t *testing.T) {
+		addr := &ServerAddr{
+			Protocol:    ProtocolODoH,
+			Address:     "https://relay.example.com/proxy",
+			ODoHConfigs: []byte{0x00},
+			ODoHTarget:  "https://target.example.com/dns-query",
+		}
+		resp, err := (&Transport{}).queryODoH(context.Background(), addr, query)
+		assert.ErrorIs(t, err, ErrInvalidODoHConfigs)
+		assert.Nil(t, resp)
+	})
+}
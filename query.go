@@ -9,6 +9,9 @@
 package dnscore
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/miekg/dns"
 	"golang.org/x/net/idna"
 )
@@ -48,10 +51,20 @@ const EDNS0SuggestedMaxResponseSizeOtherwise = 4096
 // 2. DNSSEC using [EDNS0FlagDO].
 //
 // 3. Block-length padding using [EDNS0FlagBlockLengthPadding].
+//
+// When the query already contains an OPT RR, we update it rather than
+// adding another one, and we do not clear an already set DO bit.
 func QueryOptionEDNS0(maxResponseSize uint16, flags int) QueryOption {
 	return func(q *dns.Msg) error {
 		// 1. DNSSEC OK (DO)
-		q.SetEdns0(maxResponseSize, flags&EDNS0FlagDO != 0)
+		if opt := q.IsEdns0(); opt != nil {
+			opt.SetUDPSize(maxResponseSize)
+			if flags&EDNS0FlagDO != 0 {
+				opt.SetDo()
+			}
+		} else {
+			q.SetEdns0(maxResponseSize, flags&EDNS0FlagDO != 0)
+		}
 
 		// 2. padding
 		//
@@ -84,13 +97,51 @@ func QueryOptionID(id uint16) QueryOption {
 	}
 }
 
+// QueryOptionTSIG signs the query using the given TSIG key and the
+// current time, adding a TSIG RR to the additional section -- RFC 8945.
+//
+// Since the signature covers the whole query, this option must be
+// the last option, as further changes invalidate the signature.
+//
+// To verify the signature of the response, set the same key as
+// the TSIGKey of the [*ServerAddr]. Otherwise, [ValidateResponse]
+// only checks that the response is signed using the same key and
+// that the server did not report TSIG errors.
+func QueryOptionTSIG(key *TSIGKey) QueryOption {
+	return func(q *dns.Msg) error {
+		return key.sign(q, time.Now())
+	}
+}
+
+// idnaLookup is like [idna.Lookup] except that it does not enforce the STD3
+// rules, which we enforce in [idnaToASCII] while allowing underscores.
+var idnaLookup = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// idnaToASCII IDNA encodes the given domain name like [idna.Lookup] does
+// but allows underscores, which are used by SRV owner names (RFC 2782) and
+// by other service-related names such as _dmarc and _acme-challenge.
+func idnaToASCII(name string) (string, error) {
+	punyName, err := idnaLookup.ToASCII(name)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range punyName {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.') {
+			return "", fmt.Errorf("idna: disallowed rune %U", c)
+		}
+	}
+	return punyName, nil
+}
+
 // NewQueryWithServerAddr constructs a [*dns.Message] containing a
 // query for the given domain, query type and [*ServerAddr]. We use
 // the [*ServerAddr] to enforce protocol-specific query settings,
 // such as, that DoH SHOULD use a zero query ID.
 //
 // This function takes care of IDNA encoding the domain name and
-// fails if the domain name is invalid.
+// fails if the domain name is invalid. Unlike IDNA, we allow
+// underscores, which are used, e.g., by SRV owner names.
 //
 // Additionally, [NewQuery] ensures the given name is fully qualified.
 //
@@ -100,7 +151,7 @@ func QueryOptionID(id uint16) QueryOption {
 func NewQueryWithServerAddr(serverAddr *ServerAddr, name string, qtype uint16,
 	options ...QueryOption) (*dns.Msg, error) {
 	// IDNA encode the domain name.
-	punyName, err := idna.Lookup.ToASCII(name)
+	punyName, err := idnaToASCII(name)
 	if err != nil {
 		return nil, err
 	}
@@ -124,8 +175,8 @@ func NewQueryWithServerAddr(serverAddr *ServerAddr, name string, qtype uint16,
 	// Only set the queryID for protocols that actually
 	// require a nonzero queryID to be set.
 	switch serverAddr.Protocol {
-	case ProtocolDoH, ProtocolDoQ:
-		// for DoH/DoQ, by default we leave the query ID to
+	case ProtocolDoH, ProtocolDoQ, ProtocolDoH3, ProtocolODoH:
+		// for DoH/DoQ/DoH3/ODoH, by default we leave the query ID to
 		// zero, which is what the RFCs suggest/require.
 	default:
 		query.Id = dns.Id()
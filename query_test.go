@@ -163,3 +163,53 @@ func TestQueryOptionID(t *testing.T) {
 		t.Errorf("QueryOptionID() did not set ID")
 	}
 }
+
+func TestQueryOptionTSIG(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeSOA)
+	key := &TSIGKey{Name: "key.example.com.", Secret: testTSIGSecret}
+	option := QueryOptionTSIG(key)
+	if err := option(query); err != nil {
+		t.Errorf("QueryOptionTSIG() error = %v", err)
+	}
+	rawQuery, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dns.TsigVerify(rawQuery, testTSIGSecret, "", false); err != nil {
+		t.Errorf("QueryOptionTSIG() did not correctly sign the query: %v", err)
+	}
+}
+
+func Test_idnaToASCII(t *testing.T) {
+	tests := []struct {
+		name      string
+		expect    string
+		expectErr bool
+	}{
+		{name: "EXAMPLE.com", expect: "example.com"},
+		{name: "Bücher.example", expect: "xn--bcher-kva.example"},
+		{name: "_sip._udp.example.com.", expect: "_sip._udp.example.com."},
+		{name: "_dmarc.example.com", expect: "_dmarc.example.com"},
+		{name: "\t\t\t", expectErr: true},
+		{name: "bad!name.", expectErr: true},
+		{name: "a b.example.com", expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			punyName, err := idnaToASCII(tt.name)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if punyName != tt.expect {
+				t.Fatalf("expected %q, got %q", tt.expect, punyName)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// QUIC connection abstraction for DNS-over-QUIC.
+//
+
+package dnscore
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rbmk-project/common/closepool"
+)
+
+// QUICConn is the QUIC connection abstraction used by DNS-over-QUIC.
+//
+// Use [DefaultDialQUICContext] to obtain a [QUICConn] implementation
+// wrapping a [*quic.Conn] that owns its own UDP socket, or [NewQUICConn]
+// to wrap a [*quic.Conn] you established yourself.
+type QUICConn interface {
+	// OpenStreamSync opens a new bidirectional QUIC stream, blocking
+	// until the peer allows us to open a new stream.
+	OpenStreamSync(ctx context.Context) (QUICStream, error)
+
+	// ConnectionState returns the TLS state of the connection.
+	ConnectionState() tls.ConnectionState
+
+	// Context returns a context that is done when the connection is closed.
+	Context() context.Context
+
+	// CloseWithError closes the connection using the given application
+	// error code and reason and releases the resources it owns, including,
+	// when applicable, the underlying UDP socket.
+	CloseWithError(code quic.ApplicationErrorCode, reason string) error
+
+	// LocalAddr returns the local address.
+	LocalAddr() net.Addr
+
+	// RemoteAddr returns the remote address.
+	RemoteAddr() net.Addr
+}
+
+// QUICStream is the QUIC stream abstraction used by DNS-over-QUIC.
+//
+// The [*quic.Stream] type implements this interface.
+type QUICStream interface {
+	// Read reads from the receive side of the stream.
+	Read(p []byte) (int, error)
+
+	// Write writes to the send side of the stream.
+	Write(p []byte) (int, error)
+
+	// Close closes the send side of the stream, which causes
+	// the peer to see the STREAM FIN, as required by RFC 9250.
+	Close() error
+
+	// CancelRead aborts receiving on the stream using the given error code.
+	CancelRead(code quic.StreamErrorCode)
+
+	// SetDeadline sets the read and write deadlines.
+	SetDeadline(t time.Time) error
+}
+
+// Make sure [*quic.Stream] implements [QUICStream].
+var _ QUICStream = &quic.Stream{}
+
+// DefaultDialQUICContext is the default implementation of the
+// DialQUICContext field of [*Transport].
+//
+// We create a new UDP socket for each connection using [net.ListenConfig],
+// resolve the given address, and establish a QUIC connection using the given
+// TLS and QUIC configurations. When the address contains a hostname, we
+// resolve it using [net.DefaultResolver] and try each IP address in sequence,
+// so pass IP endpoints when you need to control resolution. When early is
+// true, the connection may send 0-RTT data before completing the handshake.
+// Closing the returned connection also closes the UDP socket.
+//
+// Use the ListenPacket field of [*Transport] to wrap or observe the UDP
+// socket without replacing this function, or [NewQUICConn] to adapt a
+// [*quic.Conn] established using your own socket.
+func DefaultDialQUICContext(ctx context.Context, address string,
+	tlsConfig *tls.Config, quicConfig *quic.Config, early bool) (QUICConn, error) {
+	return dialQUICConn(ctx, defaultListenPacket, address, tlsConfig, quicConfig, early)
+}
+
+// NewQUICConn returns a [QUICConn] wrapping the given [*quic.Conn], which
+// allows a custom DialQUICContext function (see [*Transport]) to establish
+// QUIC connections using its own [*quic.Transport] and UDP socket. Closing
+// the returned connection also closes the given closers, in order, which
+// should include the resources owned by the connection (e.g., the
+// [*quic.Transport] and the UDP socket).
+func NewQUICConn(conn *quic.Conn, closers ...io.Closer) QUICConn {
+	connPool := &closepool.Pool{}
+	for _, closer := range closers {
+		connPool.Add(closer)
+	}
+	return &quicConnAdapter{conn: conn, connPool: connPool}
+}
+
+// quicConnAdapter adapts a [*quic.Conn] to the [QUICConn] interface.
+type quicConnAdapter struct {
+	// conn is the QUIC connection.
+	conn *quic.Conn
+
+	// connPool contains the resources owned by the connection.
+	connPool *closepool.Pool
+}
+
+// Make sure we actually implement [QUICConn].
+var _ QUICConn = &quicConnAdapter{}
+
+// defaultListenPacket creates UDP sockets using [net.ListenConfig].
+func defaultListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	listenConfig := &net.ListenConfig{}
+	return listenConfig.ListenPacket(ctx, network, address)
+}
+
+// dialQUICConn implements [DefaultDialQUICContext] using the given function
+// to create the UDP socket and returning the concrete adapter type, which
+// is useful for DNS-over-HTTP/3.
+func dialQUICConn(ctx context.Context,
+	listenPacket func(ctx context.Context, network, address string) (net.PacketConn, error),
+	address string, tlsConfig *tls.Config, quicConfig *quic.Config, early bool) (*quicConnAdapter, error) {
+	// 1. Create a connection pool to close all opened connections
+	// and ensure we don't leak resources on failure.
+	connPool := &closepool.Pool{}
+	success := false
+	defer func() {
+		if !success {
+			connPool.Close()
+		}
+	}()
+
+	// 2. Map the address, which may possibly contain a domain name, to
+	// the endpoints to dial, honouring the context while resolving
+	endpoints, err := resolveQUICEndpoints(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. Open the UDP connection for supporting QUIC
+	udpConn, err := listenPacket(ctx, "udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	connPool.Add(udpConn)
+
+	// 4. Establish a QUIC connection. Note that the default
+	// configuration implies a 5s timeout for handshaking and
+	// a 30s idle connection timeout.
+	tr := &quic.Transport{
+		Conn: udpConn,
+	}
+	connPool.Add(tr)
+	dial := tr.Dial
+	if early {
+		dial = tr.DialEarly
+	}
+	quicConn, err := dialEndpoints(ctx, endpoints, func(ctx context.Context, endpoint string) (*quic.Conn, error) {
+		return dial(ctx, net.UDPAddrFromAddrPort(netip.MustParseAddrPort(endpoint)), tlsConfig, quicConfig)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	success = true
+	return &quicConnAdapter{conn: quicConn, connPool: connPool}, nil
+}
+
+// resolveQUICEndpoints returns the endpoints, containing IP addresses
+// and port numbers, corresponding to the given address, resolving its host,
+// when needed, using the [net.DefaultResolver] and the given context.
+func resolveQUICEndpoints(ctx context.Context, address string) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portnum, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, err
+	}
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = append(ips, ip)
+	} else if ips, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host); err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for _, ip := range ips {
+		endpoints = append(endpoints, netip.AddrPortFrom(ip.Unmap(), uint16(portnum)).String())
+	}
+	return endpoints, nil
+}
+
+// OpenStreamSync implements [QUICConn].
+func (c *quicConnAdapter) OpenStreamSync(ctx context.Context) (QUICStream, error) {
+	stream, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// ConnectionState implements [QUICConn].
+func (c *quicConnAdapter) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// Context implements [QUICConn].
+func (c *quicConnAdapter) Context() context.Context {
+	return c.conn.Context()
+}
+
+// CloseWithError implements [QUICConn].
+func (c *quicConnAdapter) CloseWithError(code quic.ApplicationErrorCode, reason string) error {
+	err := c.conn.CloseWithError(code, reason)
+	c.connPool.Close()
+	return err
+}
+
+// LocalAddr implements [QUICConn].
+func (c *quicConnAdapter) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr implements [QUICConn].
+func (c *quicConnAdapter) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// quicConnCloser returns an [io.Closer] gracefully closing the given
+// connection without a specific error -- RFC 9250 Sect. 4.3.
+func quicConnCloser(conn QUICConn) io.Closer {
+	return closepool.CloserFunc(func() error {
+		return conn.CloseWithError(doqNoError, "")
+	})
+}
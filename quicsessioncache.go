@@ -0,0 +1,236 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// Reusable DNS-over-QUIC sessions.
+//
+// See https://datatracker.ietf.org/doc/rfc9250/
+//
+
+package dnscore
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// QUICSessionCache caches DNS-over-QUIC connections.
+//
+// Set the QUICSessionCache field of [*Transport] to opt into reusing
+// QUIC connections across queries. We keep a connection per [*ServerAddr]
+// and send each query using a new stream, as specified by RFC 9250. When
+// the connection idles out or the server closes it, including when the
+// server gracefully closes using DOQ_NO_ERROR, we reconnect.
+//
+// Since we key connections by [*ServerAddr] pointer, you should reuse
+// the same [*ServerAddr] for all the queries to the same server.
+//
+// Make sure you call [*QUICSessionCache.Close] when you are done.
+//
+// The zero value is ready to use. A [*QUICSessionCache] is safe for concurrent
+// use by multiple goroutines as long as you don't modify its fields after
+// you have started using it.
+type QUICSessionCache struct {
+	// Allow0RTT optionally enables sending queries using 0-RTT when the
+	// TLSClientSessionCache contains a ticket for the server. Because 0-RTT
+	// data can be replayed by an attacker, RFC 9250 Sect. 4.5 recommends
+	// only sending queries that are safe to replay this way.
+	Allow0RTT bool
+
+	// IdleTimeout is the optional QUIC idle timeout. If this field is
+	// zero, we use the default idle timeout of the QUIC library.
+	IdleTimeout time.Duration
+
+	// TLSClientSessionCache is the optional cache of TLS session tickets.
+	// When this field is not nil, we resume TLS sessions when reconnecting.
+	// Use [tls.NewLRUClientSessionCache] to create a cache.
+	TLSClientSessionCache tls.ClientSessionCache
+
+	// closed indicates that the cache has been closed.
+	closed bool
+
+	// mu protects closed, slots, and the session field of each slot.
+	mu sync.Mutex
+
+	// slots contains the cached sessions for each server.
+	slots map[*ServerAddr]*quicSessionSlot
+}
+
+// quicSessionSlot contains the cached session for a server.
+type quicSessionSlot struct {
+	// sem serializes establishing sessions with the server.
+	sem chan struct{}
+
+	// session is the possibly-nil session.
+	session *quicSession
+}
+
+// ErrQUICSessionCacheClosed indicates that the [*QUICSessionCache] has been closed.
+var ErrQUICSessionCacheClosed = errors.New("QUIC session cache closed")
+
+// Close closes all the cached QUIC connections. Queries in flight on
+// these connections fail and subsequent queries using this cache
+// fail with [ErrQUICSessionCacheClosed].
+func (c *QUICSessionCache) Close() error {
+	c.mu.Lock()
+	var sessions []*quicSession
+	for _, slot := range c.slots {
+		if slot.session != nil {
+			sessions = append(sessions, slot.session)
+			slot.session = nil
+		}
+	}
+	c.closed = true
+	c.mu.Unlock()
+	for _, session := range sessions {
+		session.Close()
+	}
+	return nil
+}
+
+// get returns a cached and usable session for the given server or uses the
+// dial function to establish a new one. The reused return value is true
+// when we did not establish a new session.
+func (c *QUICSessionCache) get(ctx context.Context, addr *ServerAddr,
+	dial func(ctx context.Context) (*quicSession, error)) (session *quicSession, reused bool, err error) {
+	// 1. obtain the slot for the server
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, false, ErrQUICSessionCacheClosed
+	}
+	if c.slots == nil {
+		c.slots = make(map[*ServerAddr]*quicSessionSlot)
+	}
+	slot := c.slots[addr]
+	if slot == nil {
+		slot = &quicSessionSlot{sem: make(chan struct{}, 1)}
+		c.slots[addr] = slot
+	}
+	c.mu.Unlock()
+
+	// 2. make sure only a single goroutine dials at any given time
+	select {
+	case slot.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	defer func() { <-slot.sem }()
+
+	// 3. reuse the existing session if it's still alive
+	c.mu.Lock()
+	session = slot.session
+	c.mu.Unlock()
+	if session != nil && session.alive() {
+		return session, true, nil
+	}
+	if session != nil {
+		c.forget(addr, session)
+	}
+
+	// 4. establish and cache a new session
+	session, err = dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		session.Close()
+		return nil, false, ErrQUICSessionCacheClosed
+	}
+	slot.session = session
+	c.mu.Unlock()
+	return session, false, nil
+}
+
+// forget removes the given session from the cache and closes it.
+func (c *QUICSessionCache) forget(addr *ServerAddr, session *quicSession) {
+	c.mu.Lock()
+	if slot := c.slots[addr]; slot != nil && slot.session == session {
+		slot.session = nil
+	}
+	c.mu.Unlock()
+	session.Close()
+}
+
+// quicSessionGone returns whether the error indicates that the QUIC connection
+// is gone because it idled out, the server closed it without errors, or the
+// server lost its state, in which case we should transparently reconnect.
+func quicSessionGone(err error) bool {
+	var (
+		idleErr   *quic.IdleTimeoutError
+		appErr    *quic.ApplicationError
+		resetErr  *quic.StatelessResetError
+		streamErr *quic.StreamError
+	)
+	switch {
+	case errors.As(err, &idleErr), errors.As(err, &resetErr):
+		return true
+	case errors.As(err, &appErr):
+		return appErr.Remote && appErr.ErrorCode == doqNoError
+	case errors.As(err, &streamErr):
+		return streamErr.Remote && streamErr.ErrorCode == doqNoError
+	default:
+		return false
+	}
+}
+
+// queryQUICSessionCache implements [*Transport.Query] for DNS over QUIC
+// when using the [*QUICSessionCache] to reuse QUIC connections.
+func (t *Transport) queryQUICSessionCache(ctx context.Context,
+	addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
+	cache := t.QUICSessionCache
+	dial := func(ctx context.Context) (*quicSession, error) {
+		return t.dialQUIC(ctx, addr, cache)
+	}
+	for attempt := 0; ; attempt++ {
+		// 1. Obtain a cached session or establish a new one
+		session, reused, err := cache.get(ctx, addr, dial)
+		if err != nil {
+			return nil, err
+		}
+
+		// 2. Perform the query using a new stream
+		resp, err := t.queryQUICSession(ctx, addr, query, session)
+
+		// 3. Reconnect once if the session was gone
+		if err != nil && quicSessionGone(err) {
+			cache.forget(addr, session)
+			if reused && attempt <= 0 && ctx.Err() == nil {
+				continue
+			}
+		}
+		return resp, err
+	}
+}
+
+// queryQUICSession performs a query using a new stream of the given session.
+func (t *Transport) queryQUICSession(ctx context.Context,
+	addr *ServerAddr, query *dns.Msg, session *quicSession) (*dns.Msg, error) {
+	// 1. Open a stream for sending the DoQ query
+	stream, err := newQUICStreamAdapter(ctx, session.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Make sure we cancel the stream, but not the whole connection,
+	// when the context is done, as suggested by RFC 9250 Sect. 4.3.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.Stream.CancelRead(doqRequestCancelled)
+		case <-done:
+		}
+	}()
+
+	// 3. defer to queryStream, which closes the stream after sending the query
+	return t.queryStream(ctx, addr, addr.TSIGKey, query, stream)
+}
@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuicSessionGone(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		expect bool
+	}{
+		{
+			name:   "idle timeout",
+			err:    &quic.IdleTimeoutError{},
+			expect: true,
+		},
+
+		{
+			name:   "stateless reset",
+			err:    fmt.Errorf("wrapped: %w", &quic.StatelessResetError{}),
+			expect: true,
+		},
+
+		{
+			name:   "remote DOQ_NO_ERROR",
+			err:    &quic.ApplicationError{Remote: true, ErrorCode: doqNoError},
+			expect: true,
+		},
+
+		{
+			name:   "local DOQ_NO_ERROR",
+			err:    &quic.ApplicationError{Remote: false, ErrorCode: doqNoError},
+			expect: false,
+		},
+
+		{
+			name:   "remote DOQ_PROTOCOL_ERROR",
+			err:    &quic.ApplicationError{Remote: true, ErrorCode: 0x02},
+			expect: false,
+		},
+
+		{
+			name:   "remote stream DOQ_NO_ERROR",
+			err:    &quic.StreamError{Remote: true, ErrorCode: doqNoError},
+			expect: true,
+		},
+
+		{
+			name:   "other error",
+			err:    errors.New("mocked error"),
+			expect: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, quicSessionGone(tt.err))
+		})
+	}
+}
+
+func TestQUICSessionCache(t *testing.T) {
+	t.Run("closed cache", func(t *testing.T) {
+		cache := &QUICSessionCache{}
+		assert.NoError(t, cache.Close())
+		txp := &Transport{QUICSessionCache: cache}
+		addr := NewServerAddr(ProtocolDoQ, "127.0.0.1:853")
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeA)
+		_, err := txp.Query(context.Background(), addr, query)
+		assert.ErrorIs(t, err, ErrQUICSessionCacheClosed)
+	})
+
+	t.Run("dial failure", func(t *testing.T) {
+		cache := &QUICSessionCache{}
+		defer cache.Close()
+		expected := errors.New("mocked error")
+		addr := NewServerAddr(ProtocolDoQ, "127.0.0.1:853")
+		_, _, err := cache.get(context.Background(), addr, func(ctx context.Context) (*quicSession, error) {
+			return nil, expected
+		})
+		assert.ErrorIs(t, err, expected)
+	})
+
+	t.Run("canceled context while waiting for another dial", func(t *testing.T) {
+		cache := &QUICSessionCache{}
+		defer cache.Close()
+		addr := NewServerAddr(ProtocolDoQ, "127.0.0.1:853")
+		dialing := make(chan struct{})
+		unblock := make(chan struct{})
+		go func() {
+			_, _, _ = cache.get(context.Background(), addr, func(ctx context.Context) (*quicSession, error) {
+				close(dialing)
+				<-unblock
+				return nil, errors.New("mocked error")
+			})
+		}()
+		<-dialing
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err := cache.get(ctx, addr, nil)
+		assert.ErrorIs(t, err, context.Canceled)
+		close(unblock)
+	})
+}
@@ -0,0 +1,344 @@
+//
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// SPDX-License-Identifier: BSD-3-Clause
+//
+// Adapted from: https://github.com/golang/go/blob/go1.21.10/src/net/dnsconfig_unix.go
+//
+// Adapted from: https://github.com/golang/go/blob/go1.21.10/src/net/dnsclient_unix.go
+//
+// Parsing resolv.conf and expanding names using the search
+// list along with BSD-licensed code from the stdlib.
+//
+
+package dnscore
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultResolvConfPath is the default path of the resolv.conf file.
+const DefaultResolvConfPath = "/etc/resolv.conf"
+
+// DefaultNdots is the default value of the resolv.conf ndots option.
+const DefaultNdots = 1
+
+// resolvConfMaxNameservers is the maximum number of nameservers we
+// use, which is the same limit used by glibc (i.e., MAXNS).
+const resolvConfMaxNameservers = 3
+
+// configFile is a configuration file that we possibly reload when it changes.
+//
+// Construct using [newConfigFile].
+type configFile struct {
+	// interval is the minimum interval between checks, which
+	// is zero when we should not check for changes.
+	interval time.Duration
+
+	// lastCheck is when we last checked for changes.
+	lastCheck time.Time
+
+	// modTime is the modification time when we last read the file.
+	modTime time.Time
+
+	// mu protects the mutable fields.
+	mu sync.Mutex
+
+	// path is the file path.
+	path string
+
+	// size is the file size when we last read the file.
+	size int64
+}
+
+// ConfigFileOption is an option for [NewConfigFromResolvConf] and [NewHosts].
+type ConfigFileOption func(*configFile)
+
+// ConfigFileOptionReload enables reloading the configuration file when its
+// modification time or size changes, checking at most once every interval.
+//
+// If this option is not used, we read the configuration file only once.
+func ConfigFileOptionReload(interval time.Duration) ConfigFileOption {
+	return func(f *configFile) {
+		f.interval = interval
+	}
+}
+
+// newConfigFile creates a new [*configFile].
+func newConfigFile(path string, options ...ConfigFileOption) *configFile {
+	f := &configFile{
+		interval:  0,
+		lastCheck: time.Time{},
+		modTime:   time.Time{},
+		mu:        sync.Mutex{},
+		path:      path,
+		size:      0,
+	}
+	for _, option := range options {
+		option(f)
+	}
+	return f
+}
+
+// read reads the file and records its modification time and size.
+func (f *configFile) read() ([]byte, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.lastCheck, f.modTime, f.size = time.Now(), info.ModTime(), info.Size()
+	f.mu.Unlock()
+	return data, nil
+}
+
+// changed returns whether the file changed since we last read it, checking
+// at most once every interval. Like the stdlib, we do not block when another
+// goroutine is already checking and just assume the file did not change.
+func (f *configFile) changed() bool {
+	if f == nil || !f.mu.TryLock() {
+		return false
+	}
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.interval <= 0 || now.Sub(f.lastCheck) < f.interval {
+		return false
+	}
+	f.lastCheck = now
+	info, err := os.Stat(f.path)
+	return err == nil && (!info.ModTime().Equal(f.modTime) || info.Size() != f.size)
+}
+
+// NewConfigFromResolvConf creates a new [*ResolverConfig] using the
+// nameservers and the options of the given resolv.conf file, which
+// usually is [DefaultResolvConfPath]. Use [ConfigFileOptionReload] to
+// reload the configuration when the file changes.
+//
+// Like glibc, we use up to three nameservers and the localhost nameserver
+// when there are no nameservers. We use DNS over TCP with the "use-vc"
+// option, and EDNS(0) only with the "edns0" option. The "attempts" option
+// is the number of times we try each nameserver, the "timeout" option is
+// the timeout of each query, and the "rotate" option rotates the servers.
+// The "ndots" option and the "search" and "domain" keywords configure the
+// search list (see [*ResolverConfig.SetSearch]), and we ignore the other
+// options. Unlike glibc, we do not derive the search list from the
+// hostname when there is no "search" or "domain" keyword.
+//
+// Reloading replaces all the servers, therefore, the servers added
+// using [*ResolverConfig.AddServer] are lost when we reload.
+func NewConfigFromResolvConf(path string, options ...ConfigFileOption) (*ResolverConfig, error) {
+	file := newConfigFile(path, options...)
+	c, err := parseResolvConf(file)
+	if err != nil {
+		return nil, err
+	}
+	c.file = file
+	return c, nil
+}
+
+// maybeReload reloads the resolv.conf file when it changed. In case
+// of failure, we continue using the current configuration.
+func (c *ResolverConfig) maybeReload() {
+	if !c.file.changed() {
+		return
+	}
+	fresh, err := parseResolvConf(c.file)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	c.attempts = fresh.attempts
+	c.list = fresh.list
+	c.ndots = fresh.ndots
+	c.rotate = fresh.rotate
+	c.search = fresh.search
+	c.mu.Unlock()
+}
+
+// parseResolvConf parses the given resolv.conf file.
+func parseResolvConf(file *configFile) (*ResolverConfig, error) {
+	// 1. read the file
+	data, err := file.read()
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. parse the nameservers and the options
+	var (
+		attempts = DefaultAttempts
+		edns0    = false
+		ndots    = DefaultNdots
+		noReload = false
+		rotate   = false
+		search   = []string{}
+		servers  = []string{}
+		timeout  = DefaultQueryTimeout
+		useVC    = false
+	)
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) > 0 && (line[0] == ';' || line[0] == '#') {
+			// comment.
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) < 1 {
+			continue
+		}
+		switch f[0] {
+		case "nameserver": // add one name server
+			if len(f) > 1 && len(servers) < resolvConfMaxNameservers {
+				// One more check: make sure server name is
+				// just an IP address. Otherwise we need DNS
+				// to look it up.
+				if _, err := netip.ParseAddr(f[1]); err == nil {
+					servers = append(servers, net.JoinHostPort(f[1], "53"))
+				}
+			}
+
+		case "domain": // set search path to just this domain
+			if len(f) > 1 {
+				search = []string{dns.Fqdn(f[1])}
+			}
+
+		case "search": // set search path to given servers
+			search = make([]string, 0, len(f)-1)
+			for i := 1; i < len(f); i++ {
+				name := dns.Fqdn(f[i])
+				if name == "." {
+					continue
+				}
+				search = append(search, name)
+			}
+
+		case "options": // magic options
+			for _, s := range f[1:] {
+				switch {
+				case strings.HasPrefix(s, "ndots:"):
+					n, _ := strconv.Atoi(s[6:])
+					ndots = min(max(n, 0), 15)
+
+				case strings.HasPrefix(s, "timeout:"):
+					n, _ := strconv.Atoi(s[8:])
+					timeout = time.Duration(max(n, 1)) * time.Second
+
+				case strings.HasPrefix(s, "attempts:"):
+					n, _ := strconv.Atoi(s[9:])
+					attempts = max(n, 1)
+
+				case s == "rotate":
+					rotate = true
+
+				case s == "edns0":
+					edns0 = true
+
+				case s == "use-vc" || s == "usevc" || s == "tcp":
+					useVC = true
+
+				case s == "no-reload":
+					noReload = true
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53", "[::1]:53"}
+	}
+	if noReload {
+		file.mu.Lock()
+		file.interval = 0
+		file.mu.Unlock()
+	}
+
+	// 3. create the configuration
+	protocol, maxResponseSize := ProtocolUDP, uint16(EDNS0SuggestedMaxResponseSizeUDP)
+	if useVC {
+		protocol, maxResponseSize = ProtocolTCP, EDNS0SuggestedMaxResponseSizeOtherwise
+	}
+	var queryOptions []QueryOption
+	if edns0 {
+		queryOptions = append(queryOptions, QueryOptionEDNS0(maxResponseSize, 0))
+	}
+	c := NewConfig()
+	c.SetAttempts(attempts * len(servers))
+	for _, server := range servers {
+		c.AddServer(NewServerAddr(protocol, server),
+			ServerOptionQueryOptions(queryOptions...),
+			ServerOptionQueryTimeout(timeout))
+	}
+	c.ndots = ndots
+	c.rotate = rotate
+	c.search = search
+	return c, nil
+}
+
+// nameList returns the names to query for the given name in order. Like
+// glibc and the stdlib, we only query fully qualified names (i.e., with a
+// trailing dot) as is. Otherwise, we append the search list domains and
+// query the name as is either first, when it contains at least ndots dots,
+// or last. We return an empty list when the name is too long.
+func (c *ResolverConfig) nameList(name string) []string {
+	// Check name length (see isDomainName).
+	l := len(name)
+	rooted := l > 0 && name[l-1] == '.'
+	if l > 254 || l == 254 && !rooted {
+		return nil
+	}
+
+	// If name is rooted (trailing dot), try only that name.
+	if rooted {
+		return []string{name}
+	}
+
+	c.maybeReload()
+	c.mu.RLock()
+	ndots, search := c.ndots, c.search
+	c.mu.RUnlock()
+
+	hasNdots := strings.Count(name, ".") >= ndots
+	name += "."
+	l++
+
+	// Build list of search choices.
+	names := make([]string, 0, 1+len(search))
+	// If name has enough dots, try unsuffixed first.
+	if hasNdots {
+		names = append(names, name)
+	}
+	// Try suffixes that are not too long (see isDomainName).
+	for _, suffix := range search {
+		if l+len(suffix) <= 254 {
+			names = append(names, name+suffix)
+		}
+	}
+	// Try unsuffixed, if not tried first above.
+	if !hasNdots {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,233 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfigFile writes a configuration file with the given content
+// and modification time into the test temporary directory.
+func writeConfigFile(t *testing.T, path, content string, modTime time.Time) {
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewConfigFromResolvConf(t *testing.T) {
+	type server struct {
+		address  string
+		protocol Protocol
+		options  int
+		timeout  time.Duration
+	}
+	tests := []struct {
+		name           string
+		content        string
+		expectAttempts int
+		expectNdots    int
+		expectRotate   bool
+		expectSearch   []string
+		expectServers  []server
+	}{{
+		name: "full configuration",
+		content: `# comment
+; another comment
+nameserver 192.0.2.1
+nameserver 2001:db8::1
+nameserver invalid.example.com
+domain example.com
+search example.com. corp.example.com .
+options ndots:3 timeout:2 attempts:3 rotate edns0 unknown
+`,
+		expectAttempts: 6,
+		expectNdots:    3,
+		expectRotate:   true,
+		expectSearch:   []string{"example.com.", "corp.example.com."},
+		expectServers: []server{
+			{"192.0.2.1:53", ProtocolUDP, 1, 2 * time.Second},
+			{"[2001:db8::1]:53", ProtocolUDP, 1, 2 * time.Second},
+		},
+	}, {
+		name:           "empty file",
+		content:        "",
+		expectAttempts: 2 * DefaultAttempts,
+		expectNdots:    DefaultNdots,
+		expectSearch:   []string{},
+		expectServers: []server{
+			{"127.0.0.1:53", ProtocolUDP, 0, DefaultQueryTimeout},
+			{"[::1]:53", ProtocolUDP, 0, DefaultQueryTimeout},
+		},
+	}, {
+		name: "use-vc, domain, and clamping",
+		content: `nameserver 192.0.2.1
+nameserver 192.0.2.2
+nameserver 192.0.2.3
+nameserver 192.0.2.4
+search example.com
+domain example.org
+options ndots:20 timeout:0 attempts:-1 use-vc
+`,
+		expectAttempts: 3,
+		expectNdots:    15,
+		expectSearch:   []string{"example.org."},
+		expectServers: []server{
+			{"192.0.2.1:53", ProtocolTCP, 0, time.Second},
+			{"192.0.2.2:53", ProtocolTCP, 0, time.Second},
+			{"192.0.2.3:53", ProtocolTCP, 0, time.Second},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "resolv.conf")
+			writeConfigFile(t, path, tt.content, time.Now())
+			config, err := NewConfigFromResolvConf(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.expectAttempts, config.Attempts())
+			assert.Equal(t, tt.expectNdots, config.ndots)
+			assert.Equal(t, tt.expectRotate, config.rotate)
+			assert.Equal(t, tt.expectSearch, config.search)
+			var servers []server
+			for _, s := range config.list {
+				servers = append(servers, server{s.address.Address, s.address.Protocol, len(s.queryOptions), s.timeout})
+			}
+			assert.Equal(t, tt.expectServers, servers)
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		config, err := NewConfigFromResolvConf(filepath.Join(t.TempDir(), "resolv.conf"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.Nil(t, config)
+	})
+}
+
+func TestResolverConfig_rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	writeConfigFile(t, path, "nameserver 192.0.2.1\nnameserver 192.0.2.2\noptions rotate\n", time.Now())
+	config, err := NewConfigFromResolvConf(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first []string
+	for range 4 {
+		first = append(first, config.servers()[0].address.Address)
+	}
+	assert.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.1:53", "192.0.2.2:53"}, first)
+}
+
+func TestResolverConfig_maybeReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	modTime := time.Now().Add(-time.Hour)
+	writeConfigFile(t, path, "nameserver 192.0.2.1\n", modTime)
+
+	t.Run("without reload", func(t *testing.T) {
+		config, err := NewConfigFromResolvConf(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeConfigFile(t, path, "nameserver 192.0.2.2\n", modTime.Add(time.Second))
+		assert.Equal(t, "192.0.2.1:53", config.servers()[0].address.Address)
+		writeConfigFile(t, path, "nameserver 192.0.2.1\n", modTime)
+	})
+
+	t.Run("with reload", func(t *testing.T) {
+		config, err := NewConfigFromResolvConf(path, ConfigFileOptionReload(time.Nanosecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.AddServer(NewServerAddr(ProtocolUDP, "192.0.2.53:53"))
+		assert.Len(t, config.servers(), 2)
+
+		writeConfigFile(t, path, "nameserver 192.0.2.2\noptions attempts:4 ndots:2\n", modTime.Add(time.Second))
+		servers := config.servers()
+		if assert.Len(t, servers, 1) {
+			assert.Equal(t, "192.0.2.2:53", servers[0].address.Address)
+		}
+		assert.Equal(t, 4, config.Attempts())
+		assert.Equal(t, 2, config.ndots)
+
+		// an unreadable file does not change the configuration
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "192.0.2.2:53", config.servers()[0].address.Address)
+	})
+
+	t.Run("no-reload option", func(t *testing.T) {
+		writeConfigFile(t, path, "nameserver 192.0.2.1\noptions no-reload\n", modTime)
+		config, err := NewConfigFromResolvConf(path, ConfigFileOptionReload(time.Nanosecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeConfigFile(t, path, "nameserver 192.0.2.2\n", modTime.Add(time.Second))
+		assert.Equal(t, "192.0.2.1:53", config.servers()[0].address.Address)
+	})
+}
+
+func TestResolverConfig_nameList(t *testing.T) {
+	long := strings.Repeat("a.", 126) // 252 characters
+	tests := []struct {
+		name   string
+		ndots  int
+		search []string
+		expect []string
+	}{{
+		name:   "www",
+		ndots:  1,
+		expect: []string{"www."},
+	}, {
+		name:   "www",
+		ndots:  1,
+		search: []string{"corp.example.com", "example.com"},
+		expect: []string{"www.corp.example.com.", "www.example.com.", "www."},
+	}, {
+		name:   "www.example.com",
+		ndots:  1,
+		search: []string{"corp.example.com"},
+		expect: []string{"www.example.com.", "www.example.com.corp.example.com."},
+	}, {
+		name:   "www.example.com",
+		ndots:  3,
+		search: []string{"corp.example.com"},
+		expect: []string{"www.example.com.corp.example.com.", "www.example.com."},
+	}, {
+		name:   "www.example.com.",
+		ndots:  1,
+		search: []string{"corp.example.com"},
+		expect: []string{"www.example.com."},
+	}, {
+		name:   "www",
+		ndots:  0,
+		search: []string{"example.com"},
+		expect: []string{"www.", "www.example.com."},
+	}, {
+		name:   long[:len(long)-1],
+		ndots:  1,
+		search: []string{"example.com", "b"},
+		expect: []string{long, long + "b."},
+	}, {
+		name:   long + "aa",
+		ndots:  1,
+		expect: nil,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := NewConfig()
+			config.SetNdots(tt.ndots)
+			config.SetSearch(tt.search)
+			assert.Equal(t, tt.expect, config.nameList(tt.name))
+		})
+	}
+}
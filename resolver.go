@@ -9,8 +9,10 @@ package dnscore
 import (
 	"context"
 	"errors"
+	"log/slog"
 	"net"
 	"strings"
+	"sync"
 
 	"github.com/miekg/dns"
 )
@@ -26,17 +28,62 @@ type ResolverTransport interface {
 // Resolver is a DNS resolver. This struct is API compatible with
 // the [*net.Resolver] struct from the [net] package.
 //
-// The zero value is ready to use.
+// Concurrent lookups of the same name and type share a single
+// exchange with the servers, and we emit dnsLookupCoalesced
+// structured logs when a lookup joins an in-flight one.
+//
+// The zero value is ready to use. A Resolver must not be copied
+// after first use.
 type Resolver struct {
+	// Cache optionally caches the lookup results.
+	//
+	// If nil, every lookup queries the servers.
+	Cache *Cache
+
 	// Config is the optional resolver configuration.
 	//
-	// If nil, we use an empty [*ResolverConfig].
+	// If nil, we use an empty [*ResolverConfig]. The configuration also
+	// contains the search list and the ndots option we use for expanding
+	// names that are not fully qualified (see [*ResolverConfig.SetSearch]).
 	Config *ResolverConfig
 
+	// DNSSEC optionally enables DNSSEC validation.
+	//
+	// If nil, we do not validate. Otherwise, we ask servers for signatures
+	// with the Checking Disabled (CD) bit set, we fetch the DNSKEY and DS RRs
+	// needed to build a chain of trust from the trust anchors using the same
+	// server, and we fail lookups returning bogus answers with an error
+	// wrapping [ErrDNSSECBogus]. Use [*Resolver.LookupDNSSEC] to also
+	// obtain the [DNSSECStatus] of the answers.
+	DNSSEC *DNSSECConfig
+
+	// Hosts optionally contains the hosts file entries.
+	//
+	// If nil, we do not consult a hosts file. Otherwise, we answer A and
+	// AAAA lookups for the hosts in the file, as well as reverse lookups for
+	// their addresses, without using the network. Like the [*net.Resolver],
+	// when a host is in the file but has no addresses of the requested
+	// family, we fail with [ErrNoData] rather than querying the servers.
+	Hosts *Hosts
+
+	// Logger is the optional structured logger for emitting
+	// structured diagnostic events. If this field is nil, we
+	// will not be emitting structured logs. Note that the
+	// [*Transport] has its own logger for logging queries
+	// and responses, which you need to configure separately.
+	Logger *slog.Logger
+
 	// Transport is the optional DNS transport to use for resolving queries.
 	//
 	// If nil, we use [DefaultTransport].
 	Transport ResolverTransport
+
+	// inflight contains the in-flight lookups indexed by name and type,
+	// which we share between concurrent callers (see [*Resolver.coalesce]).
+	inflight map[cacheKey]*resolverInflight
+
+	// mu protects inflight.
+	mu sync.Mutex
 }
 
 // config returns the resolver configuration or a default one.
@@ -129,13 +176,13 @@ func (r *Resolver) LookupA(ctx context.Context, host string) ([]string, error) {
 	}
 
 	// Obtain the RRs
-	rrs, err := r.lookup(ctx, host, dns.TypeA)
+	result, err := r.Lookup(ctx, host, dns.TypeA)
 	if err != nil {
 		return nil, err
 	}
 
 	// Decode as IPv4 addresses and CNAME
-	addrs, _, err := DecodeLookupA(rrs)
+	addrs, _, err := DecodeLookupA(result.RRs)
 	return addrs, err
 }
 
@@ -147,12 +194,12 @@ func (r *Resolver) LookupAAAA(ctx context.Context, host string) ([]string, error
 	}
 
 	// Obtain the RRs
-	rrs, err := r.lookup(ctx, host, dns.TypeAAAA)
+	result, err := r.Lookup(ctx, host, dns.TypeAAAA)
 	if err != nil {
 		return nil, err
 	}
 
 	// Decode as IPv6 addresses and CNAME
-	addrs, _, err := DecodeLookupAAAA(rrs)
+	addrs, _, err := DecodeLookupAAAA(result.RRs)
 	return addrs, err
 }
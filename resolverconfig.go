@@ -4,8 +4,12 @@ package dnscore
 
 import (
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 // ResolverConfig contains configuration for the resolver.
@@ -15,16 +19,32 @@ import (
 // This struct is safe for concurrent use by multiple goroutines.
 //
 // If the configuration is empty, it uses the "8.8.8.8:53/udp"
-// and "8.8.4.4:53/udp" servers as the default servers.
+// and "8.8.4.4:53/udp" servers as the default servers. Use
+// [NewConfigFromResolvConf] to use the system configuration.
 type ResolverConfig struct {
 	// attempts is the number of attempts to make for each query.
 	attempts int
 
+	// file is the resolv.conf file to reload, if any.
+	file *configFile
+
 	// list contains the list of configured servers.
 	list []resolverConfigServer
 
 	// mu is the mutex for the config.
 	mu sync.RWMutex
+
+	// ndots is the resolv.conf ndots option.
+	ndots int
+
+	// offset is the index of the first server when rotating.
+	offset atomic.Uint32
+
+	// rotate indicates that we should rotate the servers.
+	rotate bool
+
+	// search is the resolv.conf search list.
+	search []string
 }
 
 // DefaultAttempts is the default number of attempts to make for each query.
@@ -34,8 +54,13 @@ const DefaultAttempts = 2
 func NewConfig() *ResolverConfig {
 	return &ResolverConfig{
 		attempts: DefaultAttempts,
+		file:     nil,
 		list:     []resolverConfigServer{},
 		mu:       sync.RWMutex{},
+		ndots:    DefaultNdots,
+		offset:   atomic.Uint32{},
+		rotate:   false,
+		search:   []string{},
 	}
 }
 
@@ -48,11 +73,55 @@ func (c *ResolverConfig) SetAttempts(attempts int) {
 
 // Attempts returns the number of attempts to make for each query.
 func (c *ResolverConfig) Attempts() int {
+	c.maybeReload()
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	return c.attempts
 }
 
+// SetNdots sets the minimum number of dots that a name must contain for
+// trying the name as is before appending the search list domains. Use
+// [DefaultNdots] for the same default value used by glibc.
+func (c *ResolverConfig) SetNdots(ndots int) {
+	c.mu.Lock()
+	c.ndots = ndots
+	c.mu.Unlock()
+}
+
+// Ndots returns the minimum number of dots that a name must contain for
+// trying the name as is before appending the search list domains.
+func (c *ResolverConfig) Ndots() int {
+	c.maybeReload()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ndots
+}
+
+// SetSearch sets the list of domains we append to names that are not
+// fully qualified (i.e., without a trailing dot), ignoring the root domain.
+//
+// By default, the search list is empty and we only query the given name.
+func (c *ResolverConfig) SetSearch(search []string) {
+	list := make([]string, 0, len(search))
+	for _, domain := range search {
+		if domain = dns.Fqdn(domain); domain != "." {
+			list = append(list, domain)
+		}
+	}
+	c.mu.Lock()
+	c.search = list
+	c.mu.Unlock()
+}
+
+// Search returns the list of domains we append to names that
+// are not fully qualified (i.e., without a trailing dot).
+func (c *ResolverConfig) Search() []string {
+	c.maybeReload()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Clone(c.search)
+}
+
 // resolverConfigServer contains configuration for a single resolver server.
 //
 // Construct a new instance using [newResolverConfigServer].
@@ -64,17 +133,31 @@ type resolverConfigServer struct {
 	// for constructing queries to this server.
 	queryOptions []QueryOption
 
+	// tcpAddress is the address for retrying using DNS over TCP when the
+	// DNS over UDP response is truncated, which we create once such that
+	// the [*ConnPool] reuses connections across fallbacks.
+	tcpAddress *ServerAddr
+
 	// timeout is the timeout for each query.
 	timeout time.Duration
 }
 
+// tcpFallbackAddress returns the address for retrying using DNS over TCP.
+func (s resolverConfigServer) tcpFallbackAddress() *ServerAddr {
+	if s.tcpAddress != nil {
+		return s.tcpAddress
+	}
+	return s.address.withProtocol(ProtocolTCP)
+}
+
 // AddServerOption is an option for adding a server to the resolver configuration.
 type AddServerOption func(*resolverConfigServer)
 
 // ServerOptionQueryOptions sets the query options to use for constructing queries
 // to this specific server.If this option is not used, we use the default query options
 // suitable for the protocol used by the server. Specifically, we enable DNSSEC
-// validation and block-length padding for DoT, DoH, and DoQ.
+// validation and block-length padding for DoT, DoH, DoQ, DoH3, and ODoH and
+// DNSSEC validation for DNSCrypt, which pads queries on its own.
 func ServerOptionQueryOptions(queryOptions ...QueryOption) AddServerOption {
 	return func(s *resolverConfigServer) {
 		s.queryOptions = queryOptions
@@ -103,16 +186,21 @@ func newResolverConfigServer(address *ServerAddr, options ...AddServerOption) re
 
 	// apply the default query options suitable for the protocol used by the server
 	switch address.Protocol {
-	case ProtocolDoH, ProtocolDoT, ProtocolDoQ:
+	case ProtocolDoH, ProtocolDoT, ProtocolDoQ, ProtocolDoH3, ProtocolODoH:
 		server.queryOptions = append(server.queryOptions, QueryOptionEDNS0(
 			EDNS0SuggestedMaxResponseSizeOtherwise,
 			EDNS0FlagDO|EDNS0FlagBlockLengthPadding))
 
+	case ProtocolDNSCrypt:
+		server.queryOptions = append(server.queryOptions, QueryOptionEDNS0(
+			EDNS0SuggestedMaxResponseSizeOtherwise, EDNS0FlagDO))
+
 	case ProtocolTCP:
 		server.queryOptions = append(server.queryOptions, QueryOptionEDNS0(
 			EDNS0SuggestedMaxResponseSizeOtherwise, 0))
 
 	case ProtocolUDP:
+		server.tcpAddress = address.withProtocol(ProtocolTCP)
 		server.queryOptions = append(server.queryOptions, QueryOptionEDNS0(
 			EDNS0SuggestedMaxResponseSizeUDP, 0))
 	}
@@ -132,13 +220,22 @@ func (c *ResolverConfig) AddServer(address *ServerAddr, options ...AddServerOpti
 	c.mu.Unlock()
 }
 
-// servers returns the list of configured servers.
+// servers returns the list of configured servers, which starts
+// from a different server at each invocation when rotating.
 func (c *ResolverConfig) servers() []resolverConfigServer {
 	// copy the list of servers
+	c.maybeReload()
 	c.mu.RLock()
 	list := append([]resolverConfigServer(nil), c.list...)
+	rotate := c.rotate
 	c.mu.RUnlock()
 
+	// possibly rotate the list of servers
+	if rotate && len(list) > 1 {
+		offset := int((c.offset.Add(1) - 1) % uint32(len(list)))
+		list = slices.Concat(list[offset:], list[:offset])
+	}
+
 	// if empty, create the default servers
 	if len(list) == 0 {
 		defaultAddrs := []string{"8.8.8.8", "8.8.4.4"}
@@ -89,3 +89,26 @@ func TestServerOptionQueryOptions(t *testing.T) {
 		}
 	}
 }
+
+func TestSetNdots(t *testing.T) {
+	config := NewConfig()
+	if config.Ndots() != DefaultNdots {
+		t.Fatalf("Expected %d ndots, got %d", DefaultNdots, config.Ndots())
+	}
+	config.SetNdots(3)
+	if config.Ndots() != 3 {
+		t.Fatalf("Expected 3 ndots, got %d", config.Ndots())
+	}
+}
+
+func TestSetSearch(t *testing.T) {
+	config := NewConfig()
+	if len(config.Search()) != 0 {
+		t.Fatalf("Expected empty search list, got %v", config.Search())
+	}
+	config.SetSearch([]string{"corp.example.com", ".", "example.com."})
+	search := config.Search()
+	if len(search) != 2 || search[0] != "corp.example.com." || search[1] != "example.com." {
+		t.Fatalf("Unexpected search list: %v", search)
+	}
+}
@@ -26,6 +26,11 @@ var (
 
 // ValidateResponse validates a given DNS response
 // message for a given query message.
+//
+// When the query is signed using [QueryOptionTSIG], we also ensure that
+// the response is signed using the same key and that the server did not
+// report TSIG errors, returning [ErrTSIGBadSig], [ErrTSIGBadKey], or
+// [ErrTSIGBadTime] otherwise.
 func ValidateResponse(query, resp *dns.Msg) error {
 	// 1. make sure the message is actually a response
 	if !resp.Response {
@@ -57,7 +62,9 @@ func ValidateResponse(query, resp *dns.Msg) error {
 	if resp0.Qtype != query0.Qtype {
 		return ErrInvalidResponse
 	}
-	return nil
+
+	// 5. make sure a signed query has a signed response
+	return validateResponseTSIG(query, resp)
 }
 
 func equalASCIIName(x, y string) bool {
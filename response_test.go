@@ -78,6 +78,35 @@ func TestValidateResponse(t *testing.T) {
 			},
 			expected: ErrInvalidResponse,
 		},
+
+		{
+			name: "ValidSignedResponse",
+			modify: func(query, resp *dns.Msg) {
+				query.SetTsig("key.example.com.", dns.HmacSHA256, 300, 0)
+				resp.SetTsig("key.example.com.", dns.HmacSHA256, 300, 0)
+			},
+			expected: nil,
+		},
+
+		{
+			name: "InvalidSignedResponseBadSig",
+			modify: func(query, resp *dns.Msg) {
+				query.SetTsig("key.example.com.", dns.HmacSHA256, 300, 0)
+				resp.SetTsig("key.example.com.", dns.HmacSHA256, 300, 0)
+				resp.IsTsig().Error = dns.RcodeBadSig
+			},
+			expected: ErrTSIGBadSig,
+		},
+
+		{
+			name: "InvalidSignedResponseBadTime",
+			modify: func(query, resp *dns.Msg) {
+				query.SetTsig("key.example.com.", dns.HmacSHA256, 300, 0)
+				resp.SetTsig("key.example.com.", dns.HmacSHA256, 300, 0)
+				resp.IsTsig().Error = dns.RcodeBadTime
+			},
+			expected: ErrTSIGBadTime,
+		},
 	}
 
 	for _, tt := range tests {
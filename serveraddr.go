@@ -2,6 +2,19 @@
 
 package dnscore
 
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
 // Protocol is a transport protocol.
 type Protocol string
 
@@ -21,6 +34,15 @@ const (
 
 	// ProtocolDoQ is DNS over QUIC.
 	ProtocolDoQ = Protocol("doq")
+
+	// ProtocolDoH3 is DNS over HTTPS using HTTP/3.
+	ProtocolDoH3 = Protocol("doh3")
+
+	// ProtocolODoH is Oblivious DNS over HTTPS.
+	ProtocolODoH = Protocol("odoh")
+
+	// ProtocolDNSCrypt is DNSCrypt version 2.
+	ProtocolDNSCrypt = Protocol("dnscrypt")
 )
 
 // Name aliases for DNS protocols.
@@ -33,15 +55,25 @@ const (
 
 	// ProtocolQUIC is an alias for ProtocolDoQ.
 	ProtocolQUIC = ProtocolDoQ
+
+	// ProtocolHTTP3 is an alias for ProtocolDoH3.
+	ProtocolHTTP3 = ProtocolDoH3
 )
 
 // ServerAddr is a DNS server address.
 //
-// While currently minimal, ServerAddr is designed as a pointer type to
-// allow for future extensions of server-specific properties (e.g., custom
-// headers for DoH) without requiring breaking API changes.
+// Besides the protocol and the address, ServerAddr contains the optional
+// server-specific settings, including the HTTP method for DoH, the
+// DNSCrypt and ODoH parameters, the bootstrap settings, the TLS settings
+// (i.e., SNI, ALPN, and SPKI pins), and the TSIG key for verifying responses.
+// Transport-wide settings, such as the client certificates, belong to the
+// [*Transport] instead.
+//
+// The [*ConnPool] and the [*QUICSessionCache] use the pointer to identify
+// the server, so reuse the same [*ServerAddr] to reuse connections, and do
+// not modify a [*ServerAddr] while it is in use.
 //
-// Construct using [NewServerAddr].
+// Construct using [NewServerAddr], [ParseServerAddr], or [ParseStamp].
 type ServerAddr struct {
 	// Protocol is the transport protocol to use.
 	//
@@ -52,17 +84,141 @@ type ServerAddr struct {
 	// - [ProtocolDoT]
 	// - [ProtocolDoH]
 	// - [ProtocolDoQ]
+	// - [ProtocolDoH3]
+	// - [ProtocolODoH]
+	// - [ProtocolDNSCrypt]
 	Protocol Protocol
 
 	// Address is the network address of the server.
 	//
-	// For [ProtocolUDP], [ProtocolTCP], and [ProtocolDoT] this is
-	// a string in the form returned by [net.JoinHostPort].
+	// For [ProtocolUDP], [ProtocolTCP], [ProtocolDoT], and [ProtocolDNSCrypt]
+	// this is a string in the form returned by [net.JoinHostPort].
 	//
-	// For [ProtocolDoH] this is a URL.
+	// For [ProtocolDoH] and [ProtocolDoH3] this is a URL.
+	//
+	// For [ProtocolODoH] this is the URL of the relay (aka proxy).
 	Address string
+
+	// HTTPMethod is the optional HTTP method to use with [ProtocolDoH]
+	// and [ProtocolDoH3].
+	//
+	// Use "POST" to send the query as the request body or "GET" to send
+	// the query as the base64url-encoded dns URL parameter, as specified
+	// by RFC 8484. An empty string is equivalent to "POST".
+	HTTPMethod string
+
+	// DNSCryptCert contains the optional serialized certificate of the
+	// resolver when using [ProtocolDNSCrypt]. If this field is nil, we
+	// fetch the certificate using [*Transport.FetchDNSCryptCert] before
+	// each query. In both cases, we verify the certificate.
+	DNSCryptCert []byte
+
+	// DNSCryptProviderKey is the Ed25519 public key of the provider
+	// used to verify the certificate when using [ProtocolDNSCrypt].
+	DNSCryptProviderKey ed25519.PublicKey
+
+	// DNSCryptProviderName is the name of the provider (e.g.,
+	// 2.dnscrypt-cert.example.com) when using [ProtocolDNSCrypt].
+	DNSCryptProviderName string
+
+	// ODoHConfigs contains the optional serialized ObliviousDoHConfigs
+	// of the target when using [ProtocolODoH]. If this field is nil, we
+	// fetch the configs using [*Transport.FetchODoHConfigs] before each query.
+	ODoHConfigs []byte
+
+	// ODoHTarget is the URL of the target resolver (e.g.,
+	// https://odoh.cloudflare-dns.com/dns-query) when using [ProtocolODoH].
+	//
+	// The relay forwards our encrypted queries to this target, which
+	// decrypts them. Therefore, the relay knows our IP address but not
+	// the queries, while the target knows the queries but not our address.
+	ODoHTarget string
+
+	// BootstrapIPs contains the optional IP addresses of the server
+	// for protocols where the Address contains a hostname (i.e., DoT,
+	// DoH, DoH3, DoQ, and the relay of ODoH).
+	//
+	// When this field is not empty, we dial these IP addresses in
+	// sequence, using the port in the Address, until we establish a
+	// connection, while we still use the hostname for SNI and for
+	// verifying the certificate. This allows to avoid leaking the
+	// hostname through the system resolver and to pin IP addresses.
+	//
+	// Bootstrapping only applies to the default dialers. When using
+	// the DialTLSContext, HTTPClient, or HTTPClientDo fields of the
+	// [*Transport], those are responsible for bootstrapping.
+	BootstrapIPs []netip.Addr
+
+	// BootstrapResolver is the optional [*Resolver] to resolve the
+	// hostname in the Address when BootstrapIPs is empty. If this field
+	// and BootstrapResolvers are both empty, we use the default dialer,
+	// which typically uses the system resolver.
+	BootstrapResolver *Resolver
+
+	// BootstrapResolvers contains the optional addresses of plaintext DNS
+	// resolvers to resolve the hostname in the Address over UDP, when both
+	// BootstrapIPs and BootstrapResolver are empty. This is how DNS stamps
+	// specify bootstrap resolvers (see [ParseStamp]).
+	BootstrapResolvers []netip.AddrPort
+
+	// TLSServerName optionally overrides the SNI for protocols using TLS
+	// (i.e., DoT, DoH, DoH3, DoQ, and the relay of ODoH). If this field is
+	// empty, we use the hostname in the Address. When this field is set,
+	// we also verify the certificate using this name.
+	TLSServerName string
+
+	// TLSOmitServerName optionally causes us not to send the SNI. In such
+	// a case, we still verify the certificate using the hostname in the
+	// Address. This field takes precedence over TLSServerName.
+	TLSOmitServerName bool
+
+	// TLSNextProtos optionally overrides the ALPN. If this field is nil, we
+	// use the protocol defaults (e.g., "dot" for DoT and "doq" for DoQ).
+	TLSNextProtos []string
+
+	// SPKIHashes contains the optional SHA-256 hashes of the SubjectPublicKeyInfo
+	// of certificates in the server's certificate chain, as found in DNS stamps
+	// (see [ParseStamp]). When this field is not empty, at least a certificate
+	// in the chain must match one of these hashes.
+	SPKIHashes [][]byte
+
+	// SPKIHashesOnly optionally causes the SPKIHashes to replace the verification
+	// of the certificate using the root CAs. If this field is false, we require
+	// both a valid certificate and a matching hash.
+	SPKIHashesOnly bool
+
+	// LogTLSCertificates optionally causes us to include the certificate
+	// chain presented by the server, as a list of DER-encoded certificates,
+	// into the tlsPeerCertificates field of the dnsResponse log event.
+	LogTLSCertificates bool
+
+	// TSIGKey is the optional key shared with the server for verifying the
+	// TSIG signature of the responses to queries signed using [QueryOptionTSIG].
+	// When this field is not nil and the query is signed, the [*Transport]
+	// fails with [ErrTSIGBadSig], [ErrTSIGBadKey], or [ErrTSIGBadTime] unless
+	// the response is correctly signed using this key.
+	TSIGKey *TSIGKey
+
+	// Props contains the properties advertised by the server, as found
+	// in DNS stamps (see [ParseStamp]).
+	Props ServerProps
 }
 
+// ServerProps contains the properties advertised by a server.
+type ServerProps uint64
+
+const (
+	// ServerPropDNSSEC indicates that the server validates DNSSEC.
+	ServerPropDNSSEC = ServerProps(1 << 0)
+
+	// ServerPropNoLog indicates that the server does not keep logs.
+	ServerPropNoLog = ServerProps(1 << 1)
+
+	// ServerPropNoFilter indicates that the server does not filter
+	// or block domains on its own.
+	ServerPropNoFilter = ServerProps(1 << 2)
+)
+
 // NewServerAddr constructs a new [*ServerAddr] with the given protocol and address.
 func NewServerAddr(protocol Protocol, address string) *ServerAddr {
 	return &ServerAddr{
@@ -70,3 +226,183 @@ func NewServerAddr(protocol Protocol, address string) *ServerAddr {
 		Address:  address,
 	}
 }
+
+// withProtocol returns a copy of the [*ServerAddr] using the given protocol,
+// which preserves the other settings (e.g., the TSIG key and the bootstrap
+// settings) when falling back from DNS over UDP to DNS over TCP.
+func (a *ServerAddr) withProtocol(protocol Protocol) *ServerAddr {
+	addrCopy := *a
+	addrCopy.Protocol = protocol
+	return &addrCopy
+}
+
+// ErrInvalidServerAddr indicates that a server address URI is invalid.
+var ErrInvalidServerAddr = errors.New("invalid server address")
+
+// serverAddrScheme describes a URI scheme accepted by [ParseServerAddr].
+type serverAddrScheme struct {
+	// protocol is the corresponding protocol.
+	protocol Protocol
+
+	// port is the default port.
+	port string
+}
+
+// serverAddrSchemes maps URI schemes to protocols and default ports.
+var serverAddrSchemes = map[string]serverAddrScheme{
+	"udp":   {ProtocolUDP, "53"},
+	"tcp":   {ProtocolTCP, "53"},
+	"tls":   {ProtocolDoT, "853"},
+	"https": {ProtocolDoH, "443"},
+	"h3":    {ProtocolDoH3, "443"},
+	"quic":  {ProtocolDoQ, "853"},
+}
+
+// serverAddrProtocolSchemes maps protocols back to URI schemes.
+var serverAddrProtocolSchemes = map[Protocol]string{
+	ProtocolUDP:  "udp",
+	ProtocolTCP:  "tcp",
+	ProtocolDoT:  "tls",
+	ProtocolDoH:  "https",
+	ProtocolDoH3: "h3",
+	ProtocolDoQ:  "quic",
+}
+
+// serverAddrDefaultPath is the default URL path for DoH and DoH3.
+const serverAddrDefaultPath = "/dns-query"
+
+// ParseServerAddr parses a URI describing a DNS server (e.g., tls://1.1.1.1:853
+// or quic://dns.adguard.com) and returns the corresponding [*ServerAddr].
+//
+// We support the following schemes:
+//
+// - udp:// for [ProtocolUDP] (default port: 53)
+// - tcp:// for [ProtocolTCP] (default port: 53)
+// - tls:// for [ProtocolDoT] (default port: 853)
+// - https:// for [ProtocolDoH] (default port: 443, default path: /dns-query)
+// - h3:// for [ProtocolDoH3] (default port: 443, default path: /dns-query)
+// - quic:// for [ProtocolDoQ] (default port: 853)
+// - sdns:// for DNS stamps (see [ParseStamp])
+//
+// A URI without a scheme (e.g., 8.8.8.8) is equivalent to a udp:// URI. The
+// host must be an IP address or a valid domain name. Only https:// and h3://
+// URIs may contain a path and a query string.
+//
+// Use [*ServerAddr.String] to obtain the canonical URI.
+func ParseServerAddr(uri string) (*ServerAddr, error) {
+	// 1. delegate parsing DNS stamps to the stamps parser
+	if strings.HasPrefix(uri, stampScheme) {
+		return ParseStamp(uri)
+	}
+
+	// 2. parse the URI, which defaults to using the udp:// scheme
+	if !strings.Contains(uri, "://") {
+		uri = "udp://" + uri
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidServerAddr, err.Error())
+	}
+	scheme, found := serverAddrSchemes[strings.ToLower(parsed.Scheme)]
+	if !found {
+		return nil, fmt.Errorf("%w: unsupported scheme %q", ErrInvalidServerAddr, parsed.Scheme)
+	}
+	if parsed.User != nil || parsed.Fragment != "" {
+		return nil, fmt.Errorf("%w: unexpected user info or fragment", ErrInvalidServerAddr)
+	}
+
+	// 3. validate the host and the port
+	host, port := parsed.Hostname(), parsed.Port()
+	if _, err := netip.ParseAddr(host); err != nil {
+		if _, ok := dns.IsDomainName(host); !ok || host == "" || strings.Contains(host, ":") {
+			return nil, fmt.Errorf("%w: invalid host %q", ErrInvalidServerAddr, host)
+		}
+	}
+	if port == "" {
+		port = scheme.port
+	}
+	if value, err := strconv.ParseUint(port, 10, 16); err != nil || value == 0 {
+		return nil, fmt.Errorf("%w: invalid port %q", ErrInvalidServerAddr, port)
+	}
+
+	// 4. build the address depending on the protocol
+	switch scheme.protocol {
+	case ProtocolDoH, ProtocolDoH3:
+		URL := &url.URL{
+			Scheme:   "https",
+			Host:     joinServerAddrHostPort(host, port, scheme.port),
+			Path:     parsed.Path,
+			RawPath:  parsed.RawPath,
+			RawQuery: parsed.RawQuery,
+		}
+		if URL.Path == "" {
+			URL.Path = serverAddrDefaultPath
+		}
+		return NewServerAddr(scheme.protocol, URL.String()), nil
+
+	default:
+		if (parsed.Path != "" && parsed.Path != "/") || parsed.RawQuery != "" || parsed.ForceQuery {
+			return nil, fmt.Errorf("%w: unexpected path or query", ErrInvalidServerAddr)
+		}
+		return NewServerAddr(scheme.protocol, net.JoinHostPort(host, port)), nil
+	}
+}
+
+// String returns the canonical URI of the server address, which omits
+// default ports and paths, and which [ParseServerAddr] can parse.
+//
+// For [ProtocolDNSCrypt] we return the DNS stamp (see [FormatStamp]). For
+// protocols without a URI representation (e.g., [ProtocolODoH]) or invalid
+// addresses we return the protocol followed by a space and the address.
+func (a *ServerAddr) String() string {
+	if uri, ok := a.uri(); ok {
+		return uri
+	}
+	if a.Protocol == ProtocolDNSCrypt {
+		if stamp, err := FormatStamp(a); err == nil {
+			return stamp
+		}
+	}
+	return fmt.Sprintf("%s %s", a.Protocol, a.Address)
+}
+
+// uri returns the canonical URI of the server address, if possible.
+func (a *ServerAddr) uri() (string, bool) {
+	scheme, found := serverAddrProtocolSchemes[a.Protocol]
+	if !found {
+		return "", false
+	}
+	defaultPort := serverAddrSchemes[scheme].port
+	switch a.Protocol {
+	case ProtocolDoH, ProtocolDoH3:
+		URL, err := url.Parse(a.Address)
+		if err != nil || URL.Scheme != "https" || URL.Host == "" {
+			return "", false
+		}
+		URL.Scheme = scheme
+		URL.Host = joinServerAddrHostPort(URL.Hostname(), URL.Port(), defaultPort)
+		if URL.Path == serverAddrDefaultPath && URL.RawQuery == "" {
+			URL.Path, URL.RawPath = "", ""
+		}
+		return URL.String(), true
+
+	default:
+		host, port, err := net.SplitHostPort(a.Address)
+		if err != nil {
+			return "", false
+		}
+		return scheme + "://" + joinServerAddrHostPort(host, port, defaultPort), true
+	}
+}
+
+// joinServerAddrHostPort joins host and port omitting the port
+// when it is empty or equal to the default port.
+func joinServerAddrHostPort(host, port, defaultPort string) string {
+	if port != "" && port != defaultPort {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
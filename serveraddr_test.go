@@ -2,7 +2,11 @@
 
 package dnscore
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func TestNewServerAddr(t *testing.T) {
 	protocol := ProtocolUDP
@@ -17,3 +21,173 @@ func TestNewServerAddr(t *testing.T) {
 		t.Errorf("Expected address %s, got %s", address, serverAddr.Address)
 	}
 }
+
+func TestParseServerAddr(t *testing.T) {
+	tests := []struct {
+		name            string
+		uri             string
+		expectErr       error
+		expectProtocol  Protocol
+		expectAddress   string
+		expectCanonical string
+	}{{
+		name:            "UDP with default port",
+		uri:             "udp://8.8.8.8",
+		expectProtocol:  ProtocolUDP,
+		expectAddress:   "8.8.8.8:53",
+		expectCanonical: "udp://8.8.8.8",
+	}, {
+		name:            "without scheme",
+		uri:             "8.8.8.8:5353",
+		expectProtocol:  ProtocolUDP,
+		expectAddress:   "8.8.8.8:5353",
+		expectCanonical: "udp://8.8.8.8:5353",
+	}, {
+		name:            "TCP with IPv6 address",
+		uri:             "tcp://[2001:4860:4860::8888]:53",
+		expectProtocol:  ProtocolTCP,
+		expectAddress:   "[2001:4860:4860::8888]:53",
+		expectCanonical: "tcp://[2001:4860:4860::8888]",
+	}, {
+		name:            "TLS with explicit default port",
+		uri:             "tls://1.1.1.1:853",
+		expectProtocol:  ProtocolDoT,
+		expectAddress:   "1.1.1.1:853",
+		expectCanonical: "tls://1.1.1.1",
+	}, {
+		name:            "TLS with uppercase scheme and trailing slash",
+		uri:             "TLS://dns.google/",
+		expectProtocol:  ProtocolDoT,
+		expectAddress:   "dns.google:853",
+		expectCanonical: "tls://dns.google",
+	}, {
+		name:            "HTTPS with default path",
+		uri:             "https://dns.google",
+		expectProtocol:  ProtocolDoH,
+		expectAddress:   "https://dns.google/dns-query",
+		expectCanonical: "https://dns.google",
+	}, {
+		name:            "HTTPS with custom port, path, and query",
+		uri:             "https://dns.example.com:8443/resolve?ct=1",
+		expectProtocol:  ProtocolDoH,
+		expectAddress:   "https://dns.example.com:8443/resolve?ct=1",
+		expectCanonical: "https://dns.example.com:8443/resolve?ct=1",
+	}, {
+		name:            "HTTP/3 with explicit default port",
+		uri:             "h3://dns.google:443/dns-query",
+		expectProtocol:  ProtocolDoH3,
+		expectAddress:   "https://dns.google/dns-query",
+		expectCanonical: "h3://dns.google",
+	}, {
+		name:            "QUIC with default port",
+		uri:             "quic://dns.adguard.com",
+		expectProtocol:  ProtocolDoQ,
+		expectAddress:   "dns.adguard.com:853",
+		expectCanonical: "quic://dns.adguard.com",
+	}, {
+		name:            "DNS stamp",
+		uri:             "sdns://AgcAAAAAAAAAAAAHOS45LjkuOQovZG5zLXF1ZXJ5",
+		expectProtocol:  ProtocolDoH,
+		expectAddress:   "https://9.9.9.9/dns-query",
+		expectCanonical: "https://9.9.9.9",
+	}, {
+		name:      "unsupported scheme",
+		uri:       "ftp://8.8.8.8",
+		expectErr: ErrInvalidServerAddr,
+	}, {
+		name:      "invalid URI",
+		uri:       "udp://8.8.8.8:53:53",
+		expectErr: ErrInvalidServerAddr,
+	}, {
+		name:      "empty host",
+		uri:       "tls://:853",
+		expectErr: ErrInvalidServerAddr,
+	}, {
+		name:      "invalid host",
+		uri:       "udp://dns..google",
+		expectErr: ErrInvalidServerAddr,
+	}, {
+		name:      "invalid port",
+		uri:       "udp://8.8.8.8:0",
+		expectErr: ErrInvalidServerAddr,
+	}, {
+		name:      "port out of range",
+		uri:       "udp://8.8.8.8:65536",
+		expectErr: ErrInvalidServerAddr,
+	}, {
+		name:      "user info",
+		uri:       "https://user@dns.google/dns-query",
+		expectErr: ErrInvalidServerAddr,
+	}, {
+		name:      "path with TLS",
+		uri:       "tls://dns.google/dns-query",
+		expectErr: ErrInvalidServerAddr,
+	}, {
+		name:      "invalid stamp",
+		uri:       "sdns://!!",
+		expectErr: ErrInvalidStamp,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := ParseServerAddr(tt.uri)
+			assert.ErrorIs(t, err, tt.expectErr)
+			if tt.expectErr != nil {
+				assert.Nil(t, addr)
+				return
+			}
+			assert.Equal(t, tt.expectProtocol, addr.Protocol)
+			assert.Equal(t, tt.expectAddress, addr.Address)
+			assert.Equal(t, tt.expectCanonical, addr.String())
+
+			// make sure the canonical URI round trips
+			again, err := ParseServerAddr(addr.String())
+			assert.NoError(t, err)
+			assert.Equal(t, addr.Protocol, again.Protocol)
+			assert.Equal(t, addr.Address, again.Address)
+		})
+	}
+}
+
+func TestServerAddr_String(t *testing.T) {
+	tests := []struct {
+		name   string
+		addr   *ServerAddr
+		expect string
+	}{{
+		name:   "UDP with custom port",
+		addr:   NewServerAddr(ProtocolUDP, "8.8.8.8:5353"),
+		expect: "udp://8.8.8.8:5353",
+	}, {
+		name:   "DoH with custom path",
+		addr:   NewServerAddr(ProtocolDoH, "https://dns.google:443/resolve"),
+		expect: "https://dns.google/resolve",
+	}, {
+		name: "DNSCrypt",
+		addr: &ServerAddr{
+			Protocol:             ProtocolDNSCrypt,
+			Address:              "1.2.3.4:443",
+			DNSCryptProviderKey:  make([]byte, 32),
+			DNSCryptProviderName: "2.dnscrypt-cert.example.com",
+		},
+		expect: "sdns://AQAAAAAAAAAABzEuMi4zLjQgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAbMi5kbnNjcnlwdC1jZXJ0LmV4YW1wbGUuY29t",
+	}, {
+		name:   "ODoH",
+		addr:   NewServerAddr(ProtocolODoH, "https://relay.example.com/proxy"),
+		expect: "odoh https://relay.example.com/proxy",
+	}, {
+		name:   "invalid address",
+		addr:   NewServerAddr(ProtocolDoT, "dns.google"),
+		expect: "dot dns.google",
+	}, {
+		name:   "invalid URL",
+		addr:   NewServerAddr(ProtocolDoH, "http://dns.google/dns-query"),
+		expect: "doh http://dns.google/dns-query",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, tt.addr.String())
+		})
+	}
+}
@@ -4,10 +4,12 @@ package dnscore
 
 import (
 	"context"
+	"crypto/tls"
 	"log/slog"
 	"net/netip"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/rbmk-project/common/netipx"
 )
 
@@ -16,17 +18,28 @@ var addrToAddrPort = netipx.AddrToAddrPort
 
 // protocolMap maps the DNS protocol to the corresponding network protocol.
 var protocolMap = map[Protocol]string{
-	ProtocolDoH: "tcp",
-	ProtocolTCP: "tcp",
-	ProtocolDoT: "tcp",
-	ProtocolUDP: "udp",
-	ProtocolDoQ: "udp",
+	ProtocolDoH:      "tcp",
+	ProtocolTCP:      "tcp",
+	ProtocolDoT:      "tcp",
+	ProtocolUDP:      "udp",
+	ProtocolDoQ:      "udp",
+	ProtocolDoH3:     "udp",
+	ProtocolODoH:     "tcp",
+	ProtocolDNSCrypt: "udp",
 }
 
 // maybeLogQuery is a helper function that logs the query if the logger is set
 // and returns the current time for subsequent logging.
 func (t *Transport) maybeLogQuery(
 	ctx context.Context, addr *ServerAddr, rawQuery []byte) time.Time {
+	return t.maybeLogQueryNetwork(ctx, addr, protocolMap[addr.Protocol], rawQuery)
+}
+
+// maybeLogQueryNetwork is like [*Transport.maybeLogQuery] but allows to
+// specify the network protocol, which is useful for DNSCrypt, which
+// uses UDP and falls back to TCP for truncated responses.
+func (t *Transport) maybeLogQueryNetwork(ctx context.Context,
+	addr *ServerAddr, network string, rawQuery []byte) time.Time {
 	t0 := t.timeNow()
 	if t.Logger != nil {
 		t.Logger.InfoContext(
@@ -36,16 +49,28 @@ func (t *Transport) maybeLogQuery(
 			slog.String("serverAddr", addr.Address),
 			slog.String("serverProtocol", string(addr.Protocol)),
 			slog.Time("t", t0),
-			slog.String("protocol", protocolMap[addr.Protocol]),
+			slog.String("protocol", network),
 		)
 	}
 	return t0
 }
 
 // maybeLogResponseAddrPort is a helper function that logs the response if the logger is set.
+//
+// The state is the TLS connection state, if any, which we use to log the
+// certificate chain presented by the server when LogTLSCertificates is true.
 func (t *Transport) maybeLogResponseAddrPort(ctx context.Context,
 	addr *ServerAddr, t0 time.Time, rawQuery, rawResp []byte,
-	laddr, raddr netip.AddrPort) {
+	laddr, raddr netip.AddrPort, state *tls.ConnectionState) {
+	t.maybeLogResponseAddrPortNetwork(ctx, addr,
+		protocolMap[addr.Protocol], t0, rawQuery, rawResp, laddr, raddr, state)
+}
+
+// maybeLogResponseAddrPortNetwork is like [*Transport.maybeLogResponseAddrPort]
+// but allows to specify the network protocol.
+func (t *Transport) maybeLogResponseAddrPortNetwork(ctx context.Context,
+	addr *ServerAddr, network string, t0 time.Time, rawQuery, rawResp []byte,
+	laddr, raddr netip.AddrPort, state *tls.ConnectionState) {
 	if t.Logger != nil {
 		// Convert zero values to unspecified
 		if !laddr.IsValid() {
@@ -55,9 +80,7 @@ func (t *Transport) maybeLogResponseAddrPort(ctx context.Context,
 			raddr = netip.AddrPortFrom(netip.IPv6Unspecified(), 0)
 		}
 
-		t.Logger.InfoContext(
-			ctx,
-			"dnsResponse",
+		attrs := []any{
 			slog.String("localAddr", laddr.String()),
 			slog.Any("dnsRawQuery", rawQuery),
 			slog.Any("dnsRawResponse", rawResp),
@@ -66,16 +89,38 @@ func (t *Transport) maybeLogResponseAddrPort(ctx context.Context,
 			slog.String("serverProtocol", string(addr.Protocol)),
 			slog.Time("t0", t0),
 			slog.Time("t", t.timeNow()),
-			slog.String("protocol", protocolMap[addr.Protocol]),
-		)
+			slog.String("protocol", network),
+		}
+
+		// Possibly include the certificate chain presented by the server
+		if addr.LogTLSCertificates && state != nil {
+			certs := make([][]byte, 0, len(state.PeerCertificates))
+			for _, cert := range state.PeerCertificates {
+				certs = append(certs, cert.Raw)
+			}
+			attrs = append(attrs, slog.Any("tlsPeerCertificates", certs))
+		}
+
+		t.Logger.InfoContext(ctx, "dnsResponse", attrs...)
 	}
 }
 
+// tlsConnectionStater is implemented by connections, such as [*tls.Conn],
+// that expose the state of the TLS connection.
+type tlsConnectionStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
 // maybeLogResponseConn is a helper function that logs the response if the logger is set.
 func (t *Transport) maybeLogResponseConn(ctx context.Context,
 	addr *ServerAddr, t0 time.Time, rawQuery, rawResp []byte,
 	conn dnsStream) {
 	if t.Logger != nil {
+		var state *tls.ConnectionState
+		if stater, ok := conn.(tlsConnectionStater); ok {
+			cs := stater.ConnectionState()
+			state = &cs
+		}
 		t.maybeLogResponseAddrPort(
 			ctx,
 			addr,
@@ -84,6 +129,124 @@ func (t *Transport) maybeLogResponseConn(ctx context.Context,
 			rawResp,
 			addrToAddrPort(conn.LocalAddr()),
 			addrToAddrPort(conn.RemoteAddr()),
+			state,
+		)
+	}
+}
+
+// maybeLogODoHQuery is a helper function that logs the encrypted
+// ObliviousDoHMessage containing the query if the logger is set.
+func (t *Transport) maybeLogODoHQuery(ctx context.Context,
+	addr *ServerAddr, t0 time.Time, rawQuery, odohQuery []byte) {
+	if t.Logger != nil {
+		t.Logger.InfoContext(
+			ctx,
+			"odohQuery",
+			slog.Any("dnsRawQuery", rawQuery),
+			slog.Any("odohRawQuery", odohQuery),
+			slog.String("odohTarget", addr.ODoHTarget),
+			slog.String("serverAddr", addr.Address),
+			slog.String("serverProtocol", string(addr.Protocol)),
+			slog.Time("t0", t0),
+			slog.Time("t", t.timeNow()),
+		)
+	}
+}
+
+// maybeLogODoHResponse is a helper function that logs the encrypted
+// ObliviousDoHMessage containing the response if the logger is set.
+func (t *Transport) maybeLogODoHResponse(ctx context.Context,
+	addr *ServerAddr, t0 time.Time, odohQuery, odohResp, rawResp []byte) {
+	if t.Logger != nil {
+		t.Logger.InfoContext(
+			ctx,
+			"odohResponse",
+			slog.Any("dnsRawResponse", rawResp),
+			slog.Any("odohRawQuery", odohQuery),
+			slog.Any("odohRawResponse", odohResp),
+			slog.String("odohTarget", addr.ODoHTarget),
+			slog.String("serverAddr", addr.Address),
+			slog.String("serverProtocol", string(addr.Protocol)),
+			slog.Time("t0", t0),
+			slog.Time("t", t.timeNow()),
+		)
+	}
+}
+
+// maybeLogFallback is a helper function that logs that we are retrying
+// a query using another server address if the logger is set.
+func (t *Transport) maybeLogFallback(ctx context.Context,
+	addr, fallbackAddr *ServerAddr, reason string) {
+	maybeLogFallback(ctx, t.Logger, addr, fallbackAddr, reason, t.timeNow())
+}
+
+// maybeLogFallbackNetwork is like [*Transport.maybeLogFallback] but for
+// retrying using the same server address and another network protocol,
+// which is useful for DNSCrypt, which falls back from UDP to TCP.
+func (t *Transport) maybeLogFallbackNetwork(ctx context.Context,
+	addr *ServerAddr, network, fallbackNetwork, reason string) {
+	maybeLogFallback(ctx, t.Logger, addr, addr, reason, t.timeNow(),
+		slog.String("fallbackProtocol", fallbackNetwork),
+		slog.String("protocol", network),
+	)
+}
+
+// maybeLogFallbackQuery is like [*Transport.maybeLogFallback] but for
+// retrying using the same server address and another query type, which
+// is useful for zone transfers, which fall back from IXFR to AXFR.
+func (t *Transport) maybeLogFallbackQuery(ctx context.Context,
+	addr *ServerAddr, qtype, fallbackQtype uint16, reason string) {
+	maybeLogFallback(ctx, t.Logger, addr, addr, reason, t.timeNow(),
+		slog.String("fallbackQueryType", dns.TypeToString[fallbackQtype]),
+		slog.String("queryType", dns.TypeToString[qtype]),
+	)
+}
+
+// maybeLogFallback is like [*Transport.maybeLogFallback] but allows
+// to specify the logger, which is useful for the [*Resolver], and
+// additional attributes describing what changes when falling back.
+func maybeLogFallback(ctx context.Context, logger *slog.Logger,
+	addr, fallbackAddr *ServerAddr, reason string, now time.Time, attrs ...slog.Attr) {
+	if logger != nil {
+		args := []any{
+			slog.String("fallbackServerAddr", fallbackAddr.Address),
+			slog.String("fallbackServerProtocol", string(fallbackAddr.Protocol)),
+			slog.String("reason", reason),
+			slog.String("serverAddr", addr.Address),
+			slog.String("serverProtocol", string(addr.Protocol)),
+			slog.Time("t", now),
+		}
+		for _, attr := range attrs {
+			args = append(args, attr)
+		}
+		logger.InfoContext(ctx, "dnsFallback", args...)
+	}
+}
+
+// transportTimeNow returns the current time using the TimeNow field of the
+// given transport, when it is a [*Transport], such that the events logged by
+// resolvers use the same time source as the events logged by the transport.
+func transportTimeNow(txp ResolverTransport) time.Time {
+	if t, ok := txp.(*Transport); ok {
+		return t.timeNow()
+	}
+	return time.Now()
+}
+
+// maybeLogCoalesce is a helper function that logs that a caller joined
+// (dnsLookupCoalesced) or stopped waiting for (dnsLookupAbandoned) a
+// lookup shared with other callers if the logger is set. The waiters
+// argument is the number of callers waiting for the lookup result.
+func maybeLogCoalesce(ctx context.Context, logger *slog.Logger,
+	event string, key cacheKey, waiters int, now time.Time) {
+	if logger != nil {
+		logger.InfoContext(
+			ctx,
+			event,
+			slog.String("dnsLookupDomain", key.name),
+			slog.String("dnsLookupType", dns.TypeToString[key.qtype]),
+			slog.Int("waiters", waiters),
+			slog.Time("t", now),
 		)
 	}
 }
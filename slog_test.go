@@ -12,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/rbmk-project/common/mocks"
 	"github.com/stretchr/testify/assert"
 )
@@ -146,6 +147,7 @@ func TestTransport_maybeLogResponseAddrPort(t *testing.T) {
 				rawResponse,
 				tt.laddr,
 				tt.raddr,
+				nil,
 			)
 
 			actualLog := out.String()
@@ -252,3 +254,88 @@ func TestTransport_maybeLogResponseConn(t *testing.T) {
 		})
 	}
 }
+
+func TestTransport_maybeLogFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		newLogger func(w io.Writer) *slog.Logger
+		expectLog string
+	}{
+		{
+			name: "Logger set",
+			newLogger: func(w io.Writer) *slog.Logger {
+				return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+					Level: slog.LevelDebug,
+					ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+						if attr.Key == slog.TimeKey {
+							return slog.Attr{}
+						}
+						return attr
+					},
+				}))
+			},
+			expectLog: "{\"level\":\"INFO\",\"msg\":\"dnsFallback\",\"fallbackServerAddr\":\"8.8.8.8:53\",\"fallbackServerProtocol\":\"tcp\",\"reason\":\"truncated\",\"serverAddr\":\"8.8.8.8:53\",\"serverProtocol\":\"udp\",\"t\":\"2020-01-01T00:00:00Z\"}\n",
+		},
+
+		{
+			name:      "Logger not set",
+			newLogger: func(w io.Writer) *slog.Logger { return nil },
+			expectLog: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			transport := &Transport{
+				Logger: tt.newLogger(&out),
+				TimeNow: func() time.Time {
+					return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+				},
+			}
+			addr := NewServerAddr(ProtocolUDP, "8.8.8.8:53")
+			fallbackAddr := NewServerAddr(ProtocolTCP, "8.8.8.8:53")
+			transport.maybeLogFallback(context.Background(), addr, fallbackAddr, "truncated")
+			assert.Equal(t, tt.expectLog, out.String())
+		})
+	}
+}
+
+func TestTransport_maybeLogFallbackSameAddr(t *testing.T) {
+	newTransport := func(w io.Writer) *Transport {
+		return &Transport{
+			Logger: slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+				ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+					if attr.Key == slog.TimeKey {
+						return slog.Attr{}
+					}
+					return attr
+				},
+			})),
+			TimeNow: func() time.Time {
+				return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			},
+		}
+	}
+
+	t.Run("network", func(t *testing.T) {
+		var out bytes.Buffer
+		addr := NewServerAddr(ProtocolDNSCrypt, "8.8.8.8:443")
+		newTransport(&out).maybeLogFallbackNetwork(context.Background(), addr, "udp", "tcp", "truncated")
+		assert.Equal(t, "{\"level\":\"INFO\",\"msg\":\"dnsFallback\",\"fallbackServerAddr\":\"8.8.8.8:443\",\"fallbackServerProtocol\":\"dnscrypt\",\"reason\":\"truncated\",\"serverAddr\":\"8.8.8.8:443\",\"serverProtocol\":\"dnscrypt\",\"t\":\"2020-01-01T00:00:00Z\",\"fallbackProtocol\":\"tcp\",\"protocol\":\"udp\"}\n", out.String())
+	})
+
+	t.Run("query type", func(t *testing.T) {
+		var out bytes.Buffer
+		addr := NewServerAddr(ProtocolTCP, "8.8.8.8:53")
+		newTransport(&out).maybeLogFallbackQuery(context.Background(), addr, dns.TypeIXFR, dns.TypeAXFR, "ixfr-not-supported")
+		assert.Equal(t, "{\"level\":\"INFO\",\"msg\":\"dnsFallback\",\"fallbackServerAddr\":\"8.8.8.8:53\",\"fallbackServerProtocol\":\"tcp\",\"reason\":\"ixfr-not-supported\",\"serverAddr\":\"8.8.8.8:53\",\"serverProtocol\":\"tcp\",\"t\":\"2020-01-01T00:00:00Z\",\"fallbackQueryType\":\"AXFR\",\"queryType\":\"IXFR\"}\n", out.String())
+	})
+}
+
+func Test_transportTimeNow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	txp := &Transport{TimeNow: func() time.Time { return now }}
+	assert.Equal(t, now, transportTimeNow(txp))
+	assert.WithinDuration(t, time.Now(), transportTimeNow(&dnssecTestServer{}), time.Minute)
+}
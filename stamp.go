@@ -0,0 +1,656 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// DNS stamps.
+//
+// See https://dnscrypt.info/stamps-specifications
+//
+
+package dnscore
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Constants defined by the DNS stamps specification.
+const (
+	// stampScheme is the URI scheme of DNS stamps.
+	stampScheme = "sdns://"
+
+	// stampTypePlain is the stamp type of plaintext DNS.
+	stampTypePlain = 0x00
+
+	// stampTypeDNSCrypt is the stamp type of DNSCrypt.
+	stampTypeDNSCrypt = 0x01
+
+	// stampTypeDoH is the stamp type of DNS-over-HTTPS.
+	stampTypeDoH = 0x02
+
+	// stampTypeDoT is the stamp type of DNS-over-TLS.
+	stampTypeDoT = 0x03
+
+	// stampTypeDoQ is the stamp type of DNS-over-QUIC.
+	stampTypeDoQ = 0x04
+
+	// stampTypeODoHTarget is the stamp type of Oblivious DoH targets.
+	stampTypeODoHTarget = 0x05
+
+	// stampTypeDNSCryptRelay is the stamp type of Anonymized DNSCrypt relays.
+	stampTypeDNSCryptRelay = 0x81
+
+	// stampTypeODoHRelay is the stamp type of Oblivious DoH relays.
+	stampTypeODoHRelay = 0x85
+
+	// stampMoreFlag is the flag marking all but the last element
+	// of a variable length prefixed set.
+	stampMoreFlag = 0x80
+)
+
+var (
+	// ErrInvalidStamp indicates that a DNS stamp is malformed.
+	ErrInvalidStamp = errors.New("invalid DNS stamp")
+
+	// ErrUnsupportedStamp indicates that we do not support a DNS stamp type
+	// or that we cannot represent a [*ServerAddr] as a DNS stamp.
+	ErrUnsupportedStamp = errors.New("unsupported DNS stamp")
+)
+
+// ParseStamp parses a DNS stamp (e.g., sdns://AgcAAAAAAAAAAAAHOS45LjkuOQovZG5zLXF1ZXJ5)
+// and returns the corresponding [*ServerAddr].
+//
+// We support stamps for plaintext DNS (mapped to [ProtocolUDP]), DNSCrypt,
+// DoH, DoT, DoQ, and ODoH. The optional IP address of the server goes into
+// the BootstrapIPs field, the bootstrap resolvers into the BootstrapResolvers
+// field, and the certificate hashes into the SPKIHashes field.
+//
+// An ODoH target stamp only sets the ODoHTarget field, while an ODoH relay
+// stamp only sets the Address field. Use [ParseODoHStamps] to obtain a
+// [*ServerAddr] suitable for querying a target through a relay.
+func ParseStamp(stamp string) (*ServerAddr, error) {
+	// 1. decode the base64url payload following the scheme
+	payload, found := strings.CutPrefix(stamp, stampScheme)
+	if !found {
+		return nil, fmt.Errorf("%w: missing %s prefix", ErrInvalidStamp, stampScheme)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidStamp, err.Error())
+	}
+
+	// 2. dispatch on the stamp type
+	input := cryptobyte.String(data)
+	var stampType uint8
+	if !input.ReadUint8(&stampType) {
+		return nil, fmt.Errorf("%w: missing stamp type", ErrInvalidStamp)
+	}
+	var addr *ServerAddr
+	switch stampType {
+	case stampTypePlain:
+		addr, err = parseStampPlain(&input)
+	case stampTypeDNSCrypt:
+		addr, err = parseStampDNSCrypt(&input)
+	case stampTypeDoH:
+		addr, err = parseStampHTTPS(&input, ProtocolDoH)
+	case stampTypeDoT:
+		addr, err = parseStampTLS(&input, ProtocolDoT)
+	case stampTypeDoQ:
+		addr, err = parseStampTLS(&input, ProtocolDoQ)
+	case stampTypeODoHTarget:
+		addr, err = parseStampODoHTarget(&input)
+	case stampTypeODoHRelay:
+		addr, err = parseStampHTTPS(&input, ProtocolODoH)
+	case stampTypeDNSCryptRelay:
+		return nil, fmt.Errorf("%w: anonymized DNSCrypt relay", ErrUnsupportedStamp)
+	default:
+		return nil, fmt.Errorf("%w: stamp type %#02x", ErrUnsupportedStamp, stampType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. make sure there is no trailing garbage
+	if !input.Empty() {
+		return nil, fmt.Errorf("%w: trailing garbage", ErrInvalidStamp)
+	}
+	return addr, nil
+}
+
+// ParseODoHStamps parses an ODoH target stamp and an ODoH relay stamp and
+// returns a [*ServerAddr] for querying the target through the relay.
+//
+// The Props field contains the properties of the target, while the other
+// fields (e.g., BootstrapIPs) refer to the relay, which is the server we
+// actually connect to.
+func ParseODoHStamps(targetStamp, relayStamp string) (*ServerAddr, error) {
+	target, err := ParseStamp(targetStamp)
+	if err != nil {
+		return nil, err
+	}
+	if target.Protocol != ProtocolODoH || target.ODoHTarget == "" {
+		return nil, fmt.Errorf("%w: not an ODoH target stamp", ErrInvalidStamp)
+	}
+	relay, err := ParseStamp(relayStamp)
+	if err != nil {
+		return nil, err
+	}
+	if relay.Protocol != ProtocolODoH || relay.Address == "" {
+		return nil, fmt.Errorf("%w: not an ODoH relay stamp", ErrInvalidStamp)
+	}
+	relay.ODoHTarget = target.ODoHTarget
+	relay.Props = target.Props
+	return relay, nil
+}
+
+// parseStampPlain parses the fields of a plaintext DNS stamp.
+func parseStampPlain(input *cryptobyte.String) (*ServerAddr, error) {
+	var (
+		props ServerProps
+		addr  string
+	)
+	if !readStampProps(input, &props) || !readStampString(input, &addr) {
+		return nil, fmt.Errorf("%w: truncated plain DNS stamp", ErrInvalidStamp)
+	}
+	address, err := parseStampIPAddr(addr, "53")
+	if err != nil {
+		return nil, err
+	}
+	return &ServerAddr{Protocol: ProtocolUDP, Address: address, Props: props}, nil
+}
+
+// parseStampDNSCrypt parses the fields of a DNSCrypt stamp.
+func parseStampDNSCrypt(input *cryptobyte.String) (*ServerAddr, error) {
+	var (
+		props        ServerProps
+		addr         string
+		providerKey  []byte
+		providerName string
+	)
+	if !readStampProps(input, &props) || !readStampString(input, &addr) ||
+		!readStampBytes(input, &providerKey) || !readStampString(input, &providerName) {
+		return nil, fmt.Errorf("%w: truncated DNSCrypt stamp", ErrInvalidStamp)
+	}
+	address, err := parseStampIPAddr(addr, "443")
+	if err != nil {
+		return nil, err
+	}
+	if len(providerKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: invalid provider public key length", ErrInvalidStamp)
+	}
+	if providerName == "" {
+		return nil, fmt.Errorf("%w: empty provider name", ErrInvalidStamp)
+	}
+	return &ServerAddr{
+		Protocol:             ProtocolDNSCrypt,
+		Address:              address,
+		DNSCryptProviderKey:  ed25519.PublicKey(providerKey),
+		DNSCryptProviderName: providerName,
+		Props:                props,
+	}, nil
+}
+
+// parseStampHTTPS parses the fields of a DoH or ODoH relay stamp.
+func parseStampHTTPS(input *cryptobyte.String, protocol Protocol) (*ServerAddr, error) {
+	// 1. read the fields, where the bootstrap resolvers are optional
+	var (
+		props    ServerProps
+		addr     string
+		hashes   [][]byte
+		hostname string
+		path     string
+	)
+	if !readStampProps(input, &props) || !readStampString(input, &addr) ||
+		!readStampBytesSet(input, &hashes) || !readStampString(input, &hostname) ||
+		!readStampString(input, &path) {
+		return nil, fmt.Errorf("%w: truncated %s stamp", ErrInvalidStamp, protocol)
+	}
+	addrIP, addrPort, err := splitStampAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. build the URL, using the port in addr if the hostname lacks one
+	host, port, err := splitStampAddr(hostname)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("%w: invalid hostname %q", ErrInvalidStamp, hostname)
+	}
+	if port == "" {
+		port = addrPort
+	}
+	if port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("%w: invalid path %q", ErrInvalidStamp, path)
+	}
+	URL := "https://" + host + path
+	if _, err := url.Parse(URL); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidStamp, err.Error())
+	}
+
+	// 3. fill the server address
+	serverAddr := &ServerAddr{Protocol: protocol, Address: URL, Props: props}
+	if err := fillStampBootstrap(input, serverAddr, addrIP, hashes); err != nil {
+		return nil, err
+	}
+	return serverAddr, nil
+}
+
+// parseStampTLS parses the fields of a DoT or DoQ stamp.
+func parseStampTLS(input *cryptobyte.String, protocol Protocol) (*ServerAddr, error) {
+	// 1. read the fields, where the bootstrap resolvers are optional
+	var (
+		props    ServerProps
+		addr     string
+		hashes   [][]byte
+		hostname string
+	)
+	if !readStampProps(input, &props) || !readStampString(input, &addr) ||
+		!readStampBytesSet(input, &hashes) || !readStampString(input, &hostname) {
+		return nil, fmt.Errorf("%w: truncated %s stamp", ErrInvalidStamp, protocol)
+	}
+	addrIP, addrPort, err := splitStampAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. build the address, falling back to the IP address if the hostname is empty
+	host, port, err := splitStampAddr(hostname)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid hostname %q", ErrInvalidStamp, hostname)
+	}
+	if host == "" {
+		if addrIP == "" {
+			return nil, fmt.Errorf("%w: missing hostname and address", ErrInvalidStamp)
+		}
+		host = addrIP
+	}
+	if port == "" {
+		port = addrPort
+	}
+	if port == "" {
+		port = "853"
+	}
+
+	// 3. fill the server address
+	serverAddr := &ServerAddr{Protocol: protocol, Address: net.JoinHostPort(host, port), Props: props}
+	if err := fillStampBootstrap(input, serverAddr, addrIP, hashes); err != nil {
+		return nil, err
+	}
+	return serverAddr, nil
+}
+
+// parseStampODoHTarget parses the fields of an ODoH target stamp.
+func parseStampODoHTarget(input *cryptobyte.String) (*ServerAddr, error) {
+	var (
+		props    ServerProps
+		hostname string
+		path     string
+	)
+	if !readStampProps(input, &props) || !readStampString(input, &hostname) ||
+		!readStampString(input, &path) {
+		return nil, fmt.Errorf("%w: truncated ODoH target stamp", ErrInvalidStamp)
+	}
+	if hostname == "" || !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("%w: invalid ODoH target", ErrInvalidStamp)
+	}
+	URL := "https://" + hostname + path
+	if _, err := url.Parse(URL); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidStamp, err.Error())
+	}
+	return &ServerAddr{Protocol: ProtocolODoH, ODoHTarget: URL, Props: props}, nil
+}
+
+// fillStampBootstrap fills the BootstrapIPs, SPKIHashes, and BootstrapResolvers
+// fields of the given [*ServerAddr], reading the optional bootstrap resolvers
+// from the given input.
+func fillStampBootstrap(input *cryptobyte.String, serverAddr *ServerAddr, addrIP string, hashes [][]byte) error {
+	// 1. the IP address of the server is optional
+	if addrIP != "" {
+		ip, err := netip.ParseAddr(addrIP)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidStamp, err.Error())
+		}
+		serverAddr.BootstrapIPs = []netip.Addr{ip}
+	}
+
+	// 2. the hashes must be SHA-256 hashes
+	for _, hash := range hashes {
+		if len(hash) != sha256.Size {
+			return fmt.Errorf("%w: invalid hash length", ErrInvalidStamp)
+		}
+		serverAddr.SPKIHashes = append(serverAddr.SPKIHashes, hash)
+	}
+
+	// 3. the bootstrap resolvers are optional
+	if input.Empty() {
+		return nil
+	}
+	var resolvers [][]byte
+	if !readStampBytesSet(input, &resolvers) {
+		return fmt.Errorf("%w: truncated bootstrap resolvers", ErrInvalidStamp)
+	}
+	for _, resolver := range resolvers {
+		address, err := parseStampIPAddr(string(resolver), "53")
+		if err != nil {
+			return err
+		}
+		serverAddr.BootstrapResolvers = append(
+			serverAddr.BootstrapResolvers, netip.MustParseAddrPort(address))
+	}
+	return nil
+}
+
+// splitStampAddr splits an address inside a stamp into host and port,
+// where both the host and the port are optional.
+//
+// The address may be a hostname or an IP address, possibly followed by a port,
+// with IPv6 addresses enclosed in square brackets when followed by a port.
+func splitStampAddr(addr string) (host, port string, err error) {
+	switch {
+	case addr == "":
+		return "", "", nil
+	case strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]"):
+		return addr[1 : len(addr)-1], "", nil
+	case strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "["):
+		return addr, "", nil
+	case !strings.Contains(addr, ":"):
+		return addr, "", nil
+	}
+	host, port, err = net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %s", ErrInvalidStamp, err.Error())
+	}
+	return host, port, nil
+}
+
+// parseStampIPAddr parses an IP address, possibly followed by a port, inside
+// a stamp and returns the corresponding address in the form returned by
+// [net.JoinHostPort], using the given default port if needed.
+func parseStampIPAddr(addr, defaultPort string) (string, error) {
+	host, port, err := splitStampAddr(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := netip.ParseAddr(host); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidStamp, err.Error())
+	}
+	if port == "" {
+		port = defaultPort
+	}
+	address := net.JoinHostPort(host, port)
+	if _, err := netip.ParseAddrPort(address); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidStamp, err.Error())
+	}
+	return address, nil
+}
+
+// readStampProps reads the little-endian properties of a stamp.
+func readStampProps(input *cryptobyte.String, props *ServerProps) bool {
+	var raw []byte
+	if !input.ReadBytes(&raw, 8) {
+		return false
+	}
+	*props = ServerProps(binary.LittleEndian.Uint64(raw))
+	return true
+}
+
+// readStampBytes reads a length prefixed byte slice.
+func readStampBytes(input *cryptobyte.String, out *[]byte) bool {
+	var value cryptobyte.String
+	if !input.ReadUint8LengthPrefixed(&value) {
+		return false
+	}
+	*out = []byte(value)
+	return true
+}
+
+// readStampString reads a length prefixed string.
+func readStampString(input *cryptobyte.String, out *string) bool {
+	var value []byte
+	if !readStampBytes(input, &value) {
+		return false
+	}
+	*out = string(value)
+	return true
+}
+
+// readStampBytesSet reads a variable length prefixed set, skipping
+// empty elements (an empty set is encoded as a single empty element).
+func readStampBytesSet(input *cryptobyte.String, out *[][]byte) bool {
+	for {
+		var length uint8
+		if !input.ReadUint8(&length) {
+			return false
+		}
+		var value []byte
+		if !input.ReadBytes(&value, int(length&^stampMoreFlag)) {
+			return false
+		}
+		if len(value) > 0 {
+			*out = append(*out, value)
+		}
+		if length&stampMoreFlag == 0 {
+			return true
+		}
+	}
+}
+
+// FormatStamp serializes the given [*ServerAddr] as a DNS stamp.
+//
+// This function is the inverse of [ParseStamp]. Because DNS stamps
+// have no notion of the transport protocol, [ProtocolTCP] becomes a
+// plaintext DNS stamp. We only include the first IP address in the
+// BootstrapIPs field, since DNS stamps support a single server address.
+// There is no stamp type for [ProtocolDoH3].
+//
+// For [ProtocolODoH], this function returns the target stamp built
+// from the ODoHTarget field. Use [FormatODoHRelayStamp] to obtain
+// the relay stamp.
+func FormatStamp(addr *ServerAddr) (string, error) {
+	builder := cryptobyte.NewBuilder(nil)
+	switch addr.Protocol {
+	case ProtocolUDP, ProtocolTCP:
+		address, err := formatStampIPAddr(addr.Address, "53")
+		if err != nil {
+			return "", err
+		}
+		builder.AddUint8(stampTypePlain)
+		addStampProps(builder, addr.Props)
+		addStampString(builder, address)
+
+	case ProtocolDNSCrypt:
+		address, err := formatStampIPAddr(addr.Address, "443")
+		if err != nil {
+			return "", err
+		}
+		builder.AddUint8(stampTypeDNSCrypt)
+		addStampProps(builder, addr.Props)
+		addStampString(builder, address)
+		addStampString(builder, string(addr.DNSCryptProviderKey))
+		addStampString(builder, addr.DNSCryptProviderName)
+
+	case ProtocolDoH:
+		if err := formatStampHTTPS(builder, stampTypeDoH, addr, addr.Address); err != nil {
+			return "", err
+		}
+
+	case ProtocolDoT, ProtocolDoQ:
+		host, port, err := net.SplitHostPort(addr.Address)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", ErrUnsupportedStamp, err.Error())
+		}
+		hostname := host
+		if port != "853" {
+			hostname = net.JoinHostPort(host, port)
+		}
+		stampType := uint8(stampTypeDoT)
+		if addr.Protocol == ProtocolDoQ {
+			stampType = stampTypeDoQ
+		}
+		builder.AddUint8(stampType)
+		addStampProps(builder, addr.Props)
+		addStampString(builder, formatStampBootstrapIP(addr))
+		addStampBytesSet(builder, addr.SPKIHashes)
+		addStampString(builder, hostname)
+		addStampBootstrapResolvers(builder, addr)
+
+	case ProtocolODoH:
+		hostname, path, err := splitStampURL(addr.ODoHTarget)
+		if err != nil {
+			return "", err
+		}
+		builder.AddUint8(stampTypeODoHTarget)
+		addStampProps(builder, addr.Props)
+		addStampString(builder, hostname)
+		addStampString(builder, path)
+
+	default:
+		return "", fmt.Errorf("%w: protocol %s", ErrUnsupportedStamp, addr.Protocol)
+	}
+	return encodeStamp(builder)
+}
+
+// FormatODoHRelayStamp serializes the relay of the given [*ServerAddr]
+// using [ProtocolODoH] as an ODoH relay stamp.
+func FormatODoHRelayStamp(addr *ServerAddr) (string, error) {
+	if addr.Protocol != ProtocolODoH {
+		return "", fmt.Errorf("%w: protocol %s", ErrUnsupportedStamp, addr.Protocol)
+	}
+	builder := cryptobyte.NewBuilder(nil)
+	if err := formatStampHTTPS(builder, stampTypeODoHRelay, addr, addr.Address); err != nil {
+		return "", err
+	}
+	return encodeStamp(builder)
+}
+
+// encodeStamp returns the stamp containing the content of the builder.
+func encodeStamp(builder *cryptobyte.Builder) (string, error) {
+	data, err := builder.Bytes()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedStamp, err.Error())
+	}
+	return stampScheme + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// formatStampHTTPS serializes a DoH or ODoH relay stamp for the given URL.
+func formatStampHTTPS(builder *cryptobyte.Builder, stampType uint8, addr *ServerAddr, URL string) error {
+	hostname, path, err := splitStampURL(URL)
+	if err != nil {
+		return err
+	}
+	builder.AddUint8(stampType)
+	addStampProps(builder, addr.Props)
+	addStampString(builder, formatStampBootstrapIP(addr))
+	addStampBytesSet(builder, addr.SPKIHashes)
+	addStampString(builder, hostname)
+	addStampString(builder, path)
+	addStampBootstrapResolvers(builder, addr)
+	return nil
+}
+
+// splitStampURL splits an HTTPS URL into the hostname (including the
+// port unless it is the default port) and path of a stamp.
+func splitStampURL(URL string) (hostname, path string, err error) {
+	parsed, err := url.Parse(URL)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %s", ErrUnsupportedStamp, err.Error())
+	}
+	if parsed.Scheme != "https" || parsed.Host == "" {
+		return "", "", fmt.Errorf("%w: invalid URL %q", ErrUnsupportedStamp, URL)
+	}
+	hostname = parsed.Host
+	if parsed.Port() == "443" {
+		hostname = strings.TrimSuffix(hostname, ":443")
+	}
+	if strings.HasPrefix(hostname, "[") && strings.HasSuffix(hostname, "]") {
+		hostname = hostname[1 : len(hostname)-1]
+	}
+	return hostname, parsed.RequestURI(), nil
+}
+
+// formatStampIPAddr converts an address in the form returned by
+// [net.JoinHostPort] to the stamp format, omitting the default port.
+func formatStampIPAddr(address, defaultPort string) (string, error) {
+	addrport, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedStamp, err.Error())
+	}
+	return formatStampAddrPort(addrport, defaultPort), nil
+}
+
+// formatStampAddrPort converts an [netip.AddrPort] to the stamp
+// format, omitting the default port.
+func formatStampAddrPort(addrport netip.AddrPort, defaultPort string) string {
+	if strconv.Itoa(int(addrport.Port())) == defaultPort {
+		return addrport.Addr().String()
+	}
+	return addrport.String()
+}
+
+// formatStampBootstrapIP returns the first IP address in BootstrapIPs
+// or an empty string if there are no bootstrap IP addresses.
+func formatStampBootstrapIP(addr *ServerAddr) string {
+	if len(addr.BootstrapIPs) <= 0 {
+		return ""
+	}
+	return addr.BootstrapIPs[0].String()
+}
+
+// addStampBootstrapResolvers adds the optional bootstrap resolvers.
+func addStampBootstrapResolvers(builder *cryptobyte.Builder, addr *ServerAddr) {
+	if len(addr.BootstrapResolvers) <= 0 {
+		return
+	}
+	var resolvers [][]byte
+	for _, resolver := range addr.BootstrapResolvers {
+		resolvers = append(resolvers, []byte(formatStampAddrPort(resolver, "53")))
+	}
+	addStampBytesSet(builder, resolvers)
+}
+
+// addStampProps adds the little-endian properties of a stamp.
+func addStampProps(builder *cryptobyte.Builder, props ServerProps) {
+	builder.AddBytes(binary.LittleEndian.AppendUint64(nil, uint64(props)))
+}
+
+// addStampString adds a length prefixed string.
+func addStampString(builder *cryptobyte.Builder, value string) {
+	builder.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(value))
+	})
+}
+
+// addStampBytesSet adds a variable length prefixed set, encoding
+// an empty set as a single empty element.
+func addStampBytesSet(builder *cryptobyte.Builder, values [][]byte) {
+	if len(values) <= 0 {
+		builder.AddUint8(0)
+		return
+	}
+	for idx, value := range values {
+		if len(value) >= stampMoreFlag {
+			builder.SetError(errors.New("set element too long"))
+			return
+		}
+		length := uint8(len(value))
+		if idx < len(values)-1 {
+			length |= stampMoreFlag
+		}
+		builder.AddUint8(length)
+		builder.AddBytes(value)
+	}
+}
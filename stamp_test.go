@@ -0,0 +1,298 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestStamp returns a stamp with the given type, little-endian props,
+// and raw fields (which must already include their length prefixes).
+func newTestStamp(stampType byte, props byte, fields ...[]byte) string {
+	data := []byte{stampType, props, 0, 0, 0, 0, 0, 0, 0}
+	for _, field := range fields {
+		data = append(data, field...)
+	}
+	return stampScheme + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// lp returns the length prefixed encoding of the given string.
+func lp(value string) []byte {
+	return append([]byte{byte(len(value))}, value...)
+}
+
+func TestParseStamp(t *testing.T) {
+	providerKey := ed25519.PublicKey(bytes.Repeat([]byte{0x11}, ed25519.PublicKeySize))
+	hash := bytes.Repeat([]byte{0x22}, 32)
+
+	tests := []struct {
+		name      string
+		stamp     string
+		expectErr error
+		expect    *ServerAddr
+	}{{
+		name:  "Quad9 DoH",
+		stamp: "sdns://AgcAAAAAAAAAAAAHOS45LjkuOQovZG5zLXF1ZXJ5",
+		expect: &ServerAddr{
+			Protocol: ProtocolDoH,
+			Address:  "https://9.9.9.9/dns-query",
+			Props:    ServerPropDNSSEC | ServerPropNoLog | ServerPropNoFilter,
+		},
+	}, {
+		name:  "plain DNS with default port",
+		stamp: newTestStamp(stampTypePlain, 0x01, lp("8.8.8.8")),
+		expect: &ServerAddr{
+			Protocol: ProtocolUDP,
+			Address:  "8.8.8.8:53",
+			Props:    ServerPropDNSSEC,
+		},
+	}, {
+		name:  "plain DNS with IPv6 address and custom port",
+		stamp: newTestStamp(stampTypePlain, 0x00, lp("[2001:db8::1]:5353")),
+		expect: &ServerAddr{
+			Protocol: ProtocolUDP,
+			Address:  "[2001:db8::1]:5353",
+		},
+	}, {
+		name:  "DNSCrypt",
+		stamp: newTestStamp(stampTypeDNSCrypt, 0x02, lp("1.2.3.4"), lp(string(providerKey)), lp("2.dnscrypt-cert.example.com")),
+		expect: &ServerAddr{
+			Protocol:             ProtocolDNSCrypt,
+			Address:              "1.2.3.4:443",
+			DNSCryptProviderKey:  providerKey,
+			DNSCryptProviderName: "2.dnscrypt-cert.example.com",
+			Props:                ServerPropNoLog,
+		},
+	}, {
+		name: "DoH with bootstrap IP, hashes and bootstrap resolvers",
+		stamp: newTestStamp(stampTypeDoH, 0x00, lp("1.1.1.1"), append([]byte{0x80}, lp(string(hash))...),
+			lp("dns.example.com:8443"), lp("/dns-query"), []byte{0x87}, []byte("8.8.8.8"), lp("[::1]:5353")),
+		expect: &ServerAddr{
+			Protocol:           ProtocolDoH,
+			Address:            "https://dns.example.com:8443/dns-query",
+			BootstrapIPs:       []netip.Addr{netip.MustParseAddr("1.1.1.1")},
+			BootstrapResolvers: []netip.AddrPort{netip.MustParseAddrPort("8.8.8.8:53"), netip.MustParseAddrPort("[::1]:5353")},
+			SPKIHashes:         [][]byte{hash},
+		},
+	}, {
+		name:  "DoT with default port",
+		stamp: newTestStamp(stampTypeDoT, 0x00, lp(""), []byte{0x00}, lp("dns.example.com")),
+		expect: &ServerAddr{
+			Protocol: ProtocolDoT,
+			Address:  "dns.example.com:853",
+		},
+	}, {
+		name:  "DoQ using the IP address as hostname",
+		stamp: newTestStamp(stampTypeDoQ, 0x00, lp("[2001:db8::1]:8853"), []byte{0x00}, lp("")),
+		expect: &ServerAddr{
+			Protocol:     ProtocolDoQ,
+			Address:      "[2001:db8::1]:8853",
+			BootstrapIPs: []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+		},
+	}, {
+		name:  "ODoH target",
+		stamp: newTestStamp(stampTypeODoHTarget, 0x04, lp("odoh.example.com"), lp("/dns-query")),
+		expect: &ServerAddr{
+			Protocol:   ProtocolODoH,
+			ODoHTarget: "https://odoh.example.com/dns-query",
+			Props:      ServerPropNoFilter,
+		},
+	}, {
+		name:  "ODoH relay",
+		stamp: newTestStamp(stampTypeODoHRelay, 0x00, lp(""), []byte{0x00}, lp("relay.example.com"), lp("/proxy")),
+		expect: &ServerAddr{
+			Protocol: ProtocolODoH,
+			Address:  "https://relay.example.com/proxy",
+		},
+	}, {
+		name:      "missing scheme",
+		stamp:     "AgcAAAAAAAAAAAAHOS45LjkuOQovZG5zLXF1ZXJ5",
+		expectErr: ErrInvalidStamp,
+	}, {
+		name:      "invalid base64",
+		stamp:     "sdns://!!",
+		expectErr: ErrInvalidStamp,
+	}, {
+		name:      "empty stamp",
+		stamp:     stampScheme,
+		expectErr: ErrInvalidStamp,
+	}, {
+		name:      "unknown stamp type",
+		stamp:     newTestStamp(0x42, 0x00),
+		expectErr: ErrUnsupportedStamp,
+	}, {
+		name:      "anonymized DNSCrypt relay",
+		stamp:     stampScheme + base64.RawURLEncoding.EncodeToString(append([]byte{stampTypeDNSCryptRelay}, lp("1.2.3.4")...)),
+		expectErr: ErrUnsupportedStamp,
+	}, {
+		name:      "truncated stamp",
+		stamp:     newTestStamp(stampTypeDoT, 0x00, lp("")),
+		expectErr: ErrInvalidStamp,
+	}, {
+		name:      "trailing garbage",
+		stamp:     newTestStamp(stampTypePlain, 0x00, lp("8.8.8.8"), []byte{0x00}),
+		expectErr: ErrInvalidStamp,
+	}, {
+		name:      "plain DNS with hostname",
+		stamp:     newTestStamp(stampTypePlain, 0x00, lp("dns.google")),
+		expectErr: ErrInvalidStamp,
+	}, {
+		name:      "DNSCrypt with invalid provider key",
+		stamp:     newTestStamp(stampTypeDNSCrypt, 0x00, lp("1.2.3.4"), lp("abc"), lp("2.dnscrypt-cert.example.com")),
+		expectErr: ErrInvalidStamp,
+	}, {
+		name:      "DoH with invalid hash length",
+		stamp:     newTestStamp(stampTypeDoH, 0x00, lp(""), lp("abc"), lp("dns.example.com"), lp("/dns-query")),
+		expectErr: ErrInvalidStamp,
+	}, {
+		name:      "DoH with invalid path",
+		stamp:     newTestStamp(stampTypeDoH, 0x00, lp(""), []byte{0x00}, lp("dns.example.com"), lp("dns-query")),
+		expectErr: ErrInvalidStamp,
+	}, {
+		name:      "DoT without hostname and address",
+		stamp:     newTestStamp(stampTypeDoT, 0x00, lp(""), []byte{0x00}, lp("")),
+		expectErr: ErrInvalidStamp,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := ParseStamp(tt.stamp)
+			assert.ErrorIs(t, err, tt.expectErr)
+			assert.Equal(t, tt.expect, addr)
+		})
+	}
+}
+
+func TestParseODoHStamps(t *testing.T) {
+	target := newTestStamp(stampTypeODoHTarget, 0x01, lp("odoh.example.com"), lp("/dns-query"))
+	relay := newTestStamp(stampTypeODoHRelay, 0x00, lp("1.2.3.4"), []byte{0x00}, lp("relay.example.com"), lp("/proxy"))
+
+	t.Run("success", func(t *testing.T) {
+		addr, err := ParseODoHStamps(target, relay)
+		assert.NoError(t, err)
+		assert.Equal(t, &ServerAddr{
+			Protocol:     ProtocolODoH,
+			Address:      "https://relay.example.com/proxy",
+			ODoHTarget:   "https://odoh.example.com/dns-query",
+			BootstrapIPs: []netip.Addr{netip.MustParseAddr("1.2.3.4")},
+			Props:        ServerPropDNSSEC,
+		}, addr)
+	})
+
+	t.Run("swapped stamps", func(t *testing.T) {
+		_, err := ParseODoHStamps(relay, target)
+		assert.ErrorIs(t, err, ErrInvalidStamp)
+		_, err = ParseODoHStamps(target, target)
+		assert.ErrorIs(t, err, ErrInvalidStamp)
+	})
+}
+
+func TestFormatStamp(t *testing.T) {
+	hash := bytes.Repeat([]byte{0x22}, 32)
+
+	tests := []struct {
+		name      string
+		addr      *ServerAddr
+		expectErr error
+	}{{
+		name: "plain DNS",
+		addr: &ServerAddr{Protocol: ProtocolUDP, Address: "8.8.8.8:53", Props: ServerPropDNSSEC},
+	}, {
+		name: "plain DNS with IPv6 address and custom port",
+		addr: &ServerAddr{Protocol: ProtocolUDP, Address: "[2001:db8::1]:5353"},
+	}, {
+		name: "DNSCrypt",
+		addr: &ServerAddr{
+			Protocol:             ProtocolDNSCrypt,
+			Address:              "1.2.3.4:8443",
+			DNSCryptProviderKey:  ed25519.PublicKey(bytes.Repeat([]byte{0x11}, ed25519.PublicKeySize)),
+			DNSCryptProviderName: "2.dnscrypt-cert.example.com",
+		},
+	}, {
+		name: "DoH",
+		addr: &ServerAddr{
+			Protocol:           ProtocolDoH,
+			Address:            "https://dns.example.com/dns-query",
+			BootstrapIPs:       []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+			BootstrapResolvers: []netip.AddrPort{netip.MustParseAddrPort("8.8.8.8:53"), netip.MustParseAddrPort("[::1]:5353")},
+			SPKIHashes:         [][]byte{hash, hash},
+			Props:              ServerPropNoLog,
+		},
+	}, {
+		name: "DoT with custom port",
+		addr: &ServerAddr{Protocol: ProtocolDoT, Address: "dns.example.com:8853", SPKIHashes: [][]byte{hash}},
+	}, {
+		name: "DoQ with IPv6 address",
+		addr: &ServerAddr{Protocol: ProtocolDoQ, Address: "[2001:db8::1]:853"},
+	}, {
+		name: "ODoH target",
+		addr: &ServerAddr{Protocol: ProtocolODoH, ODoHTarget: "https://odoh.example.com/dns-query"},
+	}, {
+		name:      "DoH3",
+		addr:      &ServerAddr{Protocol: ProtocolDoH3, Address: "https://dns.example.com/dns-query"},
+		expectErr: ErrUnsupportedStamp,
+	}, {
+		name:      "plain DNS with hostname",
+		addr:      &ServerAddr{Protocol: ProtocolUDP, Address: "dns.google:53"},
+		expectErr: ErrUnsupportedStamp,
+	}, {
+		name:      "DoH with plaintext URL",
+		addr:      &ServerAddr{Protocol: ProtocolDoH, Address: "http://dns.example.com/dns-query"},
+		expectErr: ErrUnsupportedStamp,
+	}, {
+		name:      "DoT without port",
+		addr:      &ServerAddr{Protocol: ProtocolDoT, Address: "dns.example.com"},
+		expectErr: ErrUnsupportedStamp,
+	}, {
+		name:      "DoH with too long hash",
+		addr:      &ServerAddr{Protocol: ProtocolDoH, Address: "https://dns.example.com/dns-query", SPKIHashes: [][]byte{make([]byte, 128)}},
+		expectErr: ErrUnsupportedStamp,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stamp, err := FormatStamp(tt.addr)
+			assert.ErrorIs(t, err, tt.expectErr)
+			if tt.expectErr != nil {
+				return
+			}
+			addr, err := ParseStamp(stamp)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.addr, addr)
+		})
+	}
+
+	t.Run("canonical encoding", func(t *testing.T) {
+		const quad9 = "sdns://AgcAAAAAAAAAAAAHOS45LjkuOQovZG5zLXF1ZXJ5"
+		addr, err := ParseStamp(quad9)
+		assert.NoError(t, err)
+		stamp, err := FormatStamp(addr)
+		assert.NoError(t, err)
+		assert.Equal(t, quad9, stamp)
+	})
+}
+
+func TestFormatODoHRelayStamp(t *testing.T) {
+	addr := &ServerAddr{
+		Protocol:     ProtocolODoH,
+		Address:      "https://relay.example.com:8443/proxy",
+		ODoHTarget:   "https://odoh.example.com/dns-query",
+		BootstrapIPs: []netip.Addr{netip.MustParseAddr("1.2.3.4")},
+	}
+	target, err := FormatStamp(addr)
+	assert.NoError(t, err)
+	relay, err := FormatODoHRelayStamp(addr)
+	assert.NoError(t, err)
+	parsed, err := ParseODoHStamps(target, relay)
+	assert.NoError(t, err)
+	assert.Equal(t, addr, parsed)
+
+	_, err = FormatODoHRelayStamp(&ServerAddr{Protocol: ProtocolDoH, Address: "https://dns.example.com/"})
+	assert.ErrorIs(t, err, ErrUnsupportedStamp)
+}
@@ -0,0 +1,207 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// HTTPS and SVCB lookups.
+//
+// See https://datatracker.ietf.org/doc/html/rfc9460
+//
+
+package dnscore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// SVCBRecord is a decoded SVCB or HTTPS record.
+//
+// A zero Priority indicates AliasMode, where Target is the name to
+// query instead of the owner name and the parameters are empty. Otherwise,
+// the record is in ServiceMode and describes an alternative endpoint.
+type SVCBRecord struct {
+	// ALPN contains the supported ALPN protocol IDs (e.g., "h3").
+	ALPN []string
+
+	// ECHConfigList is the TLS Encrypted ClientHello config list.
+	ECHConfigList []byte
+
+	// IPv4Hint contains the IPv4 address hints.
+	IPv4Hint []netip.Addr
+
+	// IPv6Hint contains the IPv6 address hints.
+	IPv6Hint []netip.Addr
+
+	// NoDefaultALPN indicates that the default ALPN protocol
+	// of the scheme (e.g., "http/1.1") is not supported.
+	NoDefaultALPN bool
+
+	// Port is the alternative port or zero to use the default port.
+	Port uint16
+
+	// Priority is the priority, where lower values are preferred.
+	Priority uint16
+
+	// Target is the target name. In ServiceMode, we replace the "."
+	// target with the owner name, as specified by RFC 9460 Sect. 2.5.2.
+	// In AliasMode, the "." target means the service is not available.
+	Target string
+}
+
+// svcbSupportedKeys contains the keys we decode. Clients must ignore
+// ServiceMode records whose mandatory keys include other keys.
+var svcbSupportedKeys = []dns.SVCBKey{
+	dns.SVCB_MANDATORY,
+	dns.SVCB_ALPN,
+	dns.SVCB_NO_DEFAULT_ALPN,
+	dns.SVCB_PORT,
+	dns.SVCB_IPV4HINT,
+	dns.SVCB_ECHCONFIG,
+	dns.SVCB_IPV6HINT,
+}
+
+// newSVCBRecord decodes the given RR into a [*SVCBRecord] or returns false if
+// the RR is in ServiceMode and is incompatible according to RFC 9460 Sect. 8.
+func newSVCBRecord(rr *dns.SVCB) (*SVCBRecord, bool) {
+	// 1. handle AliasMode, where we must ignore the parameters
+	record := &SVCBRecord{Priority: rr.Priority, Target: rr.Target}
+	if rr.Priority == 0 {
+		return record, true
+	}
+
+	// 2. handle the ServiceMode "." target
+	if record.Target == "." {
+		record.Target = rr.Hdr.Name
+	}
+
+	// 3. decode the parameters
+	for _, kv := range rr.Value {
+		switch kv := kv.(type) {
+		case *dns.SVCBMandatory:
+			for _, key := range kv.Code {
+				if !slices.Contains(svcbSupportedKeys, key) {
+					return nil, false
+				}
+			}
+
+		case *dns.SVCBAlpn:
+			record.ALPN = slices.Clone(kv.Alpn)
+
+		case *dns.SVCBNoDefaultAlpn:
+			record.NoDefaultALPN = true
+
+		case *dns.SVCBPort:
+			record.Port = kv.Port
+
+		case *dns.SVCBIPv4Hint:
+			for _, ip := range kv.Hint {
+				if addr, ok := netip.AddrFromSlice(ip.To4()); ok {
+					record.IPv4Hint = append(record.IPv4Hint, addr)
+				}
+			}
+
+		case *dns.SVCBECHConfig:
+			record.ECHConfigList = slices.Clone(kv.ECH)
+
+		case *dns.SVCBIPv6Hint:
+			for _, ip := range kv.Hint {
+				if addr, ok := netip.AddrFromSlice(ip.To16()); ok {
+					record.IPv6Hint = append(record.IPv6Hint, addr)
+				}
+			}
+		}
+	}
+	return record, true
+}
+
+// svcbMaxAliases is the maximum number of AliasMode records we follow.
+const svcbMaxAliases = 8
+
+var (
+	// ErrSVCBAliasLoop indicates that AliasMode records form a loop.
+	ErrSVCBAliasLoop = errors.New("svcb: alias loop")
+
+	// ErrSVCBTooManyAliases indicates that we stopped following
+	// AliasMode records after reaching the maximum chain length.
+	ErrSVCBTooManyAliases = errors.New("svcb: too many aliases")
+)
+
+// LookupHTTPS returns the HTTPS records for the given name, following
+// AliasMode records and returning the ServiceMode records sorted by
+// priority, randomizing records with the same priority.
+//
+// For HTTPS origins using the default port, name is the host name. For
+// other ports, name is "_<port>._https.<host>" (see RFC 9460 Sect. 9.1).
+//
+// When the chain of AliasMode records ends with the "." target, meaning
+// the service is not available, we return an error wrapping [ErrNoData].
+// Like the [*net.Resolver] compatible methods, we return a [*net.DNSError]
+// wrapping the original error in case of failure.
+func (r *Resolver) LookupHTTPS(ctx context.Context, name string) ([]*SVCBRecord, error) {
+	return r.lookupSVCB(ctx, name, dns.TypeHTTPS, DecodeLookupHTTPS)
+}
+
+// LookupSVCB is like [*Resolver.LookupHTTPS] but for SVCB records, where
+// name is usually prefixed by the service and protocol labels, e.g.,
+// "_dns.resolver.arpa" for discovering designated resolvers (RFC 9462).
+func (r *Resolver) LookupSVCB(ctx context.Context, name string) ([]*SVCBRecord, error) {
+	return r.lookupSVCB(ctx, name, dns.TypeSVCB, DecodeLookupSVCB)
+}
+
+// lookupSVCB implements [*Resolver.LookupHTTPS] and [*Resolver.LookupSVCB].
+func (r *Resolver) lookupSVCB(ctx context.Context, name string, qtype uint16,
+	decode func(rrs []dns.RR) ([]*SVCBRecord, error)) ([]*SVCBRecord, error) {
+	seen := make(map[string]struct{})
+	for current, aliases := name, 0; ; aliases++ {
+		// 1. detect loops, which are possible with AliasMode records
+		key := dns.CanonicalName(current)
+		if _, found := seen[key]; found {
+			return nil, newDNSError(fmt.Errorf("%w: %s", ErrSVCBAliasLoop, current), name)
+		}
+		seen[key] = struct{}{}
+
+		// 2. obtain and decode the RRs
+		rrs, err := r.lookupRRs(ctx, current, qtype)
+		if err != nil {
+			return nil, err
+		}
+		records, err := decode(rrs)
+		if err != nil {
+			return nil, newDNSError(err, name)
+		}
+
+		// 3. when there is an AliasMode record, ignore the ServiceMode
+		// records and follow the alias, as required by RFC 9460 Sect. 2.4.2
+		idx := slices.IndexFunc(records, func(record *SVCBRecord) bool {
+			return record.Priority == 0
+		})
+		if idx < 0 {
+			svcbSort(records)
+			return records, nil
+		}
+		target := records[idx].Target
+		if target == "." {
+			return nil, newDNSError(fmt.Errorf("%w: service not available", ErrNoData), name)
+		}
+		if aliases >= svcbMaxAliases {
+			return nil, newDNSError(fmt.Errorf("%w: %s", ErrSVCBTooManyAliases, target), name)
+		}
+		current = target
+	}
+}
+
+// svcbSort sorts the records by priority, randomizing the
+// records with the same priority to spread the load.
+func svcbSort(records []*SVCBRecord) {
+	rand.Shuffle(len(records), func(i, j int) {
+		records[i], records[j] = records[j], records[i]
+	})
+	slices.SortStableFunc(records, func(a, b *SVCBRecord) int {
+		return int(a.Priority) - int(b.Priority)
+	})
+}
@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolver_LookupHTTPS(t *testing.T) {
+	reso := newNetResolverTestResolver(t,
+		`example.com. HTTPS 2 alt.example.net. alpn=h2`,
+		`example.com. HTTPS 1 . alpn="h3,h2" ech=AQID`,
+		`www.example.com. CNAME example.com.`,
+		`alias.example.com. HTTPS 0 example.com.`,
+		`alias.example.com. HTTPS 1 ignored.example.com.`,
+		`unavailable.example.com. HTTPS 0 .`,
+		`loop1.example.com. HTTPS 0 loop2.example.com.`,
+		`loop2.example.com. HTTPS 0 LOOP1.example.com.`,
+		`chain0.example.com. HTTPS 0 chain1.example.com.`,
+		`chain1.example.com. HTTPS 0 chain2.example.com.`,
+		`chain2.example.com. HTTPS 0 chain3.example.com.`,
+		`chain3.example.com. HTTPS 0 chain4.example.com.`,
+		`chain4.example.com. HTTPS 0 chain5.example.com.`,
+		`chain5.example.com. HTTPS 0 chain6.example.com.`,
+		`chain6.example.com. HTTPS 0 chain7.example.com.`,
+		`chain7.example.com. HTTPS 0 chain8.example.com.`,
+		`chain8.example.com. HTTPS 0 chain9.example.com.`,
+		`chain9.example.com. HTTPS 1 .`,
+		`noservice.example.com. A 192.0.2.1`,
+	)
+	ctx := context.Background()
+	expect := []*SVCBRecord{{
+		ALPN:          []string{"h3", "h2"},
+		ECHConfigList: []byte{1, 2, 3},
+		Priority:      1,
+		Target:        "example.com.",
+	}, {
+		ALPN:     []string{"h2"},
+		Priority: 2,
+		Target:   "alt.example.net.",
+	}}
+
+	t.Run("ServiceMode records sorted by priority", func(t *testing.T) {
+		records, err := reso.LookupHTTPS(ctx, "example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, expect, records)
+	})
+
+	t.Run("CNAME", func(t *testing.T) {
+		records, err := reso.LookupHTTPS(ctx, "www.example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, expect, records)
+	})
+
+	t.Run("AliasMode", func(t *testing.T) {
+		records, err := reso.LookupHTTPS(ctx, "alias.example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, expect, records)
+	})
+
+	t.Run("service not available", func(t *testing.T) {
+		_, err := reso.LookupHTTPS(ctx, "unavailable.example.com")
+		assertNotFound(t, err, ErrNoData)
+	})
+
+	t.Run("alias loop", func(t *testing.T) {
+		_, err := reso.LookupHTTPS(ctx, "loop1.example.com")
+		assert.ErrorIs(t, err, ErrSVCBAliasLoop)
+	})
+
+	t.Run("too many aliases", func(t *testing.T) {
+		_, err := reso.LookupHTTPS(ctx, "chain0.example.com")
+		assert.ErrorIs(t, err, ErrSVCBTooManyAliases)
+
+		records, err := reso.LookupHTTPS(ctx, "chain1.example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, []*SVCBRecord{{Priority: 1, Target: "chain9.example.com."}}, records)
+	})
+
+	t.Run("NODATA and NXDOMAIN", func(t *testing.T) {
+		_, err := reso.LookupHTTPS(ctx, "noservice.example.com")
+		assertNotFound(t, err, ErrNoData)
+
+		_, err = reso.LookupHTTPS(ctx, "nxdomain.example.com")
+		assertNotFound(t, err, ErrNoName)
+	})
+}
+
+func TestResolver_LookupSVCB(t *testing.T) {
+	reso := newNetResolverTestResolver(t,
+		`_dns.resolver.arpa. SVCB 2 dns.example.net. alpn=h2 port=443 ipv4hint=192.0.2.53`,
+		`_dns.resolver.arpa. SVCB 1 dns.example.net. alpn=dot port=853`,
+		`_dns.resolver.arpa. HTTPS 1 ignored.example.net.`,
+	)
+	records, err := reso.LookupSVCB(context.Background(), "_dns.resolver.arpa")
+	assert.NoError(t, err)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, []string{"dot"}, records[0].ALPN)
+		assert.Equal(t, uint16(853), records[0].Port)
+		assert.Equal(t, []string{"h2"}, records[1].ALPN)
+		assert.Equal(t, "192.0.2.53", records[1].IPv4Hint[0].String())
+	}
+}
+
+func Test_svcbSort(t *testing.T) {
+	records := []*SVCBRecord{
+		{Priority: 3, Target: "c."},
+		{Priority: 1, Target: "a."},
+		{Priority: 2, Target: "b1."},
+		{Priority: 2, Target: "b2."},
+	}
+	for range 16 {
+		svcbSort(records)
+		assert.Equal(t, "a.", records[0].Target)
+		assert.ElementsMatch(t, []string{"b1.", "b2."}, []string{records[1].Target, records[2].Target})
+		assert.Equal(t, "c.", records[3].Target)
+	}
+}
@@ -0,0 +1,152 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// Per-server TLS settings.
+//
+
+package dnscore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrSPKIHashMismatch indicates that no certificate in the chain
+// presented by the server matches the configured SPKI hashes.
+var ErrSPKIHashMismatch = errors.New("no certificate matches the SPKI hashes")
+
+// hasTLSSettings returns whether the server address customizes
+// the SNI, the ALPN, or the verification of the certificate.
+func (a *ServerAddr) hasTLSSettings() bool {
+	return a.TLSServerName != "" || a.TLSOmitServerName || a.TLSNextProtos != nil || len(a.SPKIHashes) > 0
+}
+
+// newTLSConfig returns the [*tls.Config] for connecting to the given hostname
+// using the given default ALPN. When the hostname is the hostname of the given
+// server address, we also apply the server address TLS settings.
+func (t *Transport) newTLSConfig(addr *ServerAddr, hostname string, nextProtos []string) *tls.Config {
+	// 1. Fill the default TLS config
+	config := &tls.Config{
+		Certificates: t.ClientCertificates,
+		NextProtos:   nextProtos,
+		RootCAs:      t.RootCAs,
+		ServerName:   hostname,
+	}
+	if !strings.EqualFold(hostname, addr.hostname()) {
+		return config
+	}
+
+	// 2. Possibly override the ALPN and the SNI
+	if addr.TLSNextProtos != nil {
+		config.NextProtos = addr.TLSNextProtos
+	}
+	verifyName := hostname
+	if addr.TLSServerName != "" {
+		config.ServerName = addr.TLSServerName
+		verifyName = addr.TLSServerName
+	}
+	if addr.TLSOmitServerName {
+		config.ServerName = ""
+	}
+
+	// 3. Verify the certificate ourselves when the stdlib cannot do that
+	if config.ServerName == "" || len(addr.SPKIHashes) > 0 {
+		config.InsecureSkipVerify = true // we verify in VerifyConnection
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return t.verifyTLSConnection(addr, verifyName, state)
+		}
+	}
+	return config
+}
+
+// verifyTLSConnection verifies the certificate chain presented by the server
+// using the given name, unless SPKIHashesOnly is true, and ensures that the
+// chain matches the SPKI hashes of the given server address, if any.
+func (t *Transport) verifyTLSConnection(addr *ServerAddr, name string, state tls.ConnectionState) error {
+	// 1. Make sure the server presented a certificate
+	if len(state.PeerCertificates) <= 0 {
+		return errors.New("tls: server did not present any certificate")
+	}
+
+	// 2. Unless the SPKI hashes replace the CAs, verify the chain
+	if !addr.SPKIHashesOnly || len(addr.SPKIHashes) <= 0 {
+		opts := x509.VerifyOptions{
+			DNSName:       name,
+			Intermediates: x509.NewCertPool(),
+			Roots:         t.RootCAs,
+		}
+		for _, cert := range state.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := state.PeerCertificates[0].Verify(opts); err != nil {
+			return err
+		}
+	}
+
+	// 3. Ensure that the chain matches the SPKI hashes, if any
+	if len(addr.SPKIHashes) > 0 && !matchSPKIHashes(state.PeerCertificates, addr.SPKIHashes) {
+		return ErrSPKIHashMismatch
+	}
+	return nil
+}
+
+// matchSPKIHashes returns whether any certificate in the chain matches any
+// of the given hashes. For compatibility with DNS stamps, which pin the
+// SHA-256 of the TBS certificate, we also accept such hashes.
+func matchSPKIHashes(chain []*x509.Certificate, hashes [][]byte) bool {
+	for _, cert := range chain {
+		spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		tbsHash := sha256.Sum256(cert.RawTBSCertificate)
+		for _, hash := range hashes {
+			if bytes.Equal(hash, spkiHash[:]) || bytes.Equal(hash, tbsHash[:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dialTLSWithConfig dials a TCP connection with the given address and
+// performs the TLS handshake using the given config. Unlike [*tls.Dialer],
+// we do not infer the SNI from the address when the ServerName is empty.
+func (t *Transport) dialTLSWithConfig(ctx context.Context,
+	network, address string, config *tls.Config) (net.Conn, error) {
+	conn, err := t.dialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialTLSAddr dials a TLS connection with the given address, applying the
+// bootstrap and TLS settings of the given server address and using the given
+// default ALPN.
+func (t *Transport) dialTLSAddr(ctx context.Context, addr *ServerAddr,
+	network, address string, nextProtos []string) (net.Conn, error) {
+	// 1. Obtain the endpoints to dial and the TLS config
+	hostname, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := t.bootstrapEndpoints(ctx, addr, address)
+	if err != nil {
+		return nil, err
+	}
+	config := t.newTLSConfig(addr, hostname, nextProtos)
+
+	// 2. Dial the endpoints in sequence
+	return dialEndpoints(ctx, endpoints, func(ctx context.Context, endpoint string) (net.Conn, error) {
+		return t.dialTLSWithConfig(ctx, network, endpoint, config)
+	})
+}
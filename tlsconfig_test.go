@@ -0,0 +1,275 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/rbmk-project/common/selfsignedcert"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTLSConfigTestCert returns a fresh self-signed certificate for
+// example.com along with a cert pool containing such a certificate.
+func newTLSConfigTestCert(t *testing.T) (*x509.Certificate, *x509.CertPool) {
+	cert := selfsignedcert.New(selfsignedcert.NewConfigExampleCom())
+	block, _ := pem.Decode(cert.CertPEM)
+	if block == nil {
+		t.Fatal("cannot decode PEM certificate")
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return parsed, pool
+}
+
+func TestServerAddr_hasTLSSettings(t *testing.T) {
+	tests := []struct {
+		name   string
+		addr   *ServerAddr
+		expect bool
+	}{
+		{name: "no settings", addr: &ServerAddr{}, expect: false},
+		{name: "server name", addr: &ServerAddr{TLSServerName: "dns.google"}, expect: true},
+		{name: "omit server name", addr: &ServerAddr{TLSOmitServerName: true}, expect: true},
+		{name: "next protos", addr: &ServerAddr{TLSNextProtos: []string{}}, expect: true},
+		{name: "SPKI hashes", addr: &ServerAddr{SPKIHashes: [][]byte{{0x01}}}, expect: true},
+		{name: "log certificates only", addr: &ServerAddr{LogTLSCertificates: true}, expect: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, tt.addr.hasTLSSettings())
+		})
+	}
+}
+
+func TestTransport_newTLSConfig(t *testing.T) {
+	tests := []struct {
+		name             string
+		addr             *ServerAddr
+		hostname         string
+		expectServerName string
+		expectNextProtos []string
+		expectCustom     bool
+	}{{
+		name:             "default settings",
+		addr:             NewServerAddr(ProtocolDoT, "dns.google:853"),
+		hostname:         "dns.google",
+		expectServerName: "dns.google",
+		expectNextProtos: []string{"dot"},
+		expectCustom:     false,
+	}, {
+		name: "custom server name and next protos",
+		addr: &ServerAddr{
+			Protocol:      ProtocolDoT,
+			Address:       "8.8.8.8:853",
+			TLSServerName: "dns.google",
+			TLSNextProtos: []string{"custom"},
+		},
+		hostname:         "8.8.8.8",
+		expectServerName: "dns.google",
+		expectNextProtos: []string{"custom"},
+		expectCustom:     false,
+	}, {
+		name: "omit server name",
+		addr: &ServerAddr{
+			Protocol:          ProtocolDoH,
+			Address:           "https://dns.google/dns-query",
+			TLSServerName:     "dns.google",
+			TLSOmitServerName: true,
+		},
+		hostname:         "dns.google",
+		expectServerName: "",
+		expectNextProtos: []string{"h2", "http/1.1"},
+		expectCustom:     true,
+	}, {
+		name: "SPKI hashes",
+		addr: &ServerAddr{
+			Protocol:   ProtocolDoQ,
+			Address:    "dns.adguard.com:853",
+			SPKIHashes: [][]byte{{0x01}},
+		},
+		hostname:         "dns.adguard.com",
+		expectServerName: "dns.adguard.com",
+		expectNextProtos: []string{"doq"},
+		expectCustom:     true,
+	}, {
+		name: "settings do not apply to other hostnames",
+		addr: &ServerAddr{
+			Protocol:          ProtocolODoH,
+			Address:           "https://relay.example.com/proxy",
+			TLSOmitServerName: true,
+			SPKIHashes:        [][]byte{{0x01}},
+		},
+		hostname:         "target.example.com",
+		expectServerName: "target.example.com",
+		expectNextProtos: []string{"h2", "http/1.1"},
+		expectCustom:     false,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txp := &Transport{}
+			var defaultNextProtos []string
+			switch tt.addr.Protocol {
+			case ProtocolDoT:
+				defaultNextProtos = []string{"dot"}
+			case ProtocolDoQ:
+				defaultNextProtos = []string{"doq"}
+			default:
+				defaultNextProtos = []string{"h2", "http/1.1"}
+			}
+			config := txp.newTLSConfig(tt.addr, tt.hostname, defaultNextProtos)
+			assert.Equal(t, tt.expectServerName, config.ServerName)
+			assert.Equal(t, tt.expectNextProtos, config.NextProtos)
+			assert.Equal(t, tt.expectCustom, config.InsecureSkipVerify)
+			assert.Equal(t, tt.expectCustom, config.VerifyConnection != nil)
+		})
+	}
+
+	t.Run("client certificates", func(t *testing.T) {
+		certs := []tls.Certificate{{}}
+		txp := &Transport{ClientCertificates: certs}
+		addr := NewServerAddr(ProtocolDoQ, "dns.adguard.com:853")
+		config := txp.newTLSConfig(addr, "dns.adguard.com", []string{"doq"})
+		assert.Equal(t, certs, config.Certificates)
+	})
+}
+
+func TestTransport_verifyTLSConnection(t *testing.T) {
+	cert, pool := newTLSConfigTestCert(t)
+	_, otherPool := newTLSConfigTestCert(t)
+	spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	tests := []struct {
+		name      string
+		rootCAs   *x509.CertPool
+		addr      *ServerAddr
+		verify    string
+		state     tls.ConnectionState
+		expectErr bool
+		errIs     error
+	}{{
+		name:      "no certificates",
+		rootCAs:   pool,
+		addr:      &ServerAddr{},
+		verify:    "www.example.com",
+		state:     tls.ConnectionState{},
+		expectErr: true,
+	}, {
+		name:      "valid certificate",
+		rootCAs:   pool,
+		addr:      &ServerAddr{},
+		verify:    "www.example.com",
+		state:     state,
+		expectErr: false,
+	}, {
+		name:      "name mismatch",
+		rootCAs:   pool,
+		addr:      &ServerAddr{},
+		verify:    "dns.google",
+		state:     state,
+		expectErr: true,
+	}, {
+		name:      "unknown authority",
+		rootCAs:   otherPool,
+		addr:      &ServerAddr{},
+		verify:    "www.example.com",
+		state:     state,
+		expectErr: true,
+	}, {
+		name:      "valid certificate and matching hash",
+		rootCAs:   pool,
+		addr:      &ServerAddr{SPKIHashes: [][]byte{spkiHash[:]}},
+		verify:    "www.example.com",
+		state:     state,
+		expectErr: false,
+	}, {
+		name:      "valid certificate and mismatching hash",
+		rootCAs:   pool,
+		addr:      &ServerAddr{SPKIHashes: [][]byte{make([]byte, 32)}},
+		verify:    "www.example.com",
+		state:     state,
+		expectErr: true,
+		errIs:     ErrSPKIHashMismatch,
+	}, {
+		name:      "unknown authority and matching hash",
+		rootCAs:   otherPool,
+		addr:      &ServerAddr{SPKIHashes: [][]byte{spkiHash[:]}},
+		verify:    "www.example.com",
+		state:     state,
+		expectErr: true,
+	}, {
+		name:      "hashes only with unknown authority and matching hash",
+		rootCAs:   otherPool,
+		addr:      &ServerAddr{SPKIHashes: [][]byte{spkiHash[:]}, SPKIHashesOnly: true},
+		verify:    "dns.google",
+		state:     state,
+		expectErr: false,
+	}, {
+		name:      "hashes only with mismatching hash",
+		rootCAs:   pool,
+		addr:      &ServerAddr{SPKIHashes: [][]byte{make([]byte, 32)}, SPKIHashesOnly: true},
+		verify:    "www.example.com",
+		state:     state,
+		expectErr: true,
+		errIs:     ErrSPKIHashMismatch,
+	}, {
+		name:      "hashes only without hashes",
+		rootCAs:   otherPool,
+		addr:      &ServerAddr{SPKIHashesOnly: true},
+		verify:    "www.example.com",
+		state:     state,
+		expectErr: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txp := &Transport{RootCAs: tt.rootCAs}
+			err := txp.verifyTLSConnection(tt.addr, tt.verify, tt.state)
+			if !tt.expectErr {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Error(t, err)
+			if tt.errIs != nil {
+				assert.ErrorIs(t, err, tt.errIs)
+			}
+		})
+	}
+}
+
+func Test_matchSPKIHashes(t *testing.T) {
+	cert, _ := newTLSConfigTestCert(t)
+	other, _ := newTLSConfigTestCert(t)
+	chain := []*x509.Certificate{other, cert}
+	spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	tbsHash := sha256.Sum256(cert.RawTBSCertificate)
+
+	tests := []struct {
+		name   string
+		hashes [][]byte
+		expect bool
+	}{
+		{name: "no hashes", hashes: nil, expect: false},
+		{name: "SPKI hash", hashes: [][]byte{spkiHash[:]}, expect: true},
+		{name: "TBS certificate hash", hashes: [][]byte{tbsHash[:]}, expect: true},
+		{name: "any of many hashes", hashes: [][]byte{make([]byte, 32), spkiHash[:]}, expect: true},
+		{name: "mismatching hash", hashes: [][]byte{make([]byte, 32)}, expect: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expect, matchSPKIHashes(chain, tt.hashes))
+		})
+	}
+}
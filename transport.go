@@ -4,6 +4,7 @@ package dnscore
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
@@ -15,6 +16,7 @@ import (
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 )
 
 // Transport allows sending and receiving DNS messages.
@@ -25,18 +27,56 @@ import (
 // as long as you don't modify its fields after construction and the
 // underlying fields you may set (e.g., DialContext) are also safe.
 type Transport struct {
+	// ClientCertificates contains the optional certificates to present
+	// to servers requiring mutual TLS. We use them for DNS-over-TLS when
+	// the DialTLSContext function pointer is nil, DNS-over-HTTPS when both
+	// HTTPClient and HTTPClientDo are nil, DNS-over-QUIC, and DNS-over-HTTP/3.
+	ClientCertificates []tls.Certificate
+
+	// ConnPool is the optional pool for reusing DNS-over-TCP and
+	// DNS-over-TLS connections and pipelining queries over them. If
+	// this field is nil, we use a new connection for each query.
+	ConnPool *ConnPool
+
 	// DialContext is the optional dialer for creating new
-	// TCP and UDP connections. If this field is nil, the default
-	// dialer from the [net] package will be used.
+	// TCP and UDP connections, including DNSCrypt ones, as well as the
+	// TCP connections underlying DNS-over-TLS when DialTLSContext is nil
+	// and DNS-over-HTTPS when using the per-server TLS or bootstrap
+	// settings (see [ServerAddr]) or ClientCertificates. If this field
+	// is nil, the default dialer from the [net] package will be used.
 	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
 
+	// DialQUICContext is the optional dialer for creating new QUIC
+	// connections for DNS-over-QUIC. The address is the endpoint to dial,
+	// which may have been obtained via bootstrap (see [ServerAddr]), and
+	// the TLS config already honours the per-server TLS settings. When early
+	// is true, the connection may send 0-RTT data (see [QUICSessionCache]).
+	// If this field is nil, we use [DefaultDialQUICContext] with the
+	// ListenPacket field. Use [NewQUICConn] to return a [*quic.Conn]
+	// established using your own [*quic.Transport] and UDP socket.
+	//
+	// DNS-over-HTTP/3 does not use this field, since the HTTP/3 client
+	// requires a concrete [*quic.Conn].
+	DialQUICContext func(ctx context.Context, address string,
+		tlsConfig *tls.Config, quicConfig *quic.Config, early bool) (QUICConn, error)
+
 	// DialTLSContext is like DialContext but for creating new
 	// TLS connections. If this field is nil, we will configure
-	// a suitable [*tls.Config] and use [*tls.Dialer].
+	// a suitable [*tls.Config], honouring the per-server TLS settings,
+	// and perform the TLS handshake over a DialContext connection.
 	DialTLSContext func(ctx context.Context, network, address string) (net.Conn, error)
 
-	// HTTPClient is the optional HTTP client to use for DNS-over-HTTPS.
-	// If this field is nil, we use the  default HTTP client from [net/http].
+	// FallbackToTCPOnTruncation optionally enables retrying DNS-over-UDP
+	// queries using DNS-over-TCP and the same server address when the
+	// response is truncated. When this field is false, we return the
+	// truncated response and let the caller decide what to do.
+	//
+	// Regardless of this field, [*Resolver] always performs this fallback.
+	FallbackToTCPOnTruncation bool
+
+	// HTTPClient is the optional HTTP client to use for DNS-over-HTTPS and
+	// Oblivious DNS-over-HTTPS. If this field is nil, we use the  default
+	// HTTP client from [net/http].
 	//
 	// When HTTPClientDo is nil and this field is not nil, we use this client to
 	// perform queries and http/httptrace to obtain connection information.
@@ -50,6 +90,13 @@ type Transport struct {
 	// precise control over connection handling and addressing information.
 	HTTPClientDo func(req *http.Request) (*http.Response, netip.AddrPort, netip.AddrPort, error)
 
+	// ListenPacket is the optional function for creating the UDP
+	// sockets underlying DNS-over-QUIC, when DialQUICContext is nil, and
+	// DNS-over-HTTP/3. We call it with the "udp" network and the ":0"
+	// address. Wrapping the returned [net.PacketConn] allows to observe
+	// packet-level events. If this field is nil, we use [net.ListenConfig].
+	ListenPacket func(ctx context.Context, network, address string) (net.PacketConn, error)
+
 	// Logger is the optional structured logger for emitting
 	// structured diagnostic events. If this field is nil, we
 	// will not be emitting structured logs.
@@ -69,9 +116,16 @@ type Transport struct {
 	// interruption useful to avoid being blocked ~forever.
 	ReadAllContext func(ctx context.Context, r io.Reader, c io.Closer) ([]byte, error)
 
+	// QUICSessionCache is the optional cache for reusing DNS-over-QUIC
+	// connections. If this field is nil, we use a new QUIC connection
+	// for each query and close it after receiving the response.
+	QUICSessionCache *QUICSessionCache
+
 	// RootCAs contains the [*x509.CertPool] used by DNS-over-TLS
-	// when the DialTLSContext function pointer is nil. Leaving this
-	// field nil implies using the system's root CAs.
+	// when the DialTLSContext function pointer is nil, as well as by
+	// DNS-over-QUIC, DNS-over-HTTP/3, and DNS-over-HTTPS when using the
+	// per-server TLS or bootstrap settings or ClientCertificates. Leaving
+	// this field nil implies using the system's root CAs.
 	RootCAs *x509.CertPool
 
 	// TimeNow is an optional function that returns the current time.
@@ -98,10 +152,10 @@ func (t *Transport) Query(ctx context.Context,
 	addr *ServerAddr, query *dns.Msg) (*dns.Msg, error) {
 	switch addr.Protocol {
 	case ProtocolUDP:
-		return t.queryUDP(ctx, addr, query)
+		return t.queryUDP(ctx, addr, addr.TSIGKey, query)
 
 	case ProtocolTCP:
-		return t.queryTCP(ctx, addr, query)
+		return t.queryTCP(ctx, addr, addr.TSIGKey, query)
 
 	case ProtocolDoT:
 		return t.queryTLS(ctx, addr, query)
@@ -112,6 +166,15 @@ func (t *Transport) Query(ctx context.Context,
 	case ProtocolDoQ:
 		return t.queryQUIC(ctx, addr, query)
 
+	case ProtocolDoH3:
+		return t.queryHTTP3(ctx, addr, query)
+
+	case ProtocolODoH:
+		return t.queryODoH(ctx, addr, query)
+
+	case ProtocolDNSCrypt:
+		return t.queryDNSCrypt(ctx, addr, query)
+
 	default:
 		return nil, fmt.Errorf("%w: %s", ErrNoSuchTransportProtocol, addr.Protocol)
 	}
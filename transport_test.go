@@ -23,6 +23,10 @@ func TestTransportQuery(t *testing.T) {
 		{protocol: ProtocolTCP, expectErr: context.Canceled},
 		{protocol: ProtocolDoT, expectErr: context.Canceled},
 		{protocol: ProtocolDoH, expectErr: context.Canceled},
+		{protocol: ProtocolDoQ, expectErr: context.Canceled},
+		{protocol: ProtocolDoH3, expectErr: context.Canceled},
+		{protocol: ProtocolODoH, expectErr: context.Canceled},
+		{protocol: ProtocolDNSCrypt, expectErr: context.Canceled},
 		{protocol: "", expectErr: ErrNoSuchTransportProtocol},
 	}
 
@@ -0,0 +1,353 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// Transaction signatures (TSIG).
+//
+// See https://datatracker.ietf.org/doc/rfc8945/
+//
+
+package dnscore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TSIGDefaultFudge is the default number of seconds of clock skew
+// tolerated when verifying TSIG signatures -- RFC 8945 Sect. 10.
+const TSIGDefaultFudge = 300
+
+// ErrInvalidTSIGKey indicates that a [*TSIGKey] is not usable.
+var ErrInvalidTSIGKey = errors.New("invalid TSIG key")
+
+// Errors emitted when a TSIG signature is not valid, either because we
+// cannot verify the response or because the server reported that it could
+// not verify the query using the TSIG error field -- RFC 8945 Sect. 5.2.
+var (
+	// ErrTSIGBadSig indicates that the MAC is not valid or that
+	// the response is not signed (BADSIG).
+	ErrTSIGBadSig = errors.New("tsig: bad signature")
+
+	// ErrTSIGBadKey indicates that the key is unknown to the server
+	// or that the response is signed using another key (BADKEY).
+	ErrTSIGBadKey = errors.New("tsig: bad key")
+
+	// ErrTSIGBadTime indicates that the time signed is not within
+	// the tolerated clock skew (BADTIME).
+	ErrTSIGBadTime = errors.New("tsig: bad time")
+)
+
+// TSIGKey is a key for signing messages using TSIG.
+type TSIGKey struct {
+	// Name is the MANDATORY name of the key, which must be the same
+	// name that the server uses for the key (e.g., "key.example.com.").
+	Name string
+
+	// Algorithm is the OPTIONAL HMAC algorithm. If this field is empty,
+	// we use [dns.HmacSHA256]. We also support [dns.HmacSHA512].
+	Algorithm string
+
+	// Secret is the MANDATORY base64-encoded shared secret.
+	Secret string
+
+	// Fudge is the OPTIONAL number of seconds of tolerated clock skew. If
+	// this field is zero, we use [TSIGDefaultFudge].
+	Fudge uint16
+}
+
+// algorithm returns the HMAC algorithm to use.
+func (k *TSIGKey) algorithm() string {
+	if k.Algorithm == "" {
+		return dns.HmacSHA256
+	}
+	return dns.Fqdn(k.Algorithm)
+}
+
+// fudge returns the tolerated clock skew in seconds.
+func (k *TSIGKey) fudge() uint16 {
+	if k.Fudge == 0 {
+		return TSIGDefaultFudge
+	}
+	return k.Fudge
+}
+
+// validate ensures the key is usable.
+func (k *TSIGKey) validate() error {
+	if k.Name == "" || k.Secret == "" {
+		return fmt.Errorf("%w: missing name or secret", ErrInvalidTSIGKey)
+	}
+	switch k.algorithm() {
+	case dns.HmacSHA256, dns.HmacSHA512:
+		return nil
+	default:
+		return fmt.Errorf("%w: unsupported algorithm: %s", ErrInvalidTSIGKey, k.Algorithm)
+	}
+}
+
+// sign signs the given message using the given time and replaces any
+// existing TSIG RR with a TSIG RR containing the MAC, such that packing
+// the message produces the signed message. Any subsequent modification
+// of the message invalidates the signature.
+func (k *TSIGKey) sign(msg *dns.Msg, now time.Time) error {
+	// 1. Make sure the key is usable
+	if err := k.validate(); err != nil {
+		return err
+	}
+
+	// 2. Add the TSIG RR, which must be the last RR
+	if tsig := msg.IsTsig(); tsig != nil {
+		msg.Extra = msg.Extra[:len(msg.Extra)-1]
+	}
+	msg.SetTsig(dns.Fqdn(k.Name), k.algorithm(), k.fudge(), now.Unix())
+	rr := msg.Extra[len(msg.Extra)-1].(*dns.TSIG)
+
+	// 3. Compute the MAC, which removes the TSIG RR from the message
+	rawMsg, mac, err := dns.TsigGenerateWithProvider(msg, &tsigProvider{key: k}, "", false)
+	if err != nil {
+		return err
+	}
+
+	// 4. Put back the TSIG RR containing the MAC
+	rr.MAC = mac
+	rr.MACSize = uint16(len(mac) / 2)
+	msg.Extra = append(msg.Extra, rr)
+
+	// 5. Make sure packing the message produces the signed message
+	packed, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(packed, rawMsg) {
+		return errors.New("tsig: cannot reproduce the signed message")
+	}
+	return nil
+}
+
+// tsigProvider is a [dns.TsigProvider] using a [*TSIGKey], which prepends
+// the given prefix to the data covered by the MAC. We need the prefix to
+// verify messages following the first one in a TCP stream, where the MAC
+// also covers the previous MAC and the unsigned messages since then.
+type tsigProvider struct {
+	// key is the key to use.
+	key *TSIGKey
+
+	// prefix is the OPTIONAL prefix of the data covered by the MAC.
+	prefix []byte
+}
+
+var _ dns.TsigProvider = &tsigProvider{}
+
+// Generate implements [dns.TsigProvider].
+func (p *tsigProvider) Generate(msg []byte, _ *dns.TSIG) ([]byte, error) {
+	secret, err := base64.StdEncoding.DecodeString(p.key.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTSIGKey, err.Error())
+	}
+	var newHash func() hash.Hash
+	switch p.key.algorithm() {
+	case dns.HmacSHA256:
+		newHash = sha256.New
+	case dns.HmacSHA512:
+		newHash = sha512.New
+	default:
+		return nil, fmt.Errorf("%w: unsupported algorithm: %s", ErrInvalidTSIGKey, p.key.Algorithm)
+	}
+	h := hmac.New(newHash, secret)
+	h.Write(p.prefix)
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+// Verify implements [dns.TsigProvider].
+func (p *tsigProvider) Verify(msg []byte, rr *dns.TSIG) error {
+	expect, err := p.Generate(msg, rr)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(rr.MAC)
+	if err != nil || !hmac.Equal(expect, mac) {
+		return ErrTSIGBadSig
+	}
+	return nil
+}
+
+// checkTSIG ensures that the given TSIG RR uses the key with the given
+// name and algorithm and maps the TSIG error field to an error.
+func checkTSIG(rr *dns.TSIG, name, algorithm string) error {
+	// 1. Make sure the RR uses the expected key
+	if !equalASCIIName(rr.Hdr.Name, name) || !equalASCIIName(rr.Algorithm, algorithm) {
+		return fmt.Errorf("%w: unexpected key: %s", ErrTSIGBadKey, rr.Hdr.Name)
+	}
+
+	// 2. Map the TSIG error field
+	switch rr.Error {
+	case dns.RcodeSuccess:
+		return nil
+	case dns.RcodeBadSig:
+		return ErrTSIGBadSig
+	case dns.RcodeBadKey:
+		return ErrTSIGBadKey
+	case dns.RcodeBadTime:
+		return ErrTSIGBadTime
+	default:
+		return fmt.Errorf("%w: TSIG error %d", ErrTSIGBadSig, rr.Error)
+	}
+}
+
+// validateResponseTSIG ensures that the response to a signed query is also
+// signed using the same key and that the server did not report TSIG errors.
+//
+// Verifying the MAC requires the raw response, so we do that when receiving
+// the response, provided that the [*ServerAddr] contains the key.
+func validateResponseTSIG(query, resp *dns.Msg) error {
+	// 1. Nothing to check if the query is not signed
+	queryTSIG := query.IsTsig()
+	if queryTSIG == nil {
+		return nil
+	}
+
+	// 2. Make sure the response is signed using the same key
+	respTSIG := resp.IsTsig()
+	if respTSIG == nil {
+		return fmt.Errorf("%w: response is not signed", ErrTSIGBadSig)
+	}
+	return checkTSIG(respTSIG, queryTSIG.Hdr.Name, queryTSIG.Algorithm)
+}
+
+// tsigMaxUnsignedMessages is the maximum number of consecutive unsigned
+// messages in a TCP stream of signed messages -- RFC 8945 Sect. 5.3.1.
+const tsigMaxUnsignedMessages = 99
+
+// tsigVerifier verifies the TSIG signatures of the responses to a signed
+// query, including the sequence of responses received over a TCP stream
+// (e.g., zone transfers), where the server may only sign some messages and
+// the MAC covers the previous MAC and the unsigned messages since then.
+type tsigVerifier struct {
+	// key is the key to use.
+	key *TSIGKey
+
+	// prevMAC is the hex-encoded MAC of the query, for the first response,
+	// or of the last signed response, for the following responses.
+	prevMAC string
+
+	// signed is the number of signed responses we have verified.
+	signed int
+
+	// unsigned contains the unsigned responses since the last signed one.
+	unsigned [][]byte
+}
+
+// newTSIGVerifier creates a new [*tsigVerifier] using the given key and
+// the given hex-encoded MAC of the signed query.
+func newTSIGVerifier(key *TSIGKey, queryMAC string) *tsigVerifier {
+	return &tsigVerifier{key: key, prevMAC: queryMAC}
+}
+
+// verify verifies the next response given its raw and parsed forms. The
+// first response must be signed, while the following ones may be unsigned
+// as long as there are no more than 99 consecutive unsigned responses.
+func (v *tsigVerifier) verify(resp *dns.Msg, rawResp []byte, now time.Time) error {
+	// 1. Handle unsigned responses, which we cover with the next MAC
+	rr := resp.IsTsig()
+	if rr == nil {
+		if v.signed <= 0 || len(v.unsigned) >= tsigMaxUnsignedMessages {
+			return fmt.Errorf("%w: response is not signed", ErrTSIGBadSig)
+		}
+		v.unsigned = append(v.unsigned, bytes.Clone(rawResp))
+		return nil
+	}
+
+	// 2. Make sure the server used our key and did not report errors
+	if err := checkTSIG(rr, dns.Fqdn(v.key.Name), v.key.algorithm()); err != nil {
+		return err
+	}
+
+	// 3. Verify the MAC. The first response covers the query MAC and all the
+	// TSIG variables, while the following ones cover the previous MAC, the
+	// unsigned responses, and only the timers -- RFC 8945 Sect. 5.3.1.
+	provider := &tsigProvider{key: v.key}
+	requestMAC, timersOnly := v.prevMAC, false
+	if v.signed > 0 {
+		prevMAC, err := hex.DecodeString(v.prevMAC)
+		if err != nil {
+			return err
+		}
+		provider.prefix = binary.BigEndian.AppendUint16(nil, uint16(len(prevMAC)))
+		provider.prefix = append(provider.prefix, prevMAC...)
+		for _, rawMsg := range v.unsigned {
+			provider.prefix = append(provider.prefix, rawMsg...)
+		}
+		requestMAC, timersOnly = "", true
+	}
+
+	// Note that [dns.TsigVerifyWithProvider] modifies the raw message and
+	// checks the time using [time.Now] after successfully verifying the MAC,
+	// so we ignore [dns.ErrTime] and check the time ourselves.
+	err := dns.TsigVerifyWithProvider(bytes.Clone(rawResp), provider, requestMAC, timersOnly)
+	switch {
+	case err == nil, errors.Is(err, dns.ErrTime):
+	case errors.Is(err, ErrTSIGBadSig), errors.Is(err, ErrInvalidTSIGKey):
+		return err
+	default:
+		return fmt.Errorf("%w: %s", ErrTSIGBadSig, err.Error())
+	}
+
+	// 4. Make sure the time signed is within the tolerated clock skew
+	signed := time.Unix(int64(rr.TimeSigned), 0)
+	if now.Sub(signed).Abs() > time.Duration(rr.Fudge)*time.Second {
+		return ErrTSIGBadTime
+	}
+
+	// 5. Remember the MAC for verifying the following responses
+	v.prevMAC = rr.MAC
+	v.signed++
+	v.unsigned = nil
+	return nil
+}
+
+// finish ensures that the last response we verified was signed.
+func (v *tsigVerifier) finish() error {
+	if v.signed <= 0 || len(v.unsigned) > 0 {
+		return fmt.Errorf("%w: last response is not signed", ErrTSIGBadSig)
+	}
+	return nil
+}
+
+// maybeVerifyResponseTSIG verifies the TSIG signature of the given response
+// when the key, which usually is the TSIG key of the [*ServerAddr], is not
+// nil and the raw query is signed.
+func (t *Transport) maybeVerifyResponseTSIG(key *TSIGKey,
+	rawQuery []byte, resp *dns.Msg, rawResp []byte) error {
+	// 1. Nothing to verify without a key
+	if key == nil {
+		return nil
+	}
+
+	// 2. Nothing to verify unless the query is signed
+	query := &dns.Msg{}
+	if err := query.Unpack(rawQuery); err != nil {
+		return err
+	}
+	queryTSIG := query.IsTsig()
+	if queryTSIG == nil {
+		return nil
+	}
+
+	// 3. Verify the response, which must be signed
+	verifier := newTSIGVerifier(key, queryTSIG.MAC)
+	if err := verifier.verify(resp, rawResp, t.timeNow()); err != nil {
+		return err
+	}
+	return verifier.finish()
+}
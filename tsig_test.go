@@ -0,0 +1,357 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testTSIGSecret is a base64-encoded secret for testing.
+const testTSIGSecret = "c2VjcmV0LWtleS1mb3ItdGVzdGluZy1wdXJwb3Nlcw=="
+
+func TestTSIGKey_sign(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       *TSIGKey
+		expectErr error
+	}{{
+		name:      "HMAC-SHA256 by default",
+		key:       &TSIGKey{Name: "key.example.com", Secret: testTSIGSecret},
+		expectErr: nil,
+	}, {
+		name:      "HMAC-SHA512",
+		key:       &TSIGKey{Name: "key.example.com.", Algorithm: dns.HmacSHA512, Secret: testTSIGSecret},
+		expectErr: nil,
+	}, {
+		name:      "missing name",
+		key:       &TSIGKey{Secret: testTSIGSecret},
+		expectErr: ErrInvalidTSIGKey,
+	}, {
+		name:      "missing secret",
+		key:       &TSIGKey{Name: "key.example.com."},
+		expectErr: ErrInvalidTSIGKey,
+	}, {
+		name:      "unsupported algorithm",
+		key:       &TSIGKey{Name: "key.example.com.", Algorithm: dns.HmacSHA1, Secret: testTSIGSecret},
+		expectErr: ErrInvalidTSIGKey,
+	}, {
+		name:      "invalid secret",
+		key:       &TSIGKey{Name: "key.example.com.", Secret: "!!!"},
+		expectErr: ErrInvalidTSIGKey,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetUpdate("example.com.")
+			now := time.Now()
+
+			err := tt.key.sign(msg, now)
+			assert.ErrorIs(t, err, tt.expectErr)
+			if tt.expectErr != nil {
+				return
+			}
+
+			// make sure the packed message carries a valid signature
+			tsig := msg.IsTsig()
+			if !assert.NotNil(t, tsig) {
+				return
+			}
+			assert.Equal(t, "key.example.com.", tsig.Hdr.Name)
+			assert.Equal(t, tt.key.algorithm(), tsig.Algorithm)
+			assert.Equal(t, uint16(TSIGDefaultFudge), tsig.Fudge)
+			assert.Equal(t, uint64(now.Unix()), tsig.TimeSigned)
+			rawMsg, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(t, dns.TsigVerify(rawMsg, testTSIGSecret, "", false))
+
+			// make sure signing again replaces the existing TSIG RR
+			assert.NoError(t, tt.key.sign(msg, now))
+			assert.Len(t, msg.Extra, 1)
+		})
+	}
+}
+
+func Test_checkTSIG(t *testing.T) {
+	tests := []struct {
+		name      string
+		rrName    string
+		algorithm string
+		tsigErr   uint16
+		expectErr error
+	}{
+		{name: "valid", rrName: "KEY.example.com.", algorithm: dns.HmacSHA256, expectErr: nil},
+		{name: "other key", rrName: "other.example.com.", algorithm: dns.HmacSHA256, expectErr: ErrTSIGBadKey},
+		{name: "other algorithm", rrName: "key.example.com.", algorithm: dns.HmacSHA512, expectErr: ErrTSIGBadKey},
+		{name: "BADSIG", rrName: "key.example.com.", algorithm: dns.HmacSHA256, tsigErr: dns.RcodeBadSig, expectErr: ErrTSIGBadSig},
+		{name: "BADKEY", rrName: "key.example.com.", algorithm: dns.HmacSHA256, tsigErr: dns.RcodeBadKey, expectErr: ErrTSIGBadKey},
+		{name: "BADTIME", rrName: "key.example.com.", algorithm: dns.HmacSHA256, tsigErr: dns.RcodeBadTime, expectErr: ErrTSIGBadTime},
+		{name: "BADTRUNC", rrName: "key.example.com.", algorithm: dns.HmacSHA256, tsigErr: dns.RcodeBadTrunc, expectErr: ErrTSIGBadSig},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := &dns.TSIG{
+				Hdr:       dns.RR_Header{Name: tt.rrName, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+				Algorithm: tt.algorithm,
+				Error:     tt.tsigErr,
+			}
+			err := checkTSIG(rr, "key.example.com.", dns.HmacSHA256)
+			assert.ErrorIs(t, err, tt.expectErr)
+		})
+	}
+}
+
+func Test_validateResponseTSIG(t *testing.T) {
+	tests := []struct {
+		name      string
+		signQuery bool
+		signResp  bool
+		respKey   string
+		expectErr error
+	}{
+		{name: "unsigned query and response", expectErr: nil},
+		{name: "unsigned query and signed response", signResp: true, respKey: "key.example.com.", expectErr: nil},
+		{name: "signed query and response", signQuery: true, signResp: true, respKey: "key.example.com.", expectErr: nil},
+		{name: "signed query and unsigned response", signQuery: true, expectErr: ErrTSIGBadSig},
+		{name: "response using another key", signQuery: true, signResp: true, respKey: "other.example.com.", expectErr: ErrTSIGBadKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := new(dns.Msg)
+			query.SetQuestion("example.com.", dns.TypeA)
+			resp := new(dns.Msg)
+			resp.SetReply(query)
+			if tt.signQuery {
+				query.SetTsig("key.example.com.", dns.HmacSHA256, 300, 0)
+			}
+			if tt.signResp {
+				resp.SetTsig(tt.respKey, dns.HmacSHA256, 300, 0)
+			}
+			assert.ErrorIs(t, validateResponseTSIG(query, resp), tt.expectErr)
+		})
+	}
+}
+
+// newTSIGTestStream returns a signed query and the raw responses to such
+// a query signed like a server would do over a TCP stream -- RFC 8945
+// Sect. 5.3.1. We leave unsigned the responses for which signed is false.
+func newTSIGTestStream(t *testing.T, key *TSIGKey, signed []bool, now time.Time) (*dns.Msg, [][]byte) {
+	// 1. create and sign the query
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeAXFR)
+	if err := key.sign(query, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2. create and sign the responses
+	var (
+		rawResps [][]byte
+		prevMAC  = query.IsTsig().MAC
+		unsigned []byte
+	)
+	for idx, sign := range signed {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		resp.Extra = nil
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(10, 0, 0, byte(idx)),
+		})
+		if !sign {
+			rawResp, err := resp.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			unsigned = append(unsigned, rawResp...)
+			rawResps = append(rawResps, rawResp)
+			continue
+		}
+		resp.SetTsig(dns.Fqdn(key.Name), key.algorithm(), key.fudge(), now.Unix())
+		provider := &tsigProvider{key: key}
+		requestMAC, timersOnly := prevMAC, false
+		if idx > 0 {
+			mac, err := hex.DecodeString(prevMAC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			provider.prefix = binary.BigEndian.AppendUint16(nil, uint16(len(mac)))
+			provider.prefix = append(provider.prefix, mac...)
+			provider.prefix = append(provider.prefix, unsigned...)
+			requestMAC, timersOnly = "", true
+		}
+		rawResp, mac, err := dns.TsigGenerateWithProvider(resp, provider, requestMAC, timersOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawResps = append(rawResps, rawResp)
+		prevMAC, unsigned = mac, nil
+	}
+	return query, rawResps
+}
+
+func Test_tsigVerifier(t *testing.T) {
+	key := &TSIGKey{Name: "key.example.com.", Secret: testTSIGSecret}
+
+	// tooManyUnsigned is a stream with 100 consecutive unsigned messages
+	tooManyUnsigned := []bool{true}
+	for i := 0; i < 100; i++ {
+		tooManyUnsigned = append(tooManyUnsigned, false)
+	}
+	tooManyUnsigned = append(tooManyUnsigned, true)
+
+	tests := []struct {
+		name      string
+		signed    []bool
+		verifyKey *TSIGKey
+		skew      time.Duration
+		tamper    func(rawResps [][]byte)
+		expectErr error
+	}{{
+		name:      "single signed response",
+		signed:    []bool{true},
+		expectErr: nil,
+	}, {
+		name:      "single unsigned response",
+		signed:    []bool{false},
+		expectErr: ErrTSIGBadSig,
+	}, {
+		name:      "all signed responses",
+		signed:    []bool{true, true, true},
+		expectErr: nil,
+	}, {
+		name:      "some unsigned responses",
+		signed:    []bool{true, false, false, true, false, true},
+		expectErr: nil,
+	}, {
+		name:      "last response unsigned",
+		signed:    []bool{true, true, false},
+		expectErr: ErrTSIGBadSig,
+	}, {
+		name:      "too many unsigned responses",
+		signed:    tooManyUnsigned,
+		expectErr: ErrTSIGBadSig,
+	}, {
+		name:      "tampered unsigned response",
+		signed:    []bool{true, false, true},
+		tamper:    func(rawResps [][]byte) { rawResps[1][len(rawResps[1])-1] ^= 0xff },
+		expectErr: ErrTSIGBadSig,
+	}, {
+		name:      "tampered signed response",
+		signed:    []bool{true, true},
+		tamper:    func(rawResps [][]byte) { rawResps[1][2] ^= 0x01 },
+		expectErr: ErrTSIGBadSig,
+	}, {
+		name:      "wrong secret",
+		signed:    []bool{true},
+		verifyKey: &TSIGKey{Name: "key.example.com.", Secret: "d3Jvbmc="},
+		expectErr: ErrTSIGBadSig,
+	}, {
+		name:      "wrong key name",
+		signed:    []bool{true},
+		verifyKey: &TSIGKey{Name: "other.example.com.", Secret: testTSIGSecret},
+		expectErr: ErrTSIGBadKey,
+	}, {
+		name:      "HMAC-SHA512",
+		signed:    []bool{true, false, true},
+		verifyKey: &TSIGKey{Name: "key.example.com.", Algorithm: dns.HmacSHA512, Secret: testTSIGSecret},
+		expectErr: nil,
+	}, {
+		name:      "clock skew within fudge",
+		signed:    []bool{true},
+		skew:      time.Minute,
+		expectErr: nil,
+	}, {
+		name:      "clock skew beyond fudge",
+		signed:    []bool{true},
+		skew:      -time.Hour,
+		expectErr: ErrTSIGBadTime,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// sign with the verify key when it has the same secret,
+			// so we can test both matching and mismatching keys
+			signKey := key
+			if tt.verifyKey != nil && tt.verifyKey.Secret == key.Secret {
+				signKey = &TSIGKey{Name: key.Name, Algorithm: tt.verifyKey.Algorithm, Secret: key.Secret}
+			}
+			verifyKey := key
+			if tt.verifyKey != nil {
+				verifyKey = tt.verifyKey
+			}
+			now := time.Now()
+			query, rawResps := newTSIGTestStream(t, signKey, tt.signed, now)
+			if tt.tamper != nil {
+				tt.tamper(rawResps)
+			}
+
+			verifier := newTSIGVerifier(verifyKey, query.IsTsig().MAC)
+			var err error
+			for _, rawResp := range rawResps {
+				resp := new(dns.Msg)
+				if err := resp.Unpack(rawResp); err != nil {
+					t.Fatal(err)
+				}
+				if err = verifier.verify(resp, rawResp, now.Add(tt.skew)); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = verifier.finish()
+			}
+			assert.ErrorIs(t, err, tt.expectErr)
+		})
+	}
+}
+
+func TestTransport_maybeVerifyResponseTSIG(t *testing.T) {
+	key := &TSIGKey{Name: "key.example.com.", Secret: testTSIGSecret}
+	now := time.Now()
+	query, rawResps := newTSIGTestStream(t, key, []bool{true}, now)
+	rawQuery, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rawResps[0]); err != nil {
+		t.Fatal(err)
+	}
+	unsignedQuery := new(dns.Msg)
+	unsignedQuery.SetQuestion("example.com.", dns.TypeA)
+	rawUnsignedQuery, err := unsignedQuery.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		key       *TSIGKey
+		rawQuery  []byte
+		now       time.Time
+		expectErr error
+	}{
+		{name: "without key", key: nil, rawQuery: rawQuery, now: now, expectErr: nil},
+		{name: "unsigned query", key: key, rawQuery: rawUnsignedQuery, now: now, expectErr: nil},
+		{name: "valid response", key: key, rawQuery: rawQuery, now: now, expectErr: nil},
+		{name: "bad time", key: key, rawQuery: rawQuery, now: now.Add(time.Hour), expectErr: ErrTSIGBadTime},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			txp := &Transport{TimeNow: func() time.Time { return tt.now }}
+			err := txp.maybeVerifyResponseTSIG(tt.key, tt.rawQuery, resp, rawResps[0])
+			assert.ErrorIs(t, err, tt.expectErr)
+		})
+	}
+}
@@ -0,0 +1,316 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// Dynamic updates.
+//
+// See https://datatracker.ietf.org/doc/rfc2136/
+//
+
+package dnscore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// UpdateOption is a function that modifies an UPDATE message by adding
+// prerequisites or updates. Note that, like for [*dns.Msg], the RRs used
+// with the [UpdateOption] functions must be fully qualified.
+type UpdateOption func(*dns.Msg) error
+
+// copyRRs returns a deep copy of the given RRs. We need to copy them since
+// the [*dns.Msg] methods for building UPDATE messages modify the headers
+// of the RRs, while the caller may reuse the same RRs more than once.
+func copyRRs(rrs []dns.RR) []dns.RR {
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		out = append(out, dns.Copy(rr))
+	}
+	return out
+}
+
+// UpdatePrereqNameInUse requires the given name to own at least
+// an RR -- RFC 2136 Sect. 2.4.4.
+func UpdatePrereqNameInUse(name string) UpdateOption {
+	return func(m *dns.Msg) error {
+		m.NameUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: dns.Fqdn(name)}}})
+		return nil
+	}
+}
+
+// UpdatePrereqNameNotInUse requires the given name not to own
+// any RR -- RFC 2136 Sect. 2.4.5.
+func UpdatePrereqNameNotInUse(name string) UpdateOption {
+	return func(m *dns.Msg) error {
+		m.NameNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: dns.Fqdn(name)}}})
+		return nil
+	}
+}
+
+// UpdatePrereqRRsetExists requires the RRset with the given name and
+// type to exist, regardless of its value -- RFC 2136 Sect. 2.4.1.
+func UpdatePrereqRRsetExists(name string, rrtype uint16) UpdateOption {
+	return func(m *dns.Msg) error {
+		m.RRsetUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: rrtype}}})
+		return nil
+	}
+}
+
+// UpdatePrereqRRsetExistsValue requires the RRsets containing the given
+// RRs to exist and to contain exactly the given RRs -- RFC 2136 Sect. 2.4.2.
+func UpdatePrereqRRsetExistsValue(rrs ...dns.RR) UpdateOption {
+	return func(m *dns.Msg) error {
+		m.Used(copyRRs(rrs))
+		return nil
+	}
+}
+
+// UpdatePrereqRRsetNotExists requires the RRset with the given name
+// and type not to exist -- RFC 2136 Sect. 2.4.3.
+func UpdatePrereqRRsetNotExists(name string, rrtype uint16) UpdateOption {
+	return func(m *dns.Msg) error {
+		m.RRsetNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: rrtype}}})
+		return nil
+	}
+}
+
+// UpdateAddRRs adds the given RRs to their RRsets -- RFC 2136 Sect. 2.5.1.
+func UpdateAddRRs(rrs ...dns.RR) UpdateOption {
+	return func(m *dns.Msg) error {
+		m.Insert(copyRRs(rrs))
+		return nil
+	}
+}
+
+// UpdateDeleteRRset deletes the RRset with the given name
+// and type -- RFC 2136 Sect. 2.5.2.
+func UpdateDeleteRRset(name string, rrtype uint16) UpdateOption {
+	return func(m *dns.Msg) error {
+		m.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: rrtype}}})
+		return nil
+	}
+}
+
+// UpdateDeleteName deletes all the RRsets owned by the
+// given name -- RFC 2136 Sect. 2.5.3.
+func UpdateDeleteName(name string) UpdateOption {
+	return func(m *dns.Msg) error {
+		m.RemoveName([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: dns.Fqdn(name)}}})
+		return nil
+	}
+}
+
+// UpdateDeleteRRs deletes the given RRs from their RRsets -- RFC 2136 Sect. 2.5.4.
+func UpdateDeleteRRs(rrs ...dns.RR) UpdateOption {
+	return func(m *dns.Msg) error {
+		m.Remove(copyRRs(rrs))
+		return nil
+	}
+}
+
+// NewUpdate constructs a [*dns.Msg] containing an UPDATE for the given
+// zone. Use the [UpdateOption] functions to add prerequisites and updates,
+// which we apply in order.
+//
+// This function fails if the zone name is invalid.
+func NewUpdate(zone string, options ...UpdateOption) (*dns.Msg, error) {
+	// 1. Make sure the zone is valid
+	if _, ok := dns.IsDomainName(zone); !ok {
+		return nil, fmt.Errorf("%w: invalid zone: %s", ErrInvalidQuery, zone)
+	}
+
+	// 2. Create the UPDATE message, which uses a random ID
+	update := new(dns.Msg)
+	update.SetUpdate(dns.Fqdn(zone))
+
+	// 3. Apply the update options.
+	for _, option := range options {
+		if err := option(update); err != nil {
+			return nil, err
+		}
+	}
+	return update, nil
+}
+
+// Errors returned by [UpdateRCodeToError].
+var (
+	// ErrUpdateYXDomain indicates that a name that should not exist
+	// exists (YXDOMAIN) -- RFC 2136 Sect. 2.2.
+	ErrUpdateYXDomain = errors.New("update: name exists when it should not")
+
+	// ErrUpdateYXRRSet indicates that an RRset that should not exist
+	// exists (YXRRSET) -- RFC 2136 Sect. 2.2.
+	ErrUpdateYXRRSet = errors.New("update: RRset exists when it should not")
+
+	// ErrUpdateNXDomain indicates that a name that should exist does
+	// not exist (NXDOMAIN) -- RFC 2136 Sect. 2.2.
+	ErrUpdateNXDomain = errors.New("update: name does not exist when it should")
+
+	// ErrUpdateNXRRSet indicates that an RRset that should exist does
+	// not exist (NXRRSET) -- RFC 2136 Sect. 2.2.
+	ErrUpdateNXRRSet = errors.New("update: RRset does not exist when it should")
+
+	// ErrUpdateNotAuth indicates that the server is not authoritative
+	// for the zone or the update is not authorized (NOTAUTH).
+	ErrUpdateNotAuth = errors.New("update: server not authoritative or not authorized")
+
+	// ErrUpdateNotZone indicates that a name used in the prerequisites or
+	// in the updates is not within the zone (NOTZONE) -- RFC 2136 Sect. 2.2.
+	ErrUpdateNotZone = errors.New("update: name not contained in zone")
+
+	// ErrUpdateRefused indicates that the server refused the update (REFUSED).
+	ErrUpdateRefused = errors.New("update: refused")
+
+	// ErrUpdateNotImplemented indicates that the server does not
+	// support dynamic updates (NOTIMP).
+	ErrUpdateNotImplemented = errors.New("update: not implemented")
+)
+
+// UpdateRCodeToError maps the RCODE of a response to an UPDATE to an error.
+//
+// Unlike [RCodeToError], we map update-specific RCODEs to distinct errors
+// and we do not treat the lack of answers as an error, since responses to
+// UPDATE messages never contain answers. For SERVFAIL and for other RCODEs,
+// we return the same errors returned by [RCodeToError].
+//
+// If the RCODE is zero, this function returns nil.
+//
+// Before invoking this function, make sure the response is valid
+// for the update by calling [ValidateUpdateResponse].
+func UpdateRCodeToError(resp *dns.Msg) error {
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		return nil
+	case dns.RcodeYXDomain:
+		return ErrUpdateYXDomain
+	case dns.RcodeYXRrset:
+		return ErrUpdateYXRRSet
+	case dns.RcodeNameError:
+		return ErrUpdateNXDomain
+	case dns.RcodeNXRrset:
+		return ErrUpdateNXRRSet
+	case dns.RcodeNotAuth:
+		return ErrUpdateNotAuth
+	case dns.RcodeNotZone:
+		return ErrUpdateNotZone
+	case dns.RcodeRefused:
+		return ErrUpdateRefused
+	case dns.RcodeNotImplemented:
+		return ErrUpdateNotImplemented
+	case dns.RcodeServerFailure:
+		return ErrServerTemporarilyMisbehaving
+	default:
+		return ErrServerMisbehaving
+	}
+}
+
+// ValidateUpdateResponse validates a given DNS response
+// message for a given UPDATE message.
+//
+// Since RFC 2136 Sect. 3.8 allows servers to omit the zone
+// section from responses, we only check the zone when the
+// response actually contains a zone section.
+func ValidateUpdateResponse(update, resp *dns.Msg) error {
+	// 1. make sure the message is actually a response to an UPDATE
+	if !resp.Response || resp.Opcode != dns.OpcodeUpdate {
+		return ErrInvalidResponse
+	}
+
+	// 2. make sure the response ID matches the update ID
+	if resp.Id != update.Id {
+		return ErrInvalidResponse
+	}
+
+	// 3. make sure the update contains a single zone
+	if update.Opcode != dns.OpcodeUpdate || len(update.Question) != 1 {
+		return ErrInvalidQuery
+	}
+	zone := update.Question[0]
+
+	// 4. make sure the zone, if present, is correct
+	switch len(resp.Question) {
+	case 0:
+	case 1:
+		resp0 := resp.Question[0]
+		if !equalASCIIName(resp0.Name, zone.Name) ||
+			resp0.Qclass != zone.Qclass || resp0.Qtype != zone.Qtype {
+			return ErrInvalidResponse
+		}
+	default:
+		return ErrInvalidResponse
+	}
+
+	// 5. make sure a signed update has a signed response
+	return validateResponseTSIG(update, resp)
+}
+
+// ErrUpdateUnsupportedProtocol indicates that we do not support sending
+// UPDATE messages using the protocol of the given [*ServerAddr].
+var ErrUpdateUnsupportedProtocol = errors.New("update: unsupported protocol")
+
+// Update sends the given UPDATE message, created using [NewUpdate],
+// to the given server address, and returns the validated response.
+//
+// We support [ProtocolUDP] and [ProtocolTCP]. When using UDP, we always
+// retry using TCP if the response is truncated.
+//
+// When the key is not nil, we sign the UPDATE using TSIG right before sending
+// it, which adds a TSIG RR to the message, and we verify the signature of the
+// response using the same key. Otherwise, we send the message as is.
+//
+// On success, the returned error is nil. Otherwise, the error is either a
+// network error, [ErrInvalidResponse], a TSIG error (e.g., [ErrTSIGBadSig]),
+// or one of the errors returned by [UpdateRCodeToError], in which case the
+// response is also returned.
+//
+// The context is used to control the update lifetime like in [*Transport.Query].
+func (t *Transport) Update(ctx context.Context,
+	addr *ServerAddr, update *dns.Msg, key *TSIGKey) (*dns.Msg, error) {
+	// 1. Make sure we support the protocol
+	switch addr.Protocol {
+	case ProtocolUDP, ProtocolTCP:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUpdateUnsupportedProtocol, addr.Protocol)
+	}
+
+	// 2. Possibly sign the update and make sure we verify the response using
+	// the same key, which we pass explicitly rather than cloning the addr, since
+	// the [*ConnPool] uses the [*ServerAddr] pointer to find connections.
+	verifyKey := addr.TSIGKey
+	if key != nil {
+		if err := key.sign(update, t.timeNow()); err != nil {
+			return nil, err
+		}
+		verifyKey = key
+	}
+
+	// 3. Send the update and possibly fallback to TCP
+	var (
+		resp *dns.Msg
+		err  error
+	)
+	switch addr.Protocol {
+	case ProtocolUDP:
+		resp, err = t.queryUDP(ctx, addr, verifyKey, update)
+		if err == nil && resp.Truncated && !t.FallbackToTCPOnTruncation {
+			resp, err = t.queryTCPFallback(ctx, addr, verifyKey, update)
+		}
+	default:
+		resp, err = t.queryTCP(ctx, addr, verifyKey, update)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 4. Validate the response and map the RCODE
+	if err := ValidateUpdateResponse(update, resp); err != nil {
+		return nil, err
+	}
+	if err := UpdateRCodeToError(resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,242 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUpdate(t *testing.T) {
+	rrA := &dns.A{
+		Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(10, 0, 0, 1),
+	}
+
+	t.Run("invalid zone", func(t *testing.T) {
+		update, err := NewUpdate("example..com")
+		assert.ErrorIs(t, err, ErrInvalidQuery)
+		assert.Nil(t, update)
+	})
+
+	t.Run("failing option", func(t *testing.T) {
+		expectedErr := errors.New("mocked error")
+		update, err := NewUpdate("example.com", func(*dns.Msg) error { return expectedErr })
+		assert.ErrorIs(t, err, expectedErr)
+		assert.Nil(t, update)
+	})
+
+	t.Run("prerequisites and updates", func(t *testing.T) {
+		update, err := NewUpdate(
+			"example.com",
+			UpdatePrereqNameInUse("example.com"),
+			UpdatePrereqNameNotInUse("new.example.com"),
+			UpdatePrereqRRsetExists("www.example.com", dns.TypeA),
+			UpdatePrereqRRsetExistsValue(rrA),
+			UpdatePrereqRRsetNotExists("www.example.com", dns.TypeAAAA),
+			UpdateDeleteRRset("old.example.com", dns.TypeA),
+			UpdateDeleteName("gone.example.com"),
+			UpdateDeleteRRs(rrA),
+			UpdateAddRRs(rrA),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// zone section
+		assert.Equal(t, dns.OpcodeUpdate, update.Opcode)
+		assert.Equal(t, []dns.Question{{Name: "example.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}}, update.Question)
+
+		// prerequisite section -- RFC 2136 Sect. 2.4
+		type rrSummary struct {
+			name   string
+			rrtype uint16
+			class  uint16
+		}
+		summarize := func(rrs []dns.RR) (out []rrSummary) {
+			for _, rr := range rrs {
+				out = append(out, rrSummary{rr.Header().Name, rr.Header().Rrtype, rr.Header().Class})
+			}
+			return
+		}
+		assert.Equal(t, []rrSummary{
+			{"example.com.", dns.TypeANY, dns.ClassANY},
+			{"new.example.com.", dns.TypeANY, dns.ClassNONE},
+			{"www.example.com.", dns.TypeA, dns.ClassANY},
+			{"www.example.com.", dns.TypeA, dns.ClassINET},
+			{"www.example.com.", dns.TypeAAAA, dns.ClassNONE},
+		}, summarize(update.Answer))
+
+		// update section -- RFC 2136 Sect. 2.5
+		assert.Equal(t, []rrSummary{
+			{"old.example.com.", dns.TypeA, dns.ClassANY},
+			{"gone.example.com.", dns.TypeANY, dns.ClassANY},
+			{"www.example.com.", dns.TypeA, dns.ClassNONE},
+			{"www.example.com.", dns.TypeA, dns.ClassINET},
+		}, summarize(update.Ns))
+
+		// make sure we did not modify the caller's RRs
+		assert.Equal(t, uint16(dns.ClassINET), rrA.Hdr.Class)
+		assert.Equal(t, uint32(300), rrA.Hdr.Ttl)
+	})
+}
+
+func TestUpdateRCodeToError(t *testing.T) {
+	tests := []struct {
+		rcode     int
+		expectErr error
+	}{
+		{rcode: dns.RcodeSuccess, expectErr: nil},
+		{rcode: dns.RcodeYXDomain, expectErr: ErrUpdateYXDomain},
+		{rcode: dns.RcodeYXRrset, expectErr: ErrUpdateYXRRSet},
+		{rcode: dns.RcodeNameError, expectErr: ErrUpdateNXDomain},
+		{rcode: dns.RcodeNXRrset, expectErr: ErrUpdateNXRRSet},
+		{rcode: dns.RcodeNotAuth, expectErr: ErrUpdateNotAuth},
+		{rcode: dns.RcodeNotZone, expectErr: ErrUpdateNotZone},
+		{rcode: dns.RcodeRefused, expectErr: ErrUpdateRefused},
+		{rcode: dns.RcodeNotImplemented, expectErr: ErrUpdateNotImplemented},
+		{rcode: dns.RcodeServerFailure, expectErr: ErrServerTemporarilyMisbehaving},
+		{rcode: dns.RcodeFormatError, expectErr: ErrServerMisbehaving},
+	}
+
+	for _, tt := range tests {
+		t.Run(dns.RcodeToString[tt.rcode], func(t *testing.T) {
+			resp := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: tt.rcode}}
+			err := UpdateRCodeToError(resp)
+			if tt.expectErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.expectErr)
+		})
+	}
+}
+
+func TestValidateUpdateResponse(t *testing.T) {
+	newUpdate := func() *dns.Msg {
+		update := new(dns.Msg)
+		update.SetUpdate("example.com.")
+		update.Id = 1234
+		return update
+	}
+	newResponse := func() *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(newUpdate())
+		return resp
+	}
+
+	tests := []struct {
+		name      string
+		update    func() *dns.Msg
+		resp      func() *dns.Msg
+		expectErr error
+	}{{
+		name:      "valid response",
+		update:    newUpdate,
+		resp:      newResponse,
+		expectErr: nil,
+	}, {
+		name:   "valid response without zone section",
+		update: newUpdate,
+		resp: func() *dns.Msg {
+			resp := newResponse()
+			resp.Question = nil
+			return resp
+		},
+		expectErr: nil,
+	}, {
+		name:   "not a response",
+		update: newUpdate,
+		resp: func() *dns.Msg {
+			resp := newResponse()
+			resp.Response = false
+			return resp
+		},
+		expectErr: ErrInvalidResponse,
+	}, {
+		name:   "wrong opcode",
+		update: newUpdate,
+		resp: func() *dns.Msg {
+			resp := newResponse()
+			resp.Opcode = dns.OpcodeQuery
+			return resp
+		},
+		expectErr: ErrInvalidResponse,
+	}, {
+		name:   "wrong ID",
+		update: newUpdate,
+		resp: func() *dns.Msg {
+			resp := newResponse()
+			resp.Id++
+			return resp
+		},
+		expectErr: ErrInvalidResponse,
+	}, {
+		name: "invalid update",
+		update: func() *dns.Msg {
+			update := newUpdate()
+			update.Question = nil
+			return update
+		},
+		resp:      newResponse,
+		expectErr: ErrInvalidQuery,
+	}, {
+		name:   "wrong zone",
+		update: newUpdate,
+		resp: func() *dns.Msg {
+			resp := newResponse()
+			resp.Question[0].Name = "example.org."
+			return resp
+		},
+		expectErr: ErrInvalidResponse,
+	}, {
+		name:   "too many zones",
+		update: newUpdate,
+		resp: func() *dns.Msg {
+			resp := newResponse()
+			resp.Question = append(resp.Question, resp.Question[0])
+			return resp
+		},
+		expectErr: ErrInvalidResponse,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateUpdateResponse(tt.update(), tt.resp())
+			if tt.expectErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.expectErr)
+		})
+	}
+}
+
+func TestTransport_Update(t *testing.T) {
+	t.Run("unsupported protocol", func(t *testing.T) {
+		update, err := NewUpdate("example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := NewServerAddr(ProtocolDoH, "https://dns.google/dns-query")
+		resp, err := (&Transport{}).Update(context.Background(), addr, update, nil)
+		assert.ErrorIs(t, err, ErrUpdateUnsupportedProtocol)
+		assert.Nil(t, resp)
+	})
+
+	t.Run("invalid TSIG key", func(t *testing.T) {
+		update, err := NewUpdate("example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := NewServerAddr(ProtocolUDP, "127.0.0.1:53")
+		resp, err := (&Transport{}).Update(context.Background(), addr, update, &TSIGKey{})
+		assert.ErrorIs(t, err, ErrInvalidTSIGKey)
+		assert.Nil(t, resp)
+	})
+}
@@ -0,0 +1,415 @@
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+//
+// Zone transfers.
+//
+// See https://datatracker.ietf.org/doc/rfc5936/ (AXFR),
+// https://datatracker.ietf.org/doc/rfc1995/ (IXFR), and
+// https://datatracker.ietf.org/doc/rfc9103/ (XoT).
+//
+
+package dnscore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// queryOptionNoRecursion clears the recursion desired flag, which
+// does not make sense for zone transfers.
+func queryOptionNoRecursion(q *dns.Msg) error {
+	q.RecursionDesired = false
+	return nil
+}
+
+// queryOptionIXFRSerial adds the SOA RR containing the serial of the
+// version of the zone known to the client -- RFC 1995 Sect. 3.
+func queryOptionIXFRSerial(serial uint32) QueryOption {
+	return func(q *dns.Msg) error {
+		q.Ns = []dns.RR{&dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   q.Question[0].Name,
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+			},
+			Ns:     ".",
+			Mbox:   ".",
+			Serial: serial,
+		}}
+		return nil
+	}
+}
+
+// NewAXFRQuery constructs a [*dns.Msg] containing an AXFR query for the
+// given zone, to use with [*Transport.Transfer]. The [QueryOption] functions
+// can be used to set additional options (e.g., [QueryOptionTSIG]).
+//
+// Like [NewQueryWithServerAddr], this function fails if the zone is invalid.
+func NewAXFRQuery(serverAddr *ServerAddr, zone string, options ...QueryOption) (*dns.Msg, error) {
+	options = append([]QueryOption{queryOptionNoRecursion}, options...)
+	return NewQueryWithServerAddr(serverAddr, zone, dns.TypeAXFR, options...)
+}
+
+// NewIXFRQuery is like [NewAXFRQuery] but constructs an IXFR query for the
+// given zone, where serial is the serial of the version of the zone known
+// to the client, such that the server only sends the differences.
+func NewIXFRQuery(serverAddr *ServerAddr, zone string,
+	serial uint32, options ...QueryOption) (*dns.Msg, error) {
+	options = append([]QueryOption{queryOptionNoRecursion, queryOptionIXFRSerial(serial)}, options...)
+	return NewQueryWithServerAddr(serverAddr, zone, dns.TypeIXFR, options...)
+}
+
+// Errors emitted by [*Transport.Transfer].
+var (
+	// ErrTransferUnsupportedProtocol indicates that we do not support zone
+	// transfers using the protocol of the given [*ServerAddr].
+	ErrTransferUnsupportedProtocol = errors.New("transfer: unsupported protocol")
+
+	// ErrTransferFailed indicates that the server responded to
+	// the zone transfer query using a nonzero RCODE.
+	ErrTransferFailed = errors.New("transfer: failed")
+)
+
+// Transfer performs the zone transfer requested by the given AXFR or IXFR
+// query, created using [NewAXFRQuery] or [NewIXFRQuery], with the given
+// server address and streams the received messages.
+//
+// This method only works with [ProtocolTCP] and [ProtocolDoT], which
+// implements zone transfers over TLS (XoT) as defined by RFC 9103. We
+// always use a dedicated connection, regardless of the ConnPool.
+//
+// We validate each message and make sure that the SOA RRs framing the
+// transfer are correct -- RFC 5936 Sect. 2.2 and RFC 1995 Sect. 4. Also,
+// like [*Transport.Query], when the query is signed using [QueryOptionTSIG]
+// and the TSIGKey of the [*ServerAddr] is set, we verify the TSIG signature
+// of each message, allowing for unsigned messages between signed ones
+// -- RFC 8945 Sect. 5.3.1.
+//
+// With IXFR, the server may send an AXFR-style response containing the
+// whole zone, or just the SOA RR if the version known to the client is
+// current. If the server responds using NOTIMP or FORMERR, we retry using
+// AXFR and we log the fallback. If the query is signed, we need the TSIGKey
+// of the [*ServerAddr] to sign the AXFR query, otherwise we cannot retry.
+//
+// As for [*Transport.QueryWithDuplicates], the context is used to control
+// the transfer lifetime. If the context is cancelled or times out, the
+// transfer will be aborted and the returned channel will be then closed.
+//
+// The returned channel is closed after emitting the message containing
+// the closing SOA RR or after emitting an error.
+func (t *Transport) Transfer(ctx context.Context,
+	addr *ServerAddr, query *dns.Msg) <-chan *MessageOrError {
+	out := make(chan *MessageOrError, 4)
+
+	// 1. Make sure we support the protocol and the query
+	var err error
+	switch {
+	case addr.Protocol != ProtocolTCP && addr.Protocol != ProtocolDoT:
+		err = fmt.Errorf("%w: %s", ErrTransferUnsupportedProtocol, addr.Protocol)
+	case !isTransferQuery(query):
+		err = ErrInvalidQuery
+	default:
+		err = ctx.Err()
+	}
+	if err != nil {
+		out <- &MessageOrError{Err: err}
+		close(out)
+		return out
+	}
+
+	// 2. Perform the transfer in the background
+	go t.transfer(ctx, addr, query, out)
+	return out
+}
+
+// isTransferQuery returns whether the query is a valid AXFR or IXFR query.
+func isTransferQuery(query *dns.Msg) bool {
+	if len(query.Question) != 1 {
+		return false
+	}
+	switch query.Question[0].Qtype {
+	case dns.TypeAXFR:
+		return true
+	case dns.TypeIXFR:
+		return len(query.Ns) == 1 && query.Ns[0].Header().Rrtype == dns.TypeSOA
+	default:
+		return false
+	}
+}
+
+// transfer implements [*Transport.Transfer].
+func (t *Transport) transfer(ctx context.Context,
+	addr *ServerAddr, query *dns.Msg, out chan *MessageOrError) {
+	// 1. Ensure the channel is closed when we're done
+	defer close(out)
+
+	// 2. Perform the transfer and possibly fallback to AXFR
+	fallback, err := t.transferStream(ctx, addr, query, out)
+	if fallback {
+		if axfrQuery, ok := t.newAXFRFallbackQuery(addr, query); ok {
+			t.maybeLogFallbackQuery(ctx, addr, dns.TypeIXFR, dns.TypeAXFR, "ixfr-not-supported")
+			_, err = t.transferStream(ctx, addr, axfrQuery, out)
+		}
+	}
+
+	// 3. Possibly emit the error
+	if err != nil {
+		t.emitMessageOrError(ctx, nil, err, out)
+	}
+}
+
+// newAXFRFallbackQuery creates the AXFR query to retry the given IXFR
+// query, which we sign using the TSIGKey of the [*ServerAddr] if the
+// original query is signed. We return false if we cannot sign the query.
+func (t *Transport) newAXFRFallbackQuery(addr *ServerAddr, query *dns.Msg) (*dns.Msg, bool) {
+	axfrQuery := query.Copy()
+	axfrQuery.Question[0].Qtype = dns.TypeAXFR
+	axfrQuery.Ns = nil
+	if axfrQuery.IsTsig() != nil {
+		if addr.TSIGKey == nil || addr.TSIGKey.sign(axfrQuery, t.timeNow()) != nil {
+			return nil, false
+		}
+	}
+	return axfrQuery, true
+}
+
+// dialTransfer dials the connection for the zone transfer.
+func (t *Transport) dialTransfer(ctx context.Context, addr *ServerAddr) (net.Conn, error) {
+	if addr.Protocol == ProtocolDoT {
+		return t.dialTLS(ctx, addr)
+	}
+	return t.dialContext(ctx, "tcp", addr.Address)
+}
+
+// transferStream performs a zone transfer using a new connection and emits the
+// received messages. On failure, the returned boolean indicates whether we
+// should retry using AXFR because the server does not support IXFR.
+func (t *Transport) transferStream(ctx context.Context,
+	addr *ServerAddr, query *dns.Msg, out chan *MessageOrError) (bool, error) {
+	// 1. Dial the connection and make sure we react to
+	// the context being canceled early.
+	conn, err := t.dialTransfer(ctx, addr)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		defer conn.Close()
+		<-ctx.Done()
+	}()
+
+	// 2. Use the context deadline to limit the transfer lifetime
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	// 3. Serialize the query, possibly log that we're sending it, and send it.
+	rawQuery, err := query.Pack()
+	if err != nil {
+		return false, err
+	}
+	t0 := t.maybeLogQuery(ctx, addr, rawQuery)
+	rawQueryFrame, err := newRawMsgFrame(addr, rawQuery)
+	if err != nil {
+		return false, err
+	}
+	if _, err := conn.Write(rawQueryFrame); err != nil {
+		return false, err
+	}
+
+	// 4. Possibly prepare for verifying the TSIG signatures
+	var verifier *tsigVerifier
+	if queryTSIG := query.IsTsig(); queryTSIG != nil && addr.TSIGKey != nil {
+		verifier = newTSIGVerifier(addr.TSIGKey, queryTSIG.MAC)
+	}
+
+	// 5. Read, validate, and emit messages until the closing SOA
+	br := bufio.NewReader(conn)
+	framer := newTransferFramer(query)
+	for first := true; ; first = false {
+		// 5.1. Read the next message, which must exist, since
+		// we have not seen the closing SOA yet
+		rawResp, err := readRawMsgFrame(br)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return false, err
+		}
+
+		// 5.2. Parse the message and possibly log that we received it.
+		resp := new(dns.Msg)
+		if err := resp.Unpack(rawResp); err != nil {
+			return false, err
+		}
+		t.maybeLogResponseConn(ctx, addr, t0, rawQuery, rawResp, conn)
+
+		// 5.3. Possibly verify the TSIG signature
+		if verifier != nil {
+			if err := verifier.verify(resp, rawResp, t.timeNow()); err != nil {
+				return false, err
+			}
+		}
+
+		// 5.4. Validate the message and handle failures
+		if err := validateTransferResponse(query, resp, first); err != nil {
+			return false, err
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			fallback := first && query.Question[0].Qtype == dns.TypeIXFR &&
+				(resp.Rcode == dns.RcodeNotImplemented || resp.Rcode == dns.RcodeFormatError)
+			return fallback, fmt.Errorf("%w: %s", ErrTransferFailed, dns.RcodeToString[resp.Rcode])
+		}
+
+		// 5.5. Check the SOA framing and make sure the last message is signed
+		done, err := framer.update(resp)
+		if err != nil {
+			return false, err
+		}
+		if done && verifier != nil {
+			if err := verifier.finish(); err != nil {
+				return false, err
+			}
+		}
+
+		// 5.6. Emit the message and stop after the closing SOA
+		t.emitMessageOrError(ctx, resp, nil, out)
+		if done {
+			return false, nil
+		}
+	}
+}
+
+// validateTransferResponse validates a message received during a zone
+// transfer. The first message must be a valid response to the query, while
+// the question section is optional in the following ones -- RFC 5936 Sect. 2.2.1.
+func validateTransferResponse(query, resp *dns.Msg, first bool) error {
+	// 1. the first message must be a valid response
+	if first {
+		return ValidateResponse(query, resp)
+	}
+
+	// 2. the following messages must be responses with the same ID
+	if !resp.Response || resp.Id != query.Id {
+		return ErrInvalidResponse
+	}
+
+	// 3. the question, if present, must be correct
+	switch len(resp.Question) {
+	case 0:
+		return nil
+	case 1:
+		resp0, query0 := resp.Question[0], query.Question[0]
+		if !equalASCIIName(resp0.Name, query0.Name) ||
+			resp0.Qclass != query0.Qclass || resp0.Qtype != query0.Qtype {
+			return ErrInvalidResponse
+		}
+		return nil
+	default:
+		return ErrInvalidResponse
+	}
+}
+
+// transferFramer checks the SOA RRs framing a zone transfer.
+//
+// An AXFR response, as well as an AXFR-style IXFR response, starts and ends
+// with the zone SOA -- RFC 5936 Sect. 2.2. An incremental IXFR response
+// starts and ends with the current zone SOA and contains sequences of
+// differences, each starting with the old SOA and containing the new SOA
+// between deleted and added RRs, so the current zone SOA appears three
+// times -- RFC 1995 Sect. 4. Finally, an IXFR response only containing the
+// current zone SOA indicates that the version of the client is current.
+type transferFramer struct {
+	// zone is the zone name.
+	zone string
+
+	// ixfr indicates whether the query is an IXFR query.
+	ixfr bool
+
+	// clientSerial is the serial known to the client for IXFR.
+	clientSerial uint32
+
+	// serial is the serial of the first SOA, if started is true.
+	serial uint32
+
+	// started indicates whether we have seen the first SOA.
+	started bool
+
+	// incremental indicates whether this is an incremental IXFR response.
+	incremental bool
+
+	// seen is the number of RRs we have processed.
+	seen int
+
+	// count is the number of SOAs containing the current serial.
+	count int
+
+	// done indicates whether we have seen the closing SOA.
+	done bool
+}
+
+// newTransferFramer creates a new [*transferFramer] for the given query,
+// which must be a valid zone transfer query.
+func newTransferFramer(query *dns.Msg) *transferFramer {
+	f := &transferFramer{zone: query.Question[0].Name}
+	if query.Question[0].Qtype == dns.TypeIXFR {
+		f.ixfr = true
+		if soa, ok := query.Ns[0].(*dns.SOA); ok {
+			f.clientSerial = soa.Serial
+		}
+	}
+	return f
+}
+
+// update processes the RRs in the given message and returns
+// whether the message contains the closing SOA.
+func (f *transferFramer) update(resp *dns.Msg) (bool, error) {
+	for _, rr := range resp.Answer {
+		// 1. the closing SOA must be the last RR
+		if f.done {
+			return false, fmt.Errorf("%w: RRs after the closing SOA", ErrInvalidResponse)
+		}
+		soa, isSOA := rr.(*dns.SOA)
+		f.seen++
+
+		// 2. the first RR must be the zone SOA
+		if !f.started {
+			if !isSOA || !equalASCIIName(soa.Hdr.Name, f.zone) {
+				return false, fmt.Errorf("%w: transfer does not start with the zone SOA", ErrInvalidResponse)
+			}
+			f.started, f.serial, f.count = true, soa.Serial, 1
+
+			// an IXFR response only containing the SOA means the client
+			// is up to date, which we check using RFC 1982 arithmetic
+			if f.ixfr && len(resp.Answer) == 1 && int32(f.clientSerial-f.serial) >= 0 {
+				f.done = true
+			}
+			continue
+		}
+		if !isSOA {
+			continue
+		}
+
+		// 3. handle the other SOAs, where an old SOA immediately
+		// following the first one means that the IXFR is incremental
+		switch {
+		case soa.Serial == f.serial:
+			f.count++
+			f.done = (!f.incremental && f.count >= 2) || f.count >= 3
+		case f.ixfr && f.seen == 2:
+			f.incremental = true
+		case f.incremental:
+			// old SOAs within the sequences of differences
+		default:
+			return false, fmt.Errorf("%w: unexpected SOA serial %d", ErrInvalidResponse, soa.Serial)
+		}
+	}
+	return f.done, nil
+}
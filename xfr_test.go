@@ -0,0 +1,339 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnscore
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAXFRQuery(t *testing.T) {
+	addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+	query, err := NewAXFRQuery(addr, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "example.com.", query.Question[0].Name)
+	assert.Equal(t, dns.TypeAXFR, query.Question[0].Qtype)
+	assert.False(t, query.RecursionDesired)
+	assert.True(t, isTransferQuery(query))
+}
+
+func TestNewIXFRQuery(t *testing.T) {
+	addr := NewServerAddr(ProtocolDoT, "127.0.0.1:853")
+	key := &TSIGKey{Name: "key.example.com.", Secret: testTSIGSecret}
+	query, err := NewIXFRQuery(addr, "example.com", 42, QueryOptionTSIG(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "example.com.", query.Question[0].Name)
+	assert.Equal(t, dns.TypeIXFR, query.Question[0].Qtype)
+	assert.False(t, query.RecursionDesired)
+	assert.True(t, isTransferQuery(query))
+	if assert.Len(t, query.Ns, 1) {
+		soa := query.Ns[0].(*dns.SOA)
+		assert.Equal(t, "example.com.", soa.Hdr.Name)
+		assert.Equal(t, uint32(42), soa.Serial)
+	}
+	assert.NotNil(t, query.IsTsig())
+}
+
+func Test_isTransferQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(query *dns.Msg)
+		expect bool
+	}{{
+		name:   "AXFR",
+		modify: func(query *dns.Msg) {},
+		expect: true,
+	}, {
+		name:   "no question",
+		modify: func(query *dns.Msg) { query.Question = nil },
+		expect: false,
+	}, {
+		name:   "A query",
+		modify: func(query *dns.Msg) { query.Question[0].Qtype = dns.TypeA },
+		expect: false,
+	}, {
+		name:   "IXFR without SOA",
+		modify: func(query *dns.Msg) { query.Question[0].Qtype = dns.TypeIXFR },
+		expect: false,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := new(dns.Msg)
+			query.SetQuestion("example.com.", dns.TypeAXFR)
+			tt.modify(query)
+			assert.Equal(t, tt.expect, isTransferQuery(query))
+		})
+	}
+}
+
+func TestTransport_Transfer(t *testing.T) {
+	t.Run("unsupported protocol", func(t *testing.T) {
+		txp := &Transport{}
+		addr := NewServerAddr(ProtocolUDP, "127.0.0.1:53")
+		query, err := NewAXFRQuery(addr, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var results []*MessageOrError
+		for result := range txp.Transfer(context.Background(), addr, query) {
+			results = append(results, result)
+		}
+		if assert.Len(t, results, 1) {
+			assert.ErrorIs(t, results[0].Err, ErrTransferUnsupportedProtocol)
+		}
+	})
+
+	t.Run("invalid query", func(t *testing.T) {
+		txp := &Transport{}
+		addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+		query, err := NewQueryWithServerAddr(addr, "example.com", dns.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var results []*MessageOrError
+		for result := range txp.Transfer(context.Background(), addr, query) {
+			results = append(results, result)
+		}
+		if assert.Len(t, results, 1) {
+			assert.ErrorIs(t, results[0].Err, ErrInvalidQuery)
+		}
+	})
+
+	t.Run("context already done", func(t *testing.T) {
+		txp := &Transport{}
+		addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+		query, err := NewAXFRQuery(addr, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		var results []*MessageOrError
+		for result := range txp.Transfer(ctx, addr, query) {
+			results = append(results, result)
+		}
+		if assert.Len(t, results, 1) {
+			assert.ErrorIs(t, results[0].Err, context.Canceled)
+		}
+	})
+}
+
+func TestTransport_newAXFRFallbackQuery(t *testing.T) {
+	key := &TSIGKey{Name: "key.example.com.", Secret: testTSIGSecret}
+	addr := NewServerAddr(ProtocolTCP, "127.0.0.1:53")
+
+	t.Run("unsigned query", func(t *testing.T) {
+		query, err := NewIXFRQuery(addr, "example.com", 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		axfrQuery, ok := (&Transport{}).newAXFRFallbackQuery(addr, query)
+		assert.True(t, ok)
+		assert.Equal(t, dns.TypeAXFR, axfrQuery.Question[0].Qtype)
+		assert.Empty(t, axfrQuery.Ns)
+		assert.Equal(t, dns.TypeIXFR, query.Question[0].Qtype)
+	})
+
+	t.Run("signed query without key", func(t *testing.T) {
+		query, err := NewIXFRQuery(addr, "example.com", 42, QueryOptionTSIG(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok := (&Transport{}).newAXFRFallbackQuery(addr, query)
+		assert.False(t, ok)
+	})
+
+	t.Run("signed query with key", func(t *testing.T) {
+		keyAddr := &ServerAddr{Protocol: ProtocolTCP, Address: "127.0.0.1:53", TSIGKey: key}
+		query, err := NewIXFRQuery(keyAddr, "example.com", 42, QueryOptionTSIG(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		axfrQuery, ok := (&Transport{}).newAXFRFallbackQuery(keyAddr, query)
+		assert.True(t, ok)
+		rawQuery, err := axfrQuery.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, dns.TsigVerify(rawQuery, testTSIGSecret, "", false))
+	})
+}
+
+func Test_validateTransferResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    bool
+		modify   func(resp *dns.Msg)
+		expected error
+	}{
+		{name: "valid first message", first: true, modify: func(resp *dns.Msg) {}, expected: nil},
+		{name: "first message without question", first: true, modify: func(resp *dns.Msg) { resp.Question = nil }, expected: ErrInvalidResponse},
+		{name: "valid following message", modify: func(resp *dns.Msg) {}, expected: nil},
+		{name: "following message without question", modify: func(resp *dns.Msg) { resp.Question = nil }, expected: nil},
+		{name: "following message not a response", modify: func(resp *dns.Msg) { resp.Response = false }, expected: ErrInvalidResponse},
+		{name: "following message with another ID", modify: func(resp *dns.Msg) { resp.Id++ }, expected: ErrInvalidResponse},
+		{name: "following message with another question", modify: func(resp *dns.Msg) { resp.Question[0].Name = "example.org." }, expected: ErrInvalidResponse},
+		{name: "following message with many questions", modify: func(resp *dns.Msg) { resp.Question = append(resp.Question, resp.Question[0]) }, expected: ErrInvalidResponse},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := new(dns.Msg)
+			query.SetAxfr("example.com.")
+			resp := new(dns.Msg)
+			resp.SetReply(query)
+			tt.modify(resp)
+			assert.ErrorIs(t, validateTransferResponse(query, resp, tt.first), tt.expected)
+		})
+	}
+}
+
+// newTransferTestSOA returns a SOA for example.com with the given serial.
+func newTransferTestSOA(serial uint32) dns.RR {
+	return &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.com.",
+		Mbox:   "admin.example.com.",
+		Serial: serial,
+	}
+}
+
+// newTransferTestA returns an A RR for www.example.com with the given last octet.
+func newTransferTestA(octet byte) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+		A:   net.IPv4(10, 0, 0, octet),
+	}
+}
+
+func Test_transferFramer(t *testing.T) {
+	soa := newTransferTestSOA
+
+	tests := []struct {
+		name         string
+		qtype        uint16
+		clientSerial uint32
+		messages     [][]dns.RR
+		expectDone   []bool
+		expectErr    error
+	}{{
+		name:       "AXFR in a single message",
+		qtype:      dns.TypeAXFR,
+		messages:   [][]dns.RR{{soa(10), newTransferTestA(1), soa(10)}},
+		expectDone: []bool{true},
+	}, {
+		name:       "AXFR in many messages",
+		qtype:      dns.TypeAXFR,
+		messages:   [][]dns.RR{{soa(10)}, {newTransferTestA(1)}, {newTransferTestA(2), soa(10)}},
+		expectDone: []bool{false, false, true},
+	}, {
+		name:      "AXFR not starting with the SOA",
+		qtype:     dns.TypeAXFR,
+		messages:  [][]dns.RR{{newTransferTestA(1), soa(10)}},
+		expectErr: ErrInvalidResponse,
+	}, {
+		name:      "AXFR starting with the SOA of another zone",
+		qtype:     dns.TypeAXFR,
+		messages:  [][]dns.RR{{&dns.SOA{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA}}}},
+		expectErr: ErrInvalidResponse,
+	}, {
+		name:      "AXFR with RRs after the closing SOA",
+		qtype:     dns.TypeAXFR,
+		messages:  [][]dns.RR{{soa(10), soa(10), newTransferTestA(1)}},
+		expectErr: ErrInvalidResponse,
+	}, {
+		name:      "AXFR with another serial",
+		qtype:     dns.TypeAXFR,
+		messages:  [][]dns.RR{{soa(10), newTransferTestA(1), soa(11)}},
+		expectErr: ErrInvalidResponse,
+	}, {
+		name:         "IXFR with current client",
+		qtype:        dns.TypeIXFR,
+		clientSerial: 10,
+		messages:     [][]dns.RR{{soa(10)}},
+		expectDone:   []bool{true},
+	}, {
+		name:         "IXFR with current client using serial arithmetic",
+		qtype:        dns.TypeIXFR,
+		clientSerial: 1,
+		messages:     [][]dns.RR{{soa(0xffffffff)}},
+		expectDone:   []bool{true},
+	}, {
+		name:         "IXFR with AXFR-style response",
+		qtype:        dns.TypeIXFR,
+		clientSerial: 8,
+		messages:     [][]dns.RR{{soa(10)}, {newTransferTestA(1), soa(10)}},
+		expectDone:   []bool{false, true},
+	}, {
+		name:         "IXFR with incremental response",
+		qtype:        dns.TypeIXFR,
+		clientSerial: 8,
+		messages: [][]dns.RR{
+			{soa(10), soa(8), newTransferTestA(1), soa(9), newTransferTestA(2)},
+			{soa(9), newTransferTestA(2), soa(10), newTransferTestA(3)},
+			{soa(10)},
+		},
+		expectDone: []bool{false, false, true},
+	}, {
+		name:         "IXFR with incremental response across messages",
+		qtype:        dns.TypeIXFR,
+		clientSerial: 9,
+		messages: [][]dns.RR{
+			{soa(10)},
+			{soa(9), newTransferTestA(2), soa(10), newTransferTestA(3), soa(10)},
+		},
+		expectDone: []bool{false, true},
+	}, {
+		name:         "AXFR with incremental-looking response",
+		qtype:        dns.TypeAXFR,
+		clientSerial: 9,
+		messages:     [][]dns.RR{{soa(10), soa(9), newTransferTestA(2), soa(10)}},
+		expectErr:    ErrInvalidResponse,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query *dns.Msg
+			switch tt.qtype {
+			case dns.TypeIXFR:
+				query = new(dns.Msg)
+				query.SetIxfr("example.com.", tt.clientSerial, ".", ".")
+			default:
+				query = new(dns.Msg)
+				query.SetAxfr("example.com.")
+			}
+			framer := newTransferFramer(query)
+
+			var (
+				done []bool
+				err  error
+			)
+			for _, answer := range tt.messages {
+				resp := new(dns.Msg)
+				resp.SetReply(query)
+				resp.Answer = answer
+				var d bool
+				if d, err = framer.update(resp); err != nil {
+					break
+				}
+				done = append(done, d)
+			}
+
+			if tt.expectErr != nil {
+				assert.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectDone, done)
+		})
+	}
+}